@@ -21,6 +21,7 @@ import (
 	"github.com/edgelesssys/estore/internal/batchskl"
 	"github.com/edgelesssys/estore/internal/humanize"
 	"github.com/edgelesssys/estore/internal/keyspan"
+	"github.com/edgelesssys/estore/internal/manual"
 	"github.com/edgelesssys/estore/internal/private"
 	"github.com/edgelesssys/estore/internal/rangedel"
 	"github.com/edgelesssys/estore/internal/rangekey"
@@ -295,6 +296,10 @@ type batchInternal struct {
 
 	commitErr error
 
+	// EDG: txSnap is the snapshot of the transaction that owns the batch, if
+	// any. Index maintenance reads the previous values of records from it.
+	txSnap *Snapshot
+
 	// Position bools together to reduce the sizeof the struct.
 
 	// ingestedSSTBatch indicates that the batch contains one or more key kinds
@@ -302,6 +307,11 @@ type batchInternal struct {
 	// then it will only contain key kinds of IngestSST.
 	ingestedSSTBatch bool
 
+	// EDG: ttlRawSets indicates that the batch contains SETs whose values
+	// don't carry a TTL header, because the batch doesn't belong to a DB with
+	// TTL enabled. The header is added when the batch is applied to such a DB.
+	ttlRawSets bool
+
 	// committing is set to true when a batch begins to commit. It's used to
 	// ensure the batch is not mutated concurrently. It is not an atomic
 	// deliberately, so as to avoid the overhead on batch mutations. This is
@@ -422,6 +432,10 @@ func (b *Batch) nextSeqNum() uint64 {
 }
 
 func (b *Batch) release() {
+	// EDG: don't keep plaintext in pooled or garbage batches. Large batches
+	// have handed their data over to a flushableBatch and set it to nil.
+	manual.Scrub(b.data)
+
 	if b.db == nil {
 		// The batch was not created using newBatch or newIndexedBatch, or an error
 		// was encountered. We don't try to reuse batches that encountered an error
@@ -510,6 +524,16 @@ func (b *Batch) Apply(batch *Batch, _ *WriteOptions) error {
 		offset = batchHeaderLen
 	}
 	b.data = append(b.data, batch.data[batchHeaderLen:]...)
+	if batch.ttlRawSets {
+		// EDG: Add the TTL header to the values of the applied SETs.
+		if b.ttlEnabled() {
+			if err := b.ttlEncodeRawSets(offset); err != nil {
+				return err
+			}
+		} else {
+			b.ttlRawSets = true
+		}
+	}
 
 	b.setCount(b.Count() + batch.Count())
 
@@ -705,6 +729,14 @@ func (b *Batch) AddInternalKey(key *base.InternalKey, value []byte, _ *WriteOpti
 //
 // It is safe to modify the contents of the arguments after Set returns.
 func (b *Batch) Set(key, value []byte, _ *WriteOptions) error {
+	// EDG: Maintain secondary indexes.
+	if err := b.updateIndexes(key, value, true); err != nil {
+		return err
+	}
+	if b.ttlEnabled() {
+		// EDG: Values carry a TTL header if TTL is enabled.
+		return b.setWithExpiry(key, value, 0)
+	}
 	deferredOp := b.SetDeferred(len(key), len(value))
 	copy(deferredOp.Key, key)
 	copy(deferredOp.Value, value)
@@ -723,7 +755,15 @@ func (b *Batch) Set(key, value []byte, _ *WriteOptions) error {
 // letting the caller encode into those objects and then call Finish() on the
 // returned object.
 func (b *Batch) SetDeferred(keyLen, valueLen int) *DeferredBatchOp {
-	b.prepareDeferredKeyValueRecord(keyLen, valueLen, InternalKeyKindSet)
+	if b.ttlEnabled() {
+		// EDG: Write the TTL header in front of the value the caller encodes.
+		b.prepareDeferredKeyValueRecord(keyLen, ttlValueLen(0, valueLen), InternalKeyKindSet)
+		b.deferredOp.Value[0] = ttlHeaderNoExpiry
+		b.deferredOp.Value = b.deferredOp.Value[1:]
+	} else {
+		b.prepareDeferredKeyValueRecord(keyLen, valueLen, InternalKeyKindSet)
+		b.ttlRawSets = true
+	}
 	b.deferredOp.index = b.index
 	return &b.deferredOp
 }
@@ -761,6 +801,10 @@ func (b *Batch) MergeDeferred(keyLen, valueLen int) *DeferredBatchOp {
 //
 // It is safe to modify the contents of the arguments after Delete returns.
 func (b *Batch) Delete(key []byte, _ *WriteOptions) error {
+	// EDG: Maintain secondary indexes.
+	if err := b.updateIndexes(key, nil, false); err != nil {
+		return err
+	}
 	deferredOp := b.DeleteDeferred(len(key))
 	copy(deferredOp.Key, key)
 	// TODO(peter): Manually inline DeferredBatchOp.Finish(). Mid-stack inlining
@@ -797,6 +841,10 @@ func (b *Batch) DeleteDeferred(keyLen int) *DeferredBatchOp {
 // It is safe to modify the contents of the arguments after DeleteSized
 // returns.
 func (b *Batch) DeleteSized(key []byte, deletedValueSize uint32, _ *WriteOptions) error {
+	// EDG: Maintain secondary indexes.
+	if err := b.updateIndexes(key, nil, false); err != nil {
+		return err
+	}
 	deferredOp := b.DeleteSizedDeferred(len(key), deletedValueSize)
 	copy(b.deferredOp.Key, key)
 	// TODO(peter): Manually inline DeferredBatchOp.Finish(). Check if in a
@@ -854,6 +902,10 @@ func (b *Batch) DeleteSizedDeferred(keyLen int, deletedValueSize uint32) *Deferr
 //
 // It is safe to modify the contents of the arguments after SingleDelete returns.
 func (b *Batch) SingleDelete(key []byte, _ *WriteOptions) error {
+	// EDG: Maintain secondary indexes.
+	if err := b.updateIndexes(key, nil, false); err != nil {
+		return err
+	}
 	deferredOp := b.SingleDeleteDeferred(len(key))
 	copy(deferredOp.Key, key)
 	// TODO(peter): Manually inline DeferredBatchOp.Finish(). Mid-stack inlining
@@ -883,6 +935,10 @@ func (b *Batch) SingleDeleteDeferred(keyLen int) *DeferredBatchOp {
 // It is safe to modify the contents of the arguments after DeleteRange
 // returns.
 func (b *Batch) DeleteRange(start, end []byte, _ *WriteOptions) error {
+	// EDG: Maintain secondary indexes.
+	if err := b.updateIndexesRange(start, end); err != nil {
+		return err
+	}
 	deferredOp := b.DeleteRangeDeferred(len(start), len(end))
 	copy(deferredOp.Key, start)
 	copy(deferredOp.Value, end)
@@ -21,6 +21,10 @@ const (
 type tableFilter []byte
 
 func (f tableFilter) MayContain(key []byte) bool {
+	return f.mayContainHash(hash(key))
+}
+
+func (f tableFilter) mayContainHash(h uint32) bool {
 	if len(f) <= 5 {
 		return false
 	}
@@ -29,7 +33,6 @@ func (f tableFilter) MayContain(key []byte) bool {
 	nLines := binary.LittleEndian.Uint32(f[n+1:])
 	cacheLineBits := 8 * (uint32(n) / nLines)
 
-	h := hash(key)
 	delta := h>>17 | h<<15
 	b := (h % nLines) * cacheLineBits
 
@@ -151,7 +154,10 @@ func newTableFilterWriter(bitsPerKey int) *tableFilterWriter {
 
 // AddKey implements the base.FilterWriter interface.
 func (w *tableFilterWriter) AddKey(key []byte) {
-	h := hash(key)
+	w.addHash(hash(key))
+}
+
+func (w *tableFilterWriter) addHash(h uint32) {
 	if w.numHashes != 0 && h == w.lastHash {
 		return
 	}
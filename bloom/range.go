@@ -0,0 +1,252 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package bloom
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/edgelesssys/estore/internal/base"
+)
+
+// rangeFilterMaxProbes limits the number of probes of a range query. Wider
+// ranges are assumed to contain a key.
+const rangeFilterMaxProbes = 1024
+
+// rangeFilterHashes returns the hashes of b as a prefix and as a whole key.
+// The hash of the Bloom filter is too weak for the many similar prefixes.
+func rangeFilterHashes(b []byte) (prefix, exact uint32) {
+	h := xxhash.Sum64(b)
+	return uint32(h), uint32(h >> 32)
+}
+
+// RangeFilterPolicy is a prefix-range Bloom filter. In addition to the keys,
+// it stores all their byte prefixes of up to MaxPrefixLen bytes, so that it
+// can rule out ranges of keys: a range query walks the trie of prefixes that
+// cover the range and probes the filter for each of them. Longer keys are
+// only represented by their prefixes.
+//
+// The filter is used by iterators with bounds to skip tables without keys
+// within the bounds. Queries are cheap if the bounds share a long common
+// prefix or differ in few bytes after it, like the bounds of a time-range
+// scan of keys that end with a big-endian timestamp. MaxPrefixLen should
+// cover the bytes up to where the bounds of typical queries differ.
+//
+// A query probes the filter for up to 256 prefixes per byte of the bounds
+// after their common prefix, and each probe may be a false positive. Range
+// filters thus need more bits per key than point filters for the same false
+// positive rate.
+//
+// Like FilterPolicy, it also answers point queries for Get and SeekPrefixGE.
+// If the comparer has a Split function, the filter holds the prefixes
+// returned by Split, and the comparer must order them bytewise.
+type RangeFilterPolicy struct {
+	// BitsPerKey is the approximate number of bits used per stored key or
+	// prefix. A good value is 10, which yields a false positive rate of ~1%
+	// for each probe.
+	BitsPerKey int
+	// MaxPrefixLen is the maximum length of the stored prefixes. It must be
+	// between 1 and 255.
+	MaxPrefixLen int
+}
+
+var _ base.RangeFilterPolicy = RangeFilterPolicy{}
+
+// Name implements the pebble.FilterPolicy interface.
+func (p RangeFilterPolicy) Name() string {
+	return "estore.PrefixRangeBloomFilter"
+}
+
+// MayContain implements the pebble.FilterPolicy interface.
+func (p RangeFilterPolicy) MayContain(ftype base.FilterType, f, key []byte) bool {
+	switch ftype {
+	case base.TableFilter:
+		rf, ok := decodeRangeFilter(f)
+		return !ok || rf.mayContain(key)
+	default:
+		panic(fmt.Sprintf("unknown filter type: %v", ftype))
+	}
+}
+
+// MayContainRange implements the pebble.RangeFilterPolicy interface.
+func (p RangeFilterPolicy) MayContainRange(ftype base.FilterType, f, lower, upper []byte) bool {
+	switch ftype {
+	case base.TableFilter:
+		rf, ok := decodeRangeFilter(f)
+		return !ok || rf.mayContainRange(lower, upper)
+	default:
+		panic(fmt.Sprintf("unknown filter type: %v", ftype))
+	}
+}
+
+// NewWriter implements the pebble.FilterPolicy interface.
+func (p RangeFilterPolicy) NewWriter(ftype base.FilterType) base.FilterWriter {
+	if p.MaxPrefixLen < 1 || p.MaxPrefixLen > 255 {
+		panic(fmt.Sprintf("invalid maximum prefix length: %d", p.MaxPrefixLen))
+	}
+	switch ftype {
+	case base.TableFilter:
+		return &rangeFilterWriter{
+			tableFilterWriter: newTableFilterWriter(p.BitsPerKey),
+			maxPrefixLen:      p.MaxPrefixLen,
+		}
+	default:
+		panic(fmt.Sprintf("unknown filter type: %v", ftype))
+	}
+}
+
+// rangeFilter is a Bloom filter in the table filter format, followed by a
+// byte that holds the maximum prefix length.
+type rangeFilter struct {
+	filter       tableFilter
+	maxPrefixLen int
+	// probes counts the probes of a range query.
+	probes int
+}
+
+func decodeRangeFilter(f []byte) (*rangeFilter, bool) {
+	if len(f) == 0 || f[len(f)-1] == 0 {
+		return nil, false
+	}
+	return &rangeFilter{filter: f[:len(f)-1], maxPrefixLen: int(f[len(f)-1])}, true
+}
+
+func (f *rangeFilter) mayContainPrefix(prefix []byte) bool {
+	f.probes++
+	if f.probes > rangeFilterMaxProbes {
+		return true
+	}
+	h, _ := rangeFilterHashes(prefix)
+	return f.filter.mayContainHash(h)
+}
+
+func (f *rangeFilter) mayContainExact(key []byte) bool {
+	f.probes++
+	if f.probes > rangeFilterMaxProbes {
+		return true
+	}
+	_, h := rangeFilterHashes(key)
+	return f.filter.mayContainHash(h)
+}
+
+func (f *rangeFilter) mayContain(key []byte) bool {
+	if len(key) > f.maxPrefixLen {
+		return f.mayContainPrefix(key[:f.maxPrefixLen])
+	}
+	return f.mayContainExact(key)
+}
+
+func (f *rangeFilter) mayContainRange(lower, upper []byte) bool {
+	if upper != nil && (len(upper) == 0 || bytes.Compare(lower, upper) >= 0) {
+		return false
+	}
+	if len(lower) == 0 {
+		lower = nil
+	}
+	return f.search(nil, lower, upper)
+}
+
+// search returns whether the filter may contain a key k with the given prefix
+// and lower <= k < upper. A non-nil bound must have the prefix.
+func (f *rangeFilter) search(prefix, lower, upper []byte) bool {
+	d := len(prefix)
+	if upper != nil && len(upper) == d {
+		// All keys with the prefix are >= upper.
+		return false
+	}
+	if d > 0 && !f.mayContainPrefix(prefix) {
+		return false
+	}
+	if d == f.maxPrefixLen || (lower == nil && upper == nil) {
+		return true
+	}
+	if lower == nil || len(lower) == d {
+		// The prefix itself is within the range.
+		if f.mayContainExact(prefix) {
+			return true
+		}
+		lower = nil
+	}
+
+	// Search the children of the prefix that are within the range. Only the
+	// first and the last one are constrained by the bounds.
+	first, last := 0, 255
+	if lower != nil {
+		first = int(lower[d])
+	}
+	if upper != nil {
+		last = int(upper[d])
+	}
+	var child []byte
+	for c := first; c <= last; c++ {
+		switch {
+		case c == first && lower != nil:
+			var childUpper []byte
+			if c == last {
+				childUpper = upper
+			}
+			if f.search(lower[:d+1], lower, childUpper) {
+				return true
+			}
+		case c == last && upper != nil:
+			if f.search(upper[:d+1], nil, upper) {
+				return true
+			}
+		default:
+			if child == nil {
+				child = append(append(make([]byte, 0, d+1), prefix...), 0)
+			}
+			child[d] = byte(c)
+			if f.search(child, nil, nil) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type rangeFilterWriter struct {
+	*tableFilterWriter
+	maxPrefixLen int
+	// last is the last added key, truncated to maxPrefixLen. Its prefixes
+	// have been added, and lastExact is set if the key itself was added.
+	last      []byte
+	lastExact bool
+	hasLast   bool
+}
+
+// AddKey implements the base.FilterWriter interface.
+func (w *rangeFilterWriter) AddKey(key []byte) {
+	exact := len(key) <= w.maxPrefixLen
+	if !exact {
+		key = key[:w.maxPrefixLen]
+	}
+	if w.hasLast && bytes.Equal(key, w.last) && (w.lastExact || !exact) {
+		// Keys are usually added in order, so duplicates are adjacent.
+		return
+	}
+	if exact {
+		_, h := rangeFilterHashes(key)
+		w.addHash(h)
+	}
+	// The shared prefixes with the last key have already been added.
+	for n := base.SharedPrefixLen(key, w.last) + 1; n <= len(key); n++ {
+		h, _ := rangeFilterHashes(key[:n])
+		w.addHash(h)
+	}
+	w.last = append(w.last[:0], key...)
+	w.lastExact = exact
+	w.hasLast = true
+}
+
+// Finish implements the base.FilterWriter interface.
+func (w *rangeFilterWriter) Finish(buf []byte) []byte {
+	w.last = w.last[:0]
+	w.hasLast = false
+	return append(w.tableFilterWriter.Finish(buf), byte(w.maxPrefixLen))
+}
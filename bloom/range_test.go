@@ -0,0 +1,120 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/stretchr/testify/require"
+)
+
+func newRangeFilter(policy RangeFilterPolicy, keys ...[]byte) []byte {
+	w := policy.NewWriter(base.TableFilter)
+	for _, key := range keys {
+		w.AddKey(key)
+	}
+	return w.Finish(nil)
+}
+
+func TestRangeFilter(t *testing.T) {
+	policy := RangeFilterPolicy{BitsPerKey: 10, MaxPrefixLen: 4}
+	rng := rand.New(rand.NewSource(1))
+	randKey := func() []byte {
+		key := make([]byte, rng.Intn(7))
+		for i := range key {
+			key[i] = []byte{0, 1, 2, 0xff}[rng.Intn(4)]
+		}
+		return key
+	}
+
+	var falsePositives, negatives int
+	for n := 0; n < 200; n++ {
+		keys := make([][]byte, rng.Intn(20)+1)
+		for i := range keys {
+			keys[i] = randKey()
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		f := newRangeFilter(policy, keys...)
+
+		for _, key := range keys {
+			require.True(t, policy.MayContain(base.TableFilter, f, key), "%x", key)
+		}
+		for q := 0; q < 100; q++ {
+			lower, upper := randKey(), randKey()
+			if rng.Intn(10) == 0 {
+				lower = nil
+			}
+			if rng.Intn(10) == 0 {
+				upper = nil
+			}
+			var want bool
+			for _, key := range keys {
+				if bytes.Compare(key, lower) >= 0 && (upper == nil || bytes.Compare(key, upper) < 0) {
+					want = true
+				}
+			}
+			got := policy.MayContainRange(base.TableFilter, f, lower, upper)
+			if want {
+				require.True(t, got, "keys %x range [%x, %x)", keys, lower, upper)
+			} else {
+				negatives++
+				if got {
+					falsePositives++
+				}
+			}
+		}
+	}
+	// Ranges that differ beyond MaxPrefixLen or contain a key only up to
+	// MaxPrefixLen are false positives, too.
+	require.Less(t, float64(falsePositives)/float64(negatives), 0.3)
+}
+
+func TestRangeFilterTimeRange(t *testing.T) {
+	require := require.New(t)
+	// A query probes the filter up to 256 times per byte of the bounds after
+	// their common prefix, so more bits per key are needed to keep the false
+	// positive rate low.
+	policy := RangeFilterPolicy{BitsPerKey: 20, MaxPrefixLen: 16}
+
+	// keys of series "a" and "b" with big-endian timestamps in [1000, 2000)
+	key := func(series string, ts uint64) []byte {
+		return binary.BigEndian.AppendUint64([]byte(series), ts)
+	}
+	var keys [][]byte
+	for _, series := range []string{"a", "b"} {
+		for ts := uint64(1000); ts < 2000; ts += 10 {
+			keys = append(keys, key(series, ts))
+		}
+	}
+	f := newRangeFilter(policy, keys...)
+
+	mayContain := func(series string, from, to uint64) bool {
+		return policy.MayContainRange(base.TableFilter, f, key(series, from), key(series, to))
+	}
+	require.True(mayContain("a", 1500, 1501))
+	require.True(mayContain("b", 0, 1001))
+	require.True(mayContain("a", 1990, 1<<40))
+	require.False(mayContain("a", 2000, 3000))
+	require.False(mayContain("b", 0, 1000))
+	require.False(mayContain("c", 1000, 2000))
+	require.False(mayContain("a", 1<<40, 1<<41))
+	require.False(policy.MayContainRange(base.TableFilter, f, []byte("c"), []byte("d")))
+	require.True(policy.MayContainRange(base.TableFilter, f, nil, []byte("a\x01")))
+	require.False(policy.MayContainRange(base.TableFilter, f, nil, []byte("a")))
+	require.False(policy.MayContainRange(base.TableFilter, f, []byte("b"), []byte("a")))
+	require.False(policy.MayContainRange(base.TableFilter, f, nil, []byte{}))
+
+	require.True(policy.MayContain(base.TableFilter, f, key("a", 1010)))
+	require.False(policy.MayContain(base.TableFilter, f, []byte("a")))
+
+	require.Panics(func() { RangeFilterPolicy{BitsPerKey: 10}.NewWriter(base.TableFilter) })
+}
@@ -0,0 +1,305 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/edgelesssys/estore/internal/base"
+)
+
+// RibbonFilterPolicy implements the FilterPolicy interface from the pebble
+// package with a Standard Ribbon filter of width 128.
+//
+// The integer value is the number of bits per key of the Bloom filter
+// (FilterPolicy) with the same false positive rate. A good value is 10, which
+// yields a filter with a false positive rate of ~0.8% that is about 30%
+// smaller than the Bloom filter.
+//
+// A Ribbon filter stores r bits per slot and has slightly more slots than
+// keys. A key maps to a window of 128 slots and to an r-bit fingerprint. The
+// filter is the solution of the linear system over GF(2) that makes the XOR of
+// a subset of the slots in the window of each key equal its fingerprint, so
+// the false positive rate is 2^-r. Building the filter buffers the hashes of
+// all keys and takes more CPU time than building a Bloom filter, while queries
+// take about the same time.
+type RibbonFilterPolicy int
+
+var _ base.FilterPolicy = RibbonFilterPolicy(0)
+
+// Name implements the pebble.FilterPolicy interface.
+func (p RibbonFilterPolicy) Name() string {
+	return "estore.RibbonFilter"
+}
+
+// MayContain implements the pebble.FilterPolicy interface.
+func (p RibbonFilterPolicy) MayContain(ftype base.FilterType, f, key []byte) bool {
+	switch ftype {
+	case base.TableFilter:
+		return ribbonFilter(f).mayContain(xxhash.Sum64(key))
+	default:
+		panic(fmt.Sprintf("unknown filter type: %v", ftype))
+	}
+}
+
+// NewWriter implements the pebble.FilterPolicy interface.
+func (p RibbonFilterPolicy) NewWriter(ftype base.FilterType) base.FilterWriter {
+	switch ftype {
+	case base.TableFilter:
+		return &ribbonFilterWriter{resultBits: ribbonResultBits(int(p))}
+	default:
+		panic(fmt.Sprintf("unknown filter type: %v", ftype))
+	}
+}
+
+const (
+	// ribbonWidth is the number of slots a key maps to.
+	ribbonWidth = 128
+	// ribbonSeeds is the number of hash seeds tried before the number of
+	// slots is increased.
+	ribbonSeeds = 16
+	// ribbonTrailerLen is the length of the trailer that holds the number of
+	// slots, the result bits and the seed.
+	ribbonTrailerLen = 6
+)
+
+// ribbonResultBits returns the number of result bits for the false positive
+// rate of a Bloom filter with bitsPerKey bits per key, which is ~0.6185^bits.
+func ribbonResultBits(bitsPerKey int) int {
+	r := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	if r < 1 {
+		r = 1
+	}
+	if r > 32 {
+		r = 32
+	}
+	return r
+}
+
+// ribbonSlots returns the initial number of slots for n keys. The overhead
+// makes the construction succeed with high probability for one of the seeds.
+func ribbonSlots(n int) int {
+	return n + n/25 + ribbonWidth
+}
+
+// ribbonRow is a row of the linear system: 128 coefficients for the slots
+// starting at start, and the expected result.
+type ribbonRow struct {
+	lo, hi uint64
+	start  int
+	result uint32
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// ribbonHash derives the row of a key hash for the given seed and number of
+// slots.
+func ribbonHash(h uint64, seed uint8, slots int, resultBits int) ribbonRow {
+	h = mix64(h + uint64(seed+1)*0x9e3779b97f4a7c15)
+	start, _ := bits.Mul64(h, uint64(slots-ribbonWidth+1))
+	// The first coefficient is always set, so the row is never zero and
+	// starts at its first slot.
+	return ribbonRow{
+		lo:     mix64(h^0x2545f4914f6cdd1d) | 1,
+		hi:     mix64(h ^ 0x61c8864680b583eb),
+		start:  int(start),
+		result: uint32(mix64(h^0x1b873593) & (1<<resultBits - 1)),
+	}
+}
+
+// ribbonFilter is the table filter format of RibbonFilterPolicy. It holds the
+// solution as resultBits bit planes of words 64-bit words each, followed by
+// the number of slots (4 bytes), the result bits and the seed.
+type ribbonFilter []byte
+
+func (f ribbonFilter) mayContain(h uint64) bool {
+	if len(f) < ribbonTrailerLen {
+		return true
+	}
+	n := len(f) - ribbonTrailerLen
+	slots := int(binary.LittleEndian.Uint32(f[n:]))
+	resultBits := int(f[n+4])
+	seed := f[n+5]
+	if slots == 0 {
+		return false
+	}
+	words := ribbonWords(slots)
+	if slots < ribbonWidth || resultBits < 1 || resultBits > 32 || n != resultBits*words*8 {
+		// Corrupt filters don't rule out any key.
+		return true
+	}
+
+	row := ribbonHash(h, seed, slots, resultBits)
+	for b := 0; b < resultBits; b++ {
+		lo, hi := ribbonWindow(f[b*words*8:(b+1)*words*8], row.start)
+		parity := bits.OnesCount64(lo&row.lo^hi&row.hi) & 1
+		if uint32(parity) != row.result>>b&1 {
+			return false
+		}
+	}
+	return true
+}
+
+// ribbonWords returns the number of 64-bit words of a bit plane.
+func ribbonWords(slots int) int {
+	return (slots + 63) / 64
+}
+
+// ribbonWindow returns the 128 bits of a bit plane starting at start.
+func ribbonWindow(plane []byte, start int) (lo, hi uint64) {
+	word := func(i int) uint64 {
+		if i*8 >= len(plane) {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(plane[i*8:])
+	}
+	i, s := start/64, uint(start%64)
+	w0, w1, w2 := word(i), word(i+1), word(i+2)
+	if s == 0 {
+		return w0, w1
+	}
+	return w0>>s | w1<<(64-s), w1>>s | w2<<(64-s)
+}
+
+type ribbonFilterWriter struct {
+	resultBits int
+	hashes     []uint64
+}
+
+// AddKey implements the base.FilterWriter interface.
+func (w *ribbonFilterWriter) AddKey(key []byte) {
+	h := xxhash.Sum64(key)
+	if n := len(w.hashes); n > 0 && w.hashes[n-1] == h {
+		return
+	}
+	w.hashes = append(w.hashes, h)
+}
+
+// Finish implements the base.FilterWriter interface.
+func (w *ribbonFilterWriter) Finish(buf []byte) []byte {
+	var rows []ribbonRow
+	var slots int
+	var seed uint8
+	if len(w.hashes) > 0 {
+		rows, slots, seed = w.band()
+	}
+	words := ribbonWords(slots)
+	buf, filter := extend(buf, w.resultBits*words*8+ribbonTrailerLen)
+	if slots != 0 {
+		solveRibbon(filter, rows, slots, w.resultBits)
+	}
+	n := len(filter) - ribbonTrailerLen
+	binary.LittleEndian.PutUint32(filter[n:], uint32(slots))
+	filter[n+4] = byte(w.resultBits)
+	filter[n+5] = seed
+	w.hashes = w.hashes[:0]
+	return buf
+}
+
+// band adds the rows of all keys to a banded matrix, trying different seeds
+// and more slots until it succeeds. It returns the rows indexed by slot.
+func (w *ribbonFilterWriter) band() ([]ribbonRow, int, uint8) {
+	slots := ribbonSlots(len(w.hashes))
+	for {
+		rows := make([]ribbonRow, slots)
+		for seed := uint8(0); seed < ribbonSeeds; seed++ {
+			if seed > 0 {
+				for i := range rows {
+					rows[i] = ribbonRow{}
+				}
+			}
+			if bandRibbon(rows, w.hashes, seed, w.resultBits) {
+				return rows, slots, seed
+			}
+		}
+		slots += slots / 10
+	}
+}
+
+// bandRibbon adds the rows of the hashes to the band by Gaussian elimination.
+// Row i of the band has its first coefficient at slot i. It returns false if
+// the system has no solution, which happens if the hashes of different keys
+// result in linearly dependent rows.
+func bandRibbon(rows []ribbonRow, hashes []uint64, seed uint8, resultBits int) bool {
+	for _, h := range hashes {
+		row := ribbonHash(h, seed, len(rows), resultBits)
+		i := row.start
+		for {
+			if rows[i].lo&1 == 0 {
+				rows[i] = ribbonRow{lo: row.lo, hi: row.hi, result: row.result}
+				break
+			}
+			row.lo ^= rows[i].lo
+			row.hi ^= rows[i].hi
+			row.result ^= rows[i].result
+			if row.lo == 0 && row.hi == 0 {
+				if row.result != 0 {
+					return false
+				}
+				// The hash is a duplicate of a hash already added.
+				break
+			}
+			// Shift the row to its first set coefficient.
+			var n int
+			if row.lo != 0 {
+				n = bits.TrailingZeros64(row.lo)
+			} else {
+				n = 64 + bits.TrailingZeros64(row.hi)
+			}
+			row.lo, row.hi = shiftRight128(row.lo, row.hi, uint(n))
+			i += n
+		}
+	}
+	return true
+}
+
+func shiftRight128(lo, hi uint64, n uint) (uint64, uint64) {
+	if n >= 64 {
+		return hi >> (n - 64), 0
+	}
+	if n == 0 {
+		return lo, hi
+	}
+	return lo>>n | hi<<(64-n), hi >> n
+}
+
+// solveRibbon writes the solution of the banded matrix to the bit planes in
+// filter by back substitution.
+func solveRibbon(filter []byte, rows []ribbonRow, slots int, resultBits int) {
+	words := ribbonWords(slots)
+	// state holds the solution of the 128 slots starting at the current one
+	// for each result bit.
+	var state [32]struct{ lo, hi uint64 }
+	for i := slots - 1; i >= 0; i-- {
+		row := &rows[i]
+		for b := 0; b < resultBits; b++ {
+			s := &state[b]
+			s.hi = s.hi<<1 | s.lo>>63
+			s.lo <<= 1
+			// Slots without a row can take any value; zero is fine.
+			if row.lo&1 == 0 {
+				continue
+			}
+			bit := uint64(bits.OnesCount64(s.lo&row.lo^s.hi&row.hi)&1) ^ uint64(row.result>>b&1)
+			s.lo |= bit
+			if bit != 0 {
+				filter[b*words*8+i/8] |= 1 << (i % 8)
+			}
+		}
+	}
+}
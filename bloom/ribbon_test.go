@@ -0,0 +1,110 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package bloom
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/stretchr/testify/require"
+)
+
+func newRibbonFilter(bitsPerKey int, keys ...[]byte) []byte {
+	w := RibbonFilterPolicy(bitsPerKey).NewWriter(base.TableFilter)
+	for _, key := range keys {
+		w.AddKey(key)
+	}
+	return w.Finish(nil)
+}
+
+func TestRibbonFilter(t *testing.T) {
+	policy := RibbonFilterPolicy(10)
+	le32 := func(i int) []byte {
+		return binary.LittleEndian.AppendUint32(nil, uint32(i))
+	}
+
+	for _, length := range []int{1, 2, 10, 100, 127, 128, 129, 1000, 10000, 100000} {
+		keys := make([][]byte, 0, length)
+		for i := 0; i < length; i++ {
+			keys = append(keys, le32(i))
+		}
+		f := newRibbonFilter(10, keys...)
+
+		// All added keys must match.
+		for _, key := range keys {
+			require.True(t, policy.MayContain(base.TableFilter, f, key), "length=%d: did not contain key %x", length, key)
+		}
+
+		// The false positive rate is 2^-7.
+		nFalsePositive := 0
+		for i := 0; i < 10000; i++ {
+			if policy.MayContain(base.TableFilter, f, le32(1e9+i)) {
+				nFalsePositive++
+			}
+		}
+		require.LessOrEqual(t, nFalsePositive, 150, "length=%d", length)
+
+		// The filter is smaller than the Bloom filter, unless it has few keys.
+		if length >= 1000 {
+			bloomLen := len(newTableFilter(10, keys...))
+			require.Less(t, float64(len(f)), 0.8*float64(bloomLen), "length=%d", length)
+		}
+	}
+}
+
+func TestRibbonFilterEdgeCases(t *testing.T) {
+	require := require.New(t)
+	policy := RibbonFilterPolicy(10)
+
+	// empty filter
+	f := newRibbonFilter(10)
+	require.False(policy.MayContain(base.TableFilter, f, []byte("a")))
+
+	// duplicate keys are added once
+	f = newRibbonFilter(10, []byte("a"), []byte("a"), []byte("b"), []byte("a"))
+	require.True(policy.MayContain(base.TableFilter, f, []byte("a")))
+	require.True(policy.MayContain(base.TableFilter, f, []byte("b")))
+
+	// truncated or corrupt filters don't rule out keys
+	require.True(policy.MayContain(base.TableFilter, f[:3], []byte("c")))
+	require.True(policy.MayContain(base.TableFilter, f[1:], []byte("c")))
+
+	// the writer can be reused
+	w := policy.NewWriter(base.TableFilter)
+	w.AddKey([]byte("a"))
+	w.Finish(nil)
+	w.AddKey([]byte("b"))
+	f = w.Finish(nil)
+	require.False(policy.MayContain(base.TableFilter, f, []byte("a")))
+	require.True(policy.MayContain(base.TableFilter, f, []byte("b")))
+
+	require.Equal(1, ribbonResultBits(0))
+	require.Equal(7, ribbonResultBits(10))
+	require.Equal(14, ribbonResultBits(20))
+	require.Equal(32, ribbonResultBits(100))
+}
+
+func BenchmarkRibbonFilter(b *testing.B) {
+	const keyLen = 128
+	const numKeys = 1024
+	keys := make([][]byte, numKeys)
+	for i := range keys {
+		keys[i] = make([]byte, keyLen)
+		_, _ = rand.Read(keys[i])
+	}
+	b.ResetTimer()
+	policy := RibbonFilterPolicy(10)
+	for i := 0; i < b.N; i++ {
+		w := policy.NewWriter(base.TableFilter)
+		for _, key := range keys {
+			w.AddKey(key)
+		}
+		w.Finish(nil)
+	}
+}
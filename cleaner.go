@@ -10,9 +10,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/errors/oserror"
 	"github.com/cockroachdb/tokenbucket"
 	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/internal/invariants"
 	"github.com/edgelesssys/estore/objstorage"
 )
@@ -31,6 +33,9 @@ type cleanupManager struct {
 	objProvider     objstorage.Provider
 	onTableDeleteFn func(fileSize uint64)
 	deletePacer     *deletionPacer
+	// keyManager is used to shred the salts of deleted files. It is nil unless
+	// Options.ForwardSecrecy is set.
+	keyManager *edg.KeyManager
 
 	// jobsCh is used as the cleanup job queue.
 	jobsCh chan *cleanupJob
@@ -70,6 +75,7 @@ func openCleanupManager(
 	objProvider objstorage.Provider,
 	onTableDeleteFn func(fileSize uint64),
 	getDeletePacerInfo func() deletionPacerInfo,
+	keyManager *edg.KeyManager,
 ) *cleanupManager {
 	cm := &cleanupManager{
 		opts:            opts,
@@ -78,6 +84,9 @@ func openCleanupManager(
 		deletePacer:     newDeletionPacer(time.Now(), int64(opts.TargetByteDeletionRate), getDeletePacerInfo),
 		jobsCh:          make(chan *cleanupJob, jobsQueueDepth),
 	}
+	if opts.ForwardSecrecy {
+		cm.keyManager = keyManager
+	}
 	cm.mu.completedJobsCond.L = &cm.mu.Mutex
 	cm.waitGroup.Add(1)
 
@@ -163,6 +172,7 @@ func (cm *cleanupManager) mainLoop() {
 				cm.deleteObsoleteObject(fileTypeTable, job.jobID, of.fileNum)
 			}
 		}
+		cm.shredObsoleteFiles(job.obsoleteFiles)
 		cm.mu.Lock()
 		cm.mu.completedJobs++
 		cm.mu.completedJobsCond.Broadcast()
@@ -171,6 +181,22 @@ func (cm *cleanupManager) mainLoop() {
 	}
 }
 
+// shredObsoleteFiles removes the salts of the obsolete files from the key
+// chain if forward secrecy is enabled. Salts are removed even if deleting the
+// file failed, because the file is never read again.
+func (cm *cleanupManager) shredObsoleteFiles(obsoleteFiles []obsoleteFile) {
+	if cm.keyManager == nil {
+		return
+	}
+	fileNums := make([]base.FileNum, len(obsoleteFiles))
+	for i, of := range obsoleteFiles {
+		fileNums[i] = of.fileNum.FileNum()
+	}
+	if err := cm.keyManager.Remove(fileNums); err != nil {
+		cm.opts.EventListener.BackgroundError(errors.Wrap(err, "estore: shredding obsolete files"))
+	}
+}
+
 func (cm *cleanupManager) needsPacing(fileType base.FileType, fileNum base.DiskFileNum) bool {
 	if fileType != fileTypeTable {
 		return false
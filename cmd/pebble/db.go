@@ -5,6 +5,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"log"
 
 	pebble "github.com/edgelesssys/estore"
@@ -52,6 +53,10 @@ type pebbleDB struct {
 	ballast []byte
 }
 
+// benchmarkEncryptionKey is the master key of the benchmarks if no key is
+// passed. It's fixed, so that a benchmark can reopen an existing database.
+var benchmarkEncryptionKey [32]byte
+
 func newPebbleDB(dir string) DB {
 	cache := pebble.NewCache(cacheSize)
 	defer cache.Unref()
@@ -91,6 +96,21 @@ func newPebbleDB(dir string) DB {
 
 	opts.EnsureDefaults()
 
+	// EDG: the benchmarks are encrypted unless encryption is disabled
+	// explicitly.
+	if disableEncryption {
+		opts.Insecure_DisableEncryption = true
+	} else {
+		opts.EncryptionKey = benchmarkEncryptionKey[:]
+		if encryptionKey != "" {
+			key, err := hex.DecodeString(encryptionKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.EncryptionKey = key
+		}
+	}
+
 	if verbose {
 		lel := pebble.MakeLoggingEventListener(nil)
 		opts.EventListener = &lel
@@ -27,6 +27,10 @@ var (
 	waitCompactions          bool
 	wipe                     bool
 	pathToLocalSharedStorage string
+	// EDG: encryptionKey is the hex-encoded master key. The benchmarks use
+	// benchmarkEncryptionKey if it's empty.
+	encryptionKey     string
+	disableEncryption bool
 	// If zero, or if !sharedStorageEnabled, secondary cache is
 	// not used.
 	secondaryCacheSize int64
@@ -74,6 +78,13 @@ func main() {
 		cmd.Flags().Int64Var(
 			&secondaryCacheSize, "secondary-cache", 0, "secondary cache size in bytes")
 	}
+	for _, cmd := range []*cobra.Command{scanCmd, syncCmd, tombstoneCmd, writeBenchCmd, ycsbCmd} {
+		cmd.Flags().StringVar(
+			&encryptionKey, "encryption-key", "", "hex-encoded encryption key of 16, 24, or 32 bytes (default a fixed 32-byte key)")
+		cmd.Flags().BoolVar(
+			&disableEncryption, "insecure-disable-encryption", false,
+			"store the database in plaintext, e.g., to measure the overhead of encryption")
+	}
 	for _, cmd := range []*cobra.Command{scanCmd, syncCmd, tombstoneCmd, ycsbCmd} {
 		cmd.Flags().Int64Var(
 			&cacheSize, "cache", 1<<30, "cache size")
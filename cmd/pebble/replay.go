@@ -24,6 +24,7 @@ import (
 	"github.com/edgelesssys/estore/bloom"
 	"github.com/edgelesssys/estore/internal/base"
 	"github.com/edgelesssys/estore/internal/cache"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/replay"
 	"github.com/edgelesssys/estore/vfs"
 	"github.com/spf13/cobra"
@@ -266,6 +267,11 @@ func (c *replayConfig) initOptions(r *replay.Runner) error {
 		if err := f.Close(); err != nil {
 			return err
 		}
+		// EDG: the rest of the OPTIONS file is encrypted. The plaintext header
+		// holds the comparer and merger.
+		if header, ok := edg.ReadOptionsHeader(o); ok {
+			o = header
+		}
 		if err := r.Opts.Parse(string(o), c.parseHooks()); err != nil {
 			return err
 		}
@@ -309,6 +315,8 @@ func (c *replayConfig) parseHooks() *pebble.ParseHooks {
 				return nil, nil
 			case "rocksdb.BuiltinBloomFilter":
 				return bloom.FilterPolicy(10), nil
+			case "estore.RibbonFilter":
+				return bloom.RibbonFilterPolicy(10), nil
 			default:
 				return nil, errors.Errorf("invalid filter policy name %q", name)
 			}
@@ -17,6 +17,7 @@ import (
 
 	"github.com/cockroachdb/errors"
 	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/internal/invalidating"
 	"github.com/edgelesssys/estore/internal/invariants"
 	"github.com/edgelesssys/estore/internal/keyspan"
@@ -472,6 +473,10 @@ const (
 	compactionKindRead
 	compactionKindRewrite
 	compactionKindIngestedFlushable
+	// EDG: compactionKindDownload denotes a compaction scheduled by
+	// DB.Download that rewrites external or shared sstables into local
+	// sstables in the same level.
+	compactionKindDownload
 )
 
 func (k compactionKind) String() string {
@@ -494,6 +499,8 @@ func (k compactionKind) String() string {
 		return "ingested-flushable"
 	case compactionKindCopy:
 		return "copy"
+	case compactionKindDownload:
+		return "download"
 	}
 	return "?"
 }
@@ -567,6 +574,13 @@ type compaction struct {
 	// to cancel, such as if a conflicting excise operation raced it to manifest
 	// application. Only holders of the manifest lock will write to this atomic.
 	cancel atomic.Bool
+	// EDG: filterSnapshotSeqNum is the sequence number of the latest snapshot
+	// that existed when the compaction filter was set up, or 0 if there was
+	// none. Newer snapshots may observe the versions that the filter changed.
+	filterSnapshotSeqNum uint64
+	// EDG: filterAttempts is the number of times the compaction was redone
+	// because a newer snapshot could observe the filtered versions.
+	filterAttempts int
 
 	kind      compactionKind
 	cmp       Compare
@@ -2337,6 +2351,7 @@ func (d *DB) maybeScheduleCompactionPicker(
 		diskAvailBytes:          d.diskAvailBytes.Load(),
 		earliestSnapshotSeqNum:  d.mu.snapshots.earliest(),
 		earliestUnflushedSeqNum: d.getEarliestUnflushedSeqNumLocked(),
+		ttlNow:                  d.ttlNow(),
 	}
 
 	// Check for delete-only compactions first, because they're expected to be
@@ -2380,6 +2395,9 @@ func (d *DB) maybeScheduleCompactionPicker(
 		}
 	}
 
+	// EDG: High-priority downloads are scheduled before automatic compactions.
+	d.maybeScheduleDownloadCompactionsLocked(env, DownloadPriorityHigh)
+
 	for !d.opts.DisableAutomaticCompactions && d.mu.compact.compactingCount < maxConcurrentCompactions {
 		env.inProgressCompactions = d.getInProgressCompactionInfoLocked(nil)
 		env.readCompactionEnv = readCompactionEnv{
@@ -2396,6 +2414,10 @@ func (d *DB) maybeScheduleCompactionPicker(
 		d.addInProgressCompaction(c)
 		go d.compact(c, nil)
 	}
+
+	// EDG: Normal-priority downloads only get the capacity that automatic
+	// compactions leave.
+	d.maybeScheduleDownloadCompactionsLocked(env, DownloadPriorityNormal)
 }
 
 // deleteCompactionHintType indicates whether the deleteCompactionHint was
@@ -2484,7 +2506,7 @@ type deleteCompactionHint struct {
 func (h deleteCompactionHint) String() string {
 	return fmt.Sprintf(
 		"L%d.%s %s-%s seqnums(tombstone=%d-%d, file-smallest=%d, type=%s)",
-		h.tombstoneLevel, h.tombstoneFile.FileNum, h.start, h.end,
+		h.tombstoneLevel, h.tombstoneFile.FileNum, base.UserData(h.start), base.UserData(h.end),
 		h.tombstoneSmallestSeqNum, h.tombstoneLargestSeqNum, h.fileSmallestSeqNum,
 		h.hintType,
 	)
@@ -2713,6 +2735,24 @@ func (d *DB) compact1(c *compaction, errChannel chan error) (err error) {
 	startTime := d.timeNow()
 
 	ve, pendingOutputs, stats, err := d.runCompaction(jobID, c)
+	// EDG: A snapshot created while the compaction ran may observe the
+	// versions that the compaction filter changed. Discard the output and redo
+	// the compaction, which respects the new snapshots. The last attempt
+	// doesn't apply the filter, so new snapshots can't starve the compaction.
+	for err == nil && d.edgFilteredVersionsObservableLocked(c, stats) {
+		d.edgDiscardOutputsLocked(pendingOutputs)
+		c.filterAttempts++
+		c.bytesIterated = 0
+		c.rangeDelFrag = keyspan.Fragmenter{}
+		c.rangeKeyFrag = keyspan.Fragmenter{}
+		ve, pendingOutputs, stats, err = d.runCompaction(jobID, c)
+	}
+	// EDG: New snapshots must not be created until the filtered output is
+	// installed, because the manifest lock and logAndApply release d.mu.
+	blockSnapshots := err == nil && stats.countFilteredKeys > 0
+	if blockSnapshots {
+		d.mu.compact.edgFilteredInstalls++
+	}
 
 	info.Duration = d.timeNow().Sub(startTime)
 	if err == nil {
@@ -2753,6 +2793,10 @@ func (d *DB) compact1(c *compaction, errChannel chan error) (err error) {
 			d.mu.versions.updateObsoleteTableMetricsLocked()
 		}
 	}
+	if blockSnapshots {
+		d.mu.compact.edgFilteredInstalls--
+		d.mu.compact.cond.Broadcast()
+	}
 
 	info.Done = true
 	info.Err = err
@@ -2793,6 +2837,7 @@ type compactStats struct {
 	cumulativePinnedKeys uint64
 	cumulativePinnedSize uint64
 	countMissizedDels    uint64
+	countFilteredKeys    uint64
 }
 
 // runCopyCompaction runs a copy compaction where a new FileNum is created that
@@ -3020,6 +3065,17 @@ func (d *DB) runCompaction(
 		c.elideRangeTombstone, d.opts.Experimental.IneffectualSingleDeleteCallback,
 		d.opts.Experimental.SingleDeleteInvariantViolationCallback,
 		d.FormatMajorVersion())
+	iter.ttlNow = d.ttlNow()
+	if c.flushing == nil && d.opts.CompactionFilter != nil && c.filterAttempts < compactionFilterMaxAttempts {
+		// EDG: Compaction filters are only applied to versions that no
+		// snapshot captured here can observe. compact1 redoes the compaction
+		// if a newer snapshot exists when the output is installed.
+		iter.filter = d.opts.CompactionFilter
+		iter.filterLevel = c.outputLevel.level
+		if len(snapshots) > 0 {
+			c.filterSnapshotSeqNum = snapshots[len(snapshots)-1]
+		}
+	}
 
 	var (
 		createdFiles    []base.DiskFileNum
@@ -3131,9 +3187,11 @@ func (d *DB) runCompaction(
 				ctx = objiotracing.WithReason(ctx, objiotracing.ForCompaction)
 			}
 		}
-		// Prefer shared storage if present.
+		// Prefer shared storage if present. EDG: The outputs of downloads are
+		// always local.
 		createOpts := objstorage.CreateOptions{
-			PreferSharedStorage: remote.ShouldCreateShared(d.opts.Experimental.CreateOnShared, c.outputLevel.level),
+			PreferSharedStorage: c.kind != compactionKindDownload &&
+				remote.ShouldCreateShared(d.opts.Experimental.CreateOnShared, c.outputLevel.level),
 		}
 		writable, objMeta, err := d.objProvider.Create(ctx, fileTypeTable, fileNum.DiskFileNum(), createOpts)
 		if err != nil {
@@ -3172,6 +3230,7 @@ func (d *DB) runCompaction(
 		if err != nil {
 			return err
 		}
+		writerOpts.EncryptionStats = d.keyManager.Stats().File(edg.FileTypeTable)
 
 		tw = sstable.NewWriter(writable, writerOpts, cacheOpts, &prevPointKey)
 
@@ -3594,6 +3653,7 @@ func (d *DB) runCompaction(
 	// keys that encoded an incorrect size. Propagate it up as a part of
 	// compactStats.
 	stats.countMissizedDels = iter.stats.countMissizedDels
+	stats.countFilteredKeys = iter.stats.countFilteredKeys
 
 	if err := d.objProvider.Sync(); err != nil {
 		return nil, pendingOutputs, stats, err
@@ -0,0 +1,110 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import "github.com/cockroachdb/errors"
+
+// CompactionFilterDecision is the result of a CompactionFilter.
+type CompactionFilterDecision int8
+
+const (
+	// CompactionFilterKeep keeps the key and its value.
+	CompactionFilterKeep CompactionFilterDecision = iota
+	// CompactionFilterRemove deletes the key. Older versions of the key don't
+	// become visible.
+	CompactionFilterRemove
+	// CompactionFilterChangeValue replaces the value of the key with the
+	// returned value.
+	CompactionFilterChangeValue
+)
+
+// String implements fmt.Stringer.
+func (d CompactionFilterDecision) String() string {
+	switch d {
+	case CompactionFilterKeep:
+		return "keep"
+	case CompactionFilterRemove:
+		return "remove"
+	case CompactionFilterChangeValue:
+		return "change-value"
+	}
+	return "unknown"
+}
+
+// CompactionFilter is called by compactions for the newest version of each
+// key that was written with Set. It's passed the level the compaction writes
+// to, and the key and value, which must not be retained or modified. For
+// CompactionFilterChangeValue, it also returns the new value, which is copied.
+//
+// Versions that a Snapshot or EventuallyFileOnlySnapshot can observe are not
+// passed to the filter, and neither are sstables that a compaction moves to
+// another level without rewriting them. If a snapshot that is created while a
+// compaction runs could observe the filter's effects, the compaction is redone
+// for the new snapshot. After a few attempts, it's redone without the filter.
+// The filter is called again for the same key in later compactions, so it
+// must be idempotent. It may be called concurrently.
+type CompactionFilter func(level int, key, value []byte) (decision CompactionFilterDecision, newValue []byte)
+
+// compactionFilterMaxAttempts is the number of times a compaction applies the
+// compaction filter before it's redone without the filter, because a newer
+// snapshot could observe the filtered versions.
+const compactionFilterMaxAttempts = 3
+
+// edgFilteredVersionsObservableLocked returns whether a snapshot that was
+// created after c set up the compaction filter may observe the versions that
+// the filter changed. Requires d.mu.
+func (d *DB) edgFilteredVersionsObservableLocked(c *compaction, stats compactStats) bool {
+	return stats.countFilteredKeys > 0 && d.mu.snapshots.latest() > c.filterSnapshotSeqNum
+}
+
+// edgDiscardOutputsLocked marks the outputs of a compaction that isn't
+// installed as obsolete. Requires d.mu.
+func (d *DB) edgDiscardOutputsLocked(pendingOutputs []physicalMeta) {
+	for _, f := range pendingOutputs {
+		d.mu.versions.obsoleteTables = append(
+			d.mu.versions.obsoleteTables,
+			fileInfo{f.FileNum.DiskFileNum(), f.Size},
+		)
+	}
+	d.mu.versions.updateObsoleteTableMetricsLocked()
+}
+
+// edgWaitForFilteredInstallsLocked waits until no compaction is installing
+// filtered output, so that a new snapshot can't observe the versions that
+// the filter changed. Requires d.mu.
+func (d *DB) edgWaitForFilteredInstallsLocked() {
+	for d.mu.compact.edgFilteredInstalls > 0 {
+		d.mu.compact.cond.Wait()
+	}
+}
+
+// filterValue calls the compaction filter for the SET at i.iterKey. For
+// CompactionFilterChangeValue, it returns the new value as it must be stored.
+func (i *compactionIter) filterValue() (CompactionFilterDecision, []byte, error) {
+	value := i.iterValue
+	var expiry uint64
+	if i.ttlNow != 0 {
+		var err error
+		if expiry, value, err = ttlDecodeValue(value); err != nil {
+			return 0, nil, err
+		}
+	}
+	decision, newValue := i.filter(i.filterLevel, i.iterKey.UserKey, value)
+	switch decision {
+	case CompactionFilterKeep, CompactionFilterRemove:
+		return decision, nil, nil
+	case CompactionFilterChangeValue:
+		if i.ttlNow != 0 {
+			// The new value keeps the expiry of the old value.
+			i.filterBuf = ttlAppendValue(i.filterBuf[:0], expiry, newValue)
+		} else {
+			i.filterBuf = append(i.filterBuf[:0], newValue...)
+		}
+		return decision, i.filterBuf, nil
+	}
+	return 0, nil, errors.Newf("estore: unknown compaction filter decision %d", errors.Safe(decision))
+}
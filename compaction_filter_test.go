@@ -0,0 +1,223 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// testCompactionFilter removes keys prefixed with "drop", uppercases the
+// values of keys prefixed with "change", and keeps all other keys.
+func testCompactionFilter(level int, key, value []byte) (CompactionFilterDecision, []byte) {
+	switch {
+	case strings.HasPrefix(string(key), "drop"):
+		return CompactionFilterRemove, nil
+	case strings.HasPrefix(string(key), "change"):
+		return CompactionFilterChangeValue, []byte(strings.ToUpper(string(value)))
+	}
+	return CompactionFilterKeep, nil
+}
+
+func scanCompactionFilterDB(t *testing.T, r Reader) []string {
+	iter, err := r.NewIter(nil)
+	require.NoError(t, err)
+	defer iter.Close()
+	var kvs []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		kvs = append(kvs, string(iter.Key())+"="+string(iter.Value()))
+	}
+	require.NoError(t, iter.Error())
+	return kvs
+}
+
+// setAndFlush writes the keys to two overlapping sstables in L0, so that
+// compacting them rewrites the data instead of moving the sstable.
+func setAndFlush(t *testing.T, d *DB, keys ...string) {
+	for i := 0; i < 2; i++ {
+		for _, key := range keys {
+			require.NoError(t, d.Set([]byte(key), []byte("val"), nil))
+		}
+		require.NoError(t, d.Flush())
+	}
+}
+
+func TestCompactionFilter(t *testing.T) {
+	require := require.New(t)
+
+	var levels []int
+	d, err := Open("", &Options{
+		FS:                          vfs.NewMem(),
+		DisableAutomaticCompactions: true,
+		CompactionFilter: func(level int, key, value []byte) (CompactionFilterDecision, []byte) {
+			levels = append(levels, level)
+			return testCompactionFilter(level, key, value)
+		},
+	})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+
+	// older versions in lower levels must not reappear
+	require.NoError(d.Set([]byte("drop-b"), []byte("old"), nil))
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	levels = nil
+
+	for _, key := range []string{"change-a", "drop-b", "keep-c"} {
+		require.NoError(d.Set([]byte(key), []byte("val"), nil))
+	}
+	// flushes don't filter
+	require.NoError(d.Flush())
+	require.Empty(levels)
+	require.Equal([]string{"change-a=val", "drop-b=val", "keep-c=val"}, scanCompactionFilterDB(t, d))
+
+	require.NoError(d.Compact([]byte("a"), []byte("z"), false))
+	require.NotEmpty(levels)
+	require.Equal([]string{"change-a=VAL", "keep-c=val"}, scanCompactionFilterDB(t, d))
+
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.Equal([]string{"change-a=VAL", "keep-c=val"}, scanCompactionFilterDB(t, d))
+	require.Equal(numLevels-1, levels[len(levels)-1])
+}
+
+func TestCompactionFilterTTL(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1000, 0)
+	d, err := Open("", &Options{
+		FS:                 vfs.NewMem(),
+		EnableTTL:          true,
+		FormatMajorVersion: FormatNewest,
+		CompactionFilter:   testCompactionFilter,
+	})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+	d.timeNow = func() time.Time { return now }
+
+	require.NoError(d.SetWithTTL([]byte("change-a"), []byte("val"), time.Hour, nil))
+	require.NoError(d.Flush())
+	require.NoError(d.SetWithTTL([]byte("change-a"), []byte("val"), time.Hour, nil))
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.Equal([]string{"change-a=VAL"}, scanCompactionFilterDB(t, d))
+
+	// the changed value keeps its expiry
+	now = now.Add(time.Hour)
+	require.Empty(scanCompactionFilterDB(t, d))
+}
+
+func TestCompactionFilterSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	d, err := Open("", &Options{FS: vfs.NewMem(), CompactionFilter: testCompactionFilter})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+
+	set := func() {
+		for _, key := range []string{"change-a", "drop-b"} {
+			require.NoError(d.Set([]byte(key), []byte("val"), nil))
+		}
+		require.NoError(d.Flush())
+	}
+	set()
+	snap := d.NewSnapshot()
+	efos := d.NewEventuallyFileOnlySnapshot([]KeyRange{{Start: []byte("a"), End: []byte("z")}})
+	set()
+
+	// the filter is only applied to the versions that the snapshots can't see
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.Equal([]string{"change-a=VAL"}, scanCompactionFilterDB(t, d))
+	want := []string{"change-a=val", "drop-b=val"}
+	require.Equal(want, scanCompactionFilterDB(t, snap))
+	require.Equal(want, scanCompactionFilterDB(t, efos))
+	require.NoError(snap.Close())
+	require.NoError(efos.Close())
+}
+
+func TestCompactionFilterConcurrentTransactions(t *testing.T) {
+	require := require.New(t)
+
+	var d *DB
+	var err error
+	var cancelled atomic.Bool
+	var txs atomic.Int32
+	d, err = Open("", &Options{
+		FS: vfs.NewMem(),
+		EventListener: &EventListener{
+			CompactionEnd: func(info CompactionInfo) {
+				if errors.Is(info.Err, ErrCancelledCompaction) {
+					cancelled.Store(true)
+				}
+			},
+		},
+		CompactionFilter: func(level int, key, value []byte) (CompactionFilterDecision, []byte) {
+			// transactions take snapshots while the compaction runs
+			for i := 0; i < 3; i++ {
+				tx := d.NewTransaction(false)
+				_, closer, err := tx.Get(key)
+				require.NoError(err)
+				require.NoError(closer.Close())
+				tx.Close()
+				txs.Add(1)
+			}
+			return testCompactionFilter(level, key, value)
+		},
+	})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+
+	setAndFlush(t, d, "change-a", "drop-b", "keep-c")
+	// the compaction isn't redone for snapshots that are closed before its
+	// output is installed
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.False(cancelled.Load())
+	require.EqualValues(9, txs.Load())
+	require.Equal([]string{"change-a=VAL", "keep-c=val"}, scanCompactionFilterDB(t, d))
+}
+
+func TestCompactionFilterConcurrentSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	var d *DB
+	var err error
+	var snap atomic.Pointer[Snapshot]
+	var calls atomic.Int32
+	d, err = Open("", &Options{
+		FS: vfs.NewMem(),
+		CompactionFilter: func(level int, key, value []byte) (CompactionFilterDecision, []byte) {
+			calls.Add(1)
+			// a snapshot created while the compaction runs can observe the
+			// original values
+			if snap.Load() == nil {
+				snap.Store(d.NewSnapshot())
+			}
+			return testCompactionFilter(level, key, value)
+		},
+	})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+
+	setAndFlush(t, d, "change-a", "drop-b")
+	// the compaction is redone, and the redo doesn't filter the versions
+	// visible to the snapshot
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.EqualValues(2, calls.Load())
+	want := []string{"change-a=val", "drop-b=val"}
+	require.Equal(want, scanCompactionFilterDB(t, d))
+	require.Equal(want, scanCompactionFilterDB(t, snap.Load()))
+
+	// once the snapshot is closed, the filter is applied again
+	require.NoError(snap.Load().Close())
+	setAndFlush(t, d, "change-a", "keep-c")
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.EqualValues(5, calls.Load())
+	require.Equal([]string{"change-a=VAL", "keep-c=val"}, scanCompactionFilterDB(t, d))
+}
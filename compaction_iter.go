@@ -268,7 +268,23 @@ type compactionIter struct {
 	stats         struct {
 		// count of DELSIZED keys that were missized.
 		countMissizedDels uint64
+		// EDG: count of keys that were removed or changed by the compaction
+		// filter.
+		countFilteredKeys uint64
 	}
+	// EDG: ttlNow is the time in Unix nanoseconds at which keys are checked
+	// for expiry, or 0 if TTL is disabled. If set, SET values carry a TTL
+	// header, and expired SETs are dropped where a tombstone would be elided.
+	ttlNow uint64
+	ttlBuf []byte
+	// EDG: ttlMergeExpiry is the expiry of the SET that the current MERGE is
+	// folded into. The merged value inherits it.
+	ttlMergeExpiry uint64
+	// EDG: filter is applied to the newest version of each key that no
+	// snapshot can observe. filterLevel is the output level of the compaction.
+	filter      CompactionFilter
+	filterLevel int
+	filterBuf   []byte
 }
 
 func newCompactionIter(
@@ -509,6 +525,52 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 			}
 
 		case InternalKeyKindSet, InternalKeyKindSetWithDelete:
+			// EDG: An expired SET hides older versions of the key just like a
+			// DEL. It can be dropped under the same conditions as a DEL.
+			if i.ttlNow != 0 && i.curSnapshotIdx == 0 {
+				var expiry uint64
+				if expiry, _, i.err = ttlDecodeValue(i.iterValue); i.err != nil {
+					i.valid = false
+					return nil, nil
+				}
+				if ttlExpired(expiry, i.ttlNow) && i.elideTombstone(i.iterKey.UserKey) {
+					i.saveKey()
+					i.skipInStripe()
+					continue
+				}
+			}
+
+			// EDG: Apply the compaction filter if no snapshot can observe this
+			// version, i.e., it's in the newest stripe.
+			var filteredValue []byte
+			var changeValue bool
+			if i.filter != nil && i.curSnapshotIdx == len(i.snapshots) {
+				var decision CompactionFilterDecision
+				if decision, filteredValue, i.err = i.filterValue(); i.err != nil {
+					i.valid = false
+					return nil, nil
+				}
+				changeValue = decision == CompactionFilterChangeValue
+				if decision == CompactionFilterRemove {
+					i.stats.countFilteredKeys++
+					if i.curSnapshotIdx == 0 && i.elideTombstone(i.iterKey.UserKey) {
+						// Nothing older can be uncovered, so drop the key
+						// like an elided tombstone.
+						i.saveKey()
+						i.skipInStripe()
+						continue
+					}
+					// Replace the key with a tombstone that shadows older
+					// versions.
+					i.saveKey()
+					i.key.SetKind(InternalKeyKindDelete)
+					i.value = nil
+					i.valid = true
+					i.skip = true
+					return &i.key, i.value
+				}
+			}
+
 			// The key we emit for this entry is a function of the current key
 			// kind, and whether this entry is followed by a DEL/SINGLEDEL
 			// entry. setNext() does the work to move the iterator forward,
@@ -518,12 +580,17 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 			if i.err != nil {
 				return nil, nil
 			}
+			if changeValue {
+				i.stats.countFilteredKeys++
+				i.value = filteredValue
+			}
 			return &i.key, i.value
 
 		case InternalKeyKindMerge:
 			// Record the snapshot index before mergeNext as merging
 			// advances the iterator, adjusting curSnapshotIdx.
 			origSnapshotIdx := i.curSnapshotIdx
+			i.ttlMergeExpiry = 0
 			var valueMerger ValueMerger
 			valueMerger, i.err = i.merge(i.iterKey.UserKey, i.iterValue)
 			var change stripeChangeType
@@ -544,6 +611,12 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 						"unexpected kind %s", redact.SafeString(i.key.Kind().String())))
 				}
 				i.value, needDelete, i.valueCloser, i.err = finishValueMerger(valueMerger, includesBase)
+				if i.err == nil && includesBase && !needDelete && i.ttlNow != 0 {
+					// EDG: The merged value becomes a SET, which needs a TTL
+					// header. It expires together with the base value.
+					i.ttlBuf = ttlAppendValue(i.ttlBuf[:0], i.ttlMergeExpiry, i.value)
+					i.value = i.ttlBuf
+				}
 			}
 			if i.err == nil {
 				if needDelete {
@@ -891,7 +964,23 @@ func (i *compactionIter) mergeNext(valueMerger ValueMerger) stripeChangeType {
 			// value and return. We change the kind of the resulting key to a
 			// Set so that it shadows keys in lower levels. That is:
 			// MERGE + (SET*) -> SET.
-			i.err = valueMerger.MergeOlder(i.iterValue)
+			value := i.iterValue
+			if i.ttlNow != 0 {
+				// EDG: Merge with the user value. An expired value is treated
+				// like a deletion tombstone.
+				var expiry uint64
+				if expiry, value, i.err = ttlDecodeValue(value); i.err != nil {
+					i.valid = false
+					return sameStripeSkippable
+				}
+				if ttlExpired(expiry, i.ttlNow) {
+					i.key.SetKind(InternalKeyKindSetWithDelete)
+					i.skip = true
+					return sameStripeSkippable
+				}
+				i.ttlMergeExpiry = expiry
+			}
+			i.err = valueMerger.MergeOlder(value)
 			if i.err != nil {
 				i.valid = false
 				return sameStripeSkippable
@@ -1264,7 +1353,7 @@ func (i *compactionIter) deleteSizedNext() (*base.InternalKey, []byte) {
 			// has a positive size.
 			expectedSize, n := binary.Uvarint(i.value)
 			if n != len(i.value) {
-				i.err = base.CorruptionErrorf("DELSIZED holds invalid value: %x", errors.Safe(i.value))
+				i.err = base.CorruptionErrorf("DELSIZED holds invalid value: %x", base.UserData(i.value))
 				i.valid = false
 				return nil, nil
 			}
@@ -1515,7 +1604,7 @@ func (f *frontier) Init(
 
 // String implements fmt.Stringer.
 func (f *frontier) String() string {
-	return string(f.key)
+	return fmt.Sprintf("%s", base.UserData(f.key))
 }
 
 // Update replaces the existing frontier's key with the provided key. The
@@ -1569,7 +1658,7 @@ func (f *frontiers) String() string {
 		if i > 0 {
 			fmt.Fprint(&buf, ", ")
 		}
-		fmt.Fprintf(&buf, "%s: %q", f.items[i], f.items[i].key)
+		fmt.Fprintf(&buf, "%s: %q", f.items[i], base.UserData(f.items[i].key))
 	}
 	return buf.String()
 }
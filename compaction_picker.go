@@ -36,6 +36,9 @@ type compactionEnv struct {
 	earliestSnapshotSeqNum  uint64
 	inProgressCompactions   []compactionInfo
 	readCompactionEnv       readCompactionEnv
+	// EDG: ttlNow is the current time in Unix nanoseconds if TTL is enabled,
+	// and 0 otherwise.
+	ttlNow uint64
 }
 
 type compactionPicker interface {
@@ -1513,6 +1516,46 @@ func (a elisionOnlyAnnotator) Merge(v interface{}, accum interface{}) interface{
 	return accumV
 }
 
+// expiredAnnotator implements the manifest.Annotator interface, annotating
+// B-Tree nodes with the *fileMetadata of the file within the subtree whose
+// point keys expire first. Only files that were written with TTL enabled and
+// whose point keys all expire are considered.
+type expiredAnnotator struct{}
+
+var _ manifest.Annotator = expiredAnnotator{}
+
+func (a expiredAnnotator) Zero(interface{}) interface{} {
+	return nil
+}
+
+func (a expiredAnnotator) Accumulate(f *fileMetadata, dst interface{}) (interface{}, bool) {
+	if f.IsCompacting() {
+		return dst, true
+	}
+	if !f.StatsValid() {
+		return dst, false
+	}
+	if f.Stats.TTLMaxExpiry == 0 {
+		return dst, true
+	}
+	return a.Merge(f, dst), true
+}
+
+func (a expiredAnnotator) Merge(v interface{}, accum interface{}) interface{} {
+	if v == nil {
+		return accum
+	}
+	if accum == nil {
+		return v
+	}
+	f := v.(*fileMetadata)
+	accumV := accum.(*fileMetadata)
+	if accumV.Stats.TTLMaxExpiry > f.Stats.TTLMaxExpiry {
+		return f
+	}
+	return accumV
+}
+
 // markedForCompactionAnnotator implements the manifest.Annotator interface,
 // annotating B-Tree nodes with the *fileMetadata of a file that is marked for
 // compaction within the subtree. If multiple files meet the criteria, it
@@ -1561,11 +1604,31 @@ func (p *compactionPickerByScore) pickElisionOnlyCompaction(
 	if p.opts.private.disableElisionOnlyCompactions {
 		return nil
 	}
-	v := p.vers.Levels[numLevels-1].Annotation(elisionOnlyAnnotator{})
+	if v := p.vers.Levels[numLevels-1].Annotation(elisionOnlyAnnotator{}); v != nil {
+		if pc := p.pickElisionOnlyCandidate(env, v.(*fileMetadata)); pc != nil {
+			return pc
+		}
+	}
+	// EDG: Also look for files whose point keys have all expired.
+	if env.ttlNow == 0 {
+		return nil
+	}
+	v := p.vers.Levels[numLevels-1].Annotation(expiredAnnotator{})
 	if v == nil {
 		return nil
 	}
 	candidate := v.(*fileMetadata)
+	if candidate.Stats.TTLMaxExpiry > env.ttlNow {
+		return nil
+	}
+	return p.pickElisionOnlyCandidate(env, candidate)
+}
+
+// pickElisionOnlyCandidate constructs an elision-only compaction of the
+// given bottommost file, if possible.
+func (p *compactionPickerByScore) pickElisionOnlyCandidate(
+	env compactionEnv, candidate *fileMetadata,
+) (pc *pickedCompaction) {
 	if candidate.IsCompacting() || candidate.LargestSeqNum >= env.earliestSnapshotSeqNum {
 		return nil
 	}
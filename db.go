@@ -424,6 +424,11 @@ type DB struct {
 			// The list of manual compactions. The next manual compaction to perform
 			// is at the start of the list. New entries are added to the end.
 			manual []*manualCompaction
+			// EDG: The spans of running Download calls.
+			downloads []*downloadSpan
+			// EDG: The number of compactions that are installing output that
+			// the compaction filter changed. New snapshots wait until it's 0.
+			edgFilteredInstalls int
 			// inProgress is the set of in-progress flushes and compactions.
 			// It's used in the calculation of some metrics and to initialize L0
 			// sublevels' state. Some of the compactions contained within this
@@ -501,9 +506,19 @@ type DB struct {
 	// compaction concurrency
 	openedAt time.Time
 
-	keyManager       *edg.KeyManager
-	txLock           sync.Mutex
+	keyManager *edg.KeyManager
+	txLock     sync.Mutex
+	// indexes are the registered secondary indexes. indexMu serializes their
+	// registration.
+	indexes          atomic.Pointer[[]*Index]
+	indexMu          sync.Mutex
 	monotonicCounter uint64
+	// monotonicCounterLatency records the latencies of the SetMonotonicCounter
+	// calls made by Transaction.Commit. It is nil if no monotonic counter is
+	// configured.
+	monotonicCounterLatency prometheus.Histogram
+	// walTailTruncated is set if the tail of a WAL was truncated during Open.
+	walTailTruncated bool
 }
 
 var _ Reader = (*DB)(nil)
@@ -592,6 +607,12 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, io.Closer,
 		comparer:     *d.opts.Comparer,
 		readState:    readState,
 		keyBuf:       buf.keyBuf,
+		ttlNow:       d.ttlNow(),
+	}
+	if i.ttlNow != 0 {
+		i.ttl.init(pointIter, i.ttlNow)
+		i.iter = &i.ttl
+		i.pointIter = &i.ttl
 	}
 
 	if !i.First() {
@@ -610,7 +631,9 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, io.Closer,
 // It is safe to modify the contents of the arguments after Set returns.
 func (d *DB) Set(key, value []byte, opts *WriteOptions) error {
 	b := newBatch(d)
-	_ = b.Set(key, value, opts)
+	if err := b.Set(key, value, opts); err != nil {
+		return err
+	}
 	if err := d.Apply(b, opts); err != nil {
 		return err
 	}
@@ -625,7 +648,9 @@ func (d *DB) Set(key, value []byte, opts *WriteOptions) error {
 // It is safe to modify the contents of the arguments after Delete returns.
 func (d *DB) Delete(key []byte, opts *WriteOptions) error {
 	b := newBatch(d)
-	_ = b.Delete(key, opts)
+	if err := b.Delete(key, opts); err != nil {
+		return err
+	}
 	if err := d.Apply(b, opts); err != nil {
 		return err
 	}
@@ -649,7 +674,9 @@ func (d *DB) Delete(key []byte, opts *WriteOptions) error {
 // returns.
 func (d *DB) DeleteSized(key []byte, valueSize uint32, opts *WriteOptions) error {
 	b := newBatch(d)
-	_ = b.DeleteSized(key, valueSize, opts)
+	if err := b.DeleteSized(key, valueSize, opts); err != nil {
+		return err
+	}
 	if err := d.Apply(b, opts); err != nil {
 		return err
 	}
@@ -664,7 +691,9 @@ func (d *DB) DeleteSized(key []byte, valueSize uint32, opts *WriteOptions) error
 // It is safe to modify the contents of the arguments after SingleDelete returns.
 func (d *DB) SingleDelete(key []byte, opts *WriteOptions) error {
 	b := newBatch(d)
-	_ = b.SingleDelete(key, opts)
+	if err := b.SingleDelete(key, opts); err != nil {
+		return err
+	}
 	if err := d.Apply(b, opts); err != nil {
 		return err
 	}
@@ -680,7 +709,9 @@ func (d *DB) SingleDelete(key []byte, opts *WriteOptions) error {
 // returns.
 func (d *DB) DeleteRange(start, end []byte, opts *WriteOptions) error {
 	b := newBatch(d)
-	_ = b.DeleteRange(start, end, opts)
+	if err := b.DeleteRange(start, end, opts); err != nil {
+		return err
+	}
 	if err := d.Apply(b, opts); err != nil {
 		return err
 	}
@@ -842,13 +873,23 @@ func (d *DB) applyInternal(batch *Batch, opts *WriteOptions, noSyncWait bool) er
 		}
 		// TODO(jackson): Assert that all range key operands are suffixless.
 	}
-	batch.committing = true
 
+	if batch.ttlRawSets && d.opts.EnableTTL {
+		// EDG: The batch has been built without this DB, so its SETs lack the
+		// TTL header.
+		if err := batch.ttlEncodeRawSets(batchHeaderLen); err != nil {
+			return err
+		}
+		batch.ttlRawSets = false
+	}
 	if batch.db == nil {
 		if err := batch.refreshMemTableSize(); err != nil {
 			return err
 		}
 	}
+	unpadded := d.edgPadBatch(batch)
+	batch.committing = true
+
 	if batch.memTableSize >= d.largeBatchThreshold {
 		var err error
 		batch.flushable, err = newFlushableBatch(batch, d.opts.Comparer)
@@ -861,6 +902,7 @@ func (d *DB) applyInternal(batch *Batch, opts *WriteOptions, noSyncWait bool) er
 		// horked at this point.
 		d.opts.Logger.Fatalf("pebble: fatal commit error: %v", err)
 	}
+	edgUnpadBatch(batch, unpadded)
 	// If this is a large batch, we need to clear the batch contents as the
 	// flushable batch may still be present in the flushables queue.
 	//
@@ -1070,10 +1112,12 @@ func (d *DB) newIter(
 		newIters:            d.newIters,
 		newIterRangeKey:     d.tableNewRangeKeyIter,
 		seqNum:              seqNum,
+		ttlNow:              d.ttlNow(),
 	}
 	if o != nil {
 		dbi.opts = *o
 		dbi.processBounds(o.LowerBound, o.UpperBound)
+		dbi.opts.initPrefetcher()
 	}
 	dbi.opts.logger = d.opts.Logger
 	if d.opts.private.disableLazyCombinedIteration {
@@ -1461,6 +1505,10 @@ func (i *Iterator) constructPointIter(
 	buf.merging.combinedIterState = &i.lazyCombinedIter.combinedIterState
 	i.pointIter = invalidating.MaybeWrapIfInvariants(&buf.merging)
 	i.merging = &buf.merging
+	if i.ttlNow != 0 {
+		i.ttl.init(i.pointIter, i.ttlNow)
+		i.pointIter = &i.ttl
+	}
 }
 
 // NewBatch returns a new empty write-only batch. Any reads on the batch will
@@ -1522,6 +1570,7 @@ func (d *DB) NewSnapshot() *Snapshot {
 	}
 
 	d.mu.Lock()
+	d.edgWaitForFilteredInstallsLocked()
 	s := &Snapshot{
 		db:     d,
 		seqNum: d.mu.versions.visibleSeqNum.Load(),
@@ -1695,6 +1744,9 @@ func (d *DB) Close() error {
 	}
 
 	err = firstError(err, d.keyManager.Close())
+	if d.opts.ZeroizeMemory {
+		d.keyManager.Wipe()
+	}
 
 	return err
 }
@@ -1849,30 +1901,6 @@ func (d *DB) splitManualCompaction(
 	return splitCompactions
 }
 
-// DownloadSpan is a key range passed to the Download method.
-type DownloadSpan struct {
-	StartKey []byte
-	// EndKey is exclusive.
-	EndKey []byte
-}
-
-// Download ensures that the LSM does not use any external sstables for the
-// given key ranges. It does so by performing appropriate compactions so that
-// all external data becomes available locally.
-//
-// Note that calling this method does not imply that all other compactions stop;
-// it simply informs Pebble of a list of spans for which external data should be
-// downloaded with high priority.
-//
-// The method returns once no external sstasbles overlap the given spans, the
-// context is canceled, or an error is hit.
-//
-// TODO(radu): consider passing a priority/impact knob to express how important
-// the download is (versus live traffic performance, LSM health).
-func (d *DB) Download(ctx context.Context, spans []DownloadSpan) error {
-	return errors.Errorf("not implemented")
-}
-
 // Flush the memtable to stable storage.
 func (d *DB) Flush() error {
 	flushDone, err := d.AsyncFlush()
@@ -1991,6 +2019,7 @@ func (d *DB) Metrics() *Metrics {
 	d.mu.versions.logUnlock()
 
 	metrics.LogWriter.FsyncLatency = d.mu.log.metrics.fsyncLatency
+	d.edgEncryptionMetrics(metrics)
 	if err := metrics.LogWriter.Merge(&d.mu.log.metrics.LogWriterMetrics); err != nil {
 		d.opts.Logger.Infof("metrics error: %s", err)
 	}
@@ -2374,7 +2403,9 @@ func (d *DB) newMemTable(logNum FileNum, logSeqNum uint64) (*memTable, *flushabl
 		}
 
 		// The next memtable allocation might be able to reuse this memtable.
-		// Stash it on d.memTableRecycle.
+		// Stash it on d.memTableRecycle. EDG: the arena must not keep the
+		// plaintext while it waits for reuse.
+		manual.Scrub(mem.arenaBuf)
 		if unusedMem := d.memTableRecycle.Swap(mem); unusedMem != nil {
 			// There was already a memtable waiting to be recycled. We're now
 			// responsible for freeing it.
@@ -2607,6 +2638,13 @@ func (d *DB) rotateWAL() (newLogNum FileNum, prevLogSize uint64) {
 
 	newLogName := base.MakeFilepath(d.opts.FS, d.walDirname, fileTypeLog, newLogNum.DiskFileNum())
 
+	// EDG: Create the key before the log file, so that a crash can't leave a
+	// log file whose salt isn't in the SALTCHAIN.
+	var encryptionKey []byte
+	if err == nil {
+		encryptionKey, err = d.keyManager.Create(newLogNum)
+	}
+
 	// Try to use a recycled log file. Recycling log files is an important
 	// performance optimization as it is faster to sync a file that has
 	// already been written, than one which is being written for the first
@@ -2665,11 +2703,6 @@ func (d *DB) rotateWAL() (newLogNum FileNum, prevLogSize uint64) {
 		err = firstError(err, d.logRecycler.pop(recycleLog.fileNum.FileNum()))
 	}
 
-	var encryptionKey []byte
-	if err == nil {
-		encryptionKey, err = d.keyManager.Create(newLogNum)
-	}
-
 	d.opts.EventListener.WALCreated(WALCreateInfo{
 		JobID:           jobID,
 		Path:            newLogName,
@@ -2698,6 +2731,7 @@ func (d *DB) rotateWAL() (newLogNum FileNum, prevLogSize uint64) {
 		QueueSemChan:       d.commit.logSyncQSem,
 	})
 	d.mu.log.LogWriter.EncryptionKey = encryptionKey
+	d.mu.log.LogWriter.EncryptionStats = d.keyManager.Stats().File(edg.FileTypeWAL)
 
 	if d.mu.log.registerLogWriterForTesting != nil {
 		d.mu.log.registerLogWriterForTesting(d.mu.log.LogWriter)
@@ -2969,18 +3003,18 @@ func (d *DB) checkVirtualBounds(m *fileMetadata) {
 		// Check that iterator keys are within bounds.
 		for key, _ := pointIter.First(); key != nil; key, _ = pointIter.Next() {
 			if d.cmp(key.UserKey, m.SmallestPointKey.UserKey) < 0 || d.cmp(key.UserKey, m.LargestPointKey.UserKey) > 0 {
-				panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, key.UserKey))
+				panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, base.UserData(key.UserKey)))
 			}
 		}
 
 		if rangeDelIter != nil {
 			for key := rangeDelIter.First(); key != nil; key = rangeDelIter.Next() {
 				if d.cmp(key.SmallestKey().UserKey, m.SmallestPointKey.UserKey) < 0 {
-					panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, key.SmallestKey().UserKey))
+					panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, base.UserData(key.SmallestKey().UserKey)))
 				}
 
 				if d.cmp(key.LargestKey().UserKey, m.LargestPointKey.UserKey) > 0 {
-					panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, key.LargestKey().UserKey))
+					panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, base.UserData(key.LargestKey().UserKey)))
 				}
 			}
 		}
@@ -3009,10 +3043,10 @@ func (d *DB) checkVirtualBounds(m *fileMetadata) {
 
 	for key := rangeKeyIter.First(); key != nil; key = rangeKeyIter.Next() {
 		if d.cmp(key.SmallestKey().UserKey, m.SmallestRangeKey.UserKey) < 0 {
-			panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, key.SmallestKey().UserKey))
+			panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, base.UserData(key.SmallestKey().UserKey)))
 		}
 		if d.cmp(key.LargestKey().UserKey, m.LargestRangeKey.UserKey) > 0 {
-			panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, key.LargestKey().UserKey))
+			panic(errors.Newf("pebble: virtual sstable %s point key %s is not within bounds", m.FileNum, base.UserData(key.LargestKey().UserKey)))
 		}
 	}
 }
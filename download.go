@@ -0,0 +1,291 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/internal/manifest"
+)
+
+// DownloadPriority determines how download compactions are scheduled relative
+// to automatic compactions. Download compactions always count against
+// Options.MaxConcurrentCompactions.
+type DownloadPriority int8
+
+const (
+	// DownloadPriorityNormal schedules download compactions only if no
+	// automatic compaction is pending, so that downloading doesn't affect the
+	// health of the LSM.
+	DownloadPriorityNormal DownloadPriority = iota
+	// DownloadPriorityHigh schedules download compactions before automatic
+	// compactions.
+	DownloadPriorityHigh
+)
+
+// DownloadSpan is a key range passed to the Download method.
+type DownloadSpan struct {
+	StartKey []byte
+	// EndKey is exclusive.
+	EndKey []byte
+	// Priority determines how the download compactions of the span are
+	// scheduled.
+	Priority DownloadPriority
+}
+
+// downloadSpan is a span registered by a running Download call.
+type downloadSpan struct {
+	start, end []byte
+	priority   DownloadPriority
+	// doneChans receive the results of the download compactions started for
+	// the span. Each channel has a buffer size of 1 and is only passed into
+	// one compaction.
+	doneChans []chan error
+	// err is the first error hit while picking a download compaction for the
+	// span. It's returned by Download.
+	err error
+}
+
+// Download ensures that the LSM does not use any external sstables for the
+// given key ranges. It does so by performing appropriate compactions so that
+// all external data becomes available locally.
+//
+// Every external or shared sstable overlapping the spans is rewritten to a
+// local sstable in the same level. Like any other output of a compaction, the
+// new sstable is encrypted with a fresh key whose salt is added to the
+// SALTCHAIN. Progress is reported through EventListener.DownloadProgress.
+//
+// Note that calling this method does not imply that all other compactions stop;
+// it simply informs Pebble of a list of spans for which external data should be
+// downloaded. DownloadSpan.Priority determines how the download competes with
+// automatic compactions.
+//
+// The method returns once no external sstables overlap the given spans, the
+// context is canceled, or an error is hit. Download compactions that are
+// already running when the context is canceled run to completion.
+func (d *DB) Download(ctx context.Context, spans []DownloadSpan) error {
+	if err := d.closed.Load(); err != nil {
+		panic(err)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	dspans := make([]*downloadSpan, len(spans))
+	for i, s := range spans {
+		dspans[i] = &downloadSpan{start: s.StartKey, end: s.EndKey, priority: s.Priority}
+	}
+
+	// Wake up the loop below if the context is canceled.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.mu.Lock()
+			d.mu.compact.cond.Broadcast()
+			d.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info := DownloadInfo{JobID: d.mu.nextJobID, Spans: spans}
+	d.mu.nextJobID++
+	startTime := d.timeNow()
+
+	d.mu.compact.downloads = append(d.mu.compact.downloads, dspans...)
+	defer d.removeDownloadSpansLocked(dspans)
+
+	lastRemaining := -1
+	for {
+		var err error
+		for _, s := range dspans {
+			info.Downloaded += s.collectDoneLocked(&err)
+			if err == nil {
+				err = s.err
+			}
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		var remaining int
+		if err == nil {
+			remaining, err = d.remoteTablesLocked(dspans)
+		}
+		info.Remaining = remaining
+		info.Duration = d.timeNow().Sub(startTime)
+		if err != nil || remaining == 0 {
+			info.Done = true
+			info.Err = err
+			d.opts.EventListener.DownloadProgress(info)
+			return err
+		}
+		if remaining != lastRemaining {
+			d.opts.EventListener.DownloadProgress(info)
+			lastRemaining = remaining
+		}
+
+		d.maybeScheduleCompaction()
+		d.mu.compact.cond.Wait()
+	}
+}
+
+// collectDoneLocked returns the number of download compactions of the span
+// that completed successfully since the last call. *errp is set to the first
+// error of a failed compaction, unless it's already set. Compactions that
+// were cancelled don't count as failed: the files are picked again.
+func (s *downloadSpan) collectDoneLocked(errp *error) (downloaded int) {
+	pending := s.doneChans[:0]
+	for _, ch := range s.doneChans {
+		select {
+		case err := <-ch:
+			switch {
+			case err == nil:
+				downloaded++
+			case errors.Is(err, ErrCancelledCompaction):
+			case *errp == nil:
+				*errp = err
+			}
+		default:
+			pending = append(pending, ch)
+		}
+	}
+	s.doneChans = pending
+	return downloaded
+}
+
+// removeDownloadSpansLocked unregisters the spans of a Download call.
+func (d *DB) removeDownloadSpansLocked(spans []*downloadSpan) {
+	downloads := d.mu.compact.downloads[:0]
+	for _, s := range d.mu.compact.downloads {
+		remove := false
+		for _, r := range spans {
+			remove = remove || s == r
+		}
+		if !remove {
+			downloads = append(downloads, s)
+		}
+	}
+	d.mu.compact.downloads = downloads
+}
+
+// remoteTablesLocked returns the number of external or shared sstables in the
+// current version that overlap any of the spans.
+func (d *DB) remoteTablesLocked(spans []*downloadSpan) (int, error) {
+	v := d.mu.versions.currentVersion()
+	seen := make(map[*fileMetadata]struct{})
+	for _, s := range spans {
+		for l := 0; l < numLevels; l++ {
+			overlaps := v.Overlaps(l, d.cmp, s.start, s.end, true /* exclusiveEnd */)
+			iter := overlaps.Iter()
+			for f := iter.First(); f != nil; f = iter.Next() {
+				if _, ok := seen[f]; ok {
+					continue
+				}
+				isRemote, err := d.isRemoteTable(f)
+				if err != nil {
+					return 0, err
+				}
+				if isRemote {
+					seen[f] = struct{}{}
+				}
+			}
+		}
+	}
+	return len(seen), nil
+}
+
+func (d *DB) isRemoteTable(f *fileMetadata) (bool, error) {
+	objMeta, err := d.objProvider.Lookup(fileTypeTable, f.FileBacking.DiskFileNum)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot lookup table %s in provider", f.FileBacking.DiskFileNum)
+	}
+	return objMeta.IsRemote(), nil
+}
+
+// maybeScheduleDownloadCompactionsLocked schedules download compactions for
+// the registered spans of the given priority while there is capacity for
+// more compactions.
+func (d *DB) maybeScheduleDownloadCompactionsLocked(env compactionEnv, priority DownloadPriority) {
+	maxConcurrentCompactions := d.opts.MaxConcurrentCompactions()
+	for _, s := range d.mu.compact.downloads {
+		if s.priority != priority {
+			continue
+		}
+		for d.mu.compact.compactingCount < maxConcurrentCompactions {
+			env.inProgressCompactions = d.getInProgressCompactionInfoLocked(nil)
+			pc := d.pickDownloadCompactionLocked(env, s)
+			if pc == nil {
+				break
+			}
+			c := newCompaction(pc, d.opts, d.timeNow(), d.ObjProvider())
+			ch := make(chan error, 1)
+			s.doneChans = append(s.doneChans, ch)
+			d.mu.compact.compactingCount++
+			d.addInProgressCompaction(c)
+			go d.compact(c, ch)
+		}
+	}
+}
+
+// pickDownloadCompactionLocked picks a compaction that rewrites an external
+// or shared sstable overlapping the span into a local sstable in the same
+// level. Like pickRewriteCompaction, it pulls in adjacent files in the
+// file's atomic compaction unit if necessary. A file that can't be looked up
+// in the objProvider is skipped, and the error is recorded in the span.
+func (d *DB) pickDownloadCompactionLocked(env compactionEnv, s *downloadSpan) *pickedCompaction {
+	v := d.mu.versions.currentVersion()
+	for l := 0; l < numLevels; l++ {
+		overlaps := v.Overlaps(l, d.cmp, s.start, s.end, true /* exclusiveEnd */)
+		iter := overlaps.Iter()
+		for f := iter.First(); f != nil; f = iter.Next() {
+			if f.IsCompacting() {
+				continue
+			}
+			if isRemote, err := d.isRemoteTable(f); err != nil {
+				if s.err == nil {
+					s.err = err
+				}
+				continue
+			} else if !isRemote {
+				continue
+			}
+
+			lf := v.Levels[l].Find(d.cmp, f)
+			if lf == nil {
+				panic(fmt.Sprintf("file %s not found in level %d as expected", f.FileNum, l))
+			}
+			inputs := lf.Slice()
+			if l > 0 {
+				var isCompacting bool
+				inputs, isCompacting = expandToAtomicUnit(d.cmp, inputs, false /* disableIsCompacting */)
+				if isCompacting {
+					continue
+				}
+			}
+
+			pc := newPickedCompaction(d.opts, v, l, l, d.mu.versions.picker.getBaseLevel())
+			pc.outputLevel.level = l
+			pc.kind = compactionKindDownload
+			pc.startLevel.files = inputs
+			pc.smallest, pc.largest = manifest.KeyRange(pc.cmp, pc.startLevel.files.Iter())
+
+			// Fail-safe to protect against compacting the same sstable concurrently.
+			if !inputRangeAlreadyCompacting(env, pc) {
+				if pc.startLevel.level == 0 {
+					pc.startLevel.l0SublevelInfo = generateSublevelInfo(pc.cmp, pc.startLevel.files)
+				}
+				return pc
+			}
+		}
+	}
+	return nil
+}
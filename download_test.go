@@ -0,0 +1,135 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/edgelesssys/estore/objstorage/objstorageprovider"
+	"github.com/edgelesssys/estore/objstorage/remote"
+	"github.com/edgelesssys/estore/sstable"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownload(t *testing.T) {
+	require := require.New(t)
+
+	var events []DownloadInfo
+	storage := remote.NewInMem()
+	opts := &Options{
+		FS:                 vfs.NewMem(),
+		FormatMajorVersion: FormatNewest,
+		EventListener: &EventListener{DownloadProgress: func(info DownloadInfo) {
+			events = append(events, info)
+		}},
+	}
+	opts.Experimental.RemoteStorage = remote.MakeSimpleFactory(map[remote.Locator]remote.Storage{
+		"external": storage,
+	})
+	d, err := Open("", opts)
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+	require.NoError(d.SetCreatorID(1))
+
+	// Build an external sstable. Without a master key, it's encrypted with
+	// the random test key.
+	memFS := vfs.NewMem()
+	f, err := memFS.Create("ext.sst")
+	require.NoError(err)
+	w := sstable.NewWriter(objstorageprovider.NewFileWritable(f), sstable.WriterOptions{
+		TableFormat: d.FormatMajorVersion().MaxTableFormat(),
+	})
+	require.NoError(w.Set([]byte("a"), []byte("val-a")))
+	require.NoError(w.Set([]byte("b"), []byte("val-b")))
+	require.NoError(w.Close())
+	f, err = memFS.Open("ext.sst")
+	require.NoError(err)
+	data, err := io.ReadAll(f)
+	require.NoError(err)
+	require.NoError(f.Close())
+	obj, err := storage.CreateObject("ext.sst")
+	require.NoError(err)
+	_, err = obj.Write(data)
+	require.NoError(err)
+	require.NoError(obj.Close())
+
+	_, err = d.IngestExternalFiles([]ExternalFile{{
+		Locator:         "external",
+		ObjName:         "ext.sst",
+		Size:            uint64(len(data)),
+		SmallestUserKey: []byte("a"),
+		LargestUserKey:  []byte("c"),
+		HasPointKey:     true,
+	}})
+	require.NoError(err)
+
+	// a canceled download returns without downloading
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(d.Download(ctx, []DownloadSpan{{StartKey: []byte("a"), EndKey: []byte("z")}}), context.Canceled)
+	require.Zero(d.Metrics().Compact.DownloadCount)
+
+	// spans that don't overlap the external sstable return immediately
+	events = nil
+	require.NoError(d.Download(context.Background(), []DownloadSpan{{StartKey: []byte("x"), EndKey: []byte("z")}}))
+	require.Zero(d.Metrics().Compact.DownloadCount)
+	require.Len(events, 1)
+	require.True(events[0].Done)
+
+	events = nil
+	saltsBefore := d.Metrics().Encryption.SaltChain.Salts
+	require.NoError(d.Download(context.Background(), []DownloadSpan{
+		{StartKey: []byte("a"), EndKey: []byte("z"), Priority: DownloadPriorityHigh},
+	}))
+	m := d.Metrics()
+	require.EqualValues(1, m.Compact.DownloadCount)
+	require.Equal(saltsBefore+1, m.Encryption.SaltChain.Salts)
+	require.False(events[0].Done)
+	require.Equal(1, events[0].Remaining)
+	last := events[len(events)-1]
+	require.True(last.Done)
+	require.NoError(last.Err)
+	require.Equal(1, last.Downloaded)
+	require.Zero(last.Remaining)
+
+	// the data is local now
+	require.NoError(storage.Delete("ext.sst"))
+	for _, k := range []string{"a", "b"} {
+		val, closer, err := d.Get([]byte(k))
+		require.NoError(err)
+		require.Equal("val-"+k, string(val))
+		require.NoError(closer.Close())
+	}
+}
+
+func TestDownloadLookupError(t *testing.T) {
+	require := require.New(t)
+
+	d, err := Open("", &Options{FS: vfs.NewMem(), FormatMajorVersion: FormatNewest})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+	require.NoError(d.Set([]byte("a"), []byte("val-a"), nil))
+	require.NoError(d.Flush())
+
+	// a table that the objProvider doesn't know is skipped
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var f *fileMetadata
+	for _, level := range d.mu.versions.currentVersion().Levels {
+		if iter := level.Iter(); f == nil {
+			f = iter.First()
+		}
+	}
+	require.NotNil(f)
+	require.NoError(d.objProvider.Remove(fileTypeTable, f.FileBacking.DiskFileNum))
+	s := &downloadSpan{start: []byte("a"), end: []byte("z")}
+	require.Nil(d.pickDownloadCompactionLocked(compactionEnv{}, s))
+	require.ErrorContains(s.err, "cannot lookup table")
+}
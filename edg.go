@@ -7,13 +7,28 @@ SPDX-License-Identifier: AGPL-3.0-only
 package estore
 
 import (
+	"bytes"
+	"crypto"
 	"encoding/binary"
+	"fmt"
+	"io"
 
 	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/internal/private"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var edgMonotonicCounterKey = []byte("!EDGELESS_MONOTONIC_COUNTER")
 
+func init() {
+	private.ObserveKeyManager = func(opts *Options, observe func(*edg.KeyManager)) {
+		opts.private.observeKeyManager = observe
+	}
+}
+
 func (d *DB) edgGetMonotonicCounterFromStore() (uint64, error) {
 	value, closer, err := d.Get(edgMonotonicCounterKey)
 	if errors.Is(err, ErrNotFound) {
@@ -30,6 +45,183 @@ func (d *DB) edgSetMonotonicCounterOnStore(value uint64) error {
 	return d.Set(edgMonotonicCounterKey, binary.LittleEndian.AppendUint64(nil, value), nil)
 }
 
+// edgPadBatch adds a LogData record of zeros to the batch, so that its
+// representation, which is written to the WAL as a single record, is a
+// multiple of Options.WALPadding bytes. LogData records are skipped when the
+// WAL is replayed. Large batches, which become flushable batches, aren't
+// padded. It returns the length of the representation before the padding, to
+// which edgUnpadBatch restores the batch after the commit.
+func (d *DB) edgPadBatch(b *Batch) int {
+	unpadded := len(b.Repr())
+	granularity := d.opts.WALPadding
+	if granularity <= 0 || d.opts.DisableWAL || b.ingestedSSTBatch || b.memTableSize >= d.largeBatchThreshold {
+		return unpadded
+	}
+	pad := edg.PaddingLen(unpadded, granularity)
+	if pad == 0 {
+		return unpadded
+	}
+	// The record consists of the kind, the varint encoded length and the data.
+	// If no data length fits the padding exactly, because the varint grows by a
+	// byte, try the next multiple.
+	var buf [binary.MaxVarintLen64]byte
+	for ; ; pad += granularity {
+		for n := pad - 2; n >= 0 && n >= pad-1-binary.MaxVarintLen64; n-- {
+			if 1+binary.PutUvarint(buf[:], uint64(n))+n == pad {
+				_ = b.LogData(make([]byte, n), nil)
+				d.keyManager.Stats().File(edg.FileTypeWAL).Padded(pad)
+				return unpadded
+			}
+		}
+	}
+}
+
+// edgUnpadBatch removes the padding that edgPadBatch added, so that the
+// caller's batch is left as it was. The WAL record and the memtable don't
+// reference the batch's data after the commit.
+func edgUnpadBatch(b *Batch, unpadded int) {
+	if b.data != nil {
+		b.data = b.data[:unpadded]
+	}
+}
+
+// edgOptionsHeader returns the non-secret header of the OPTIONS file. It uses
+// the format of the OPTIONS file, so that tools can parse it like an
+// unencrypted OPTIONS file, and holds what is needed to check whether a DB is
+// compatible without the key.
+func (d *DB) edgOptionsHeader() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[Version]\n")
+	fmt.Fprintf(&buf, "  pebble_version=0.1\n")
+	fmt.Fprintf(&buf, "\n")
+	fmt.Fprintf(&buf, "[Options]\n")
+	fmt.Fprintf(&buf, "  comparer=%s\n", d.opts.Comparer.Name)
+	fmt.Fprintf(&buf, "  format_major_version=%d\n", d.FormatMajorVersion())
+	fmt.Fprintf(&buf, "  merger=%s\n", d.opts.Merger.Name)
+	fmt.Fprintf(&buf, "\n")
+	fmt.Fprintf(&buf, "[Encryption]\n")
+	fmt.Fprintf(&buf, "  cipher_suite=%s\n", d.keyManager.CipherSuite())
+	return buf.Bytes()
+}
+
+// edgReadOptionsHeader returns the plaintext header of the OPTIONS file at
+// path without authenticating it. If the file doesn't have a header, it
+// returns the whole file and false.
+func edgReadOptionsHeader(fs vfs.FS, path string) ([]byte, bool, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, false, err
+	}
+	header, ok := edg.ReadOptionsHeader(data)
+	if !ok {
+		return data, false, nil
+	}
+	return header, true, nil
+}
+
+// edgPeekOptions fills in the fields of desc that are read from the header of
+// the most recent OPTIONS file.
+func edgPeekOptions(fs vfs.FS, dirname string, desc *DBDesc) error {
+	ls, err := fs.List(dirname)
+	if err != nil {
+		return err
+	}
+	var optionsFileNum FileNum
+	for _, filename := range ls {
+		ft, fn, ok := base.ParseFilename(fs, filename)
+		if ok && ft == fileTypeOptions && (desc.OptionsFilename == "" || fn.FileNum() > optionsFileNum) {
+			desc.OptionsFilename = fs.PathJoin(dirname, filename)
+			optionsFileNum = fn.FileNum()
+		}
+	}
+	if desc.OptionsFilename == "" {
+		return nil
+	}
+	header, ok, err := edgReadOptionsHeader(fs, desc.OptionsFilename)
+	if err != nil || !ok {
+		return err
+	}
+	return parseOptions(string(header), func(section, key, value string) error {
+		switch section + "." + key {
+		case "Options.comparer":
+			desc.Comparer = value
+		case "Options.merger":
+			desc.Merger = value
+		case "Encryption.cipher_suite":
+			desc.CipherSuite = value
+		}
+		return nil
+	})
+}
+
+// edgNewKeyManager creates the KeyManager of the DB in dirname.
+func edgNewKeyManager(opts *Options, dirname string) (*edg.KeyManager, error) {
+	return edg.OpenKeyManager(opts.FS, dirname, opts.EncryptionKey, opts.Insecure_DisableEncryption)
+}
+
+// edgCheckEncryptionMode returns an error if the DB in dirname has been created
+// in the other encryption mode than the one of opts. The mode is read from the
+// header of the most recent OPTIONS file without authenticating it, which
+// gives a clear error before the SALTCHAIN fails to verify with the wrong key.
+// checkOptions authenticates the header later.
+func edgCheckEncryptionMode(opts *Options, dirname string) error {
+	var desc DBDesc
+	if err := edgPeekOptions(opts.FS, dirname, &desc); err != nil {
+		// A header that can't be parsed is left to checkOptions, which
+		// authenticates it.
+		if IsCorruptionError(err) {
+			return nil
+		}
+		return err
+	}
+	if desc.CipherSuite == "" {
+		return nil
+	}
+	plaintext := desc.CipherSuite == edg.PlaintextCipherSuite
+	if plaintext && !opts.Insecure_DisableEncryption {
+		return errors.Newf("estore: DB in %q has been created with Insecure_DisableEncryption; use EncryptInPlace to encrypt it", dirname)
+	}
+	if !plaintext && opts.Insecure_DisableEncryption {
+		return errors.Newf("estore: DB in %q is encrypted, but Insecure_DisableEncryption is set", dirname)
+	}
+	return nil
+}
+
+// edgCheckCipherSuite returns an error if the cipher suite recorded in the
+// header of an OPTIONS file differs from cipherSuite.
+func edgCheckCipherSuite(header []byte, cipherSuite string) error {
+	return parseOptions(string(header), func(section, key, value string) error {
+		if section == "Encryption" && key == "cipher_suite" && value != cipherSuite {
+			return errors.Errorf("estore: cipher_suite from file %q != cipher_suite from options %q",
+				errors.Safe(value), errors.Safe(cipherSuite))
+		}
+		return nil
+	})
+}
+
+// edgEncryptionMetrics fills in the encryption metrics.
+func (d *DB) edgEncryptionMetrics(m *Metrics) {
+	stats := d.keyManager.Stats()
+	for t, fm := range map[edg.FileType]*EncryptionFileMetrics{
+		edg.FileTypeTable:    &m.Encryption.Table,
+		edg.FileTypeWAL:      &m.Encryption.WAL,
+		edg.FileTypeManifest: &m.Encryption.Manifest,
+		edg.FileTypeOptions:  &m.Encryption.Options,
+	} {
+		fm.BytesEncrypted = stats.File(t).BytesEncrypted.Load()
+		fm.BytesDecrypted = stats.File(t).BytesDecrypted.Load()
+		fm.BytesPadded = stats.File(t).BytesPadded.Load()
+	}
+	m.Encryption.AuthFailures, m.Encryption.RecentAuthFailures = stats.AuthFailures()
+	m.Encryption.SaltChain = d.keyManager.ChainStats()
+	m.Encryption.MonotonicCounterLatency = d.monotonicCounterLatency
+}
+
 func (d *DB) edgVerifyFreshness() error {
 	if d.opts.SetMonotonicCounter == nil {
 		return nil
@@ -48,7 +240,13 @@ func (d *DB) edgVerifyFreshness() error {
 	}
 
 	if storeCount < sourceCount {
-		return errors.Newf("rollback detected: store counter: %v, trusted source counter: %v", storeCount, sourceCount)
+		err := errors.Newf("rollback detected: store counter: %v, trusted source counter: %v", storeCount, sourceCount)
+		if d.walTailTruncated {
+			// The store counter is synced before the source counter is incremented, so a crash can't
+			// tear a WAL record that the source counter already depends on.
+			err = errors.WithHint(err, "a torn WAL tail was truncated during recovery; it contained acknowledged writes")
+		}
+		return err
 	}
 	if storeCount > sourceCount {
 		d.opts.Logger.Infof("WARNING: open: monotonic counter source lags behind: store counter: %v, source counter: %v", storeCount, sourceCount)
@@ -56,5 +254,194 @@ func (d *DB) edgVerifyFreshness() error {
 	}
 
 	d.monotonicCounter = storeCount
+	d.monotonicCounterLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Buckets: MonotonicCounterLatencyBuckets,
+	})
+	return nil
+}
+
+// edgSetCurrent moves the manifest marker to the MANIFEST and records it in
+// the SALTCHAIN. The SALTCHAIN is updated after the marker, so the marker may
+// be ahead of the SALTCHAIN after a crash, but never behind it.
+func (vs *versionSet) edgSetCurrent(manifestFileNum FileNum) error {
+	if err := vs.setCurrent(manifestFileNum); err != nil {
+		return err
+	}
+	return vs.keyManager.SetMarker(edg.MarkerManifest, uint64(manifestFileNum))
+}
+
+// edgVerifyMarkers checks the active MANIFEST and the format major version
+// against the values recorded in the SALTCHAIN. Unlike the plaintext markers,
+// the SALTCHAIN is authenticated, so a marker that has been moved back to an
+// older MANIFEST or format major version is detected even without a monotonic
+// counter.
+//
+// Values of an existing DB that are ahead of the SALTCHAIN are the result of a
+// crash before the SALTCHAIN was updated, or of a DB that was created before
+// the values were recorded. They are recorded if record is set, unless the DB
+// is opened read-only.
+func (d *DB) edgVerifyMarkers(
+	formatVersion FormatMajorVersion,
+	manifestFileNum base.DiskFileNum,
+	manifestExists bool,
+	record bool,
+) error {
+	type check struct {
+		marker edg.Marker
+		name   string
+		value  uint64
+		exists bool
+	}
+	for _, c := range []check{
+		{edg.MarkerManifest, "MANIFEST", uint64(manifestFileNum.FileNum()), manifestExists},
+		{edg.MarkerFormatVersion, "format major version", uint64(formatVersion), true},
+	} {
+		recorded, ok := d.keyManager.Marker(c.marker)
+		if ok && !c.exists {
+			return errors.Newf("estore: rollback detected: no %s found, but SALTCHAIN records %d", c.name, recorded)
+		}
+		if ok && c.value < recorded {
+			return errors.Newf("estore: rollback detected: %s is %d, but SALTCHAIN records %d", c.name, c.value, recorded)
+		}
+		if record && manifestExists && (!ok || c.value > recorded) && !d.opts.ReadOnly {
+			if err := d.keyManager.SetMarker(c.marker, c.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// edgDropTornSaltBlock drops a partially written block at the end of the
+// SALTCHAIN, which is the result of a crash while a key was created. The
+// KeyManager syncs a block before it returns the key, so no data can have been
+// written with the salt of a torn block, and no durable MANIFEST or WAL can
+// reference its file. If the active MANIFEST, a file of the recovered version
+// or a WAL that is replayed may belong to the block, the SALTCHAIN has been
+// truncated, which is an error. walNums are the WALs that are replayed; for a
+// new DB, nothing is referenced. As a sanity check, no file on disk that the
+// block may belong to may contain data either.
+//
+// A block that may record a marker is only dropped if the current value is
+// ahead of the recorded one, which is the case after a crash because the
+// SALTCHAIN is updated last (see edgSetCurrent). Otherwise, tearing the block
+// would allow the marker to be moved back.
+func (d *DB) edgDropTornSaltBlock(
+	formatVersion FormatMajorVersion,
+	manifestFileNum base.DiskFileNum,
+	manifestExists bool,
+	walNums []base.FileNum,
+) error {
+	torn, ok := d.keyManager.TornTail()
+	if !ok {
+		return nil
+	}
+	for _, c := range []struct {
+		marker edg.Marker
+		name   string
+		value  uint64
+		exists bool
+	}{
+		{edg.MarkerManifest, "MANIFEST", uint64(manifestFileNum.FileNum()), manifestExists},
+		{edg.MarkerFormatVersion, "format major version", uint64(formatVersion), true},
+	} {
+		if !torn.MayRecord(c.marker) {
+			continue
+		}
+		if recorded, ok := d.keyManager.Marker(c.marker); !c.exists || (ok && c.value <= recorded) {
+			return errors.Newf("estore: SALTCHAIN ends with a torn block that may record the %s, but the %s isn't ahead of the SALTCHAIN", c.name, c.name)
+		}
+	}
+	if manifestExists {
+		referenced := func(fileNum base.FileNum, desc string) error {
+			if torn.MayBelongTo(fileNum) {
+				return errors.Newf("estore: SALTCHAIN ends with a torn block, but it may belong to %s %s, which the DB references", desc, fileNum)
+			}
+			return nil
+		}
+		if err := referenced(manifestFileNum.FileNum(), "MANIFEST"); err != nil {
+			return err
+		}
+		for _, level := range d.mu.versions.currentVersion().Levels {
+			iter := level.Iter()
+			for f := iter.First(); f != nil; f = iter.Next() {
+				if err := referenced(f.FileBacking.DiskFileNum.FileNum(), "sstable"); err != nil {
+					return err
+				}
+			}
+		}
+		for _, walNum := range walNums {
+			if err := referenced(walNum, "WAL"); err != nil {
+				return err
+			}
+		}
+	}
+	dirs := []string{d.dirname}
+	if d.walDirname != d.dirname {
+		dirs = append(dirs, d.walDirname)
+	}
+	for _, dir := range dirs {
+		ls, err := d.opts.FS.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, filename := range ls {
+			_, fileNum, ok := base.ParseFilename(d.opts.FS, filename)
+			if !ok || !torn.MayBelongTo(fileNum.FileNum()) {
+				continue
+			}
+			info, err := d.opts.FS.Stat(d.opts.FS.PathJoin(dir, filename))
+			if err != nil {
+				return err
+			}
+			if info.Size() > 0 {
+				return errors.Newf("estore: SALTCHAIN ends with a torn block, but %s contains data", filename)
+			}
+		}
+	}
+
+	if d.opts.ReadOnly {
+		d.opts.Logger.Infof("estore: ignoring torn block of %d bytes at the end of the SALTCHAIN", torn.Size)
+		return nil
+	}
+	if err := d.keyManager.DropTornTail(); err != nil {
+		return err
+	}
+	d.opts.Logger.Infof("estore: dropped torn block of %d bytes at the end of the SALTCHAIN", torn.Size)
 	return nil
 }
+
+// Sealer seals the master key in the keyring of a DB. See package sealing for
+// implementations.
+type Sealer = edg.Sealer
+
+// RecoverWithKey recovers the master key of the DB in dirname with the private
+// key of one of its recovery keys, e.g., after the sealing key of the enclave
+// has changed. The recovery key must be an *rsa.PrivateKey or an
+// *ecdh.PrivateKey of curve X25519. The master key is wrapped for newPrimary,
+// and the recovery keys are kept. The DB must not be open.
+func RecoverWithKey(dirname string, fs vfs.FS, recoveryKey crypto.PrivateKey, newPrimary Sealer) error {
+	lock, err := LockDirectory(dirname, fs)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	keyring, err := edg.ReadKeyring(fs, dirname)
+	if err != nil {
+		return err
+	}
+	masterKey, err := keyring.Recover(recoveryKey)
+	if err != nil {
+		return err
+	}
+	recoveryKeys, err := keyring.RecoveryKeys()
+	if err != nil {
+		return err
+	}
+	keyring, err = edg.NewKeyring(masterKey, newPrimary, recoveryKeys)
+	if err != nil {
+		return err
+	}
+	return keyring.Write(fs, dirname)
+}
@@ -0,0 +1,309 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/record"
+	"github.com/edgelesssys/estore/sstable"
+	"github.com/edgelesssys/estore/vfs"
+)
+
+// EncryptInPlace encrypts the DB in dirname, which has been created with
+// Options.Insecure_DisableEncryption, with newKey. Afterwards, the DB must be
+// opened with newKey as Options.EncryptionKey. opts are the options the DB is
+// opened with; Insecure_DisableEncryption doesn't need to be set.
+//
+// The DB is opened and closed first, so that its memtables are flushed. Then
+// the MANIFESTs, sstables, WALs and OPTIONS files are rewritten and the
+// SALTCHAIN is replaced by one for newKey. The sstables keep their layout, so
+// their sizes recorded in the MANIFEST stay valid.
+//
+// The DB must not be open. If EncryptInPlace fails, the DB may be left
+// unusable, so back it up first. Note that the storage device may still hold
+// the plaintext of the rewritten and deleted files.
+func EncryptInPlace(dirname string, opts *Options, newKey []byte) error {
+	if len(newKey) == 0 || edg.IsPlaintextKey(newKey) {
+		return errors.New("estore: EncryptInPlace requires an encryption key")
+	}
+	if _, err := edg.GetCipher(newKey); err != nil {
+		return errors.Wrap(err, "estore: invalid encryption key")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts = opts.Clone()
+	opts.Insecure_DisableEncryption = true
+	opts.EncryptionKey = nil
+	opts.ErrorIfNotExists = true
+	opts.EnsureDefaults()
+
+	// Hold the lock until all files have been rewritten.
+	if opts.Lock == nil {
+		lock, err := LockDirectory(dirname, opts.FS)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+		opts.Lock = lock
+	}
+	db, err := Open(dirname, opts)
+	if err != nil {
+		return err
+	}
+	err = db.Flush()
+	if err := errors.CombineErrors(err, db.Close()); err != nil {
+		return err
+	}
+
+	return edgEncryptFiles(dirname, opts, newKey)
+}
+
+// edgEncryptedFile is a file that EncryptInPlace rewrites.
+type edgEncryptedFile struct {
+	typ     base.FileType
+	fileNum base.DiskFileNum
+	path    string
+	key     []byte
+	// header and plaintext are the contents of an OPTIONS file
+	header, plaintext []byte
+}
+
+// edgEncryptFiles rewrites the files of the closed plaintext DB in dirname
+// with newKey.
+func edgEncryptFiles(dirname string, opts *Options, newKey []byte) error {
+	fs := opts.FS
+	dirs := []string{dirname}
+	if opts.WALDir != "" && opts.WALDir != dirname {
+		dirs = append(dirs, opts.WALDir)
+	}
+
+	// Collect the files and their current keys.
+	oldKeys, err := edg.NewPlaintextKeyManager(fs, dirname)
+	if err != nil {
+		return err
+	}
+	files, err := edgCollectEncryptedFiles(fs, dirs, oldKeys)
+	if err != nil {
+		_ = oldKeys.Close()
+		return err
+	}
+	markers := make(map[edg.Marker]uint64)
+	for _, mk := range []edg.Marker{edg.MarkerManifest, edg.MarkerFormatVersion} {
+		if value, ok := oldKeys.Marker(mk); ok {
+			markers[mk] = value
+		}
+	}
+	if err := oldKeys.Close(); err != nil {
+		return err
+	}
+
+	// Replace the SALTCHAIN. The old one is kept until all files are
+	// rewritten.
+	saltChain := fs.PathJoin(dirname, edg.SaltChainFilename)
+	oldSaltChain := saltChain + ".old"
+	if err := fs.Rename(saltChain, oldSaltChain); err != nil {
+		return err
+	}
+	newKeys, err := edg.NewKeyManager(fs, dirname, newKey)
+	if err != nil {
+		return err
+	}
+	for mk, value := range markers {
+		if err := newKeys.SetMarker(mk, value); err != nil {
+			_ = newKeys.Close()
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := edgEncryptFile(fs, f, opts, newKeys); err != nil {
+			_ = newKeys.Close()
+			return errors.Wrapf(err, "estore: encrypting %s", f.path)
+		}
+	}
+	if err := newKeys.Close(); err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := edgSyncDir(fs, dir); err != nil {
+			return err
+		}
+	}
+	return fs.Remove(oldSaltChain)
+}
+
+func edgCollectEncryptedFiles(
+	fs vfs.FS, dirs []string, keyManager *edg.KeyManager,
+) ([]edgEncryptedFile, error) {
+	var files []edgEncryptedFile
+	for i, dir := range dirs {
+		filenames, err := fs.List(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			typ, fileNum, ok := base.ParseFilename(fs, filename)
+			if !ok {
+				continue
+			}
+			// only WALs are stored in the WAL dir
+			switch {
+			case typ == fileTypeLog:
+			case i > 0:
+				continue
+			case typ == fileTypeManifest, typ == fileTypeTable, typ == fileTypeOptions:
+			default:
+				continue
+			}
+			f := edgEncryptedFile{typ: typ, fileNum: fileNum, path: fs.PathJoin(dir, filename)}
+			if typ == fileTypeOptions {
+				data, err := edgReadFile(fs, f.path)
+				if err != nil {
+					return nil, err
+				}
+				if f.header, f.plaintext, err = edg.DecryptOptions(data, fileNum.FileNum(), keyManager); err != nil {
+					return nil, errors.Wrapf(err, "estore: reading %s", f.path)
+				}
+			} else if f.key, err = keyManager.Get(fileNum.FileNum()); err != nil {
+				return nil, errors.Wrapf(err, "estore: getting key of %s", f.path)
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// edgEncryptFile rewrites f with a new key that it creates in keyManager.
+func edgEncryptFile(fs vfs.FS, f edgEncryptedFile, opts *Options, keyManager *edg.KeyManager) error {
+	if f.typ == fileTypeOptions {
+		header := bytes.Replace(f.header,
+			[]byte("cipher_suite="+edg.PlaintextCipherSuite+"\n"),
+			[]byte("cipher_suite="+keyManager.CipherSuite()+"\n"), 1)
+		data, err := edg.EncryptOptions(header, f.plaintext, f.fileNum, keyManager)
+		if err != nil {
+			return err
+		}
+		return edgReplaceFile(fs, f.path, func(_, dst vfs.File) error {
+			_, err := dst.WriteApproved(data)
+			return err
+		})
+	}
+
+	key, err := keyManager.Create(f.fileNum.FileNum())
+	if err != nil {
+		return err
+	}
+	if f.typ == fileTypeTable {
+		return edgReplaceFile(fs, f.path, func(src, dst vfs.File) error {
+			data, err := io.ReadAll(src)
+			if err != nil {
+				return err
+			}
+			readable, err := sstable.NewSimpleReadable(edgNopCloseFile{src})
+			if err != nil {
+				return err
+			}
+			readerOpts := opts.MakeReaderOptions()
+			readerOpts.EncryptionKey = f.key
+			r, err := sstable.NewReader(readable, readerOpts)
+			if err != nil {
+				return err
+			}
+			err = sstable.ReencryptBlocks(r, data, key)
+			if err := errors.CombineErrors(err, r.Close()); err != nil {
+				return err
+			}
+			_, err = dst.WriteApproved(data)
+			return err
+		})
+	}
+
+	// MANIFESTs and WALs are rewritten record by record. A torn tail is
+	// dropped, as it would be when the file is replayed.
+	return edgReplaceFile(fs, f.path, func(src, dst vfs.File) error {
+		rr := record.NewReader(src, f.fileNum.FileNum())
+		rr.EncryptionKey = f.key
+		rw := record.NewWriter(dst)
+		rw.EncryptionKey = key
+		for {
+			r, err := rr.Next()
+			if err == io.EOF || record.IsInvalidRecord(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			w, err := rw.Next()
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, r); err != nil {
+				return err
+			}
+		}
+		return rw.Close()
+	})
+}
+
+// edgReplaceFile writes a new version of the file at path to a temporary file
+// using write, and then replaces the original file.
+func edgReplaceFile(fs vfs.FS, path string, write func(src, dst vfs.File) error) error {
+	src, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	dst, err := fs.Create(tmpPath)
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+	err = write(src, dst)
+	err = errors.CombineErrors(err, src.Close())
+	if err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmpPath, path)
+}
+
+func edgReadFile(fs vfs.FS, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func edgSyncDir(fs vfs.FS, dirname string) error {
+	dir, err := fs.OpenDir(dirname)
+	if err != nil {
+		return err
+	}
+	return errors.CombineErrors(dir.Sync(), dir.Close())
+}
+
+// edgNopCloseFile prevents the sstable reader from closing the file, which is
+// left to edgReplaceFile.
+type edgNopCloseFile struct {
+	vfs.File
+}
+
+func (edgNopCloseFile) Close() error { return nil }
@@ -151,6 +151,44 @@ func (i levelInfos) SafeFormat(w redact.SafePrinter, _ rune) {
 // file.
 type DiskSlowInfo = vfs.DiskSlowInfo
 
+// DownloadInfo contains the info for a download progress event.
+type DownloadInfo struct {
+	// JobID is the ID of the Download call.
+	JobID int
+	// Spans are the spans passed to Download.
+	Spans []DownloadSpan
+	// Downloaded is the number of download compactions that have completed.
+	Downloaded int
+	// Remaining is the number of external or shared sstables that still
+	// overlap the spans.
+	Remaining int
+	// Done is set for the last event of a Download call.
+	Done bool
+	// Duration is the time since the Download call began.
+	Duration time.Duration
+	// Err is the error that ended the Download call.
+	Err error
+}
+
+func (i DownloadInfo) String() string {
+	return redact.StringWithoutMarkers(i)
+}
+
+// SafeFormat implements redact.SafeFormatter.
+func (i DownloadInfo) SafeFormat(w redact.SafePrinter, _ rune) {
+	if i.Err != nil {
+		w.Printf("[JOB %d] download error: %s", redact.Safe(i.JobID), i.Err)
+		return
+	}
+	if i.Done {
+		w.Printf("[JOB %d] downloaded: %d compactions in %.1fs",
+			redact.Safe(i.JobID), redact.Safe(i.Downloaded), redact.Safe(i.Duration.Seconds()))
+		return
+	}
+	w.Printf("[JOB %d] downloading: %d compactions, %d external tables remaining",
+		redact.Safe(i.JobID), redact.Safe(i.Downloaded), redact.Safe(i.Remaining))
+}
+
 // FlushInfo contains the info for a flush event.
 type FlushInfo struct {
 	// JobID is the ID of the flush job.
@@ -463,6 +501,29 @@ func (i WALDeleteInfo) SafeFormat(w redact.SafePrinter, _ rune) {
 	w.Printf("[JOB %d] WAL deleted %s", redact.Safe(i.JobID), i.FileNum)
 }
 
+// WALTailTruncatedInfo contains the info for a WAL tail truncation event.
+type WALTailTruncatedInfo struct {
+	// JobID is the ID of the job that replayed the WAL.
+	JobID   int
+	Path    string
+	FileNum FileNum
+	// Offset is the offset of the first record that was discarded. Zero if the
+	// whole WAL was discarded.
+	Offset int64
+	// Err is the reason the tail was discarded.
+	Err error
+}
+
+func (i WALTailTruncatedInfo) String() string {
+	return redact.StringWithoutMarkers(i)
+}
+
+// SafeFormat implements redact.SafeFormatter.
+func (i WALTailTruncatedInfo) SafeFormat(w redact.SafePrinter, _ rune) {
+	w.Printf("[JOB %d] WAL %s truncated at offset %d: %s",
+		redact.Safe(i.JobID), i.FileNum, redact.Safe(i.Offset), i.Err)
+}
+
 // WriteStallBeginInfo contains the info for a write stall begin event.
 type WriteStallBeginInfo struct {
 	Reason string
@@ -505,6 +566,11 @@ type EventListener struct {
 	// working.
 	DiskSlow func(DiskSlowInfo)
 
+	// DownloadProgress is invoked by DB.Download whenever the number of
+	// external sstables that remain to be downloaded changes, and when the
+	// download is done.
+	DownloadProgress func(DownloadInfo)
+
 	// FlushBegin is invoked after the inputs to a flush have been determined,
 	// but before the flush has produced any output.
 	FlushBegin func(FlushInfo)
@@ -546,6 +612,10 @@ type EventListener struct {
 	// WALDeleted is invoked after a WAL has been deleted.
 	WALDeleted func(WALDeleteInfo)
 
+	// WALTailTruncated is invoked during Open when a torn tail of a WAL is
+	// discarded according to Options.WALRecoveryMode.
+	WALTailTruncated func(WALTailTruncatedInfo)
+
 	// WriteStallBegin is invoked when writes are intentionally delayed.
 	WriteStallBegin func(WriteStallBeginInfo)
 
@@ -576,6 +646,9 @@ func (l *EventListener) EnsureDefaults(logger Logger) {
 	if l.DiskSlow == nil {
 		l.DiskSlow = func(info DiskSlowInfo) {}
 	}
+	if l.DownloadProgress == nil {
+		l.DownloadProgress = func(info DownloadInfo) {}
+	}
 	if l.FlushBegin == nil {
 		l.FlushBegin = func(info FlushInfo) {}
 	}
@@ -612,6 +685,15 @@ func (l *EventListener) EnsureDefaults(logger Logger) {
 	if l.WALDeleted == nil {
 		l.WALDeleted = func(info WALDeleteInfo) {}
 	}
+	if l.WALTailTruncated == nil {
+		if logger != nil {
+			l.WALTailTruncated = func(info WALTailTruncatedInfo) {
+				logger.Infof("WARNING: %s", info)
+			}
+		} else {
+			l.WALTailTruncated = func(info WALTailTruncatedInfo) {}
+		}
+	}
 	if l.WriteStallBegin == nil {
 		l.WriteStallBegin = func(info WriteStallBeginInfo) {}
 	}
@@ -640,6 +722,9 @@ func MakeLoggingEventListener(logger Logger) EventListener {
 		DiskSlow: func(info DiskSlowInfo) {
 			logger.Infof("%s", info)
 		},
+		DownloadProgress: func(info DownloadInfo) {
+			logger.Infof("%s", info)
+		},
 		FlushBegin: func(info FlushInfo) {
 			logger.Infof("%s", info)
 		},
@@ -676,6 +761,9 @@ func MakeLoggingEventListener(logger Logger) EventListener {
 		WALDeleted: func(info WALDeleteInfo) {
 			logger.Infof("%s", info)
 		},
+		WALTailTruncated: func(info WALTailTruncatedInfo) {
+			logger.Infof("%s", info)
+		},
 		WriteStallBegin: func(info WriteStallBeginInfo) {
 			logger.Infof("%s", info)
 		},
@@ -706,6 +794,10 @@ func TeeEventListener(a, b EventListener) EventListener {
 			a.DiskSlow(info)
 			b.DiskSlow(info)
 		},
+		DownloadProgress: func(info DownloadInfo) {
+			a.DownloadProgress(info)
+			b.DownloadProgress(info)
+		},
 		FlushBegin: func(info FlushInfo) {
 			a.FlushBegin(info)
 			b.FlushBegin(info)
@@ -754,6 +846,10 @@ func TeeEventListener(a, b EventListener) EventListener {
 			a.WALDeleted(info)
 			b.WALDeleted(info)
 		},
+		WALTailTruncated: func(info WALTailTruncatedInfo) {
+			a.WALTailTruncated(info)
+			b.WALTailTruncated(info)
+		},
 		WriteStallBegin: func(info WriteStallBeginInfo) {
 			a.WriteStallBegin(info)
 			b.WriteStallBegin(info)
@@ -0,0 +1,52 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/edgelesssys/estore/bloom"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRibbonFilterPolicy(t *testing.T) {
+	require := require.New(t)
+
+	d, err := Open("", &Options{
+		FS:     vfs.NewMem(),
+		Levels: []LevelOptions{{FilterPolicy: bloom.RibbonFilterPolicy(10)}},
+
+		DisableAutomaticCompactions: true,
+	})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+
+	// two tables with overlapping key ranges
+	for table := 0; table < 2; table++ {
+		for i := table; i < 1000; i += 2 {
+			require.NoError(d.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i)), nil))
+		}
+		require.NoError(d.Flush())
+	}
+
+	for i := 0; i < 1000; i++ {
+		value, closer, err := d.Get([]byte(fmt.Sprintf("key%04d", i)))
+		require.NoError(err)
+		require.Equal(fmt.Sprint(i), string(value))
+		require.NoError(closer.Close())
+	}
+	_, _, err = d.Get([]byte("key0000x"))
+	require.ErrorIs(err, ErrNotFound)
+
+	// The lookups of the keys in the older table check the filter of the
+	// newer table first.
+	m := d.Metrics().Filter
+	require.Greater(m.Hits, int64(480))
+	require.Less(m.Misses, int64(1020))
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/cockroachdb/errors"
 	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/internal/manifest"
 	"github.com/edgelesssys/estore/sstable"
 	"github.com/edgelesssys/estore/vfs"
@@ -433,6 +434,9 @@ func (d *DB) ratchetFormatMajorVersionLocked(formatVers FormatMajorVersion) erro
 	d.mu.formatVers.ratcheting = true
 	defer func() { d.mu.formatVers.ratcheting = false }()
 
+	if d.FormatMajorVersion() == formatVers {
+		return nil
+	}
 	for nextVers := d.FormatMajorVersion() + 1; nextVers <= formatVers; nextVers++ {
 		if err := formatMajorVersionMigrations[nextVers](d); err != nil {
 			return errors.Wrapf(err, "migrating to version %d", nextVers)
@@ -448,7 +452,10 @@ func (d *DB) ratchetFormatMajorVersionLocked(formatVers FormatMajorVersion) erro
 			d.opts.Logger.Fatalf("pebble: successful migration to format version %d never finalized the upgrade", nextVers)
 		}
 	}
-	return nil
+	// EDG: Record the format major version in the SALTCHAIN, so that the
+	// marker can't be moved back. A crash before this only leaves the marker
+	// ahead of the SALTCHAIN, which Open accepts.
+	return d.keyManager.SetMarker(edg.MarkerFormatVersion, uint64(formatVers))
 }
 
 // finalizeFormatVersUpgrade is typically only be called from within a
@@ -0,0 +1,684 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/cockroachdb/errors"
+)
+
+// edgReservedKeyPrefix is the prefix of keys that estore writes on its own.
+// Such keys are never indexed.
+var edgReservedKeyPrefix = []byte("!EDGELESS_")
+
+// Index entries are stored in a reserved keyspace. The key of an entry is
+//
+//	indexKeyPrefix | name | 0x00 | escaped index key | 0x00 0x01 | primary key
+//
+// The index key is escaped by replacing 0x00 with 0x00 0xff, so that entries
+// are ordered by index key and then by primary key under a bytewise
+// comparer. Entries have an empty value.
+var indexKeyPrefix = []byte("!EDGELESS_INDEX/")
+
+const indexKeyEscape = 0xff
+
+var indexKeyTerminator = []byte{0x00, 0x01}
+
+// indexRepairBatchSize is the number of entries that Backfill repairs per
+// transaction.
+const indexRepairBatchSize = 1000
+
+// IndexFunc returns the index keys of a record. A record may have any number
+// of index keys. The function must be deterministic and must not retain or
+// modify its arguments.
+type IndexFunc func(key, value []byte) ([][]byte, error)
+
+// IndexOptions holds the optional parameters of an index.
+type IndexOptions struct {
+	// LowerBound and UpperBound restrict the indexed records to primary keys
+	// in [LowerBound, UpperBound). A nil bound is unbounded. Restricting an
+	// index to the keyspace of the records avoids the overhead of index
+	// maintenance for other writes.
+	LowerBound []byte
+	UpperBound []byte
+}
+
+// Index is a secondary index that maps index keys to the primary keys of
+// records. It is maintained automatically for every Set, Delete and
+// DeleteRange of a Batch or Transaction, and in the same batch as the
+// records, so that the index is updated atomically with them.
+//
+// To remove the entries of the previous value of a record, index maintenance
+// reads it. A Transaction reads it from its own view. Other batches read it
+// from the batch if they're indexed and from the current DB state otherwise,
+// so concurrent writes to the same record may leave stale entries. Index
+// iterators check every entry against its record and skip stale ones, and
+// Backfill removes them.
+//
+// Merge, ingestion, and the deferred batch operations bypass index
+// maintenance, as do writes before the index was registered. Run Backfill to
+// index such records.
+type Index struct {
+	db           *DB
+	name         string
+	fn           IndexFunc
+	lower, upper []byte
+	// prefix is the common prefix of all entries of the index.
+	prefix []byte
+}
+
+// RegisterIndex registers a secondary index with the given name. Indexes
+// aren't persisted, so they must be registered after every Open, before any
+// write to the indexed records. The name must not be empty or contain a zero
+// byte, and it must not be changed for an existing index.
+//
+// Index keys are stored in a reserved keyspace with the prefix
+// "!EDGELESS_INDEX/", which requires a comparer that orders keys with this
+// prefix bytewise, like DefaultComparer. A DeleteRange that covers the
+// reserved keyspace deletes the entries of all indexes.
+func (d *DB) RegisterIndex(name string, fn IndexFunc, opts *IndexOptions) (*Index, error) {
+	if name == "" || bytes.IndexByte([]byte(name), 0) >= 0 {
+		return nil, errors.Newf("estore: invalid index name %q", name)
+	}
+	if opts == nil {
+		opts = &IndexOptions{}
+	}
+	idx := &Index{
+		db:     d,
+		name:   name,
+		fn:     fn,
+		lower:  append([]byte(nil), opts.LowerBound...),
+		upper:  append([]byte(nil), opts.UpperBound...),
+		prefix: append(append(append([]byte(nil), indexKeyPrefix...), name...), 0),
+	}
+	if opts.LowerBound == nil {
+		idx.lower = nil
+	}
+	if opts.UpperBound == nil {
+		idx.upper = nil
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+	var indexes []*Index
+	if p := d.indexes.Load(); p != nil {
+		indexes = *p
+	}
+	for _, other := range indexes {
+		if other.name == name {
+			return nil, errors.Newf("estore: index %q is already registered", name)
+		}
+	}
+	indexes = append(indexes[:len(indexes):len(indexes)], idx)
+	d.indexes.Store(&indexes)
+	return idx, nil
+}
+
+// Name returns the name of the index.
+func (i *Index) Name() string {
+	return i.name
+}
+
+// contains returns whether the record with the given primary key is indexed.
+func (i *Index) contains(key []byte) bool {
+	return (i.lower == nil || i.db.cmp(key, i.lower) >= 0) && (i.upper == nil || i.db.cmp(key, i.upper) < 0)
+}
+
+// extract returns the index keys of a record.
+func (i *Index) extract(key, value []byte) ([][]byte, error) {
+	indexKeys, err := i.fn(key, value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "estore: index %q", i.name)
+	}
+	return indexKeys, nil
+}
+
+// entryKey returns the key of the entry for the index key and primary key.
+func (i *Index) entryKey(indexKey, key []byte) []byte {
+	buf := make([]byte, 0, len(i.prefix)+len(indexKey)+len(indexKeyTerminator)+len(key)+4)
+	buf = appendEscapedIndexKey(append(buf, i.prefix...), indexKey)
+	buf = append(buf, indexKeyTerminator...)
+	return append(buf, key...)
+}
+
+// appendEscapedIndexKey appends the escaped index key to dst.
+func appendEscapedIndexKey(dst, indexKey []byte) []byte {
+	for _, c := range indexKey {
+		dst = append(dst, c)
+		if c == 0 {
+			dst = append(dst, indexKeyEscape)
+		}
+	}
+	return dst
+}
+
+// decodeEntryKey splits the key of an entry of the index into the index key
+// and the primary key.
+func (i *Index) decodeEntryKey(entry []byte) (indexKey, key []byte, err error) {
+	if !bytes.HasPrefix(entry, i.prefix) {
+		return nil, nil, errors.New("estore: invalid index entry")
+	}
+	entry = entry[len(i.prefix):]
+	for len(entry) > 0 {
+		c := entry[0]
+		if c != 0 {
+			indexKey = append(indexKey, c)
+			entry = entry[1:]
+			continue
+		}
+		if len(entry) < 2 {
+			break
+		}
+		switch entry[1] {
+		case indexKeyEscape:
+			indexKey = append(indexKey, 0)
+			entry = entry[2:]
+		case indexKeyTerminator[1]:
+			if indexKey == nil {
+				indexKey = []byte{}
+			}
+			return indexKey, entry[2:], nil
+		default:
+			return nil, nil, errors.New("estore: invalid index entry")
+		}
+	}
+	return nil, nil, errors.New("estore: invalid index entry")
+}
+
+// lowerBound returns the lower bound of the entries with an index key >=
+// indexKey, or of all entries if indexKey is nil.
+func (i *Index) lowerBound(indexKey []byte) []byte {
+	return appendEscapedIndexKey(append([]byte(nil), i.prefix...), indexKey)
+}
+
+// upperBound returns the upper bound of the entries with an index key <
+// indexKey, or of all entries if indexKey is nil.
+func (i *Index) upperBound(indexKey []byte) []byte {
+	if indexKey == nil {
+		bound := append([]byte(nil), i.prefix...)
+		bound[len(bound)-1]++
+		return bound
+	}
+	return i.lowerBound(indexKey)
+}
+
+// check returns whether the record with the given value has the index key.
+func (i *Index) check(indexKey, key, value []byte) (bool, error) {
+	indexKeys, err := i.extract(key, value)
+	if err != nil {
+		return false, err
+	}
+	return containsIndexKey(indexKeys, indexKey), nil
+}
+
+func containsIndexKey(indexKeys [][]byte, indexKey []byte) bool {
+	for _, k := range indexKeys {
+		if bytes.Equal(k, indexKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// batchIndexes returns the registered indexes that contain the record with
+// the given key, or nil if there are none.
+func (b *Batch) batchIndexes(key []byte) []*Index {
+	if b.db == nil || bytes.HasPrefix(key, edgReservedKeyPrefix) {
+		return nil
+	}
+	p := b.db.indexes.Load()
+	if p == nil {
+		return nil
+	}
+	var indexes []*Index
+	for _, idx := range *p {
+		if idx.contains(key) {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
+
+// indexGet reads the current value of a record for index maintenance.
+func (b *Batch) indexGet(key []byte) ([]byte, io.Closer, error) {
+	if b.index != nil {
+		return b.db.getInternal(key, b, b.txSnap)
+	}
+	return b.db.Get(key)
+}
+
+// updateIndexes updates the entries of the indexes for a Set of the record
+// with the given key to value, or for a deletion of the record if value is
+// nil. It must be called before the record is written to the batch.
+func (b *Batch) updateIndexes(key, value []byte, set bool) error {
+	indexes := b.batchIndexes(key)
+	if len(indexes) == 0 {
+		return nil
+	}
+	old, closer, err := b.indexGet(key)
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	} else if err == nil {
+		defer closer.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range indexes {
+		var oldKeys, newKeys [][]byte
+		if old != nil {
+			// Ignore invalid old values. Their entries, if any, are stale
+			// and skipped by index iterators.
+			oldKeys, _ = idx.extract(key, old)
+		}
+		if set {
+			if newKeys, err = idx.extract(key, value); err != nil {
+				return err
+			}
+		}
+		for _, k := range oldKeys {
+			if !containsIndexKey(newKeys, k) {
+				if err := b.Delete(idx.entryKey(k, key), nil); err != nil {
+					return err
+				}
+			}
+		}
+		// Always write the new entries. Another operation of a non-indexed
+		// batch may have deleted them.
+		for _, k := range newKeys {
+			if err := b.Set(idx.entryKey(k, key), nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateIndexesRange deletes the entries of the records in [start, end) from
+// the indexes. It must be called before the range deletion is written to the
+// batch.
+func (b *Batch) updateIndexesRange(start, end []byte) error {
+	if b.db == nil {
+		return nil
+	}
+	p := b.db.indexes.Load()
+	if p == nil {
+		return nil
+	}
+	var overlaps bool
+	for _, idx := range *p {
+		if (idx.upper == nil || b.db.cmp(start, idx.upper) < 0) && (idx.lower == nil || b.db.cmp(end, idx.lower) > 0) {
+			overlaps = true
+		}
+	}
+	if !overlaps {
+		return nil
+	}
+
+	var iter *Iterator
+	var err error
+	if b.index != nil {
+		iter, err = b.NewIter(&IterOptions{LowerBound: start, UpperBound: end})
+	} else {
+		iter, err = b.db.NewIter(&IterOptions{LowerBound: start, UpperBound: end})
+	}
+	if err != nil {
+		return err
+	}
+	// Collect the entries first, as the batch must not be modified while an
+	// iterator reads it.
+	var entries [][]byte
+	for iter.First(); iter.Valid() && err == nil; iter.Next() {
+		key := iter.Key()
+		indexes := b.batchIndexes(key)
+		if len(indexes) == 0 {
+			continue
+		}
+		var value []byte
+		if value, err = iter.ValueAndErr(); err != nil {
+			break
+		}
+		for _, idx := range indexes {
+			// Ignore invalid values like updateIndexes.
+			indexKeys, _ := idx.extract(key, value)
+			for _, k := range indexKeys {
+				entries = append(entries, idx.entryKey(k, key))
+			}
+		}
+	}
+	if err := firstError(err, firstError(iter.Error(), iter.Close())); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := b.Delete(entry, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewIter returns an iterator over the entries of the index that are
+// consistent with the records read from r. The bounds of o are index keys,
+// and the other options apply to the iteration over the reserved keyspace.
+// Entries are ordered by index key and then by primary key.
+func (i *Index) NewIter(r Reader, o *IterOptions) (*IndexIterator, error) {
+	return i.newIter(r.NewIter, r.Get, o)
+}
+
+// NewIndexIter is like Index.NewIter, but reads the entries and records from
+// the transaction.
+func (t *Transaction) NewIndexIter(i *Index, o *IterOptions) (*IndexIterator, error) {
+	return i.newIter(func(o *IterOptions) (*Iterator, error) { return t.NewIter(o), nil }, t.Get, o)
+}
+
+func (i *Index) newIter(
+	newIter func(*IterOptions) (*Iterator, error),
+	get func([]byte) ([]byte, io.Closer, error),
+	o *IterOptions,
+) (*IndexIterator, error) {
+	var opts IterOptions
+	if o != nil {
+		opts = *o
+	}
+	opts.LowerBound = i.lowerBound(opts.LowerBound)
+	opts.UpperBound = i.upperBound(opts.UpperBound)
+	iter, err := newIter(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexIterator{index: i, iter: iter, get: get}, nil
+}
+
+// IndexIterator iterates over the entries of an index. It skips stale
+// entries whose record doesn't exist or doesn't have the index key anymore.
+type IndexIterator struct {
+	index *Index
+	iter  *Iterator
+	get   func([]byte) ([]byte, io.Closer, error)
+
+	indexKey, key, value []byte
+	closer               io.Closer
+	valid                bool
+	err                  error
+}
+
+// First moves the iterator to the first entry.
+func (it *IndexIterator) First() bool {
+	return it.find(it.iter.First(), it.iter.Next)
+}
+
+// Last moves the iterator to the last entry.
+func (it *IndexIterator) Last() bool {
+	return it.find(it.iter.Last(), it.iter.Prev)
+}
+
+// SeekGE moves the iterator to the first entry with an index key >=
+// indexKey.
+func (it *IndexIterator) SeekGE(indexKey []byte) bool {
+	return it.find(it.iter.SeekGE(it.index.lowerBound(indexKey)), it.iter.Next)
+}
+
+// SeekLT moves the iterator to the last entry with an index key < indexKey.
+func (it *IndexIterator) SeekLT(indexKey []byte) bool {
+	return it.find(it.iter.SeekLT(it.index.lowerBound(indexKey)), it.iter.Prev)
+}
+
+// Next moves the iterator to the next entry.
+func (it *IndexIterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	return it.find(it.iter.Next(), it.iter.Next)
+}
+
+// Prev moves the iterator to the previous entry.
+func (it *IndexIterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	return it.find(it.iter.Prev(), it.iter.Prev)
+}
+
+// find moves the iterator in the direction of step until it's positioned at
+// a consistent entry.
+func (it *IndexIterator) find(valid bool, step func() bool) bool {
+	it.reset()
+	for ; valid; valid = step() {
+		indexKey, key, err := it.index.decodeEntryKey(it.iter.Key())
+		if err != nil {
+			it.err = err
+			return false
+		}
+		value, closer, err := it.get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		// Invalid records have no index keys.
+		if ok, _ := it.index.check(indexKey, key, value); !ok {
+			closer.Close()
+			continue
+		}
+		it.indexKey, it.key, it.value, it.closer = indexKey, key, value, closer
+		it.valid = true
+		return true
+	}
+	return false
+}
+
+func (it *IndexIterator) reset() {
+	if it.closer != nil {
+		it.closer.Close()
+	}
+	it.indexKey, it.key, it.value, it.closer = nil, nil, nil, nil
+	it.valid = false
+	it.err = nil
+}
+
+// Valid returns true if the iterator is positioned at a valid entry.
+func (it *IndexIterator) Valid() bool {
+	return it.valid
+}
+
+// IndexKey returns the index key of the current entry.
+func (it *IndexIterator) IndexKey() []byte {
+	return it.indexKey
+}
+
+// Key returns the primary key of the current entry.
+func (it *IndexIterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the record of the current entry. The slice is
+// valid until the iterator is moved.
+func (it *IndexIterator) Value() []byte {
+	return it.value
+}
+
+// Error returns any accumulated error.
+func (it *IndexIterator) Error() error {
+	return firstError(it.err, it.iter.Error())
+}
+
+// Close closes the iterator and returns any accumulated error.
+func (it *IndexIterator) Close() error {
+	it.reset()
+	return firstError(it.err, it.iter.Close())
+}
+
+// IndexStats are the results of Index.Verify and Index.Backfill.
+type IndexStats struct {
+	// Records is the number of indexed records.
+	Records uint64
+	// Entries is the number of index entries, including stale ones.
+	Entries uint64
+	// Invalid is the number of records whose index keys couldn't be
+	// extracted. They aren't indexed.
+	Invalid uint64
+	// Missing is the number of entries that were missing.
+	Missing uint64
+	// Stale is the number of entries whose record doesn't exist or doesn't
+	// have the index key.
+	Stale uint64
+}
+
+// Verify checks the index against the records visible in the snapshot and
+// returns the number of missing and stale entries. It can run concurrently
+// with writes.
+func (i *Index) Verify(ctx context.Context, snap *Snapshot) (IndexStats, error) {
+	return i.verify(ctx, snap, false)
+}
+
+// Backfill adds the missing entries and removes the stale entries that
+// Verify finds in the snapshot. It runs online: each repair is checked
+// against the latest state of its record in a write transaction before it's
+// applied, so it must not be called while the calling goroutine has an open
+// write transaction. Records written after the snapshot are indexed by
+// regular index maintenance.
+func (i *Index) Backfill(ctx context.Context, snap *Snapshot) (IndexStats, error) {
+	return i.verify(ctx, snap, true)
+}
+
+// indexRepair is a repair of an index entry.
+type indexRepair struct {
+	indexKey, key []byte
+}
+
+func (i *Index) verify(ctx context.Context, snap *Snapshot, repair bool) (stats IndexStats, err error) {
+	var repairs []indexRepair
+	flush := func() error {
+		if !repair || len(repairs) == 0 {
+			return nil
+		}
+		err := i.repair(repairs)
+		repairs = repairs[:0]
+		return err
+	}
+
+	// Find missing entries.
+	iter, err := snap.NewIter(&IterOptions{LowerBound: i.lower, UpperBound: i.upper})
+	if err != nil {
+		return stats, err
+	}
+	for iter.First(); iter.Valid() && err == nil; iter.Next() {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		key := iter.Key()
+		if bytes.HasPrefix(key, edgReservedKeyPrefix) {
+			continue
+		}
+		var value []byte
+		if value, err = iter.ValueAndErr(); err != nil {
+			break
+		}
+		stats.Records++
+		indexKeys, extractErr := i.extract(key, value)
+		if extractErr != nil {
+			// Invalid records have no index keys.
+			stats.Invalid++
+			continue
+		}
+		for _, k := range indexKeys {
+			var closer io.Closer
+			_, closer, err = snap.Get(i.entryKey(k, key))
+			if errors.Is(err, ErrNotFound) {
+				err = nil
+				stats.Missing++
+				repairs = append(repairs, indexRepair{indexKey: append([]byte(nil), k...), key: append([]byte(nil), key...)})
+				if len(repairs) >= indexRepairBatchSize {
+					err = flush()
+				}
+				continue
+			}
+			if err != nil {
+				break
+			}
+			closer.Close()
+		}
+	}
+	if err = firstError(err, firstError(iter.Error(), iter.Close())); err != nil {
+		return stats, err
+	}
+
+	// Find stale entries.
+	iter, err = snap.NewIter(&IterOptions{LowerBound: i.lowerBound(nil), UpperBound: i.upperBound(nil)})
+	if err != nil {
+		return stats, err
+	}
+	for iter.First(); iter.Valid() && err == nil; iter.Next() {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		stats.Entries++
+		var indexKey, key []byte
+		if indexKey, key, err = i.decodeEntryKey(iter.Key()); err != nil {
+			break
+		}
+		var ok bool
+		if ok, err = i.checkIn(snap.Get, indexKey, key); err != nil {
+			break
+		}
+		if !ok {
+			stats.Stale++
+			repairs = append(repairs, indexRepair{indexKey: indexKey, key: append([]byte(nil), key...)})
+			if len(repairs) >= indexRepairBatchSize {
+				err = flush()
+			}
+		}
+	}
+	if err = firstError(err, firstError(iter.Error(), iter.Close())); err != nil {
+		return stats, err
+	}
+	return stats, flush()
+}
+
+// checkIn returns whether the record read with get has the index key.
+func (i *Index) checkIn(get func([]byte) ([]byte, io.Closer, error), indexKey, key []byte) (bool, error) {
+	value, closer, err := get(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer closer.Close()
+	// Invalid records have no index keys.
+	ok, _ := i.check(indexKey, key, value)
+	return ok, nil
+}
+
+// repair applies the repairs in a write transaction. Each entry is written if
+// the latest state of its record has the index key and deleted otherwise.
+func (i *Index) repair(repairs []indexRepair) error {
+	tx := i.db.NewTransaction(true)
+	defer tx.Close()
+	for _, r := range repairs {
+		ok, err := i.checkIn(tx.Get, r.indexKey, r.key)
+		if err != nil {
+			return err
+		}
+		entry := i.entryKey(r.indexKey, r.key)
+		if ok {
+			err = tx.Set(entry, nil, nil)
+		} else {
+			err = tx.Delete(entry, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
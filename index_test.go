@@ -0,0 +1,314 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testIndexFunc indexes a record by the comma-separated index keys of its
+// value. Values starting with '!' are invalid.
+func testIndexFunc(key, value []byte) ([][]byte, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if value[0] == '!' {
+		return nil, errors.New("invalid value")
+	}
+	return bytes.Split(value, []byte(",")), nil
+}
+
+type indexEntry struct {
+	indexKey, key, value string
+}
+
+func scanIndex(t *testing.T, it *IndexIterator, reverse bool) []indexEntry {
+	t.Helper()
+	var entries []indexEntry
+	first, next := it.First, it.Next
+	if reverse {
+		first, next = it.Last, it.Prev
+	}
+	for valid := first(); valid; valid = next() {
+		entries = append(entries, indexEntry{string(it.IndexKey()), string(it.Key()), string(it.Value())})
+	}
+	require.NoError(t, it.Error())
+	require.NoError(t, it.Close())
+	return entries
+}
+
+func readIndex(t *testing.T, r Reader, idx *Index, o *IterOptions) []indexEntry {
+	t.Helper()
+	it, err := idx.NewIter(r, o)
+	require.NoError(t, err)
+	return scanIndex(t, it, false)
+}
+
+func TestIndexEntryKey(t *testing.T) {
+	require := require.New(t)
+	db := newDB(t)
+	defer func() { require.NoError(db.Close()) }()
+	idx, err := db.RegisterIndex("idx", testIndexFunc, nil)
+	require.NoError(err)
+
+	indexKeys := [][]byte{{}, {0}, {0, 0}, {0, 1}, {0, 0xff}, {1}, []byte("a"), []byte("a\x00"), []byte("ab")}
+	var prev []byte
+	for _, indexKey := range indexKeys {
+		for _, key := range []string{"", "\x00", "k"} {
+			entry := idx.entryKey(indexKey, []byte(key))
+			require.True(bytes.HasPrefix(entry, idx.prefix))
+			// entries are ordered by index key and then by primary key
+			require.Less(string(prev), string(entry))
+			prev = entry
+
+			gotIndexKey, gotKey, err := idx.decodeEntryKey(entry)
+			require.NoError(err)
+			require.Equal(indexKey, gotIndexKey)
+			require.Equal(key, string(gotKey))
+		}
+	}
+
+	for _, entry := range [][]byte{idx.prefix, append(idx.entryKey([]byte("a"), nil)[:len(idx.prefix)+1], 0, 2)} {
+		_, _, err := idx.decodeEntryKey(entry)
+		require.Error(err)
+	}
+}
+
+func TestRegisterIndex(t *testing.T) {
+	require := require.New(t)
+	db := newDB(t)
+	defer func() { require.NoError(db.Close()) }()
+
+	for _, name := range []string{"", "a\x00b"} {
+		_, err := db.RegisterIndex(name, testIndexFunc, nil)
+		require.Error(err)
+	}
+	idx, err := db.RegisterIndex("idx", testIndexFunc, nil)
+	require.NoError(err)
+	require.Equal("idx", idx.Name())
+	_, err = db.RegisterIndex("idx", testIndexFunc, nil)
+	require.Error(err)
+	_, err = db.RegisterIndex("idx2", testIndexFunc, nil)
+	require.NoError(err)
+}
+
+func TestIndexMaintenance(t *testing.T) {
+	require := require.New(t)
+	db := newDB(t)
+	defer func() { require.NoError(db.Close()) }()
+
+	idx, err := db.RegisterIndex("color", testIndexFunc, &IndexOptions{LowerBound: []byte("r/"), UpperBound: []byte("r0")})
+	require.NoError(err)
+	_, err = db.RegisterIndex("other", testIndexFunc, &IndexOptions{LowerBound: []byte("s/"), UpperBound: []byte("s0")})
+	require.NoError(err)
+
+	// DB writes
+	require.NoError(db.Set([]byte("r/1"), []byte("red,blue"), nil))
+	require.NoError(db.Set([]byte("r/2"), []byte("blue"), nil))
+	require.NoError(db.Set([]byte("x"), []byte("red"), nil))
+	require.Equal([]indexEntry{
+		{"blue", "r/1", "red,blue"},
+		{"blue", "r/2", "blue"},
+		{"red", "r/1", "red,blue"},
+	}, readIndex(t, db, idx, nil))
+
+	// updates remove the entries of the old value
+	require.NoError(db.Set([]byte("r/1"), []byte("green"), nil))
+	require.NoError(db.Delete([]byte("r/2"), nil))
+	require.NoError(db.Set([]byte("r/3"), []byte("red"), nil))
+	require.Equal([]indexEntry{
+		{"green", "r/1", "green"},
+		{"red", "r/3", "red"},
+	}, readIndex(t, db, idx, nil))
+
+	// invalid values can't be written
+	require.Error(db.Set([]byte("r/4"), []byte("!"), nil))
+	require.Error(db.Set([]byte("r/1"), []byte("!"), nil))
+	// but they are written if they aren't indexed
+	require.NoError(db.Set([]byte("x"), []byte("!"), nil))
+
+	// indexed batch
+	b := db.NewIndexedBatch()
+	require.NoError(b.Set([]byte("r/4"), []byte("red"), nil))
+	require.NoError(b.Set([]byte("r/4"), []byte("blue"), nil))
+	require.NoError(b.Delete([]byte("r/3"), nil))
+	require.Equal([]indexEntry{
+		{"blue", "r/4", "blue"},
+		{"green", "r/1", "green"},
+	}, readIndex(t, b, idx, nil))
+	require.Len(readIndex(t, db, idx, nil), 2)
+	require.NoError(b.Commit(nil))
+	require.Equal([]indexEntry{
+		{"blue", "r/4", "blue"},
+		{"green", "r/1", "green"},
+	}, readIndex(t, db, idx, nil))
+
+	// DeleteRange removes the entries of the deleted records
+	require.NoError(db.Set([]byte("r/5"), []byte("red"), nil))
+	require.NoError(db.DeleteRange([]byte("r/2"), []byte("r/5"), nil))
+	require.Equal([]indexEntry{
+		{"green", "r/1", "green"},
+		{"red", "r/5", "red"},
+	}, readIndex(t, db, idx, nil))
+
+	// no stale entries were left behind
+	snap := db.NewSnapshot()
+	defer func() { require.NoError(snap.Close()) }()
+	stats, err := idx.Verify(context.Background(), snap)
+	require.NoError(err)
+	require.Equal(IndexStats{Records: 2, Entries: 2}, stats)
+}
+
+func TestIndexTransaction(t *testing.T) {
+	require := require.New(t)
+	db := newDB(t)
+	defer func() { require.NoError(db.Close()) }()
+
+	idx, err := db.RegisterIndex("idx", testIndexFunc, nil)
+	require.NoError(err)
+	require.NoError(db.Set([]byte("a"), []byte("x"), nil))
+
+	tx := db.NewTransaction(true)
+	require.NoError(tx.Set([]byte("a"), []byte("y"), nil))
+	require.NoError(tx.Set([]byte("b"), []byte("x,y"), nil))
+
+	// the transaction sees its own writes
+	it, err := tx.NewIndexIter(idx, nil)
+	require.NoError(err)
+	require.Equal([]indexEntry{
+		{"x", "b", "x,y"},
+		{"y", "a", "y"},
+		{"y", "b", "x,y"},
+	}, scanIndex(t, it, false))
+	// others don't
+	require.Equal([]indexEntry{{"x", "a", "x"}}, readIndex(t, db, idx, nil))
+
+	require.NoError(tx.Commit())
+	require.Equal([]indexEntry{
+		{"x", "b", "x,y"},
+		{"y", "a", "y"},
+		{"y", "b", "x,y"},
+	}, readIndex(t, db, idx, nil))
+
+	// a discarded transaction doesn't change the index
+	tx = db.NewTransaction(true)
+	require.NoError(tx.Delete([]byte("a"), nil))
+	require.NoError(tx.DeleteRange([]byte("b"), []byte("c"), nil))
+	it, err = tx.NewIndexIter(idx, nil)
+	require.NoError(err)
+	require.Empty(scanIndex(t, it, false))
+	tx.Close()
+	require.Len(readIndex(t, db, idx, nil), 3)
+}
+
+func TestIndexIterator(t *testing.T) {
+	require := require.New(t)
+	db := newDB(t)
+	defer func() { require.NoError(db.Close()) }()
+
+	idx, err := db.RegisterIndex("idx", testIndexFunc, nil)
+	require.NoError(err)
+	require.NoError(db.Set([]byte("k1"), []byte("a,a\x00"), nil))
+	require.NoError(db.Set([]byte("k2"), []byte("ab,b"), nil))
+	require.NoError(db.Set([]byte("k3"), []byte("a\x00b,c"), nil))
+
+	all := []indexEntry{
+		{"a", "k1", "a,a\x00"},
+		{"a\x00", "k1", "a,a\x00"},
+		{"a\x00b", "k3", "a\x00b,c"},
+		{"ab", "k2", "ab,b"},
+		{"b", "k2", "ab,b"},
+		{"c", "k3", "a\x00b,c"},
+	}
+	require.Equal(all, readIndex(t, db, idx, nil))
+
+	// reverse iteration
+	it, err := idx.NewIter(db, nil)
+	require.NoError(err)
+	reversed := scanIndex(t, it, true)
+	for i := range all {
+		require.Equal(all[len(all)-1-i], reversed[i])
+	}
+
+	// bounds are index keys
+	require.Equal(all[1:4], readIndex(t, db, idx, &IterOptions{LowerBound: []byte("a\x00"), UpperBound: []byte("b")}))
+	require.Equal(all[:1], readIndex(t, db, idx, &IterOptions{UpperBound: []byte("a\x00")}))
+
+	// seeks
+	it, err = idx.NewIter(db, nil)
+	require.NoError(err)
+	require.True(it.SeekGE([]byte("a\x00a")))
+	require.Equal("a\x00b", string(it.IndexKey()))
+	require.True(it.SeekLT([]byte("ab")))
+	require.Equal("a\x00b", string(it.IndexKey()))
+	require.True(it.Prev())
+	require.Equal("a\x00", string(it.IndexKey()))
+	require.True(it.SeekGE([]byte("c")))
+	require.Equal("k3", string(it.Key()))
+	require.False(it.Next())
+	require.False(it.SeekGE([]byte("d")))
+	require.False(it.SeekLT([]byte("a")))
+	require.NoError(it.Close())
+}
+
+func TestIndexBackfill(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	db := newDB(t)
+	defer func() { require.NoError(db.Close()) }()
+
+	// records written before the index was registered aren't indexed
+	for _, kv := range [][2]string{{"a", "x"}, {"b", "x,y"}, {"c", ""}, {"d", "!"}} {
+		require.NoError(db.Set([]byte(kv[0]), []byte(kv[1]), nil))
+	}
+	idx, err := db.RegisterIndex("idx", testIndexFunc, nil)
+	require.NoError(err)
+	require.Empty(readIndex(t, db, idx, nil))
+
+	// stale entries are skipped by iterators
+	require.NoError(db.Set(idx.entryKey([]byte("x"), []byte("c")), nil, nil))
+	require.NoError(db.Set(idx.entryKey([]byte("z"), []byte("e")), nil, nil))
+	require.NoError(db.Set(idx.entryKey([]byte("x"), []byte("d")), nil, nil))
+	require.Empty(readIndex(t, db, idx, nil))
+
+	snap := db.NewSnapshot()
+	stats, err := idx.Verify(ctx, snap)
+	require.NoError(err)
+	want := IndexStats{Records: 4, Entries: 3, Invalid: 1, Missing: 3, Stale: 3}
+	require.Equal(want, stats)
+
+	// writes after the snapshot are indexed by regular maintenance
+	require.NoError(db.Set([]byte("b"), []byte("y"), nil))
+	require.NoError(db.Set([]byte("f"), []byte("z"), nil))
+
+	stats, err = idx.Backfill(ctx, snap)
+	require.NoError(err)
+	require.Equal(want, stats)
+	require.NoError(snap.Close())
+
+	require.Equal([]indexEntry{
+		{"x", "a", "x"},
+		{"y", "b", "y"},
+		{"z", "f", "z"},
+	}, readIndex(t, db, idx, nil))
+
+	snap = db.NewSnapshot()
+	defer func() { require.NoError(snap.Close()) }()
+	stats, err = idx.Verify(ctx, snap)
+	require.NoError(err)
+	require.Equal(IndexStats{Records: 5, Entries: 3, Invalid: 1}, stats)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = idx.Verify(ctx, snap)
+	require.ErrorIs(err, context.Canceled)
+}
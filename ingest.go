@@ -243,6 +243,10 @@ func ingestLoad1(
 			tf, fmv, fmv.MinTableFormat(), fmv.MaxTableFormat(),
 		)
 	}
+	// EDG: Values must carry the TTL header if TTL is enabled.
+	if err := ttlCheckIngest(opts, &r.Properties); err != nil {
+		return nil, err
+	}
 
 	meta := &fileMetadata{}
 	meta.FileNum = fileNum.FileNum()
@@ -471,7 +475,7 @@ func ingestSortAndVerify(cmp Compare, lr ingestLoadResult, exciseSpan KeyRange)
 	for i := range lr.sharedMeta {
 		f := lr.sharedMeta[i]
 		if !exciseSpan.Contains(cmp, f.Smallest) || !exciseSpan.Contains(cmp, f.Largest) {
-			return errors.AssertionFailedf("pebble: shared file outside of excise span, span [%s-%s), file = %s", exciseSpan.Start, exciseSpan.End, f.String())
+			return errors.AssertionFailedf("pebble: shared file outside of excise span, span [%s-%s), file = %s", base.UserData(exciseSpan.Start), base.UserData(exciseSpan.End), f.String())
 		}
 	}
 	if len(lr.externalMeta) > 0 {
@@ -246,6 +246,10 @@ const lowerhex = "0123456789abcdef"
 
 // Format implements the fmt.Formatter interface.
 func (p FormatBytes) Format(s fmt.State, c rune) {
+	if Redacted() { // EDG
+		s.Write([]byte(RedactedMarker))
+		return
+	}
 	buf := make([]byte, 0, len(p))
 	for _, b := range p {
 		if b < utf8.RuneSelf && strconv.IsPrint(rune(b)) {
@@ -480,10 +480,15 @@ type prettyInternalKey struct {
 }
 
 func (k prettyInternalKey) Format(s fmt.State, c rune) {
+	formatKey := k.formatKey
+	if Redacted() {
+		// EDG: custom formatters don't know about redaction
+		formatKey = DefaultFormatter
+	}
 	if seqNum := k.SeqNum(); seqNum == InternalKeySeqNumMax {
-		fmt.Fprintf(s, "%s#inf,%s", k.formatKey(k.UserKey), k.Kind())
+		fmt.Fprintf(s, "%s#inf,%s", formatKey(k.UserKey), k.Kind())
 	} else {
-		fmt.Fprintf(s, "%s#%d,%s", k.formatKey(k.UserKey), k.SeqNum(), k.Kind())
+		fmt.Fprintf(s, "%s#%d,%s", formatKey(k.UserKey), k.SeqNum(), k.Kind())
 	}
 }
 
@@ -64,6 +64,22 @@ type FilterPolicy interface {
 	NewWriter(ftype FilterType) FilterWriter
 }
 
+// RangeFilterPolicy is a FilterPolicy whose filters can also rule out
+// ranges of keys. Tables written with such a policy have the RangeFiltering
+// property, and iterators with bounds skip them if their filter doesn't
+// contain a key within the bounds.
+//
+// The filter holds the Split prefixes of the keys, so it can only be used
+// with comparers that order prefixes bytewise.
+type RangeFilterPolicy interface {
+	FilterPolicy
+
+	// MayContainRange returns whether the encoded filter may contain a key k
+	// with lower <= k < upper in bytewise order. A nil bound is unbounded.
+	// False positives are possible.
+	MayContainRange(ftype FilterType, filter, lower, upper []byte) bool
+}
+
 // BlockPropertyFilter is used in an Iterator to filter sstables and blocks
 // within the sstable. It should not maintain any per-sstable state, and must
 // be thread-safe.
@@ -0,0 +1,70 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package base
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// RedactedMarker is emitted in place of user keys and values if redaction is
+// enabled.
+const RedactedMarker = "<redacted>"
+
+var redactUserData atomic.Bool
+
+// EnableRedaction makes the formatting of user keys and values emit
+// RedactedMarker. It applies to the whole process and can't be disabled,
+// because some of the formatting, e.g., of an InternalKey, isn't associated
+// with a DB.
+func EnableRedaction() {
+	redactUserData.Store(true)
+}
+
+// Redacted returns whether redaction is enabled.
+func Redacted() bool {
+	return redactUserData.Load()
+}
+
+// UserData formats a user key or value like a byte slice, or as
+// RedactedMarker if redaction is enabled.
+type UserData []byte
+
+// Format implements the fmt.Formatter interface.
+func (d UserData) Format(s fmt.State, c rune) {
+	if Redacted() {
+		fmt.Fprint(s, RedactedMarker)
+		return
+	}
+	fmt.Fprintf(s, fmt.FormatString(s, c), []byte(d))
+}
+
+type redactedFormatter struct{}
+
+// Format implements the fmt.Formatter interface.
+func (redactedFormatter) Format(s fmt.State, c rune) {
+	fmt.Fprint(s, RedactedMarker)
+}
+
+// RedactComparer returns a copy of the comparer whose FormatKey and
+// FormatValue emit RedactedMarker.
+func RedactComparer(c *Comparer) *Comparer {
+	rc := *c
+	rc.FormatKey = func(key []byte) fmt.Formatter {
+		return redactedFormatter{}
+	}
+	rc.FormatValue = func(key, value []byte) fmt.Formatter {
+		return redactedFormatter{}
+	}
+	return &rc
+}
+
+// TestDisableRedaction disables redaction again, so that a test that enables
+// it doesn't affect other tests.
+func TestDisableRedaction() {
+	redactUserData.Store(false)
+}
@@ -45,6 +45,8 @@ func newValue(n int) *Value {
 
 func (v *Value) free() {
 	if !cgoEnabled {
+		// EDG: the garbage collector doesn't clear the buffer
+		manual.Scrub(v.buf)
 		return
 	}
 
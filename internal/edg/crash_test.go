@@ -0,0 +1,400 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package edg_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/edgelesssys/estore/vfs/errorfs"
+	"github.com/stretchr/testify/require"
+)
+
+// crashPoint is the state of the FS if the process crashed at a sync.
+type crashPoint struct {
+	fs *vfs.MemFS
+	// path of the file or directory that was about to be synced
+	path string
+	// number of writes that had been acknowledged
+	acked int
+	// torn is set if the SALTCHAIN ends with a partially written block
+	torn bool
+}
+
+// TestCrashConsistency runs a workload that flushes, compacts, rotates the
+// MANIFEST and creates and removes keys. It takes a crash snapshot of the FS
+// before every sync, including one with a partially written SALTCHAIN block
+// before each sync of the SALTCHAIN. Each snapshot must open without integrity
+// errors and contain all acknowledged writes. A partially written block must be
+// dropped.
+func TestCrashConsistency(t *testing.T) {
+	require := require.New(t)
+
+	const numKeys = 60
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	value := func(i int) []byte { return []byte(fmt.Sprintf("value%03d", i)) }
+
+	memFS := vfs.NewStrictMem()
+	var mu sync.Mutex
+	var points []crashPoint
+	var acked atomic.Int64
+	fs := errorfs.Wrap(memFS, errorfs.InjectorFunc(func(op errorfs.Op, path string) error {
+		if op != errorfs.OpFileSync {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		p := crashPoint{fs: memFS.CrashClone(), path: path, acked: int(acked.Load())}
+		points = append(points, p)
+		// The SALTCHAIN may be synced through the handle of the temp file that
+		// replaced it.
+		if strings.HasPrefix(memFS.PathBase(path), edg.SaltChainFilename) {
+			if torn, ok := tornSaltChain(t, memFS, p); ok {
+				points = append(points, torn)
+			}
+		}
+		return nil
+	}))
+
+	opts := &estore.Options{
+		EncryptionKey:         testKey(),
+		FS:                    fs,
+		Logger:                base.NoopLoggerAndTracer{},
+		ForwardSecrecy:        true,
+		L0CompactionThreshold: 2,
+		MaxManifestFileSize:   1,
+	}
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+	for i := 0; i < numKeys; i++ {
+		require.NoError(db.Set(key(i), value(i), estore.Sync))
+		acked.Add(1)
+		if i%10 == 9 {
+			require.NoError(db.Flush())
+		}
+		if i%30 == 29 {
+			require.NoError(db.Compact(key(0), key(numKeys), true))
+			require.NoError(db.ShredObsolete())
+		}
+	}
+	require.NoError(db.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(points)
+	for i, p := range points {
+		name := fmt.Sprintf("%03d-%s", i, p.path)
+		if p.torn {
+			name += "-torn"
+		}
+		t.Run(name, func(t *testing.T) { checkCrashPoint(t, p, key, value) })
+	}
+}
+
+// checkCrashPoint opens the DB in the crash snapshot and checks that it
+// contains all acknowledged writes and passes CheckLevels.
+func checkCrashPoint(t *testing.T, p crashPoint, key, value func(int) []byte) {
+	require := require.New(t)
+
+	logger := &bufferLogger{}
+	db, err := estore.Open("", &estore.Options{
+		EncryptionKey: testKey(),
+		FS:            p.fs,
+		Logger:        logger,
+	})
+	require.NoError(err)
+	if p.torn {
+		require.Contains(logger.String(), "dropped torn block")
+	}
+	for i := 0; i < p.acked; i++ {
+		val, closer, err := db.Get(key(i))
+		require.NoError(err, "acknowledged write of %s is lost", key(i))
+		require.Equal(value(i), val)
+		require.NoError(closer.Close())
+	}
+	require.NoError(db.CheckLevels(nil))
+	require.NoError(db.Close())
+}
+
+// tornSaltChain returns a crash point based on p whose SALTCHAIN additionally
+// contains the first half of the data that the sync of the SALTCHAIN in fs is
+// about to persist. It returns false if the SALTCHAIN has no unsynced data.
+func tornSaltChain(t *testing.T, fs *vfs.MemFS, p crashPoint) (crashPoint, bool) {
+	require := require.New(t)
+
+	read := func(fs vfs.FS) []byte {
+		f, err := fs.Open(edg.SaltChainFilename)
+		require.NoError(err)
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		require.NoError(err)
+		return data
+	}
+	if _, err := p.fs.Stat(edg.SaltChainFilename); err != nil {
+		return p, false
+	}
+	synced := read(p.fs)
+	unsynced := read(fs)[len(synced):]
+	if len(unsynced) == 0 {
+		return p, false
+	}
+
+	p.fs = fs.CrashClone()
+	p.torn = true
+	f, err := p.fs.Create(edg.SaltChainFilename)
+	require.NoError(err)
+	_, err = f.WriteApproved(append(synced, unsynced[:len(unsynced)/2]...))
+	require.NoError(err)
+	require.NoError(f.Sync())
+	require.NoError(f.Close())
+	return p, true
+}
+
+func TestTornSaltChainOfWrittenFile(t *testing.T) {
+	// setup creates a DB with a flushed sstable and an unflushed WAL. It
+	// returns the file numbers of both.
+	setup := func(t *testing.T, fs vfs.FS, opts *estore.Options) (sstNum, walNum uint64) {
+		require := require.New(t)
+		db, err := estore.Open("", opts)
+		require.NoError(err)
+		require.NoError(db.Set([]byte("key1"), []byte("value"), nil))
+		require.NoError(db.Flush())
+		require.NoError(db.Set([]byte("key2"), []byte("value"), estore.Sync))
+		require.NoError(db.Close())
+
+		ls, err := fs.List("")
+		require.NoError(err)
+		for _, filename := range ls {
+			if strings.HasSuffix(filename, ".sst") {
+				_, err := fmt.Sscanf(filename, "%d.sst", &sstNum)
+				require.NoError(err)
+			}
+			if strings.HasSuffix(filename, ".log") {
+				if info, err := fs.Stat(filename); err == nil && info.Size() > 0 {
+					_, err := fmt.Sscanf(filename, "%d.log", &walNum)
+					require.NoError(err)
+				}
+			}
+		}
+		require.NotZero(sstNum)
+		require.NotZero(walNum)
+		return sstNum, walNum
+	}
+
+	// tear truncates the SALTCHAIN at the block of fileNum, or keeps it if
+	// fileNum has no block, and appends the file number of a torn block for
+	// fileNum. It returns the size of the resulting SALTCHAIN.
+	tear := func(t *testing.T, fs vfs.FS, fileNum uint64) int {
+		require := require.New(t)
+		f, err := fs.Open(edg.SaltChainFilename)
+		require.NoError(err)
+		chain, err := io.ReadAll(f)
+		require.NoError(err)
+		require.NoError(f.Close())
+		rawFileNum := binary.LittleEndian.AppendUint64(nil, fileNum)
+		if i := bytes.Index(chain, rawFileNum); i >= 0 {
+			chain = chain[:i]
+		}
+		chain = append(chain, rawFileNum...)
+		f, err = fs.Create(edg.SaltChainFilename)
+		require.NoError(err)
+		_, err = f.WriteApproved(chain)
+		require.NoError(err)
+		require.NoError(f.Close())
+		return len(chain)
+	}
+
+	// chainSize returns the size of the SALTCHAIN.
+	chainSize := func(t *testing.T, fs vfs.FS) int {
+		info, err := fs.Stat(edg.SaltChainFilename)
+		require.NoError(t, err)
+		return int(info.Size())
+	}
+
+	newOpts := func(fs vfs.FS) *estore.Options {
+		return &estore.Options{
+			EncryptionKey: testKey(),
+			FS:            fs,
+			Logger:        base.NoopLoggerAndTracer{},
+		}
+	}
+
+	// A torn block can't belong to a file that the DB references, because the
+	// salt is synced before the key is used. Such a SALTCHAIN has been
+	// tampered with, even if the file has been truncated to hide its data.
+	t.Run("referenced", func(t *testing.T) {
+		for _, tc := range []struct {
+			name string
+			file func(sstNum, walNum uint64) (string, uint64)
+		}{
+			{"sstable", func(sstNum, _ uint64) (string, uint64) { return fmt.Sprintf("%06d.sst", sstNum), sstNum }},
+			{"WAL", func(_, walNum uint64) (string, uint64) { return fmt.Sprintf("%06d.log", walNum), walNum }},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				require := require.New(t)
+				fs := vfs.NewMem()
+				opts := newOpts(fs)
+				filename, fileNum := tc.file(setup(t, fs, opts))
+				size := tear(t, fs, fileNum)
+				f, err := fs.Create(filename)
+				require.NoError(err)
+				require.NoError(f.Close())
+
+				_, err = estore.Open("", opts)
+				require.ErrorContains(err, "which the DB references")
+				// the SALTCHAIN is left as is
+				require.Equal(size, chainSize(t, fs))
+			})
+		}
+	})
+
+	// As a sanity check, a file that isn't referenced mustn't contain data
+	// either.
+	t.Run("orphaned", func(t *testing.T) {
+		require := require.New(t)
+		fs := vfs.NewMem()
+		opts := newOpts(fs)
+		sstNum, _ := setup(t, fs, opts)
+		const orphanNum = 999
+		require.NoError(vfs.Copy(fs, fmt.Sprintf("%06d.sst", sstNum), fmt.Sprintf("%06d.sst", orphanNum)))
+		size := tear(t, fs, orphanNum)
+
+		_, err := estore.Open("", opts)
+		require.ErrorContains(err, "contains data")
+		require.Equal(size, chainSize(t, fs))
+	})
+
+	// An empty orphaned file is the result of a crash after the file was
+	// created, but before its salt was synced.
+	t.Run("empty", func(t *testing.T) {
+		require := require.New(t)
+		fs := vfs.NewMem()
+		opts := newOpts(fs)
+		setup(t, fs, opts)
+		const orphanNum = 999
+		f, err := fs.Create(fmt.Sprintf("%06d.sst", orphanNum))
+		require.NoError(err)
+		require.NoError(f.Close())
+		tear(t, fs, orphanNum)
+
+		db, err := estore.Open("", opts)
+		require.NoError(err)
+		for _, key := range []string{"key1", "key2"} {
+			val, closer, err := db.Get([]byte(key))
+			require.NoError(err)
+			require.Equal("value", string(val))
+			require.NoError(closer.Close())
+		}
+		require.NoError(db.Close())
+	})
+}
+
+func TestTornSaltChainMarker(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		EncryptionKey: testKey(),
+		FS:            fs,
+		Logger:        base.NoopLoggerAndTracer{},
+	}
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	// A torn block that records the active MANIFEST can only be the result of
+	// a crash if CURRENT has already been moved ahead of the SALTCHAIN.
+	// Otherwise, CURRENT may have been moved back and the block torn to hide
+	// it.
+	f, err := fs.OpenReadWrite(edg.SaltChainFilename)
+	require.NoError(err)
+	_, err = io.ReadAll(f)
+	require.NoError(err)
+	_, err = f.WriteApproved(binary.LittleEndian.AppendUint64(nil, math.MaxUint64))
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	_, err = estore.Open("", opts)
+	require.ErrorContains(err, "isn't ahead of the SALTCHAIN")
+}
+
+// TestForwardSecrecyCrashBeforeShredding simulates a crash after obsolete
+// files have been deleted, but before their salts have been removed from the
+// SALTCHAIN. Open must shred the leftover salts.
+func TestForwardSecrecyCrashBeforeShredding(t *testing.T) {
+	require := require.New(t)
+
+	memFS := vfs.NewMem()
+	var crashed atomic.Bool
+	fs := errorfs.Wrap(memFS, errorfs.InjectorFunc(func(op errorfs.Op, path string) error {
+		// The SALTCHAIN is rewritten to remove salts.
+		if crashed.Load() && op == errorfs.OpCreate && strings.HasPrefix(memFS.PathBase(path), edg.SaltChainFilename) {
+			return errorfs.ErrInjected
+		}
+		return nil
+	}))
+	opts := &estore.Options{
+		EncryptionKey:  testKey(),
+		FS:             fs,
+		Logger:         base.NoopLoggerAndTracer{},
+		ForwardSecrecy: true,
+	}
+
+	// fileNums returns the file numbers of the files in the directory and of
+	// the salts in the SALTCHAIN
+	fileNums := func() (files, salts []base.FileNum) {
+		ls, err := memFS.List("")
+		require.NoError(err)
+		for _, filename := range ls {
+			if _, fileNum, ok := base.ParseFilename(memFS, filename); ok {
+				files = append(files, fileNum.FileNum())
+			}
+		}
+		chain, err := edg.ReadSaltChain(memFS, "", testKey())
+		require.NoError(err)
+		for fileNum := range chain {
+			salts = append(salts, fileNum)
+		}
+		return files, salts
+	}
+
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+	for i := 0; i < 3; i++ {
+		require.NoError(db.Set([]byte(fmt.Sprint("key", i)), []byte("value"), nil))
+		require.NoError(db.Flush())
+	}
+	crashed.Store(true)
+	require.NoError(db.Compact([]byte("key0"), []byte("key9"), true))
+	require.NoError(db.Close())
+
+	// the compacted tables have been deleted, but their salts are left
+	files, salts := fileNums()
+	require.NotSubset(files, salts)
+
+	crashed.Store(false)
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	files, salts = fileNums()
+	require.Subset(files, salts)
+	val, closer, err := db.Get([]byte("key2"))
+	require.NoError(err)
+	require.Equal("value", string(val))
+	require.NoError(closer.Close())
+	require.NoError(db.Close())
+}
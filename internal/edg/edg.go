@@ -7,9 +7,12 @@ SPDX-License-Identifier: AGPL-3.0-only
 package edg
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
+	"fmt"
 
 	"github.com/edgelesssys/estore/internal/base"
 )
@@ -19,8 +22,12 @@ const GCMTagSize = 16
 
 var randomTestKey []byte
 
-// GetCipher returns an AES-GCM cipher for key.
+// GetCipher returns an AES-GCM cipher for key. For the key returned by
+// PlaintextKey, it returns a cipher that doesn't encrypt.
 func GetCipher(key []byte) (cipher.AEAD, error) {
+	if IsPlaintextKey(key) {
+		return plaintextAEAD{}, nil
+	}
 	// randomTestKey is set by TestEnableRandomKey. It's only
 	// called in *_test.go, so is always nil in production.
 	if len(key) == 0 && len(randomTestKey) == 16 {
@@ -43,9 +50,30 @@ func TestEnableRandomKey() {
 	}
 }
 
-// EncryptOptions encrypts the contents of an OPTIONS file.
+// CipherSuite returns the name of the cipher that GetCipher returns for keys
+// of length keyLen.
+func CipherSuite(keyLen int) string {
+	if keyLen == 0 && len(randomTestKey) == 16 {
+		keyLen = len(randomTestKey)
+	}
+	return fmt.Sprintf("AES-%d-GCM", keyLen*8)
+}
+
+// optionsMagic starts an OPTIONS file that has a plaintext header. OPTIONS
+// files written before the header was introduced consist of the ciphertext
+// only.
+const optionsMagic = "EDGOPTS1"
+
+// EncryptOptions encrypts the contents of an OPTIONS file. The header is
+// written in plaintext before the ciphertext, so that it can be read with
+// ReadOptionsHeader without the key. It must not contain secrets. The header
+// is authenticated as additional data of the ciphertext, so DecryptOptions
+// detects if it has been modified.
+//
+// The file has the format: optionsMagic | uint32(len(header)) | header |
+// ciphertext.
 func EncryptOptions(
-	serializedOpts []byte, fileNum base.DiskFileNum, keyManager *KeyManager,
+	header, serializedOpts []byte, fileNum base.DiskFileNum, keyManager *KeyManager,
 ) ([]byte, error) {
 	key, err := keyManager.Create(fileNum.FileNum())
 	if err != nil {
@@ -55,23 +83,64 @@ func EncryptOptions(
 	if err != nil {
 		return nil, err
 	}
+	data := append([]byte(optionsMagic), binary.LittleEndian.AppendUint32(nil, uint32(len(header)))...)
+	data = append(data, header...)
+	keyManager.Stats().File(FileTypeOptions).Encrypted(len(serializedOpts))
 	// Use all-zero nonce because the key is unique and won't be used again for another encryption.
-	return aead.Seal(nil, make([]byte, aead.NonceSize()), serializedOpts, nil), nil
+	return aead.Seal(data[:len(data):len(data)], make([]byte, aead.NonceSize()), serializedOpts, data), nil
 }
 
-// DecryptOptions decrypts the contents of an OPTIONS file.
+// ReadOptionsHeader returns the plaintext header of an OPTIONS file without
+// authenticating it. It returns false if the file doesn't have a header.
+func ReadOptionsHeader(data []byte) (header []byte, ok bool) {
+	header, _, ok = splitOptions(data)
+	return header, ok
+}
+
+// DecryptOptions decrypts the contents of an OPTIONS file and authenticates
+// its header. The header is nil if the file doesn't have one.
 func DecryptOptions(
-	ciphertext []byte, fileNum base.FileNum, keyManager *KeyManager,
-) ([]byte, error) {
+	data []byte, fileNum base.FileNum, keyManager *KeyManager,
+) (header, plaintext []byte, err error) {
+	header, ciphertext, ok := splitOptions(data)
+	var additionalData []byte
+	if ok {
+		additionalData = data[:len(data)-len(ciphertext)]
+	}
+
 	key, err := keyManager.Get(fileNum)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	aead, err := GetCipher(key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	stats := keyManager.Stats().File(FileTypeOptions)
+	plaintext, err = aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, additionalData)
+	if err != nil {
+		stats.AuthFailed(fileNum, 0)
+		return nil, nil, err
+	}
+	stats.Decrypted(len(plaintext))
+	return header, plaintext, nil
+}
+
+// splitOptions splits an OPTIONS file into the header and the ciphertext. ok is
+// false if the file doesn't have a valid header, in which case all of data is
+// treated as the ciphertext. A modified header thus fails authentication like
+// any other modification.
+func splitOptions(data []byte) (header, ciphertext []byte, ok bool) {
+	rest, found := bytes.CutPrefix(data, []byte(optionsMagic))
+	if !found || len(rest) < 4 {
+		return nil, data, false
+	}
+	headerLen := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	if uint64(len(rest)) < uint64(headerLen) {
+		return nil, data, false
 	}
-	return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, nil)
+	return rest[:headerLen], rest[headerLen:], true
 }
 
 // Writer is an interface for Write and WriteApproved.
@@ -8,16 +8,24 @@ package edg_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"math"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 
 	"github.com/edgelesssys/estore"
 	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/internal/manual"
+	"github.com/edgelesssys/estore/objstorage/objstorageprovider"
+	"github.com/edgelesssys/estore/sstable"
 	"github.com/edgelesssys/estore/vfs"
+	"github.com/edgelesssys/estore/vfs/atomicfs"
+	prometheusgo "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -101,6 +109,324 @@ func TestConfidentiality(t *testing.T) {
 	}
 }
 
+// TestRedactUserData checks that logs, events and errors don't contain plaintext user keys and values if redaction is
+// enabled.
+func TestRedactUserData(t *testing.T) {
+	require := require.New(t)
+	defer base.TestDisableRedaction()
+
+	logger := &bufferLogger{}
+	el := estore.MakeLoggingEventListener(logger)
+	db, err := estore.Open("", &estore.Options{
+		EncryptionKey:  testKey(),
+		FS:             vfs.NewMem(),
+		Logger:         logger,
+		EventListener:  &el,
+		RedactUserData: true,
+		Comparer:       &comparerWithFormatter,
+	})
+	require.NoError(err)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Set([]byte(fmt.Sprintf("lorem ipsum %03d", i)), []byte("consectetur adipisici elit"), nil))
+	}
+	require.NoError(db.Flush())
+	require.NoError(db.DeleteRange([]byte("lorem ipsum 010"), []byte("lorem ipsum 020"), nil))
+	require.NoError(db.Compact([]byte("lorem"), []byte("lorem ipsum 999"), true))
+
+	var out []string
+	tables, err := db.SSTables()
+	require.NoError(err)
+	require.NotEmpty(tables)
+	out = append(out, fmt.Sprint(tables), db.Metrics().String())
+	for _, level := range tables {
+		for _, table := range level {
+			out = append(out, fmt.Sprintf("%v %s %s", table, table.Smallest, table.Largest))
+		}
+	}
+	key := base.MakeInternalKey([]byte("lorem ipsum"), 1, base.InternalKeyKindSet)
+	out = append(out, key.String(), fmt.Sprint(key.Pretty(comparerWithFormatter.FormatKey)))
+
+	// an error that includes keys
+	fs := vfs.NewMem()
+	f, err := fs.Create("ext.sst")
+	require.NoError(err)
+	w := sstable.NewWriter(objstorageprovider.NewFileWritable(f), sstable.WriterOptions{
+		EncryptionKey: testKey(),
+		Comparer:      &comparerWithFormatter,
+	})
+	require.NoError(w.Set([]byte("lorem ipsum 2"), nil))
+	err = w.Set([]byte("lorem ipsum 1"), nil)
+	require.Error(err)
+	out = append(out, err.Error())
+	require.Contains(err.Error(), base.RedactedMarker)
+	_ = w.Close()
+
+	require.NoError(db.Close())
+	log := logger.String()
+	out = append(out, log)
+	require.Contains(log, "compacted")
+
+	for _, s := range out {
+		require.NotContains(s, "ipsum")
+		require.NotContains(s, "adipi")
+	}
+}
+
+// TestZeroizeMemory checks that released batch data is overwritten and that the DB can be reopened with the same
+// options after the keys have been wiped on close.
+func TestZeroizeMemory(t *testing.T) {
+	require := require.New(t)
+	defer manual.TestDisableZeroization()
+
+	opts := &estore.Options{
+		EncryptionKey: testKey(),
+		FS:            vfs.NewMem(),
+		ZeroizeMemory: true,
+	}
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+
+	batch := db.NewBatch()
+	require.NoError(batch.Set([]byte("lorem ipsum"), []byte("consectetur adipisici elit"), nil))
+	repr := batch.Repr()
+	require.NoError(db.Apply(batch, nil))
+	require.NoError(batch.Close())
+	require.Equal(make([]byte, len(repr)), repr)
+
+	require.NoError(db.Flush())
+	require.NoError(db.Close())
+	require.Equal(testKey(), opts.EncryptionKey)
+
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	value, closer, err := db.Get([]byte("lorem ipsum"))
+	require.NoError(err)
+	require.Equal("consectetur adipisici elit", string(value))
+	require.NoError(closer.Close())
+	require.NoError(db.Close())
+}
+
+// TestPadding checks that batches and blocks are padded and that the padded data can be read back.
+func TestPadding(t *testing.T) {
+	require := require.New(t)
+	const walPadding = 256
+
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		EncryptionKey: testKey(),
+		FS:            fs,
+		BlockPadding:  4096,
+		WALPadding:    walPadding,
+	}
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+
+	// cover all offsets within the granularity, including those where the varint length of the padding grows
+	for i := 0; i < 2*walPadding; i++ {
+		batch := db.NewBatch()
+		require.NoError(batch.Set([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte{'v'}, i), nil))
+		repr := append([]byte(nil), batch.Repr()...)
+		padded := db.Metrics().Encryption.WAL.BytesPadded
+		require.NoError(db.Apply(batch, nil))
+		// the WAL record is padded, but the caller's batch is left as is, apart from the sequence number in the header
+		require.Zero((uint64(len(repr)) + db.Metrics().Encryption.WAL.BytesPadded - padded) % walPadding)
+		require.Equal(repr[12:], batch.Repr()[12:])
+		require.NoError(batch.Close())
+	}
+	require.NotZero(db.Metrics().Encryption.WAL.BytesPadded)
+	require.NoError(db.Close())
+
+	// the WAL is replayed and flushed
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Flush())
+	value, closer, err := db.Get([]byte("key300"))
+	require.NoError(err)
+	require.Equal(bytes.Repeat([]byte{'v'}, 300), value)
+	require.NoError(closer.Close())
+
+	require.NotZero(db.Metrics().Encryption.Table.BytesPadded)
+
+	// older versions that a snapshot keeps are written to value blocks, which are padded, too
+	require.NoError(db.RatchetFormatMajorVersion(estore.FormatNewest))
+	snap := db.NewSnapshot()
+	require.NoError(db.Set([]byte("key300"), []byte("new"), nil))
+	padded := db.Metrics().Encryption.Table.BytesPadded
+	require.NoError(db.Flush())
+	require.NoError(db.Compact([]byte("key"), []byte("kez"), true))
+	require.Greater(db.Metrics().Encryption.Table.BytesPadded, padded)
+	value, closer, err = snap.Get([]byte("key300"))
+	require.NoError(err)
+	require.Equal(bytes.Repeat([]byte{'v'}, 300), value)
+	require.NoError(closer.Close())
+	require.NoError(snap.Close())
+	require.NoError(db.Close())
+}
+
+// TestOptionsHeader checks that the OPTIONS header can be read without the key and that modifying it is detected.
+func TestOptionsHeader(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		EncryptionKey: bytes.Repeat([]byte{2}, 32),
+		FS:            fs,
+		BytesPerSync:  12345,
+	}
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	desc, err := estore.Peek("", fs)
+	require.NoError(err)
+	require.True(desc.Exists)
+	require.Equal(estore.DefaultComparer.Name, desc.Comparer)
+	require.Equal(estore.DefaultMerger.Name, desc.Merger)
+	require.Equal("AES-256-GCM", desc.CipherSuite)
+
+	// only the header is plaintext
+	file, err := fs.Open(desc.OptionsFilename)
+	require.NoError(err)
+	data, err := io.ReadAll(file)
+	require.NoError(err)
+	require.NoError(file.Close())
+	require.Contains(string(data), "comparer=")
+	require.NotContains(string(data), "12345")
+
+	file, err = fs.Create(desc.OptionsFilename)
+	require.NoError(err)
+	_, err = file.WriteApproved(bytes.Replace(data, []byte("AES-256-GCM"), []byte("AES-128-GCM"), 1))
+	require.NoError(err)
+	require.NoError(file.Close())
+
+	_, err = estore.Open("", opts)
+	require.Error(err)
+}
+
+func TestDisableEncryption(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		Insecure_DisableEncryption: true,
+		FS:                         fs,
+		Levels:                     []estore.LevelOptions{{Compression: estore.NoCompression}},
+		Logger:                     base.NoopLoggerAndTracer{},
+	}
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Set([]byte("lorem ipsum"), []byte("dolor sit amet"), nil))
+	require.NoError(db.Flush())
+	require.NoError(db.Set([]byte("consectetur"), []byte("adipisici elit"), nil))
+	require.NoError(db.Close())
+
+	desc, err := estore.Peek("", fs)
+	require.NoError(err)
+	require.Equal(edg.PlaintextCipherSuite, desc.CipherSuite)
+	require.Contains(readAll(t, fs, ""), "dolor sit amet")
+	require.Contains(readAll(t, fs, ""), "adipisici elit")
+
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	for key, want := range map[string]string{"lorem ipsum": "dolor sit amet", "consectetur": "adipisici elit"} {
+		val, closer, err := db.Get([]byte(key))
+		require.NoError(err)
+		require.Equal(want, string(val))
+		require.NoError(closer.Close())
+	}
+	require.NoError(db.Close())
+
+	// the mode can't be changed
+	_, err = estore.Open("", &estore.Options{EncryptionKey: testKey(), FS: fs})
+	require.ErrorContains(err, "Insecure_DisableEncryption")
+	_, err = estore.Open("", &estore.Options{
+		EncryptionKey:              testKey(),
+		Insecure_DisableEncryption: true,
+		FS:                         vfs.NewMem(),
+	})
+	require.ErrorContains(err, "EncryptionKey must not be set")
+
+	// the mode can only be selected with the option, not with a key
+	_, err = estore.Open("", &estore.Options{EncryptionKey: edg.PlaintextKey(), FS: vfs.NewMem()})
+	require.Error(err)
+	_, err = edg.NewKeyManager(vfs.NewMem(), "", edg.PlaintextKey())
+	require.Error(err)
+
+	encryptedFS := vfs.NewMem()
+	db, err = estore.Open("", &estore.Options{EncryptionKey: testKey(), FS: encryptedFS})
+	require.NoError(err)
+	require.NoError(db.Close())
+	_, err = estore.Open("", &estore.Options{Insecure_DisableEncryption: true, FS: encryptedFS})
+	require.ErrorContains(err, "is encrypted")
+
+	// a modified mode is detected
+	desc, err = estore.Peek("", fs)
+	require.NoError(err)
+	data := []byte(readFile(t, fs, desc.OptionsFilename))
+	writeFile(t, fs, desc.OptionsFilename, bytes.Replace(data, []byte("cipher_suite=none"), []byte("cipher_suite=nope"), 1))
+	_, err = estore.Open("", opts)
+	require.Error(err)
+}
+
+func TestEncryptInPlace(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		Insecure_DisableEncryption: true,
+		FS:                         fs,
+		WALDir:                     "wal",
+		Levels:                     []estore.LevelOptions{{Compression: estore.NoCompression}},
+		Logger:                     base.NoopLoggerAndTracer{},
+	}
+	db, err := estore.Open("db", opts)
+	require.NoError(err)
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Set([]byte(fmt.Sprintf("lorem ipsum %03d", i)), []byte("dolor sit amet"), nil))
+		if i%25 == 0 {
+			require.NoError(db.Flush())
+		}
+	}
+	require.NoError(db.DeleteRange([]byte("lorem ipsum 010"), []byte("lorem ipsum 020"), nil))
+	require.NoError(db.Compact([]byte("lorem"), []byte("lorem ipsum 050"), false))
+	require.NoError(db.Set([]byte("consectetur"), []byte("adipisici elit"), nil))
+	require.NoError(db.Close())
+
+	// the DB must be plaintext and the key must be valid
+	require.Error(estore.EncryptInPlace("db", &estore.Options{FS: fs, WALDir: "wal"}, nil))
+	require.Error(estore.EncryptInPlace("db", &estore.Options{FS: fs, WALDir: "wal"}, bytes.Repeat([]byte{2}, 20)))
+	require.NoError(estore.EncryptInPlace("db", &estore.Options{FS: fs, WALDir: "wal", Logger: base.NoopLoggerAndTracer{}}, testKey()))
+	require.Error(estore.EncryptInPlace("db", &estore.Options{FS: fs, WALDir: "wal"}, testKey()))
+
+	for _, dir := range []string{"db", "wal"} {
+		require.NotContains(readAll(t, fs, dir), "dolor sit amet")
+		require.NotContains(readAll(t, fs, dir), "adipisici elit")
+	}
+	desc, err := estore.Peek("db", fs)
+	require.NoError(err)
+	require.Equal("AES-128-GCM", desc.CipherSuite)
+	_, err = estore.Open("db", opts)
+	require.ErrorContains(err, "is encrypted")
+
+	db, err = estore.Open("db", &estore.Options{EncryptionKey: testKey(), FS: fs, WALDir: "wal", Logger: base.NoopLoggerAndTracer{}})
+	require.NoError(err)
+	require.NoError(db.CheckLevels(nil))
+	iter, err := db.NewIter(nil)
+	require.NoError(err)
+	n := 0
+	for valid := iter.First(); valid; valid = iter.Next() {
+		n++
+	}
+	require.NoError(iter.Close())
+	require.Equal(91, n)
+	val, closer, err := db.Get([]byte("consectetur"))
+	require.NoError(err)
+	require.Equal("adipisici elit", string(val))
+	require.NoError(closer.Close())
+	require.NoError(db.Close())
+}
+
 // TestIntegrity checks that modified bytes in data files cause crypto errors.
 func TestIntegrity(t *testing.T) {
 	require := require.New(t)
@@ -476,6 +802,441 @@ func TestRollbackProtection_AdvancingCounterSourceCausesFailure(t *testing.T) {
 	require.NoError(db.Close())
 }
 
+// TestWALRecoveryMode checks that a torn WAL tail is only truncated by the tolerant recovery modes.
+func TestRollbackProtection_Markers(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		EncryptionKey:      testKey(),
+		FS:                 fs,
+		FormatMajorVersion: estore.FormatPrePebblev1Marked,
+	}
+	manifests := func() []string {
+		var names []string
+		ls, err := fs.List("")
+		require.NoError(err)
+		for _, name := range ls {
+			if strings.HasPrefix(name, "MANIFEST-") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	moveMarker := func(name, value string) {
+		marker, _, err := atomicfs.LocateMarker(fs, "", name)
+		require.NoError(err)
+		require.NoError(marker.Move(value))
+		require.NoError(marker.Close())
+	}
+
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Set([]byte("key"), []byte("val1"), nil))
+	require.NoError(db.Close())
+	oldManifests := manifests()
+	require.Len(oldManifests, 1)
+
+	// Reopening rotates the MANIFEST and keeps the previous one.
+	opts.FormatMajorVersion = estore.FormatNewest
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Set([]byte("key"), []byte("val2"), nil))
+	require.NoError(db.Close())
+	require.Contains(manifests(), oldManifests[0])
+	require.Len(manifests(), 2)
+
+	// The DB can be opened read-only and read-write.
+	opts.ReadOnly = true
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Close())
+	opts.ReadOnly = false
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	require.NoError(db.Close())
+	current := manifests()[len(manifests())-1]
+
+	// try to roll back the manifest marker
+	moveMarker("manifest", oldManifests[0])
+	_, err = estore.Open("", opts)
+	require.ErrorContains(err, "rollback detected: MANIFEST")
+	moveMarker("manifest", current)
+
+	// try to downgrade the format major version
+	moveMarker("format-version", estore.FormatPrePebblev1Marked.String())
+	opts.FormatMajorVersion = estore.FormatPrePebblev1Marked
+	_, err = estore.Open("", opts)
+	require.ErrorContains(err, "rollback detected: format major version")
+	moveMarker("format-version", estore.FormatNewest.String())
+
+	db, err = estore.Open("", opts)
+	require.NoError(err)
+	val, closer, err := db.Get([]byte("key"))
+	require.NoError(err)
+	require.Equal("val2", string(val))
+	require.NoError(closer.Close())
+	require.NoError(db.Close())
+}
+
+func TestWALRecoveryMode(t *testing.T) {
+	for _, mode := range []estore.WALRecoveryMode{
+		estore.AbsoluteConsistency,
+		estore.TolerateCorruptedTailRecords,
+		estore.PointInTimeRecovery,
+	} {
+		t.Run(mode.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			var truncated []estore.WALTailTruncatedInfo
+			fs := vfs.NewMem()
+			opts := &estore.Options{
+				EncryptionKey:   testKey(),
+				FS:              fs,
+				Logger:          base.NoopLoggerAndTracer{},
+				WALRecoveryMode: mode,
+				EventListener: &estore.EventListener{
+					WALTailTruncated: func(info estore.WALTailTruncatedInfo) {
+						truncated = append(truncated, info)
+					},
+				},
+			}
+
+			db, err := estore.Open("", opts)
+			require.NoError(err)
+			require.NoError(db.Set([]byte("key1"), []byte("val1"), nil))
+			require.NoError(db.Set([]byte("key2"), []byte("val2"), nil))
+			require.NoError(db.Close())
+
+			// tear the last record
+			rewriteWAL(t, fs, func(data []byte) []byte { return data[:len(data)-3] })
+
+			db, err = estore.Open("", opts)
+			if mode == estore.AbsoluteConsistency {
+				require.True(isCryptoError(err), "open: %+v", err)
+				return
+			}
+			require.NoError(err)
+			require.Len(truncated, 1)
+
+			val, closer, err := db.Get([]byte("key1"))
+			require.NoError(err)
+			require.EqualValues("val1", val)
+			require.NoError(closer.Close())
+			_, _, err = db.Get([]byte("key2"))
+			require.ErrorIs(err, estore.ErrNotFound)
+			require.NoError(db.Close())
+		})
+	}
+}
+
+// TestWALRecoveryMode_CorruptionBeforeTail checks that the tolerant recovery modes still reject modified WAL records
+// that are followed by other data.
+func TestWALRecoveryMode_CorruptionBeforeTail(t *testing.T) {
+	for _, mode := range []estore.WALRecoveryMode{
+		estore.TolerateCorruptedTailRecords,
+		estore.PointInTimeRecovery,
+	} {
+		t.Run(mode.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			fs := vfs.NewMem()
+			opts := &estore.Options{
+				EncryptionKey:   testKey(),
+				FS:              fs,
+				Logger:          base.NoopLoggerAndTracer{},
+				WALRecoveryMode: mode,
+			}
+
+			db, err := estore.Open("", opts)
+			require.NoError(err)
+			require.NoError(db.Set([]byte("key1"), []byte("val1"), nil))
+			require.NoError(db.Set([]byte("key2"), []byte("val2"), nil))
+			require.NoError(db.Close())
+
+			// modify the first record
+			rewriteWAL(t, fs, func(data []byte) []byte {
+				data[20] ^= 1
+				return data
+			})
+
+			_, err = estore.Open("", opts)
+			require.True(isCryptoError(err), "open: %+v", err)
+		})
+	}
+}
+
+// TestWALRecoveryMode_RollbackProtection checks that truncating a WAL tail can't be used to roll back transactions
+// when a monotonic counter is used.
+func TestWALRecoveryMode_RollbackProtection(t *testing.T) {
+	require := require.New(t)
+
+	var counter fakeCounter
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		EncryptionKey:       testKey(),
+		SetMonotonicCounter: counter.set,
+		FS:                  fs,
+		Logger:              base.NoopLoggerAndTracer{},
+		WALRecoveryMode:     estore.TolerateCorruptedTailRecords,
+	}
+
+	db, err := estore.Open("", opts)
+	require.NoError(err)
+	for _, val := range []string{"val1", "val2"} {
+		tx := db.NewTransaction(true)
+		require.NoError(tx.Set([]byte("key"), bytes.Repeat([]byte(val), 250), nil))
+		require.NoError(tx.Commit())
+	}
+	require.NoError(db.Close())
+
+	// The WAL ends with the record that sets the store counter, followed by the record of the transaction.
+	// Remove the latter and tear the former.
+	const txRecordSize = 19 + 12 + 1 + 1 + 3 + 2 + 1000 // chunk header, batch header, kind, key, value
+	rewriteWAL(t, fs, func(data []byte) []byte { return data[:len(data)-txRecordSize-10] })
+
+	_, err = estore.Open("", opts)
+	require.ErrorContains(err, "rollback detected")
+}
+
+// TestShredObsolete checks that deleted data can't be decrypted after shredding, even with an old copy of the files.
+func TestShredObsolete(t *testing.T) {
+	require := require.New(t)
+
+	const dbdir = "db"
+	const olddir = "old"
+	fs := vfs.NewMem()
+	opts := &estore.Options{
+		EncryptionKey:  testKey(),
+		FS:             fs,
+		Logger:         base.NoopLoggerAndTracer{},
+		ForwardSecrecy: true,
+	}
+
+	db, err := estore.Open(dbdir, opts)
+	require.NoError(err)
+	require.NoError(db.Set([]byte("key1"), []byte("val1"), nil))
+	require.NoError(db.Set([]byte("key2"), []byte("val2"), nil))
+	require.NoError(db.Flush())
+
+	// keep an old copy of the files
+	ok, err := vfs.Clone(fs, fs, dbdir, olddir)
+	require.NoError(err)
+	require.True(ok)
+
+	require.NoError(db.Delete([]byte("key1"), nil))
+	require.NoError(db.ShredObsolete())
+	require.NoError(db.Close())
+
+	db, err = estore.Open(dbdir, opts)
+	require.NoError(err)
+	_, _, err = db.Get([]byte("key1"))
+	require.ErrorIs(err, estore.ErrNotFound)
+	val, closer, err := db.Get([]byte("key2"))
+	require.NoError(err)
+	require.EqualValues("val2", val)
+	require.NoError(closer.Close())
+	require.NoError(db.Close())
+
+	// the old files can't be used with the current SALTCHAIN
+	require.NoError(fs.Remove(fs.PathJoin(olddir, edg.SaltChainFilename)))
+	require.NoError(vfs.Copy(fs, fs.PathJoin(dbdir, edg.SaltChainFilename), fs.PathJoin(olddir, edg.SaltChainFilename)))
+	_, err = estore.Open(olddir, opts)
+	require.ErrorContains(err, "rollback detected")
+
+	// not even if the SALTCHAIN didn't record the active MANIFEST
+	km, err := edg.NewKeyManager(fs, olddir, testKey())
+	require.NoError(err)
+	require.NoError(km.SetMarker(edg.MarkerManifest, 0))
+	require.NoError(km.Close())
+	_, err = estore.Open(olddir, opts)
+	require.ErrorContains(err, "fileNum not found")
+}
+
+func TestShredObsolete_RequiresForwardSecrecy(t *testing.T) {
+	require := require.New(t)
+
+	db, err := estore.Open("", &estore.Options{
+		EncryptionKey: testKey(),
+		FS:            vfs.NewMem(),
+	})
+	require.NoError(err)
+	require.Error(db.ShredObsolete())
+	require.NoError(db.Close())
+}
+
+func TestEncryptionMetrics(t *testing.T) {
+	require := require.New(t)
+
+	const dbdir = "db"
+	fs := vfs.NewMem()
+	var counter fakeCounter
+	opts := &estore.Options{
+		EncryptionKey:       testKey(),
+		SetMonotonicCounter: counter.set,
+		FS:                  fs,
+		Logger:              base.NoopLoggerAndTracer{},
+	}
+
+	db, err := estore.Open(dbdir, opts)
+	require.NoError(err)
+	for i := 0; i < 3; i++ {
+		tx := db.NewTransaction(true)
+		require.NoError(tx.Set([]byte("key"), []byte("val"), nil))
+		require.NoError(tx.Commit())
+	}
+	require.NoError(db.Flush())
+
+	m := db.Metrics()
+	require.NotZero(m.Encryption.Table.BytesEncrypted)
+	require.NotZero(m.Encryption.WAL.BytesEncrypted)
+	require.NotZero(m.Encryption.Manifest.BytesEncrypted)
+	require.NotZero(m.Encryption.Options.BytesEncrypted)
+	require.Zero(m.Encryption.AuthFailures)
+	require.NotZero(m.Encryption.SaltChain.Salts)
+	// the salts and the block that records the MANIFEST
+	require.EqualValues((m.Encryption.SaltChain.Salts+1)*(8+16+32), m.Encryption.SaltChain.Size)
+	var hist prometheusgo.Metric
+	require.NoError(m.Encryption.MonotonicCounterLatency.Write(&hist))
+	require.EqualValues(3, hist.Histogram.GetSampleCount())
+	require.Contains(m.String(), "Auth failures: 0")
+	// leave an unflushed write in the WAL
+	require.NoError(db.Set([]byte("key2"), []byte("val"), nil))
+	require.NoError(db.Close())
+
+	// corrupt the first data block of the sstable
+	files, err := fs.List(dbdir)
+	require.NoError(err)
+	var sstName string
+	for _, filename := range files {
+		if strings.HasSuffix(filename, ".sst") {
+			sstName = filename
+		}
+	}
+	require.NotEmpty(sstName)
+	sstPath := fs.PathJoin(dbdir, sstName)
+	file, err := fs.Open(sstPath)
+	require.NoError(err)
+	data, err := io.ReadAll(file)
+	require.NoError(err)
+	require.NoError(file.Close())
+	data[1] ^= 1
+	file, err = fs.Create(sstPath)
+	require.NoError(err)
+	_, err = file.WriteApproved(data)
+	require.NoError(err)
+	require.NoError(file.Close())
+
+	// reading the counter at open would already fail
+	opts.SetMonotonicCounter = nil
+	db, err = estore.Open(dbdir, opts)
+	require.NoError(err)
+	m = db.Metrics()
+	require.NotZero(m.Encryption.Manifest.BytesDecrypted)
+	require.NotZero(m.Encryption.Options.BytesDecrypted)
+	require.NotZero(m.Encryption.WAL.BytesDecrypted)
+	_, _, err = db.Get([]byte("key"))
+	require.Error(err)
+
+	m = db.Metrics()
+	require.EqualValues(1, m.Encryption.AuthFailures)
+	require.Len(m.Encryption.RecentAuthFailures, 1)
+	failure := m.Encryption.RecentAuthFailures[0]
+	require.Equal(edg.FileTypeTable, failure.FileType)
+	require.Equal(sstName, base.MakeFilename(base.FileTypeTable, failure.FileNum.DiskFileNum()))
+	require.Zero(failure.Offset)
+	require.Contains(m.String(), "Auth failures: 1  last: sstable")
+	require.NoError(db.Close())
+}
+
+// rewriteWAL replaces the contents of the only WAL in fs.
+func rewriteWAL(t *testing.T, fs vfs.FS, mutate func([]byte) []byte) {
+	require := require.New(t)
+
+	files, err := fs.List("")
+	require.NoError(err)
+	var walName string
+	for _, filename := range files {
+		if fileType, _, ok := base.ParseFilename(fs, filename); ok && fileType == base.FileTypeLog {
+			require.Empty(walName, "found multiple WALs")
+			walName = filename
+		}
+	}
+	require.NotEmpty(walName)
+
+	file, err := fs.Open(walName)
+	require.NoError(err)
+	data, err := io.ReadAll(file)
+	require.NoError(err)
+	require.NoError(file.Close())
+
+	file, err = fs.Create(walName)
+	require.NoError(err)
+	_, err = file.WriteApproved(mutate(data))
+	require.NoError(err)
+	require.NoError(file.Close())
+}
+
+// comparerWithFormatter is a comparer with a custom key formatter that doesn't know about redaction.
+var comparerWithFormatter = func() estore.Comparer {
+	c := *estore.DefaultComparer
+	c.FormatKey = func(key []byte) fmt.Formatter { return base.FormatBytes(append([]byte("key:"), key...)) }
+	c.FormatValue = func(key, value []byte) fmt.Formatter { return base.FormatBytes(value) }
+	return c
+}()
+
+// bufferLogger is a Logger that writes to a buffer.
+type bufferLogger struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (l *bufferLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.buf, format+"\n", args...)
+}
+
+func (l *bufferLogger) Fatalf(format string, args ...interface{}) {
+	l.Infof(format, args...)
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (l *bufferLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// readAll returns the concatenated contents of the files in dir.
+func readAll(t *testing.T, fs vfs.FS, dir string) string {
+	files, err := fs.List(dir)
+	require.NoError(t, err)
+	var buf strings.Builder
+	for _, filename := range files {
+		buf.WriteString(readFile(t, fs, fs.PathJoin(dir, filename)))
+	}
+	return buf.String()
+}
+
+func readFile(t *testing.T, fs vfs.FS, path string) string {
+	file, err := fs.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func writeFile(t *testing.T, fs vfs.FS, path string, data []byte) {
+	file, err := fs.Create(path)
+	require.NoError(t, err)
+	_, err = file.WriteApproved(data)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
+
 func testKey() []byte {
 	return bytes.Repeat([]byte{2}, 16)
 }
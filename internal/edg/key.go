@@ -7,12 +7,16 @@ SPDX-License-Identifier: AGPL-3.0-only
 package edg
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"io"
+	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/edgelesssys/estore/internal/base"
@@ -24,6 +28,8 @@ const (
 	// SaltChainFilename is the name of the salt chain file.
 	SaltChainFilename = "SALTCHAIN"
 
+	saltChainTempFilename = SaltChainFilename + ".tmp"
+
 	minKeySize    = 16
 	saltBlockSize = fileNumSize + saltSize + macSize
 	fileNumSize   = 8 // uint64
@@ -31,6 +37,35 @@ const (
 	macSize       = sha256.Size
 )
 
+// Marker identifies a value that is recorded in the SALTCHAIN.
+//
+// The atomic markers that point to the active MANIFEST and hold the format
+// major version are plaintext files. The values are also recorded in the
+// SALTCHAIN, which is integrity-protected, so that the DB can detect markers
+// that have been moved back to older values.
+type Marker uint64
+
+const (
+	// MarkerManifest records the file number of the active MANIFEST.
+	MarkerManifest Marker = iota
+	// MarkerFormatVersion records the format major version.
+	MarkerFormatVersion
+
+	numMarkers
+)
+
+// fileNum returns the reserved file number of the blocks that record the
+// marker. These blocks store the value in place of the salt.
+func (mk Marker) fileNum() base.FileNum {
+	return base.FileNum(math.MaxUint64 - uint64(mk))
+}
+
+// markerOf returns the marker that is recorded by blocks with the file number.
+func markerOf(fileNum base.FileNum) (Marker, bool) {
+	mk := Marker(math.MaxUint64 - uint64(fileNum))
+	return mk, mk < numMarkers
+}
+
 // KeyManager manages the encryption keys for database files.
 //
 // Call Create(fileNum) to create a new key when writing a file.
@@ -38,29 +73,123 @@ const (
 //
 // Internally, KeyManager maps file numbers to unique salts. File keys are derived with hkdf(masterKey, salt).
 // The salts are stored integrity-protected in the SALTCHAIN file. The file is an append-only chain of
-// saltBlocks, linked by HMACs.
+// saltBlocks, linked by HMACs. The chain also records the values of Markers in blocks with reserved
+// file numbers.
 //
 // As the encrypted files are file-level integrity-protected, together with key management
 // via the salt chain we achieve "snapshot integrity" for the entire database.
 type KeyManager struct {
 	masterKey []byte
+	// plaintext is set if the files aren't encrypted (see
+	// NewPlaintextKeyManager). masterKey is plaintextKey then.
+	plaintext bool
+	fs        vfs.FS
+	dirname   string
 	mu        sync.Mutex
 	saltFile  vfs.File
 	salts     map[base.FileNum][]byte
+	keys      map[base.FileNum][]byte // derived keys, so that Wipe and Remove can overwrite them
+	markers   map[Marker]uint64
 	lastMAC   []byte // MAC of the last written block
+	blocks    int    // number of blocks in the SALTCHAIN, including shadowed ones
+	tornTail  *TornTail
+	stats     *Stats
+	// verifyDuration is the time it took to read and verify the SALTCHAIN in NewKeyManager.
+	verifyDuration time.Duration
 }
 
-// TODO implement saltchain compaction
+// ChainStats describes the SALTCHAIN.
+type ChainStats struct {
+	// Salts is the number of live salts.
+	Salts int
+	// Size is the size of the SALTCHAIN file in bytes. It grows beyond
+	// Salts*blockSize if salts are shadowed, and includes the blocks that
+	// record markers.
+	Size int64
+	// VerifyDuration is the time it took to read and verify the SALTCHAIN at
+	// open.
+	VerifyDuration time.Duration
+}
+
+// TornTail describes a partially written block at the end of the SALTCHAIN,
+// which is the result of a crash while a block was appended.
+type TornTail struct {
+	// Size is the size of the partial block in bytes.
+	Size int
+	// FileNum is the file number of the partial block. It is only valid if
+	// HasFileNum is set, i.e., if the file number has been written completely.
+	FileNum    base.FileNum
+	HasFileNum bool
+	// maxFileNum is the largest file number of the complete blocks.
+	maxFileNum base.FileNum
+	// fileNumPrefix holds the bytes of the file number that have been written.
+	fileNumPrefix []byte
+}
+
+// MayBelongTo returns whether the partial block may hold the salt of the file.
+// If the file number of the block hasn't been written completely, this is the
+// case for all files that are newer than the ones in the SALTCHAIN.
+func (t TornTail) MayBelongTo(fileNum base.FileNum) bool {
+	if t.HasFileNum {
+		return fileNum == t.FileNum
+	}
+	return fileNum > t.maxFileNum
+}
+
+// MayRecord returns whether the partial block may record the marker. This is
+// also the case if only a part of the file number of the block has been
+// written and it matches the reserved file number of the marker.
+func (t TornTail) MayRecord(mk Marker) bool {
+	var fileNum [fileNumSize]byte
+	binary.LittleEndian.PutUint64(fileNum[:], uint64(mk.fileNum()))
+	return bytes.HasPrefix(fileNum[:], t.fileNumPrefix)
+}
 
 // NewKeyManager creates a new KeyManager.
+//
+// A partially written block at the end of the SALTCHAIN is not an error, but
+// nothing can be appended until it has been dropped with DropTornTail. See
+// TornTail.
 func NewKeyManager(fs vfs.FS, dirname string, masterKey []byte) (*KeyManager, error) {
 	if len(masterKey) < minKeySize && !(masterKey == nil && len(randomTestKey) == 16) {
 		return nil, errors.New("invalid key size")
 	}
+	if IsPlaintextKey(masterKey) {
+		return nil, errors.New("invalid key")
+	}
+	return newKeyManager(fs, dirname, masterKey, false)
+}
+
+// NewPlaintextKeyManager creates a KeyManager for a DB whose files aren't
+// encrypted. The SALTCHAIN is kept as for an encrypted DB, but the keys of all
+// files are PlaintextKey.
+func NewPlaintextKeyManager(fs vfs.FS, dirname string) (*KeyManager, error) {
+	return newKeyManager(fs, dirname, PlaintextKey(), true)
+}
+
+// OpenKeyManager creates a KeyManager with NewPlaintextKeyManager if
+// plaintext is set, and with NewKeyManager otherwise.
+func OpenKeyManager(fs vfs.FS, dirname string, masterKey []byte, plaintext bool) (*KeyManager, error) {
+	if plaintext {
+		return NewPlaintextKeyManager(fs, dirname)
+	}
+	return NewKeyManager(fs, dirname, masterKey)
+}
+
+func newKeyManager(fs vfs.FS, dirname string, masterKey []byte, plaintext bool) (*KeyManager, error) {
 	m := &KeyManager{
-		masterKey: masterKey,
+		// copy the master key, so that Wipe doesn't modify the caller's slice
+		masterKey: append([]byte(nil), masterKey...),
+		plaintext: plaintext,
+		fs:        fs,
+		dirname:   dirname,
 		salts:     map[base.FileNum][]byte{},
+		keys:      map[base.FileNum][]byte{},
+		markers:   map[Marker]uint64{},
+		stats:     NewStats(),
 	}
+
+	start := time.Now()
 	var err error
 	m.saltFile, err = fs.OpenReadWrite(fs.PathJoin(dirname, SaltChainFilename))
 	if err != nil {
@@ -68,35 +197,78 @@ func NewKeyManager(fs vfs.FS, dirname string, masterKey []byte) (*KeyManager, er
 	}
 
 	// read and verify existing SALTCHAIN
+	if err := m.readChain(m.saltFile); err != nil {
+		return nil, err
+	}
+	m.verifyDuration = time.Since(start)
+
+	return m, nil
+}
+
+// ReadSaltChain reads and verifies the SALTCHAIN in dirname without modifying
+// it and returns the salts by file number. It may be called while a DB is
+// appending to the SALTCHAIN: a partially written last block is ignored.
+func ReadSaltChain(fs vfs.FS, dirname string, masterKey []byte) (map[base.FileNum][]byte, error) {
+	file, err := fs.Open(fs.PathJoin(dirname, SaltChainFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m := &KeyManager{masterKey: masterKey, salts: map[base.FileNum][]byte{}, markers: map[Marker]uint64{}}
+	if err := m.readChain(file); err != nil {
+		return nil, err
+	}
+	return m.salts, nil
+}
+
+// readChain reads and verifies the blocks of a SALTCHAIN. A partially written
+// last block can't be verified and is recorded in m.tornTail.
+func (m *KeyManager) readChain(r io.Reader) error {
+	var maxFileNum base.FileNum
 	for {
 		// read block
 		rawBlock := make([]byte, saltBlockSize)
-		_, err := io.ReadFull(m.saltFile, rawBlock)
+		n, err := io.ReadFull(r, rawBlock)
 		if err == io.EOF {
-			break
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			m.tornTail = &TornTail{Size: n, maxFileNum: maxFileNum, fileNumPrefix: rawBlock[:n]}
+			if n >= fileNumSize {
+				m.tornTail.FileNum = base.FileNum(binary.LittleEndian.Uint64(rawBlock))
+				m.tornTail.HasFileNum = true
+				m.tornTail.fileNumPrefix = rawBlock[:fileNumSize]
+			}
+			return nil
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 		var block saltBlock
 		if err := block.UnmarshalBinary(rawBlock); err != nil {
-			return nil, err
+			return err
 		}
 
 		// verify block's mac
 		mac, err := m.hmac(block.fileNum, block.salt, m.lastMAC)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if !hmac.Equal(mac, block.mac) {
-			return nil, errors.New("invalid mac")
+			return errors.New("invalid mac")
 		}
 
 		m.lastMAC = mac
-		m.salts[block.fileNum] = block.salt
+		if mk, ok := markerOf(block.fileNum); ok {
+			m.markers[mk] = binary.LittleEndian.Uint64(block.salt)
+		} else {
+			m.salts[block.fileNum] = block.salt
+			if block.fileNum > maxFileNum {
+				maxFileNum = block.fileNum
+			}
+		}
+		m.blocks++
 	}
-
-	return m, nil
 }
 
 // Close closes the KeyManager.
@@ -104,15 +276,41 @@ func (m *KeyManager) Close() error {
 	return m.saltFile.Close()
 }
 
+// Wipe overwrites the master key, the salts and all keys derived by m with
+// zeros. m may not be used afterwards. The keys that m returned are copies and
+// aren't affected.
+func (m *KeyManager) Wipe() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wipe(m.masterKey)
+	for _, salt := range m.salts {
+		wipe(salt)
+	}
+	for _, key := range m.keys {
+		wipe(key)
+	}
+	m.keys = map[base.FileNum][]byte{}
+}
+
 // Create creates a new key for writing a file.
 func (m *KeyManager) Create(fileNum base.FileNum) ([]byte, error) {
-	// prepare new block
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return m.Import(fileNum, salt)
+}
+
+// Import adds an existing salt for a file, e.g., one returned by Salt or
+// ReadSaltChain for a file that has been copied from another DB encrypted with
+// the same master key. It returns the file's key.
+func (m *KeyManager) Import(fileNum base.FileNum, salt []byte) ([]byte, error) {
+	if len(salt) != saltSize {
+		return nil, errors.New("invalid salt size")
+	}
 	block := saltBlock{
 		fileNum: fileNum,
-		salt:    make([]byte, saltSize),
-	}
-	if _, err := rand.Read(block.salt); err != nil {
-		return nil, err
+		salt:    append([]byte(nil), salt...),
 	}
 
 	// derive key
@@ -123,38 +321,222 @@ func (m *KeyManager) Create(fileNum base.FileNum) ([]byte, error) {
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
-
-	// calculate new block's mac
-	block.mac, err = m.hmac(fileNum, block.salt, m.lastMAC)
-	if err != nil {
+	if err := m.appendLocked(&block); err != nil {
 		return nil, err
 	}
+	m.salts[fileNum] = block.salt
+	m.keys[fileNum] = key
+	return append([]byte(nil), key...), nil
+}
+
+// Marker returns the value of the marker recorded in the SALTCHAIN, or false
+// if it hasn't been recorded.
+func (m *KeyManager) Marker(mk Marker) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.markers[mk]
+	return value, ok
+}
+
+// SetMarker records the value of the marker in the SALTCHAIN.
+func (m *KeyManager) SetMarker(mk Marker, value uint64) error {
+	block := markerBlock(mk, value)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.appendLocked(&block); err != nil {
+		return err
+	}
+	m.markers[mk] = value
+	return nil
+}
+
+// TornTail returns the partially written block at the end of the SALTCHAIN, or
+// false if there is none.
+func (m *KeyManager) TornTail() (TornTail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tornTail == nil {
+		return TornTail{}, false
+	}
+	return *m.tornTail, true
+}
 
-	// write block
+// DropTornTail drops the partially written block at the end of the SALTCHAIN
+// by atomically replacing the SALTCHAIN with one that only contains the
+// complete blocks. The caller must make sure that no file depends on the salt
+// of the partial block.
+func (m *KeyManager) DropTornTail() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tornTail == nil {
+		return nil
+	}
+	if err := m.rewriteLocked(); err != nil {
+		return err
+	}
+	m.tornTail = nil
+	return nil
+}
+
+// appendLocked calculates the MAC of the block and appends it to the
+// SALTCHAIN. m.mu must be held.
+func (m *KeyManager) appendLocked(block *saltBlock) error {
+	if m.tornTail != nil {
+		return errors.New("SALTCHAIN ends with a torn block")
+	}
+	var err error
+	block.mac, err = m.hmac(block.fileNum, block.salt, m.lastMAC)
+	if err != nil {
+		return err
+	}
 	rawBlock, err := block.MarshalBinary()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if _, err := m.saltFile.WriteApproved(rawBlock); err != nil {
-		return nil, err
+		return err
 	}
 	if err := m.saltFile.Sync(); err != nil {
-		return nil, err
+		return err
 	}
-
 	m.lastMAC = block.mac
-	m.salts[fileNum] = block.salt
+	m.blocks++
+	return nil
+}
 
-	return key, nil
+// FileNums returns the file numbers of the salts in ascending order.
+func (m *KeyManager) FileNums() []base.FileNum {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fileNums := make([]base.FileNum, 0, len(m.salts))
+	for fileNum := range m.salts {
+		fileNums = append(fileNums, fileNum)
+	}
+	sort.Slice(fileNums, func(i, j int) bool { return fileNums[i] < fileNums[j] })
+	return fileNums
 }
 
-// Get gets the key for reading a file.
+// Remove removes the salts of the given files, so that their keys can't be derived anymore, not even with the
+// master key. This crypto-shreds the files. The SALTCHAIN is rewritten without the removed salts and atomically
+// replaces the previous one.
+func (m *KeyManager) Remove(fileNums []base.FileNum) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed [][]byte
+	for _, fileNum := range fileNums {
+		if salt, ok := m.salts[fileNum]; ok {
+			delete(m.salts, fileNum)
+			removed = append(removed, salt)
+		}
+		if key, ok := m.keys[fileNum]; ok {
+			delete(m.keys, fileNum)
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if err := m.rewriteLocked(); err != nil {
+		return err
+	}
+
+	// don't keep the salts and keys in memory longer than necessary
+	for _, b := range removed {
+		wipe(b)
+	}
+	return nil
+}
+
+// rewriteLocked writes a new SALTCHAIN containing the current salts. m.mu must be held.
+func (m *KeyManager) rewriteLocked() error {
+	fileNums := make([]base.FileNum, 0, len(m.salts))
+	for fileNum := range m.salts {
+		fileNums = append(fileNums, fileNum)
+	}
+	sort.Slice(fileNums, func(i, j int) bool { return fileNums[i] < fileNums[j] })
+
+	blocks := make([]saltBlock, 0, len(fileNums)+len(m.markers))
+	for _, fileNum := range fileNums {
+		blocks = append(blocks, saltBlock{fileNum: fileNum, salt: m.salts[fileNum]})
+	}
+	// keep the recorded markers
+	for mk := Marker(0); mk < numMarkers; mk++ {
+		if value, ok := m.markers[mk]; ok {
+			blocks = append(blocks, markerBlock(mk, value))
+		}
+	}
+
+	var data []byte
+	var lastMAC []byte
+	for _, block := range blocks {
+		var err error
+		block.mac, err = m.hmac(block.fileNum, block.salt, lastMAC)
+		if err != nil {
+			return err
+		}
+		rawBlock, err := block.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		data = append(data, rawBlock...)
+		lastMAC = block.mac
+	}
+
+	// Write the new chain to a temp file and rename it. A leftover temp file from an interrupted rewrite is
+	// overwritten.
+	tempPath := m.fs.PathJoin(m.dirname, saltChainTempFilename)
+	file, err := m.fs.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteApproved(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := m.fs.Rename(tempPath, m.fs.PathJoin(m.dirname, SaltChainFilename)); err != nil {
+		_ = file.Close()
+		return err
+	}
+	dir, err := m.fs.OpenDir(m.dirname)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := errors.CombineErrors(dir.Sync(), dir.Close()); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	// continue appending to the new chain
+	oldFile := m.saltFile
+	m.saltFile = file
+	m.lastMAC = lastMAC
+	m.blocks = len(blocks)
+	return oldFile.Close()
+}
+
+// Get gets the key for reading a file. It returns a copy, so that a reader
+// still using the key isn't affected if Remove or Wipe overwrite the cached
+// key.
 func (m *KeyManager) Get(fileNum base.FileNum) ([]byte, error) {
 	m.mu.Lock()
-	salt, ok := m.salts[fileNum]
-	m.mu.Unlock()
-	if ok {
-		return m.derive(salt)
+	defer m.mu.Unlock()
+	if salt, ok := m.salts[fileNum]; ok {
+		key, ok := m.keys[fileNum]
+		if !ok {
+			var err error
+			if key, err = m.derive(salt); err != nil {
+				return nil, err
+			}
+			m.keys[fileNum] = key
+		}
+		return append([]byte(nil), key...), nil
 	}
 	if m.masterKey == nil && len(randomTestKey) == 16 {
 		return randomTestKey, nil
@@ -162,7 +544,52 @@ func (m *KeyManager) Get(fileNum base.FileNum) ([]byte, error) {
 	return nil, errors.New("fileNum not found")
 }
 
+// Salt returns a copy of the salt of a file, or false if the SALTCHAIN doesn't
+// contain it. The salt can be imported into the KeyManager of a copy of the
+// file's directory that uses the same master key.
+func (m *KeyManager) Salt(fileNum base.FileNum) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	salt, ok := m.salts[fileNum]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), salt...), true
+}
+
+// CipherSuite returns the name of the cipher used for the files whose keys are
+// managed by m.
+func (m *KeyManager) CipherSuite() string {
+	if m.plaintext {
+		return PlaintextCipherSuite
+	}
+	return CipherSuite(len(m.masterKey))
+}
+
+// Stats returns the encryption statistics of the files whose keys are managed
+// by m. Returns nil if m is nil.
+func (m *KeyManager) Stats() *Stats {
+	if m == nil {
+		return nil
+	}
+	return m.stats
+}
+
+// ChainStats returns statistics about the SALTCHAIN.
+func (m *KeyManager) ChainStats() ChainStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ChainStats{
+		Salts:          len(m.salts),
+		Size:           int64(m.blocks) * saltBlockSize,
+		VerifyDuration: m.verifyDuration,
+	}
+}
+
 func (m *KeyManager) derive(salt []byte) ([]byte, error) {
+	if m.plaintext {
+		return PlaintextKey(), nil
+	}
 	kdf := hkdf.New(sha256.New, m.masterKey, salt, nil)
 	key := make([]byte, len(m.masterKey))
 	if _, err := kdf.Read(key); err != nil {
@@ -171,6 +598,12 @@ func (m *KeyManager) derive(salt []byte) ([]byte, error) {
 	return key, nil
 }
 
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func (m *KeyManager) hmac(fileNum base.FileNum, salt []byte, previousMAC []byte) ([]byte, error) {
 	data := binary.LittleEndian.AppendUint64(nil, uint64(fileNum))
 	data = append(data, salt...)
@@ -188,6 +621,13 @@ type saltBlock struct {
 	mac     []byte // hmac(fileNum|salt|previousMAC)
 }
 
+// markerBlock returns a block that records the value of the marker.
+func markerBlock(mk Marker, value uint64) saltBlock {
+	salt := make([]byte, saltSize)
+	binary.LittleEndian.PutUint64(salt, value)
+	return saltBlock{fileNum: mk.fileNum(), salt: salt}
+}
+
 func (b saltBlock) MarshalBinary() ([]byte, error) {
 	data := binary.LittleEndian.AppendUint64(nil, uint64(b.fileNum))
 	data = append(data, b.salt...)
@@ -8,6 +8,10 @@ package edg
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
 	"testing"
 
 	"github.com/edgelesssys/estore/internal/base"
@@ -92,3 +96,294 @@ func TestKeyManager(t *testing.T) {
 	requireGet(km, 4, key4)
 	require.NoError(km.Close())
 }
+
+func TestKeyManagerRemove(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	masterKey := bytes.Repeat([]byte{2}, 16)
+
+	km, err := NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	var keys [4][]byte
+	for i := range keys {
+		keys[i], err = km.Create(base.FileNum(i))
+		require.NoError(err)
+	}
+
+	// Remove keys 1 and 2, and an unknown key
+	require.NoError(km.Remove([]base.FileNum{1, 2, 7}))
+	_, err = km.Get(1)
+	require.Error(err)
+	_, err = km.Get(2)
+	require.Error(err)
+
+	// Appending to the rewritten chain works
+	key4, err := km.Create(4)
+	require.NoError(err)
+	stats := km.ChainStats()
+	require.Equal(3, stats.Salts)
+	require.EqualValues(3*saltBlockSize, stats.Size)
+	require.NoError(km.Close())
+
+	// Removed keys stay removed after reopening
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	for _, n := range []base.FileNum{1, 2} {
+		_, err := km.Get(n)
+		require.Error(err)
+	}
+	for _, n := range []base.FileNum{0, 3} {
+		key, err := km.Get(n)
+		require.NoError(err)
+		require.Equal(keys[n], key)
+	}
+	key, err := km.Get(4)
+	require.NoError(err)
+	require.Equal(key4, key)
+	require.NoError(km.Close())
+
+	// A leftover temp file of an interrupted Remove is ignored
+	f, err := fs.Create(saltChainTempFilename)
+	require.NoError(err)
+	_, err = f.WriteApproved([]byte("garbage"))
+	require.NoError(err)
+	require.NoError(f.Close())
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	key, err = km.Get(4)
+	require.NoError(err)
+	require.Equal(key4, key)
+	require.NoError(km.Close())
+}
+
+func TestKeyManagerWipe(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	masterKey := bytes.Repeat([]byte{2}, 16)
+	zero := make([]byte, 16)
+
+	km, err := NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	key1, err := km.Create(1)
+	require.NoError(err)
+	require.NoError(km.Close())
+
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	key, err := km.Get(1)
+	require.NoError(err)
+	require.Equal(key1, key)
+	require.NoError(km.Close())
+	km.Wipe()
+
+	// the cached keys and the salts are wiped, but the handed out key and the
+	// caller's master key are untouched
+	require.Empty(km.keys)
+	for _, salt := range km.salts {
+		require.Equal(make([]byte, saltSize), salt)
+	}
+	require.Equal(key1, key)
+	require.NotEqual(zero, key)
+	require.Equal(bytes.Repeat([]byte{2}, 16), masterKey)
+}
+
+func TestKeyManagerGetRemove(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	masterKey := bytes.Repeat([]byte{2}, 16)
+
+	km, err := NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	created, err := km.Create(1)
+	require.NoError(err)
+	key, err := km.Get(1)
+	require.NoError(err)
+	expected := append([]byte(nil), key...)
+
+	// a reader that still uses the key isn't affected by the removal
+	require.NoError(km.Remove([]base.FileNum{1}))
+	require.Equal(expected, key)
+	require.Equal(expected, created)
+
+	// the key still works
+	block, err := aes.NewCipher(key)
+	require.NoError(err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(err)
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nil, nonce, []byte("data"), nil)
+	block, err = aes.NewCipher(expected)
+	require.NoError(err)
+	aead, err = cipher.NewGCM(block)
+	require.NoError(err)
+	opened, err := aead.Open(nil, nonce, sealed, nil)
+	require.NoError(err)
+	require.Equal([]byte("data"), opened)
+	require.NoError(km.Close())
+}
+
+func TestKeyManagerMarkers(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	masterKey := bytes.Repeat([]byte{2}, 16)
+
+	km, err := NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	_, ok := km.Marker(MarkerManifest)
+	require.False(ok)
+	_, err = km.Create(1)
+	require.NoError(err)
+	require.NoError(km.SetMarker(MarkerManifest, 1))
+	require.NoError(km.SetMarker(MarkerFormatVersion, 16))
+	_, err = km.Create(2)
+	require.NoError(err)
+	require.NoError(km.SetMarker(MarkerManifest, 2))
+	require.NoError(km.Close())
+
+	// markers are read from the chain, and aren't salts
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	value, ok := km.Marker(MarkerManifest)
+	require.True(ok)
+	require.EqualValues(2, value)
+	value, ok = km.Marker(MarkerFormatVersion)
+	require.True(ok)
+	require.EqualValues(16, value)
+	require.Equal(2, km.ChainStats().Salts)
+	_, err = km.Get(MarkerManifest.fileNum())
+	require.Error(err)
+
+	// markers survive rewrites
+	require.NoError(km.Remove([]base.FileNum{1}))
+	require.EqualValues(3*saltBlockSize, km.ChainStats().Size)
+	require.NoError(km.Close())
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	value, ok = km.Marker(MarkerManifest)
+	require.True(ok)
+	require.EqualValues(2, value)
+	value, ok = km.Marker(MarkerFormatVersion)
+	require.True(ok)
+	require.EqualValues(16, value)
+	salt, ok := km.Salt(2)
+	require.True(ok)
+	_, ok = km.Salt(1)
+	require.False(ok)
+	_, ok = km.Salt(MarkerManifest.fileNum())
+	require.False(ok)
+	require.NoError(km.Close())
+
+	salts, err := ReadSaltChain(fs, "", masterKey)
+	require.NoError(err)
+	require.Len(salts, 1)
+	require.Equal(salt, salts[2])
+}
+
+func TestKeyManagerTornTail(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	masterKey := bytes.Repeat([]byte{2}, 16)
+
+	// rewriteChain replaces the SALTCHAIN with mutate(SALTCHAIN)
+	rewriteChain := func(mutate func([]byte) []byte) {
+		f, err := fs.Open(SaltChainFilename)
+		require.NoError(err)
+		data, err := io.ReadAll(f)
+		require.NoError(err)
+		require.NoError(f.Close())
+		f, err = fs.Create(SaltChainFilename)
+		require.NoError(err)
+		_, err = f.WriteApproved(mutate(data))
+		require.NoError(err)
+		require.NoError(f.Close())
+	}
+	// appendPartial appends the first n bytes of a block for the file
+	appendPartial := func(fileNum base.FileNum, n int) {
+		rewriteChain(func(data []byte) []byte {
+			block := binary.LittleEndian.AppendUint64(nil, uint64(fileNum))
+			block = append(block, bytes.Repeat([]byte{1}, saltBlockSize)...)
+			return append(data, block[:n]...)
+		})
+	}
+
+	km, err := NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	key1, err := km.Create(1)
+	require.NoError(err)
+	key2, err := km.Create(2)
+	require.NoError(err)
+	_, ok := km.TornTail()
+	require.False(ok)
+	require.NoError(km.Close())
+
+	// the file number of the partial block is known
+	appendPartial(3, 20)
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	torn, ok := km.TornTail()
+	require.True(ok)
+	require.Equal(20, torn.Size)
+	require.True(torn.HasFileNum)
+	require.EqualValues(3, torn.FileNum)
+	require.True(torn.MayBelongTo(3))
+	require.False(torn.MayBelongTo(4))
+	require.False(torn.MayRecord(MarkerManifest))
+
+	// nothing can be appended until the partial block is dropped
+	_, err = km.Create(4)
+	require.Error(err)
+	require.NoError(km.DropTornTail())
+	_, ok = km.TornTail()
+	require.False(ok)
+	key4, err := km.Create(4)
+	require.NoError(err)
+	require.NoError(km.Close())
+
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	_, ok = km.TornTail()
+	require.False(ok)
+	for fileNum, key := range map[base.FileNum][]byte{1: key1, 2: key2, 4: key4} {
+		got, err := km.Get(fileNum)
+		require.NoError(err)
+		require.Equal(key, got)
+	}
+	require.NoError(km.Close())
+
+	// the file number of the partial block is unknown
+	appendPartial(5, 4)
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	torn, ok = km.TornTail()
+	require.True(ok)
+	require.False(torn.HasFileNum)
+	require.False(torn.MayBelongTo(4))
+	require.True(torn.MayBelongTo(5))
+	require.False(torn.MayRecord(MarkerManifest))
+	require.NoError(km.Close())
+
+	// a partial block that may record a marker
+	rewriteChain(func(data []byte) []byte { return data[:len(data)-4] })
+	appendPartial(MarkerManifest.fileNum(), 3)
+	km, err = NewKeyManager(fs, "", masterKey)
+	require.NoError(err)
+	torn, ok = km.TornTail()
+	require.True(ok)
+	require.True(torn.MayRecord(MarkerManifest))
+	require.False(torn.MayRecord(MarkerFormatVersion))
+	require.NoError(km.Close())
+
+	// ReadSaltChain ignores the partial block
+	salts, err := ReadSaltChain(fs, "", masterKey)
+	require.NoError(err)
+	require.Len(salts, 3)
+
+	// a complete block that fails verification is still an error
+	rewriteChain(func(data []byte) []byte {
+		data = data[:len(data)-3]
+		data[len(data)-1] ^= 1
+		return data
+	})
+	_, err = NewKeyManager(fs, "", masterKey)
+	require.ErrorContains(err, "invalid mac")
+}
@@ -0,0 +1,414 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package edg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/vfs"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyringFilename is the name of the file next to the SALTCHAIN that holds the
+// wrapped master key.
+const KeyringFilename = "KEYRING"
+
+const (
+	keyringMagic = "EDGKEYR1"
+
+	// minRecoveryRSABits is the minimum size of an RSA recovery key.
+	minRecoveryRSABits = 2048
+)
+
+var (
+	// keyringContext is the additional data of the master key wrapped by the
+	// primary Sealer and the label of RSA-OAEP.
+	keyringContext = []byte("estore master key")
+	// keyringMACInfo is the HKDF info of the key that authenticates the keyring.
+	keyringMACInfo = []byte("estore keyring mac")
+	// keyringX25519Info is the HKDF info of the key-encryption key of X25519
+	// recovery keys.
+	keyringX25519Info = []byte("estore keyring x25519")
+)
+
+// Sealer seals data so that only the same or an authorized party can unseal
+// it. The additional data is authenticated, but not stored in the sealed data.
+type Sealer interface {
+	// Seal encrypts and authenticates plaintext and additionalData.
+	Seal(plaintext, additionalData []byte) ([]byte, error)
+	// Unseal decrypts sealed data that Seal returned for the same
+	// additionalData.
+	Unseal(sealed, additionalData []byte) ([]byte, error)
+}
+
+type wrapType uint8
+
+const (
+	wrapPrimary wrapType = iota + 1
+	wrapRSAOAEP
+	wrapX25519
+)
+
+// keyringEntry is the master key wrapped by one key-encryption key.
+type keyringEntry struct {
+	typ wrapType
+	// publicKey is the PKIX encoding of the recovery key. It's empty for the
+	// primary entry.
+	publicKey []byte
+	wrapped   []byte
+}
+
+// Keyring holds the master key wrapped by several independent key-encryption
+// keys: a primary Sealer, e.g., bound to the enclave, and recovery public keys,
+// whose private keys are kept offline. Any of them can unwrap the master key,
+// so that the DB can be recovered if the primary sealing key changes.
+//
+// The keyring is authenticated with a key derived from the master key. It's
+// verified by Unseal and Recover after the master key has been unwrapped.
+type Keyring struct {
+	entries []keyringEntry
+	mac     []byte
+	// authenticated is the part of the encoded keyring covered by mac.
+	authenticated []byte
+}
+
+// NewKeyring wraps masterKey with primary and each of the recovery keys, which
+// must be *rsa.PublicKey or *ecdh.PublicKey of curve X25519.
+func NewKeyring(masterKey []byte, primary Sealer, recoveryKeys []crypto.PublicKey) (*Keyring, error) {
+	sealed, err := primary.Seal(masterKey, keyringContext)
+	if err != nil {
+		return nil, errors.Wrap(err, "sealing master key")
+	}
+	k := &Keyring{entries: []keyringEntry{{typ: wrapPrimary, wrapped: sealed}}}
+	for _, pub := range recoveryKeys {
+		entry, err := wrapForRecovery(masterKey, pub)
+		if err != nil {
+			return nil, err
+		}
+		k.entries = append(k.entries, entry)
+	}
+	k.authenticated = k.encodeEntries()
+	k.mac, err = keyringMAC(masterKey, k.authenticated)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ReadKeyring reads the keyring in dirname. It isn't authenticated until it has
+// been unwrapped by Unseal or Recover.
+func ReadKeyring(fs vfs.FS, dirname string) (*Keyring, error) {
+	f, err := fs.Open(fs.PathJoin(dirname, KeyringFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKeyring(data)
+}
+
+// Write atomically writes the keyring to dirname.
+func (k *Keyring) Write(fs vfs.FS, dirname string) error {
+	data := append(bytes.Clone(k.authenticated), k.mac...)
+	path := fs.PathJoin(dirname, KeyringFilename)
+	tempPath := path + ".tmp"
+	f, err := fs.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteApproved(data); err != nil {
+		return errors.CombineErrors(err, f.Close())
+	}
+	if err := f.Sync(); err != nil {
+		return errors.CombineErrors(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tempPath, path); err != nil {
+		return err
+	}
+	dir, err := fs.OpenDir(dirname)
+	if err != nil {
+		return err
+	}
+	return errors.CombineErrors(dir.Sync(), dir.Close())
+}
+
+// Unseal unwraps the master key with the primary Sealer.
+func (k *Keyring) Unseal(primary Sealer) ([]byte, error) {
+	for _, entry := range k.entries {
+		if entry.typ != wrapPrimary {
+			continue
+		}
+		masterKey, err := primary.Unseal(entry.wrapped, keyringContext)
+		if err != nil {
+			return nil, errors.Wrap(err, "unsealing master key")
+		}
+		return masterKey, k.verify(masterKey)
+	}
+	return nil, errors.New("keyring has no primary key")
+}
+
+// Recover unwraps the master key with the private key of one of the recovery
+// keys, which must be *rsa.PrivateKey or *ecdh.PrivateKey.
+func (k *Keyring) Recover(recoveryKey crypto.PrivateKey) ([]byte, error) {
+	signer, ok := recoveryKey.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return nil, errors.Newf("unsupported recovery key type %T", recoveryKey)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range k.entries {
+		if entry.typ == wrapPrimary || !bytes.Equal(entry.publicKey, publicKey) {
+			continue
+		}
+		masterKey, err := unwrapForRecovery(entry, recoveryKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "unwrapping master key with recovery key")
+		}
+		return masterKey, k.verify(masterKey)
+	}
+	return nil, errors.New("keyring has no entry for the recovery key")
+}
+
+// RecoveryKeys returns the recovery public keys of the keyring.
+func (k *Keyring) RecoveryKeys() ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, entry := range k.entries {
+		if entry.typ == wrapPrimary {
+			continue
+		}
+		pub, err := x509.ParsePKIXPublicKey(entry.publicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+// verify checks the MAC of the keyring with a key derived from masterKey.
+func (k *Keyring) verify(masterKey []byte) error {
+	mac, err := keyringMAC(masterKey, k.authenticated)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, k.mac) {
+		return errors.New("keyring failed authentication")
+	}
+	return nil
+}
+
+func keyringMAC(masterKey, data []byte) ([]byte, error) {
+	macKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, keyringMACInfo), macKey); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// encodeEntries returns magic | uint32 count | entries, where an entry is
+// uint8 type | uint32 len | publicKey | uint32 len | wrapped.
+func (k *Keyring) encodeEntries() []byte {
+	data := []byte(keyringMagic)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(k.entries)))
+	for _, entry := range k.entries {
+		data = append(data, byte(entry.typ))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(entry.publicKey)))
+		data = append(data, entry.publicKey...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(entry.wrapped)))
+		data = append(data, entry.wrapped...)
+	}
+	return data
+}
+
+func decodeKeyring(data []byte) (*Keyring, error) {
+	errInvalid := errors.New("invalid keyring")
+	if len(data) < len(keyringMagic)+4+sha256.Size || string(data[:len(keyringMagic)]) != keyringMagic {
+		return nil, errInvalid
+	}
+	k := &Keyring{
+		authenticated: data[:len(data)-sha256.Size],
+		mac:           data[len(data)-sha256.Size:],
+	}
+	rest := k.authenticated[len(keyringMagic):]
+	count := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	// readBytes reads a length-prefixed byte string
+	readBytes := func() ([]byte, bool) {
+		if len(rest) < 4 {
+			return nil, false
+		}
+		n := uint64(binary.LittleEndian.Uint32(rest))
+		if uint64(len(rest)-4) < n {
+			return nil, false
+		}
+		b := rest[4 : 4+n]
+		rest = rest[4+n:]
+		return b, true
+	}
+	for i := uint32(0); i < count; i++ {
+		if len(rest) < 1 {
+			return nil, errInvalid
+		}
+		entry := keyringEntry{typ: wrapType(rest[0])}
+		rest = rest[1:]
+		var ok1, ok2 bool
+		entry.publicKey, ok1 = readBytes()
+		entry.wrapped, ok2 = readBytes()
+		if !ok1 || !ok2 {
+			return nil, errInvalid
+		}
+		k.entries = append(k.entries, entry)
+	}
+	if len(rest) != 0 {
+		return nil, errInvalid
+	}
+	return k, nil
+}
+
+// wrapForRecovery wraps masterKey with a recovery public key.
+func wrapForRecovery(masterKey []byte, recoveryKey crypto.PublicKey) (keyringEntry, error) {
+	publicKey, err := x509.MarshalPKIXPublicKey(recoveryKey)
+	if err != nil {
+		return keyringEntry{}, err
+	}
+	entry := keyringEntry{publicKey: publicKey}
+	switch pub := recoveryKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < minRecoveryRSABits {
+			return keyringEntry{}, errors.Newf("RSA recovery key must have at least %d bits", minRecoveryRSABits)
+		}
+		entry.typ = wrapRSAOAEP
+		entry.wrapped, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, masterKey, keyringContext)
+		if err != nil {
+			return keyringEntry{}, err
+		}
+	case *ecdh.PublicKey:
+		if pub.Curve() != ecdh.X25519() {
+			return keyringEntry{}, errors.New("ECDH recovery key must use X25519")
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return keyringEntry{}, err
+		}
+		kek, err := x25519KEK(ephemeral, pub, ephemeral.PublicKey())
+		if err != nil {
+			return keyringEntry{}, err
+		}
+		wrapped, err := SealGCM(kek, masterKey, keyringContext)
+		if err != nil {
+			return keyringEntry{}, err
+		}
+		entry.typ = wrapX25519
+		entry.wrapped = append(ephemeral.PublicKey().Bytes(), wrapped...)
+	default:
+		return keyringEntry{}, errors.Newf("unsupported recovery key type %T", recoveryKey)
+	}
+	return entry, nil
+}
+
+// unwrapForRecovery unwraps the master key of the entry with a recovery
+// private key.
+func unwrapForRecovery(entry keyringEntry, recoveryKey crypto.PrivateKey) ([]byte, error) {
+	switch {
+	case entry.typ == wrapRSAOAEP:
+		priv, ok := recoveryKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("entry requires an RSA key")
+		}
+		return rsa.DecryptOAEP(sha256.New(), nil, priv, entry.wrapped, keyringContext)
+	case entry.typ == wrapX25519:
+		priv, ok := recoveryKey.(*ecdh.PrivateKey)
+		if !ok {
+			return nil, errors.New("entry requires an X25519 key")
+		}
+		const ephemeralSize = 32
+		if len(entry.wrapped) < ephemeralSize {
+			return nil, errors.New("wrapped key is too short")
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(entry.wrapped[:ephemeralSize])
+		if err != nil {
+			return nil, err
+		}
+		kek, err := x25519KEK(priv, ephemeral, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		return OpenGCM(kek, entry.wrapped[ephemeralSize:], keyringContext)
+	default:
+		return nil, errors.Newf("unknown keyring entry type %d", entry.typ)
+	}
+}
+
+// x25519KEK derives a key-encryption key from the shared secret of priv and
+// peer. The ephemeral public key is bound to the key.
+func x25519KEK(priv *ecdh.PrivateKey, peer, ephemeral *ecdh.PublicKey) ([]byte, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	kek := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, ephemeral.Bytes(), keyringX25519Info), kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// SealGCM encrypts plaintext with AES-GCM and a random nonce. The result is
+// nonce|ciphertext. Unlike GetCipher, it always encrypts.
+func SealGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// OpenGCM decrypts data that SealGCM returned.
+func OpenGCM(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
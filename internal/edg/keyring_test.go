@@ -0,0 +1,100 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package edg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// testSealer seals with a fixed key.
+type testSealer []byte
+
+func (s testSealer) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	return SealGCM(s, plaintext, additionalData)
+}
+
+func (s testSealer) Unseal(sealed, additionalData []byte) ([]byte, error) {
+	return OpenGCM(s, sealed, additionalData)
+}
+
+func TestKeyring(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	masterKey := bytes.Repeat([]byte{2}, 16)
+	primary := testSealer(bytes.Repeat([]byte{3}, 16))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(err)
+	otherKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(err)
+
+	// recovery keys must be strong enough
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(err)
+	_, err = NewKeyring(masterKey, primary, []crypto.PublicKey{&weakKey.PublicKey})
+	require.Error(err)
+	p256Key, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(err)
+	_, err = NewKeyring(masterKey, primary, []crypto.PublicKey{p256Key.PublicKey()})
+	require.Error(err)
+
+	keyring, err := NewKeyring(masterKey, primary, []crypto.PublicKey{&rsaKey.PublicKey, x25519Key.PublicKey()})
+	require.NoError(err)
+	require.NoError(keyring.Write(fs, ""))
+	keyring, err = ReadKeyring(fs, "")
+	require.NoError(err)
+
+	// any of the key-encryption keys unwraps the master key
+	key, err := keyring.Unseal(primary)
+	require.NoError(err)
+	require.Equal(masterKey, key)
+	for _, recoveryKey := range []crypto.PrivateKey{rsaKey, x25519Key} {
+		key, err = keyring.Recover(recoveryKey)
+		require.NoError(err)
+		require.Equal(masterKey, key)
+	}
+	_, err = keyring.Recover(otherKey)
+	require.Error(err)
+	_, err = keyring.Unseal(testSealer(bytes.Repeat([]byte{4}, 16)))
+	require.Error(err)
+
+	recoveryKeys, err := keyring.RecoveryKeys()
+	require.NoError(err)
+	require.Len(recoveryKeys, 2)
+	require.True(rsaKey.PublicKey.Equal(recoveryKeys[0]))
+	require.True(x25519Key.PublicKey().Equal(recoveryKeys[1]))
+
+	// an entry for another key can't be added without the master key
+	forged, err := NewKeyring(bytes.Repeat([]byte{5}, 16), primary, []crypto.PublicKey{otherKey.PublicKey()})
+	require.NoError(err)
+	keyring.entries = append(keyring.entries, forged.entries[1])
+	keyring.authenticated = keyring.encodeEntries()
+	require.NoError(keyring.Write(fs, ""))
+	keyring, err = ReadKeyring(fs, "")
+	require.NoError(err)
+	_, err = keyring.Unseal(primary)
+	require.ErrorContains(err, "authentication")
+	_, err = keyring.Recover(rsaKey)
+	require.ErrorContains(err, "authentication")
+
+	// a truncated keyring is invalid
+	data := append(bytes.Clone(keyring.authenticated), keyring.mac...)
+	for i := range data {
+		_, err := decodeKeyring(data[:i])
+		require.Error(err)
+	}
+}
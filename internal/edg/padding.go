@@ -0,0 +1,20 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package edg
+
+// PaddingLen returns the number of bytes that must be appended to n bytes so
+// that the total is a multiple of granularity. It returns 0 if granularity is
+// not positive.
+func PaddingLen(n, granularity int) int {
+	if granularity <= 0 {
+		return 0
+	}
+	if rem := n % granularity; rem != 0 {
+		return granularity - rem
+	}
+	return 0
+}
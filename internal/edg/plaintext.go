@@ -0,0 +1,77 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package edg
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cockroachdb/errors"
+)
+
+// PlaintextCipherSuite is the cipher suite of a DB that has been created with
+// Options.Insecure_DisableEncryption.
+const PlaintextCipherSuite = "none"
+
+// plaintextKey is the key of the files of a DB that isn't encrypted, for
+// which GetCipher returns plaintextAEAD. Its length is no valid AES key size,
+// so it can't be confused with a real key. A KeyManager created with
+// NewPlaintextKeyManager also uses it as its master key to authenticate the
+// SALTCHAIN.
+const plaintextKey = "INSECURE-PLAINTEXT"
+
+// PlaintextKey returns the file key that disables encryption. NewKeyManager
+// rejects it as a master key.
+func PlaintextKey() []byte {
+	return []byte(plaintextKey)
+}
+
+// IsPlaintextKey returns whether key is the key returned by PlaintextKey.
+func IsPlaintextKey(key []byte) bool {
+	return string(key) == plaintextKey
+}
+
+// plaintextAEAD is the cipher.AEAD of a DB that isn't encrypted. It has the
+// same nonce size and overhead as AES-GCM, so that the file formats don't
+// change, but it stores the plaintext followed by a checksum instead of the
+// ciphertext and the tag. The checksum only detects corruption; it doesn't
+// authenticate anything.
+type plaintextAEAD struct{}
+
+func (plaintextAEAD) NonceSize() int { return 12 }
+func (plaintextAEAD) Overhead() int  { return GCMTagSize }
+
+func (a plaintextAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	tag := a.tag(nonce, plaintext, additionalData)
+	// dst may overlap plaintext, as with AES-GCM
+	ret := append(dst, plaintext...)
+	return append(ret, tag[:]...)
+}
+
+func (a plaintextAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < GCMTagSize {
+		return nil, errors.New("plaintext: checksum mismatch")
+	}
+	plaintext, tag := ciphertext[:len(ciphertext)-GCMTagSize], ciphertext[len(ciphertext)-GCMTagSize:]
+	want := a.tag(nonce, plaintext, additionalData)
+	if !bytes.Equal(tag, want[:]) {
+		return nil, errors.New("plaintext: checksum mismatch")
+	}
+	return append(dst, plaintext...), nil
+}
+
+func (plaintextAEAD) tag(nonce, plaintext, additionalData []byte) [GCMTagSize]byte {
+	d := xxhash.New()
+	_, _ = d.Write(nonce)
+	_, _ = d.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(additionalData))))
+	_, _ = d.Write(additionalData)
+	_, _ = d.Write(plaintext)
+	var tag [GCMTagSize]byte
+	binary.LittleEndian.PutUint64(tag[:], d.Sum64())
+	return tag
+}
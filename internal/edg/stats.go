@@ -0,0 +1,144 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package edg
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/edgelesssys/estore/internal/base"
+)
+
+// FileType is the type of an encrypted file.
+type FileType int
+
+// The types of encrypted files.
+const (
+	FileTypeTable FileType = iota
+	FileTypeWAL
+	FileTypeManifest
+	FileTypeOptions
+	NumFileTypes
+)
+
+func (t FileType) String() string {
+	switch t {
+	case FileTypeTable:
+		return "sstable"
+	case FileTypeWAL:
+		return "WAL"
+	case FileTypeManifest:
+		return "MANIFEST"
+	case FileTypeOptions:
+		return "OPTIONS"
+	}
+	return "unknown"
+}
+
+// maxRecentAuthFailures is the number of authentication failures kept by Stats.
+const maxRecentAuthFailures = 16
+
+// AuthFailure describes a ciphertext that failed AEAD authentication.
+type AuthFailure struct {
+	FileType FileType
+	FileNum  base.FileNum
+	// Offset is the offset of the block in the file. For WAL and MANIFEST
+	// files, it is the offset of the chunk.
+	Offset int64
+}
+
+// Stats collects encryption statistics. All methods are safe for concurrent
+// use.
+type Stats struct {
+	files [NumFileTypes]FileStats
+	mu    struct {
+		sync.Mutex
+		authFailures       uint64
+		recentAuthFailures []AuthFailure
+	}
+}
+
+// NewStats creates a new Stats.
+func NewStats() *Stats {
+	s := &Stats{}
+	for i := range s.files {
+		s.files[i].stats = s
+		s.files[i].fileType = FileType(i)
+	}
+	return s
+}
+
+// File returns the stats for files of type t. Returns nil if s is nil.
+func (s *Stats) File(t FileType) *FileStats {
+	if s == nil {
+		return nil
+	}
+	return &s.files[t]
+}
+
+// AuthFailures returns the number of authentication failures and the most
+// recent ones.
+func (s *Stats) AuthFailures() (uint64, []AuthFailure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.authFailures, append([]AuthFailure(nil), s.mu.recentAuthFailures...)
+}
+
+// FileStats counts the bytes encrypted, decrypted and padded for one file
+// type. A nil *FileStats is valid and counts nothing.
+type FileStats struct {
+	stats    *Stats
+	fileType FileType
+	// BytesEncrypted is the number of plaintext bytes that have been encrypted.
+	BytesEncrypted atomic.Uint64
+	// BytesDecrypted is the number of plaintext bytes that have been decrypted.
+	BytesDecrypted atomic.Uint64
+	// BytesPadded is the number of bytes that have been written to hide the
+	// lengths of blocks and records.
+	BytesPadded atomic.Uint64
+}
+
+// Encrypted records that n bytes have been encrypted.
+func (f *FileStats) Encrypted(n int) {
+	if f != nil {
+		f.BytesEncrypted.Add(uint64(n))
+	}
+}
+
+// Decrypted records that n bytes have been decrypted.
+func (f *FileStats) Decrypted(n int) {
+	if f != nil {
+		f.BytesDecrypted.Add(uint64(n))
+	}
+}
+
+// Padded records that n bytes of padding have been written.
+func (f *FileStats) Padded(n int) {
+	if f != nil {
+		f.BytesPadded.Add(uint64(n))
+	}
+}
+
+// AuthFailed records that the block at offset of file fileNum failed
+// authentication.
+func (f *FileStats) AuthFailed(fileNum base.FileNum, offset int64) {
+	if f == nil {
+		return
+	}
+	s := f.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.authFailures++
+	if len(s.mu.recentAuthFailures) == maxRecentAuthFailures {
+		s.mu.recentAuthFailures = append(s.mu.recentAuthFailures[:0], s.mu.recentAuthFailures[1:]...)
+	}
+	s.mu.recentAuthFailures = append(s.mu.recentAuthFailures, AuthFailure{
+		FileType: f.fileType,
+		FileNum:  fileNum,
+		Offset:   offset,
+	})
+}
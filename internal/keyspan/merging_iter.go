@@ -1068,7 +1068,7 @@ func (m *MergingIter) prevEntry() {
 // merging iterator and its heap for debugging purposes.
 func (m *MergingIter) DebugString() string {
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "Current bounds: [%q, %q)\n", m.start, m.end)
+	fmt.Fprintf(&buf, "Current bounds: [%q, %q)\n", base.UserData(m.start), base.UserData(m.end))
 	for i := range m.levels {
 		fmt.Fprintf(&buf, "%d: heap key %s\n", i, m.levels[i].heapKey)
 	}
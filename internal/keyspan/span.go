@@ -382,17 +382,22 @@ func (s prettySpan) Format(fs fmt.State, c rune) {
 		fmt.Fprintf(fs, "<invalid>")
 		return
 	}
-	fmt.Fprintf(fs, "%s-%s:{", s.formatKey(s.Start), s.formatKey(s.End))
+	formatKey := s.formatKey
+	if base.Redacted() {
+		// EDG: custom formatters don't know about redaction
+		formatKey = base.DefaultFormatter
+	}
+	fmt.Fprintf(fs, "%s-%s:{", formatKey(s.Start), formatKey(s.End))
 	for i, k := range s.Keys {
 		if i > 0 {
 			fmt.Fprint(fs, " ")
 		}
 		fmt.Fprintf(fs, "(#%d,%s", k.SeqNum(), k.Kind())
 		if len(k.Suffix) > 0 || len(k.Value) > 0 {
-			fmt.Fprintf(fs, ",%s", k.Suffix)
+			fmt.Fprintf(fs, ",%s", base.UserData(k.Suffix))
 		}
 		if len(k.Value) > 0 {
-			fmt.Fprintf(fs, ",%s", k.Value)
+			fmt.Fprintf(fs, ",%s", base.UserData(k.Value))
 		}
 		fmt.Fprint(fs, ")")
 	}
@@ -82,6 +82,9 @@ func TestLint(t *testing.T) {
 			stream.Sequence(
 				dirCmd(t, pkg.Dir, cmdGo, args...),
 				stream.GrepNot("go: downloading"),
+				// The underscore deliberately makes the insecure option stand out
+				// wherever it's set.
+				stream.GrepNot(`options\.go:.*Insecure_DisableEncryption should be InsecureDisableEncryption`),
 			), func(s string) {
 				t.Errorf("\n%s", s)
 			}); err != nil {
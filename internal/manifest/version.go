@@ -71,6 +71,10 @@ type TableStats struct {
 	RangeDeletionsBytesEstimate uint64
 	// Total size of value blocks and value index block.
 	ValueBlocksSize uint64
+	// EDG: The latest expiry of the table's point keys in Unix nanoseconds. It
+	// is zero if the table wasn't written with TTL enabled, or if any of its
+	// point keys doesn't expire.
+	TTLMaxExpiry uint64
 }
 
 // boundType represents the type of key (point or range) present as the smallest
@@ -48,12 +48,14 @@ func New(n int) []byte {
 	return (*[MaxArrayLen]byte)(unsafe.Pointer(ptr))[:n:n]
 }
 
-// Free frees the specified slice.
+// Free frees the specified slice. If zeroization is enabled, the memory is
+// overwritten with zeros first.
 func Free(b []byte) {
 	if cap(b) != 0 {
 		if len(b) == 0 {
 			b = b[:cap(b)]
 		}
+		Scrub(b)
 		ptr := unsafe.Pointer(&b[0])
 		C.free(ptr)
 	}
@@ -15,6 +15,8 @@ func New(n int) []byte {
 	return make([]byte, n)
 }
 
-// Free frees the specified slice.
+// Free frees the specified slice. If zeroization is enabled, the memory is
+// overwritten with zeros, because the garbage collector doesn't clear it.
 func Free(b []byte) {
+	Scrub(b)
 }
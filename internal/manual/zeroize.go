@@ -0,0 +1,42 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package manual
+
+import "sync/atomic"
+
+var zeroize atomic.Bool
+
+// EnableZeroization makes Free and Scrub overwrite memory with zeros, so that
+// plaintext doesn't linger in freed memory, e.g., in core dumps or swapped
+// pages. It applies to the whole process and can't be disabled, because the
+// block cache may be shared by several DBs.
+func EnableZeroization() {
+	zeroize.Store(true)
+}
+
+// Zeroization returns whether zeroization is enabled.
+func Zeroization() bool {
+	return zeroize.Load()
+}
+
+// Scrub overwrites the whole capacity of b with zeros if zeroization is
+// enabled.
+func Scrub(b []byte) {
+	if !zeroize.Load() {
+		return
+	}
+	b = b[:cap(b)]
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// TestDisableZeroization disables zeroization again, so that a test that
+// enables it doesn't affect other tests.
+func TestDisableZeroization() {
+	zeroize.Store(false)
+}
@@ -0,0 +1,13 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package private
+
+// ObserveKeyManager is a func(*estore.Options, func(*edg.KeyManager)) hook
+// that makes Open pass the KeyManager of the DB to the given function. It's
+// used by the workload collector to look up the salts of the files it
+// captures. It's an untyped interface{} to avoid a cyclic dependency.
+var ObserveKeyManager interface{}
@@ -267,6 +267,10 @@ type Iterator struct {
 	// During SetOptions on an iterator over an indexed batch, this field is
 	// used to update the merging iterator's batch snapshot.
 	merging *mergingIter
+	// EDG: ttlNow is the time in Unix nanoseconds at which the iterator checks
+	// keys for expiry, or 0 if TTL is disabled. If set, ttl wraps pointIter.
+	ttlNow uint64
+	ttl    ttlIter
 
 	// Keeping the bools here after all the 8 byte aligned fields shrinks the
 	// sizeof this struct by 24 bytes.
@@ -1778,7 +1782,7 @@ func (i *Iterator) nextPrefix() IterValidityState {
 			i.iterKey, i.iterValue = i.iter.Next()
 			if invariants.Enabled && !i.equal(i.iterKey.UserKey, i.key) {
 				i.opts.logger.Fatalf("pebble: invariant violation: Nexting internal iterator from iterPosPrev landed on %q, not %q",
-					i.iterKey.UserKey, i.key)
+					base.UserData(i.iterKey.UserKey), base.UserData(i.key))
 			}
 		}
 		// The internal iterator is now positioned at i.key. Advance to the next
@@ -1824,7 +1828,7 @@ func (i *Iterator) internalNextPrefix(currKeyPrefixLen int) {
 	if invariants.Enabled && i.iterKey != nil {
 		if iterKeyPrefixLen := i.split(i.iterKey.UserKey); i.cmp(i.iterKey.UserKey[:iterKeyPrefixLen], i.prefixOrFullSeekKey) < 0 {
 			panic(errors.AssertionFailedf("pebble: iter.NextPrefix did not advance beyond the current prefix: now at %q; expected to be geq %q",
-				i.iterKey, i.prefixOrFullSeekKey))
+				i.iterKey, base.UserData(i.prefixOrFullSeekKey)))
 		}
 	}
 }
@@ -2491,10 +2495,12 @@ func (i *Iterator) SetOptions(o *IterOptions) {
 		o.TableFilter != nil || i.opts.TableFilter != nil
 
 	// If either options specify block property filters for an iterator stack,
-	// reconstruct it.
+	// reconstruct it. EDG: The table iterators use the prefetcher, so also
+	// reconstruct it if the prefetch options change.
 	if i.pointIter != nil && (closeBoth || len(o.PointKeyFilters) > 0 || len(i.opts.PointKeyFilters) > 0 ||
 		o.RangeKeyMasking.Filter != nil || i.opts.RangeKeyMasking.Filter != nil || o.SkipPoint != nil ||
-		i.opts.SkipPoint != nil) {
+		i.opts.SkipPoint != nil ||
+		o.PrefetchBlocks != i.opts.PrefetchBlocks || o.PrefetchMemory != i.opts.PrefetchMemory) {
 		i.err = firstError(i.err, i.pointIter.Close())
 		i.pointIter = nil
 	}
@@ -2594,7 +2600,8 @@ func (i *Iterator) SetOptions(o *IterOptions) {
 		(i.pointIter != nil || !i.opts.pointKeys()) &&
 		(i.rangeKey != nil || !i.opts.rangeKeys() || i.opts.KeyTypes == IterKeyTypePointsAndRanges) &&
 		i.equal(o.RangeKeyMasking.Suffix, i.opts.RangeKeyMasking.Suffix) &&
-		o.UseL6Filters == i.opts.UseL6Filters {
+		o.UseL6Filters == i.opts.UseL6Filters &&
+		o.PrefetchBlocks == i.opts.PrefetchBlocks && o.PrefetchMemory == i.opts.PrefetchMemory {
 		// The options are identical, so we can likely use the fast path. In
 		// addition to all the above constraints, we cannot use the fast path if
 		// configured to perform lazy combined iteration but an indexed batch
@@ -2609,6 +2616,10 @@ func (i *Iterator) SetOptions(o *IterOptions) {
 	}
 	// Slow path.
 
+	// EDG: Keep the prefetcher if the prefetch options didn't change.
+	prefetcher := i.opts.prefetcher
+	prefetchEqual := o.PrefetchBlocks == i.opts.PrefetchBlocks && o.PrefetchMemory == i.opts.PrefetchMemory
+
 	// The options changed. Save the new ones to i.opts.
 	if boundsEqual {
 		// Copying the options into i.opts will overwrite LowerBound and
@@ -2631,6 +2642,11 @@ func (i *Iterator) SetOptions(o *IterOptions) {
 			i.rangeKey.iterConfig.SetBounds(i.opts.LowerBound, i.opts.UpperBound)
 		}
 	}
+	if prefetchEqual {
+		i.opts.prefetcher = prefetcher
+	} else {
+		i.opts.initPrefetcher()
+	}
 
 	// Even though this is not a positioning operation, the invalidation of the
 	// iterator stack means we cannot optimize Seeks by using Next.
@@ -2769,8 +2785,10 @@ func (i *Iterator) CloneWithContext(ctx context.Context, opts CloneOptions) (*It
 		newIters:            i.newIters,
 		newIterRangeKey:     i.newIterRangeKey,
 		seqNum:              i.seqNum,
+		ttlNow:              i.ttlNow,
 	}
 	dbi.processBounds(dbi.opts.LowerBound, dbi.opts.UpperBound)
+	dbi.opts.initPrefetcher()
 
 	// If the caller requested the clone have a current view of the indexed
 	// batch, set the clone's batch sequence number appropriately.
@@ -0,0 +1,84 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/edgelesssys/estore"
+)
+
+// NewComparer returns the comparer for keys encoded by this package whose
+// Split returns the prefix made up of the first prefixLen elements of a key.
+// Keys with fewer elements are their own prefix.
+//
+// Bloom filters are built from the prefixes, so a prefix seek for a tuple of
+// prefixLen elements can skip the sstables that don't contain it. The name
+// of the comparer includes prefixLen, because changing it invalidates the
+// filters of existing sstables.
+//
+// Keys are ordered bytewise, so the comparer also handles keys that aren't
+// valid tuples. FormatKey formats them like DefaultComparer.
+func NewComparer(prefixLen int) *estore.Comparer {
+	if prefixLen < 1 {
+		panic("estore: prefix length must be positive")
+	}
+	def := estore.DefaultComparer
+	return &estore.Comparer{
+		Compare:        bytes.Compare,
+		Equal:          bytes.Equal,
+		AbbreviatedKey: def.AbbreviatedKey,
+		FormatKey: func(key []byte) fmt.Formatter {
+			return formattedKey(key)
+		},
+		// The separators and successors of the default comparer may cut an
+		// element short, but they are only compared with other keys.
+		Separator: def.Separator,
+		Successor: def.Successor,
+		ImmediateSuccessor: func(dst, a []byte) []byte {
+			return append(append(dst, a...), 0)
+		},
+		Split: func(key []byte) int {
+			return PrefixLen(key, prefixLen)
+		},
+		Name: fmt.Sprintf("estore.keys.%d", prefixLen),
+	}
+}
+
+// formattedKey formats a key as a tuple.
+type formattedKey []byte
+
+func (k formattedKey) Format(s fmt.State, c rune) {
+	elems, err := Decode(k)
+	if err != nil {
+		estore.DefaultComparer.FormatKey(k).Format(s, c)
+		return
+	}
+	parts := make([]string, len(elems))
+	for i, elem := range elems {
+		parts[i] = formatElem(elem)
+	}
+	fmt.Fprintf(s, "(%s)", strings.Join(parts, ", "))
+}
+
+func formatElem(elem any) string {
+	switch v := elem.(type) {
+	case []byte:
+		return fmt.Sprintf("0x%x", v)
+	case string:
+		return fmt.Sprintf("%q", v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case Desc:
+		return "desc " + formatElem(v.Value)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+// Package keys implements an order-preserving encoding of tuples for use as
+// keys.
+//
+// A key is the concatenation of its encoded elements. The encoding of each
+// element is self-delimiting, so the bytewise order of two keys is the order
+// of their tuples: elements are compared from left to right, and a tuple
+// sorts before any longer tuple that extends it. Keys that share leading
+// elements share a byte prefix, which the prefix compression of sstable
+// blocks exploits, and all keys that extend a tuple can be found by a prefix
+// scan or a prefix seek.
+//
+// The supported element types are []byte, string, signed and unsigned
+// integers, float64 and time.Time. Elements of different types are ordered
+// by type, so the elements at the same position should have the same type.
+// Wrapping an element in Desc reverses its order.
+//
+// NewComparer returns the Comparer for these keys, whose Split returns the
+// prefix made up of a fixed number of leading elements.
+package keys // import "github.com/edgelesssys/estore/keys"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// The tag byte at the start of an element determines its type. The tags of
+// descending elements are inverted and thus >= 0x80.
+const (
+	tagBytes   = 0x10
+	tagString  = 0x11
+	tagInt64   = 0x20
+	tagUint64  = 0x21
+	tagFloat64 = 0x22
+	tagTime    = 0x30
+
+	descMask = 0xff
+)
+
+// Byte strings are terminated by bytesTerminator. A zero byte inside a byte
+// string is followed by bytesEscape, which sorts after the terminator.
+const (
+	bytesEscape     = 0xff
+	bytesTerminator = 0x01
+)
+
+// Desc wraps an element that is encoded in descending order.
+type Desc struct {
+	Value any
+}
+
+// Encode returns the key of the tuple with the given elements.
+func Encode(elems ...any) ([]byte, error) {
+	return Append(nil, elems...)
+}
+
+// Append appends the encoded elements to dst, which is usually a key that
+// holds the preceding elements of the tuple. Signed integers are encoded as
+// int64 and unsigned integers as uint64.
+func Append(dst []byte, elems ...any) ([]byte, error) {
+	for _, elem := range elems {
+		var err error
+		if dst, err = appendElem(dst, elem); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+func appendElem(dst []byte, elem any) ([]byte, error) {
+	switch v := elem.(type) {
+	case []byte:
+		return AppendBytes(dst, v), nil
+	case string:
+		return AppendString(dst, v), nil
+	case int:
+		return AppendInt64(dst, int64(v)), nil
+	case int8:
+		return AppendInt64(dst, int64(v)), nil
+	case int16:
+		return AppendInt64(dst, int64(v)), nil
+	case int32:
+		return AppendInt64(dst, int64(v)), nil
+	case int64:
+		return AppendInt64(dst, v), nil
+	case uint:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint8:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint16:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint32:
+		return AppendUint64(dst, uint64(v)), nil
+	case uint64:
+		return AppendUint64(dst, v), nil
+	case float64:
+		return AppendFloat64(dst, v), nil
+	case time.Time:
+		return AppendTime(dst, v), nil
+	case Desc:
+		if _, ok := v.Value.(Desc); ok {
+			return nil, errors.New("estore: nested Desc key element")
+		}
+		n := len(dst)
+		dst, err := appendElem(dst, v.Value)
+		if err != nil {
+			return nil, err
+		}
+		invert(dst[n:])
+		return dst, nil
+	default:
+		return nil, errors.Newf("estore: unsupported key element type %T", elem)
+	}
+}
+
+// AppendBytes appends the encoding of a byte string to dst.
+func AppendBytes(dst, b []byte) []byte {
+	return appendEscaped(append(dst, tagBytes), b)
+}
+
+// AppendString appends the encoding of a string to dst.
+func AppendString(dst []byte, s string) []byte {
+	return appendEscaped(append(dst, tagString), []byte(s))
+}
+
+func appendEscaped(dst, b []byte) []byte {
+	for {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			break
+		}
+		dst = append(append(dst, b[:i+1]...), bytesEscape)
+		b = b[i+1:]
+	}
+	return append(append(dst, b...), 0, bytesTerminator)
+}
+
+// AppendInt64 appends the encoding of a signed integer to dst.
+func AppendInt64(dst []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, tagInt64), uint64(v)^(1<<63))
+}
+
+// AppendUint64 appends the encoding of an unsigned integer to dst.
+func AppendUint64(dst []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, tagUint64), v)
+}
+
+// AppendFloat64 appends the encoding of a float to dst. Negative zero sorts
+// before zero, and NaNs sort before -Inf or after +Inf depending on their
+// sign bit.
+func AppendFloat64(dst []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(append(dst, tagFloat64), bits)
+}
+
+// AppendTime appends the encoding of a time to dst. The location and the
+// monotonic clock reading aren't encoded.
+func AppendTime(dst []byte, t time.Time) []byte {
+	dst = binary.BigEndian.AppendUint64(append(dst, tagTime), uint64(t.Unix())^(1<<63))
+	return binary.BigEndian.AppendUint32(dst, uint32(t.Nanosecond()))
+}
+
+// invert inverts the bytes of an encoded element to reverse its order.
+func invert(b []byte) {
+	for i := range b {
+		b[i] ^= descMask
+	}
+}
+
+// Decode returns the elements of the tuple encoded in key. Byte strings are
+// returned as []byte, strings as string, signed integers as int64, unsigned
+// integers as uint64, floats as float64 and times as time.Time in UTC.
+// Descending elements are returned wrapped in Desc.
+func Decode(key []byte) ([]any, error) {
+	var elems []any
+	for len(key) > 0 {
+		elem, n, err := decodeElem(key)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+		key = key[n:]
+	}
+	return elems, nil
+}
+
+// DecodeFirst decodes the first element of key and returns it together with
+// the remainder of the key.
+func DecodeFirst(key []byte) (elem any, rest []byte, err error) {
+	elem, n, err := decodeElem(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return elem, key[n:], nil
+}
+
+func decodeElem(key []byte) (any, int, error) {
+	if len(key) == 0 {
+		return nil, 0, errors.New("estore: empty key element")
+	}
+	var mask byte
+	tag := key[0]
+	if tag >= 0x80 {
+		mask = descMask
+		tag ^= mask
+	}
+	elem, n, err := decodeValue(key[1:], tag, mask)
+	if err != nil {
+		return nil, 0, err
+	}
+	if mask != 0 {
+		elem = Desc{Value: elem}
+	}
+	return elem, 1 + n, nil
+}
+
+func decodeValue(b []byte, tag, mask byte) (any, int, error) {
+	fixed := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, errors.New("estore: truncated key element")
+		}
+		v := append([]byte(nil), b[:n]...)
+		if mask != 0 {
+			invert(v)
+		}
+		return v, nil
+	}
+
+	switch tag {
+	case tagBytes, tagString:
+		v, n, err := decodeEscaped(b, mask)
+		if err != nil {
+			return nil, 0, err
+		}
+		if tag == tagString {
+			return string(v), n, nil
+		}
+		return v, n, nil
+	case tagInt64, tagUint64, tagFloat64:
+		v, err := fixed(8)
+		if err != nil {
+			return nil, 0, err
+		}
+		bits := binary.BigEndian.Uint64(v)
+		switch tag {
+		case tagInt64:
+			return int64(bits ^ (1 << 63)), 8, nil
+		case tagUint64:
+			return bits, 8, nil
+		}
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), 8, nil
+	case tagTime:
+		v, err := fixed(12)
+		if err != nil {
+			return nil, 0, err
+		}
+		sec := int64(binary.BigEndian.Uint64(v) ^ (1 << 63))
+		nsec := binary.BigEndian.Uint32(v[8:])
+		if nsec >= 1e9 {
+			return nil, 0, errors.New("estore: invalid time key element")
+		}
+		return time.Unix(sec, int64(nsec)).UTC(), 12, nil
+	default:
+		return nil, 0, errors.Newf("estore: invalid key element tag %#x", tag)
+	}
+}
+
+func decodeEscaped(b []byte, mask byte) ([]byte, int, error) {
+	v := []byte{}
+	for i := 0; i < len(b); i++ {
+		c := b[i] ^ mask
+		if c != 0 {
+			v = append(v, c)
+			continue
+		}
+		if i+1 == len(b) {
+			break
+		}
+		switch b[i+1] ^ mask {
+		case bytesTerminator:
+			return v, i + 2, nil
+		case bytesEscape:
+			v = append(v, 0)
+			i++
+		default:
+			return nil, 0, errors.New("estore: invalid escape in key element")
+		}
+	}
+	return nil, 0, errors.New("estore: truncated key element")
+}
+
+// elemLen returns the length of the encoded element at the start of key, or
+// false if key doesn't start with a valid element. It doesn't validate the
+// contents of the element.
+func elemLen(key []byte) (int, bool) {
+	if len(key) == 0 {
+		return 0, false
+	}
+	var mask byte
+	tag := key[0]
+	if tag >= 0x80 {
+		mask = descMask
+		tag ^= mask
+	}
+	n := 0
+	switch tag {
+	case tagBytes, tagString:
+		zero, terminator := mask, bytesTerminator^mask
+		for i := 1; i+1 < len(key); i++ {
+			if key[i] == zero {
+				if key[i+1] == terminator {
+					return i + 2, true
+				}
+				i++
+			}
+		}
+		return 0, false
+	case tagInt64, tagUint64, tagFloat64:
+		n = 9
+	case tagTime:
+		n = 13
+	default:
+		return 0, false
+	}
+	if len(key) < n {
+		return 0, false
+	}
+	return n, true
+}
+
+// PrefixLen returns the length of the first n elements of key. If key has
+// fewer than n elements or is malformed, it returns len(key).
+func PrefixLen(key []byte, n int) int {
+	i := 0
+	for ; n > 0; n-- {
+		l, ok := elemLen(key[i:])
+		if !ok {
+			return len(key)
+		}
+		i += l
+	}
+	return i
+}
+
+// PrefixEnd returns the smallest key that is greater than all keys starting
+// with prefix, for use as an exclusive upper bound of a prefix scan. It
+// returns nil if there is no such key.
+func PrefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte(nil), prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/bloom"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundtrip(t *testing.T) {
+	require := require.New(t)
+
+	elems := []any{
+		[]byte{}, []byte{0, 1, 0, 0xff, 0}, "", "a\x00b", "\xff",
+		int64(0), int64(math.MinInt64), int64(math.MaxInt64), uint64(0), uint64(math.MaxUint64),
+		0.0, math.Copysign(0, -1), -1.5, math.Inf(1), math.Inf(-1), math.MaxFloat64,
+		time.Unix(0, 0).UTC(), time.Unix(-1e12, 999999999).UTC(), time.Unix(1e12, 1).UTC(),
+	}
+	for _, elem := range elems {
+		for _, e := range []any{elem, Desc{Value: elem}} {
+			key, err := Encode(e, "suffix")
+			require.NoError(err)
+			got, err := Decode(key)
+			require.NoError(err)
+			require.Equal([]any{e, "suffix"}, got)
+
+			first, rest, err := DecodeFirst(key)
+			require.NoError(err)
+			require.Equal(e, first)
+			require.Equal(AppendString(nil, "suffix"), rest)
+			n, ok := elemLen(key)
+			require.True(ok)
+			require.Equal(len(key)-len(rest), n)
+		}
+	}
+
+	// other integer types are encoded as 64-bit integers
+	key, err := Encode(int8(-1), uint16(2), 3, uint(4))
+	require.NoError(err)
+	got, err := Decode(key)
+	require.NoError(err)
+	require.Equal([]any{int64(-1), uint64(2), int64(3), uint64(4)}, got)
+
+	// NaN can't be compared with Equal
+	key, err = Encode(math.NaN())
+	require.NoError(err)
+	got, err = Decode(key)
+	require.NoError(err)
+	require.True(math.IsNaN(got[0].(float64)))
+
+	for _, elem := range []any{true, nil, Desc{Value: Desc{Value: 1}}, Desc{Value: 1.5i}} {
+		_, err := Encode(elem)
+		require.Error(err, "%v", elem)
+	}
+	for _, key := range [][]byte{
+		{0}, {tagInt64, 1}, {tagBytes, 'a'}, {tagBytes, 0, 2}, {tagString, 0},
+		{tagTime, 0x80, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff},
+	} {
+		_, err := Decode(key)
+		require.Error(err, "%x", key)
+	}
+}
+
+// compareElems compares elements of the same type.
+func compareElems(a, b any) int {
+	switch a := a.(type) {
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	case string:
+		return bytes.Compare([]byte(a), []byte(b.(string)))
+	case int64:
+		return compareOrdered(a, b.(int64))
+	case uint64:
+		return compareOrdered(a, b.(uint64))
+	case float64:
+		return compareOrdered(a, b.(float64))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case Desc:
+		return -compareElems(a.Value, b.(Desc).Value)
+	}
+	panic("unreachable")
+}
+
+func compareOrdered[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func TestOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randBytes := func() []byte {
+		b := make([]byte, rng.Intn(4))
+		for i := range b {
+			b[i] = []byte{0, 1, 0xfe, 0xff}[rng.Intn(4)]
+		}
+		return b
+	}
+	// The tuples have the schema (string, desc int64, float64, time, bytes)
+	// and may be truncated.
+	gens := []func() any{
+		func() any { return string(randBytes()) },
+		func() any { return Desc{Value: rng.Int63n(5) - 2} },
+		func() any { return float64(rng.Intn(5)-2) / 2 },
+		func() any { return time.Unix(rng.Int63n(3)-1, rng.Int63n(2)).UTC() },
+		func() any { return randBytes() },
+	}
+	tuples := make([][]any, 1000)
+	for i := range tuples {
+		for _, gen := range gens[:rng.Intn(len(gens)+1)] {
+			tuples[i] = append(tuples[i], gen())
+		}
+	}
+
+	sort.Slice(tuples, func(i, j int) bool {
+		a, b := tuples[i], tuples[j]
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if c := compareElems(a[k], b[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return len(a) < len(b)
+	})
+	var prev []byte
+	for i, tuple := range tuples {
+		key, err := Encode(tuple...)
+		require.NoError(t, err)
+		if i > 0 {
+			require.LessOrEqual(t, string(prev), string(key), "%v < %v", tuples[i-1], tuple)
+		}
+		prev = key
+	}
+}
+
+func TestComparer(t *testing.T) {
+	require := require.New(t)
+	cmp := NewComparer(2)
+	require.Equal("estore.keys.2", cmp.Name)
+	require.Panics(func() { NewComparer(0) })
+
+	encode := func(elems ...any) []byte {
+		key, err := Encode(elems...)
+		require.NoError(err)
+		return key
+	}
+	prefix := encode("a\x00", Desc{Value: "b\x00"})
+	key := append(append([]byte(nil), prefix...), encode(int64(1), "c")...)
+	require.Equal(len(prefix), cmp.Split(key))
+	require.Equal(len(prefix), cmp.Split(prefix))
+	short := encode("a")
+	require.Equal(len(short), cmp.Split(short))
+	require.Equal(len(prefix), cmp.Split(append(prefix, 0xff)))
+	require.Equal(len(short)+1, cmp.Split(append(short, 0xff)))
+	require.Equal(0, cmp.Split(nil))
+
+	succ := cmp.ImmediateSuccessor(nil, prefix)
+	require.Less(string(prefix), string(succ))
+	require.Less(string(succ), string(key))
+
+	end := PrefixEnd(prefix)
+	require.Less(string(key), string(end))
+	require.Less(string(append(prefix, 0xff, 0xff)), string(end))
+	require.Nil(PrefixEnd([]byte{0xff}))
+
+	date := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	require.Equal(`("a", desc 5, 0x00ff, 2024-01-02T03:04:05.000000006Z, 1.5)`,
+		fmt.Sprint(cmp.FormatKey(encode("a", Desc{Value: 5}, []byte{0, 0xff}, date, 1.5))))
+	require.Equal("()", fmt.Sprint(cmp.FormatKey(nil)))
+	require.Equal(`\x00`, fmt.Sprint(cmp.FormatKey([]byte{0})))
+}
+
+func TestDB(t *testing.T) {
+	require := require.New(t)
+
+	db, err := estore.Open("", &estore.Options{
+		FS:            vfs.NewMem(),
+		EncryptionKey: bytes.Repeat([]byte{2}, 16),
+		Comparer:      NewComparer(1),
+		Levels:        []estore.LevelOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+
+		DisableAutomaticCompactions: true,
+	})
+	require.NoError(err)
+	defer func() { require.NoError(db.Close()) }()
+
+	// versions of records, newest first
+	for _, user := range []string{"alice", "bob", "carol"} {
+		for version := int64(1); version <= 3; version++ {
+			key, err := Encode(user, Desc{Value: version})
+			require.NoError(err)
+			require.NoError(db.Set(key, []byte(fmt.Sprint(user, version)), nil))
+		}
+		require.NoError(db.Flush())
+	}
+	// a table whose key range contains bob, but not its prefix
+	for _, user := range []string{"alice", "carol"} {
+		key, err := Encode(user, Desc{Value: int64(4)})
+		require.NoError(err)
+		require.NoError(db.Set(key, []byte(fmt.Sprint(user, 4)), nil))
+	}
+	require.NoError(db.Flush())
+
+	iter, err := db.NewIter(nil)
+	require.NoError(err)
+	prefix := AppendString(nil, "bob")
+	var values []string
+	for valid := iter.SeekPrefixGE(prefix); valid; valid = iter.Next() {
+		values = append(values, string(iter.Value()))
+	}
+	require.Equal([]string{"bob3", "bob2", "bob1"}, values)
+	require.False(iter.SeekPrefixGE(AppendString(nil, "dave")))
+	require.NoError(iter.Close())
+	require.Positive(db.Metrics().Filter.Hits)
+
+	// prefix scans use PrefixEnd
+	iter, err = db.NewIter(&estore.IterOptions{LowerBound: prefix, UpperBound: PrefixEnd(prefix)})
+	require.NoError(err)
+	require.True(iter.Last())
+	require.Equal("bob1", string(iter.Value()))
+	require.NoError(iter.Close())
+}
@@ -0,0 +1,151 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package mergers
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore"
+)
+
+// The precision of a HyperLogLog sketch is the number of bits of the hash
+// that select a register. A sketch has 2^precision registers of one byte each,
+// and its standard error is about 1.04/sqrt(2^precision).
+const (
+	MinHyperLogLogPrecision = 4
+	MaxHyperLogLogPrecision = 16
+)
+
+func validHyperLogLogPrecision(precision uint8) bool {
+	return MinHyperLogLogPrecision <= precision && precision <= MaxHyperLogLogPrecision
+}
+
+// HyperLogLog returns a merger that unions HyperLogLog sketches of the given
+// precision to estimate the number of distinct elements added to a key.
+// Operands are created with HyperLogLogOperand, and HyperLogLogCount returns
+// the estimate for a value. The precision is part of the merger's name, so it
+// can't be changed for an existing store.
+func HyperLogLog(precision uint8) *estore.Merger {
+	if !validHyperLogLogPrecision(precision) {
+		panic(fmt.Sprintf("estore: HyperLogLog precision must be in [%d, %d]", MinHyperLogLogPrecision, MaxHyperLogLogPrecision))
+	}
+	return &estore.Merger{
+		Merge: func(key, value []byte) (estore.ValueMerger, error) {
+			m := &hyperLogLogMerger{}
+			m.sketch = make([]byte, 1+1<<precision)
+			m.sketch[0] = precision
+			if err := m.MergeNewer(value); err != nil {
+				return nil, err
+			}
+			return m, nil
+		},
+		Name: fmt.Sprintf("%s%d", hyperLogLogPrefix, precision),
+	}
+}
+
+// HyperLogLogOperand returns a sketch of the given precision that contains
+// the elements. It's an operand for the HyperLogLog merger of the same
+// precision.
+func HyperLogLogOperand(precision uint8, elements ...[]byte) []byte {
+	if !validHyperLogLogPrecision(precision) {
+		panic(fmt.Sprintf("estore: HyperLogLog precision must be in [%d, %d]", MinHyperLogLogPrecision, MaxHyperLogLogPrecision))
+	}
+	sketch := make([]byte, 1+1<<precision)
+	sketch[0] = precision
+	registers := sketch[1:]
+	for _, e := range elements {
+		h := xxhash.Sum64(e)
+		idx := h >> (64 - precision)
+		// Set a sentinel bit so that the rank is bounded if the remaining
+		// bits are all zero.
+		rank := uint8(bits.LeadingZeros64(h<<precision|1<<(precision-1))) + 1
+		if rank > registers[idx] {
+			registers[idx] = rank
+		}
+	}
+	return sketch
+}
+
+// HyperLogLogCount returns the estimated number of distinct elements in a
+// value of the HyperLogLog merger.
+func HyperLogLogCount(value []byte) (uint64, error) {
+	if err := checkHyperLogLogSketch(value, 0); err != nil {
+		return 0, err
+	}
+	registers := value[1:]
+	m := float64(len(registers))
+	var sum float64
+	var zeros int
+	for _, r := range registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5), nil
+}
+
+// checkHyperLogLogSketch checks that value is a sketch. If precision isn't 0,
+// the sketch must have that precision.
+func checkHyperLogLogSketch(value []byte, precision uint8) error {
+	if len(value) == 0 || !validHyperLogLogPrecision(value[0]) || len(value) != 1+1<<value[0] {
+		return errors.New("estore: invalid HyperLogLog operand")
+	}
+	if precision != 0 && value[0] != precision {
+		return errors.Newf("estore: HyperLogLog operand has precision %d, want %d",
+			errors.Safe(value[0]), errors.Safe(precision))
+	}
+	return nil
+}
+
+// hyperLogLogMerger unions sketches by keeping the maximum of each register.
+// As this is commutative, the order of the operands doesn't matter.
+type hyperLogLogMerger struct {
+	sketch []byte
+}
+
+func (m *hyperLogLogMerger) MergeNewer(value []byte) error {
+	if err := checkHyperLogLogSketch(value, m.sketch[0]); err != nil {
+		return err
+	}
+	registers := m.sketch[1:]
+	for i, r := range value[1:] {
+		if r > registers[i] {
+			registers[i] = r
+		}
+	}
+	return nil
+}
+
+func (m *hyperLogLogMerger) MergeOlder(value []byte) error {
+	return m.MergeNewer(value)
+}
+
+func (m *hyperLogLogMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	return m.sketch, nil, nil
+}
@@ -0,0 +1,48 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package mergers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	const precision = 12
+	merger := HyperLogLog(precision)
+
+	count := func(value []byte) uint64 {
+		n, err := HyperLogLogCount(value)
+		require.NoError(t, err)
+		return n
+	}
+
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			// split the elements into overlapping operands
+			var operands [][]byte
+			for start := 0; start < n || len(operands) == 0; start += 1 + n/4 {
+				var elements [][]byte
+				for i := start; i <= start+n/2 && i < n; i++ {
+					elements = append(elements, []byte(fmt.Sprint(i)))
+				}
+				operands = append(operands, HyperLogLogOperand(precision, elements...))
+			}
+			got := count(checkMerger(t, merger, operands...))
+			// The standard error is 1.6%.
+			require.InDelta(t, n, got, 0.05*float64(n))
+		})
+	}
+
+	_, err := merger.Merge(nil, HyperLogLogOperand(precision+1))
+	require.Error(t, err)
+	_, err = HyperLogLogCount([]byte{precision, 0})
+	require.Error(t, err)
+	require.Panics(t, func() { HyperLogLog(MaxHyperLogLogPrecision + 1) })
+}
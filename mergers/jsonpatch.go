@@ -0,0 +1,215 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package mergers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore"
+)
+
+// JSONMergePatch applies JSON merge patches (RFC 7396). The oldest operand is
+// the document, and each newer operand is a patch that is applied to it. The
+// result is re-encoded with sorted object keys.
+//
+// Merge patches can't always be combined into a single patch. If a
+// compaction only sees some of the operands of a key, it may write a value
+// that holds a sequence of patches instead. Such a value starts with a zero
+// byte and is never returned by reads.
+var JSONMergePatch = &estore.Merger{
+	Merge: func(key, value []byte) (estore.ValueMerger, error) {
+		return &jsonMergePatchMerger{newer: [][]byte{append([]byte(nil), value...)}}, nil
+	},
+	Name: "estore.jsonmergepatch",
+}
+
+// jsonPatchListMarker is the first byte of a value that holds a sequence of
+// patches encoded with EncodeList. It can't start a JSON text.
+const jsonPatchListMarker = 0
+
+// jsonMergePatchMerger buffers the operands and applies them in Finish.
+type jsonMergePatchMerger struct {
+	// older holds the operands passed to MergeOlder from newest to oldest,
+	// and newer the remaining ones from oldest to newest.
+	older, newer [][]byte
+}
+
+func (m *jsonMergePatchMerger) MergeNewer(value []byte) error {
+	m.newer = append(m.newer, append([]byte(nil), value...))
+	return nil
+}
+
+func (m *jsonMergePatchMerger) MergeOlder(value []byte) error {
+	m.older = append(m.older, append([]byte(nil), value...))
+	return nil
+}
+
+func (m *jsonMergePatchMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	operands := make([][]byte, 0, len(m.older)+len(m.newer))
+	for i := len(m.older) - 1; i >= 0; i-- {
+		operands = append(operands, m.older[i])
+	}
+	operands = append(operands, m.newer...)
+
+	var patches []any
+	for _, operand := range operands {
+		var err error
+		if patches, err = appendJSONPatches(patches, operand); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if includesBase {
+		doc := patches[0]
+		for _, p := range patches[1:] {
+			doc = mergePatch(doc, p)
+		}
+		value, err := marshalJSON(doc)
+		return value, nil, err
+	}
+
+	// Without the base, combine adjacent patches where possible.
+	combined := patches[:1]
+	for _, p := range patches[1:] {
+		last := combined[len(combined)-1]
+		if canComposePatches(last, p) {
+			combined[len(combined)-1] = composePatches(last, p)
+		} else {
+			combined = append(combined, p)
+		}
+	}
+	if len(combined) == 1 {
+		value, err := marshalJSON(combined[0])
+		return value, nil, err
+	}
+	value := []byte{jsonPatchListMarker}
+	for _, p := range combined {
+		enc, err := marshalJSON(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		value = appendList(value, enc)
+	}
+	return value, nil, nil
+}
+
+// appendJSONPatches decodes a single JSON operand or a sequence of patches
+// and appends them to dst.
+func appendJSONPatches(dst []any, value []byte) ([]any, error) {
+	if len(value) == 0 || value[0] != jsonPatchListMarker {
+		v, err := unmarshalJSON(value)
+		if err != nil {
+			return nil, err
+		}
+		return append(dst, v), nil
+	}
+	elements, err := DecodeList(value[1:])
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range elements {
+		v, err := unmarshalJSON(e)
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, v)
+	}
+	return dst, nil
+}
+
+func unmarshalJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as they are instead of converting them to float64.
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, errors.Wrap(err, "estore: invalid JSON operand")
+	}
+	if dec.More() {
+		return nil, errors.New("estore: invalid JSON operand: trailing data")
+	}
+	return v, nil
+}
+
+func marshalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// mergePatch applies patch to target as specified by RFC 7396. It may modify
+// and reuse both arguments.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// canComposePatches returns whether a single patch has the same effect as
+// applying first and then second to any document. That's not the case if
+// second patches an object that first replaces, because a patch can only
+// replace a member with an object by merging into it.
+func canComposePatches(first, second any) bool {
+	s, ok := second.(map[string]any)
+	if !ok {
+		return true
+	}
+	f, ok := first.(map[string]any)
+	if !ok {
+		return false
+	}
+	for k, sv := range s {
+		fv, ok := f[k]
+		if !ok {
+			continue
+		}
+		if _, ok := sv.(map[string]any); ok && !canComposePatches(fv, sv) {
+			return false
+		}
+	}
+	return true
+}
+
+// composePatches returns the patch that has the same effect as applying first
+// and then second. canComposePatches must be true. It may modify and reuse
+// both arguments.
+func composePatches(first, second any) any {
+	s, ok := second.(map[string]any)
+	if !ok {
+		return second
+	}
+	f := first.(map[string]any)
+	for k, sv := range s {
+		fv, ok := f[k]
+		if _, isObject := sv.(map[string]any); ok && isObject {
+			f[k] = composePatches(fv, sv)
+		} else {
+			f[k] = sv
+		}
+	}
+	return f
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package mergers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONMergePatch(t *testing.T) {
+	testCases := map[string]struct {
+		operands []string
+		want     string
+	}{
+		"single": {
+			operands: []string{`{"b": 1, "a": null}`},
+			want:     `{"a":null,"b":1}`,
+		},
+		"merge": {
+			operands: []string{`{"a": "b", "c": {"d": 1, "e": 2}}`, `{"a": "z", "c": {"d": null}}`, `{"f": [1, 2]}`},
+			want:     `{"a":"z","c":{"e":2},"f":[1,2]}`,
+		},
+		"replace document": {
+			operands: []string{`{"a": 1}`, `[1]`, `{"b": 2}`},
+			want:     `{"b":2}`,
+		},
+		"large numbers": {
+			operands: []string{`{"a": 12345678901234567890}`, `{"b": 1.5}`},
+			want:     `{"a":12345678901234567890,"b":1.5}`,
+		},
+		"no html escaping": {
+			operands: []string{`{"a": "<&>"}`, `{}`},
+			want:     `{"a":"<&>"}`,
+		},
+		// The following patches can't be composed without the base.
+		"patch deleted member": {
+			operands: []string{`{"a": {"x": 1}}`, `{"a": null}`, `{"a": {"y": 2}}`, `{"b": 1}`},
+			want:     `{"a":{"y":2},"b":1}`,
+		},
+		"patch replaced member": {
+			operands: []string{`{"a": {"x": 1}}`, `{"a": 5}`, `{"a": {"y": null, "z": 1}}`},
+			want:     `{"a":{"z":1}}`,
+		},
+		"patch replaced document": {
+			operands: []string{`{"a": 1}`, `"s"`, `{"b": 1}`, `{"c": 1}`},
+			want:     `{"b":1,"c":1}`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var operands [][]byte
+			for _, op := range tc.operands {
+				operands = append(operands, []byte(op))
+			}
+			require.Equal(t, tc.want, string(checkMerger(t, JSONMergePatch, operands...)))
+		})
+	}
+
+	vm, err := JSONMergePatch.Merge(nil, []byte(`{"a": 1} x`))
+	require.NoError(t, err)
+	_, _, err = vm.Finish(true)
+	require.Error(t, err)
+}
+
+func TestJSONMergePatchPartial(t *testing.T) {
+	require := require.New(t)
+
+	operands := [][]byte{[]byte(`{"a": {"x": 1}}`), []byte(`{"a": {"y": null}}`)}
+	// composable patches are combined into one
+	require.Equal(`{"a":{"x":1,"y":null}}`, string(merge(t, JSONMergePatch, operands, true, false)))
+
+	// others are kept as a list of patches
+	operands = [][]byte{[]byte(`{"a": null}`), []byte(`{"a": {"y": 1}}`)}
+	value := merge(t, JSONMergePatch, operands, true, false)
+	require.EqualValues(jsonPatchListMarker, value[0])
+	patches, err := DecodeList(value[1:])
+	require.NoError(err)
+	require.Equal([][]byte{[]byte(`{"a":null}`), []byte(`{"a":{"y":1}}`)}, patches)
+}
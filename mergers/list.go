@@ -0,0 +1,183 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package mergers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore"
+)
+
+// SortedUvarintUnion computes the union of sets of unsigned integers. A set
+// is encoded with EncodeUvarintList as a strictly increasing list of uvarints.
+var SortedUvarintUnion = &estore.Merger{
+	Merge: func(key, value []byte) (estore.ValueMerger, error) {
+		m := &uvarintUnionMerger{}
+		if err := m.MergeNewer(value); err != nil {
+			return nil, err
+		}
+		return m, nil
+	},
+	Name: "estore.sorteduvarintunion",
+}
+
+// EncodeUvarintList encodes values as an operand for SortedUvarintUnion. The
+// values don't need to be sorted, and duplicates are removed.
+func EncodeUvarintList(values []uint64) []byte {
+	values = append([]uint64(nil), values...)
+	return encodeSortedUvarints(values)
+}
+
+// DecodeUvarintList decodes a value of SortedUvarintUnion.
+func DecodeUvarintList(value []byte) ([]uint64, error) {
+	return appendUvarintList(nil, value)
+}
+
+func appendUvarintList(dst []uint64, value []byte) ([]uint64, error) {
+	n := len(dst)
+	for len(value) > 0 {
+		v, l := binary.Uvarint(value)
+		if l <= 0 {
+			return nil, errors.New("estore: invalid uvarint in list operand")
+		}
+		if len(dst) > n && v <= dst[len(dst)-1] {
+			return nil, errors.New("estore: uvarint list operand isn't strictly increasing")
+		}
+		dst = append(dst, v)
+		value = value[l:]
+	}
+	return dst, nil
+}
+
+// encodeSortedUvarints sorts values in place and encodes them without
+// duplicates.
+func encodeSortedUvarints(values []uint64) []byte {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	buf := make([]byte, 0, len(values))
+	for i, v := range values {
+		if i > 0 && v == values[i-1] {
+			continue
+		}
+		buf = binary.AppendUvarint(buf, v)
+	}
+	return buf
+}
+
+// uvarintUnionMerger collects the values of all operands. As the union is
+// commutative, the order of the operands doesn't matter.
+type uvarintUnionMerger struct {
+	values []uint64
+}
+
+func (m *uvarintUnionMerger) MergeNewer(value []byte) (err error) {
+	m.values, err = appendUvarintList(m.values, value)
+	return err
+}
+
+func (m *uvarintUnionMerger) MergeOlder(value []byte) error {
+	return m.MergeNewer(value)
+}
+
+func (m *uvarintUnionMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	return encodeSortedUvarints(m.values), nil, nil
+}
+
+// BoundedAppend returns a merger that appends lists of byte strings and keeps
+// the newest limit elements. A list is encoded with EncodeList. The limit is
+// part of the merger's name, so it can't be changed for an existing store.
+func BoundedAppend(limit int) *estore.Merger {
+	if limit <= 0 {
+		panic("estore: bounded append limit must be positive")
+	}
+	return &estore.Merger{
+		Merge: func(key, value []byte) (estore.ValueMerger, error) {
+			m := &boundedAppendMerger{limit: limit}
+			if err := m.MergeNewer(value); err != nil {
+				return nil, err
+			}
+			return m, nil
+		},
+		Name: fmt.Sprintf("%s%d", boundedAppendPrefix, limit),
+	}
+}
+
+// EncodeList encodes elements as an operand for BoundedAppend. Each element
+// is prefixed with its length as uvarint.
+func EncodeList(elements ...[]byte) []byte {
+	return appendList(nil, elements...)
+}
+
+func appendList(dst []byte, elements ...[]byte) []byte {
+	for _, e := range elements {
+		dst = binary.AppendUvarint(dst, uint64(len(e)))
+		dst = append(dst, e...)
+	}
+	return dst
+}
+
+// DecodeList decodes a value of BoundedAppend. The returned elements point
+// into value.
+func DecodeList(value []byte) ([][]byte, error) {
+	var elements [][]byte
+	for len(value) > 0 {
+		l, n := binary.Uvarint(value)
+		if n <= 0 || l > uint64(len(value)-n) {
+			return nil, errors.New("estore: invalid list operand")
+		}
+		elements = append(elements, value[n:n+int(l)])
+		value = value[n+int(l):]
+	}
+	return elements, nil
+}
+
+// boundedAppendMerger keeps the newest limit elements of the operands seen
+// so far, ordered from oldest to newest.
+type boundedAppendMerger struct {
+	limit    int
+	elements [][]byte
+}
+
+func (m *boundedAppendMerger) decode(value []byte) ([][]byte, error) {
+	// The caller retains ownership of value.
+	return DecodeList(append([]byte(nil), value...))
+}
+
+func (m *boundedAppendMerger) MergeNewer(value []byte) error {
+	elements, err := m.decode(value)
+	if err != nil {
+		return err
+	}
+	m.elements = append(m.elements, elements...)
+	if n := len(m.elements) - m.limit; n > 0 {
+		m.elements = m.elements[n:]
+	}
+	return nil
+}
+
+func (m *boundedAppendMerger) MergeOlder(value []byte) error {
+	elements, err := m.decode(value)
+	if err != nil {
+		return err
+	}
+	n := m.limit - len(m.elements)
+	if n <= 0 {
+		return nil
+	}
+	if n < len(elements) {
+		elements = elements[len(elements)-n:]
+	}
+	m.elements = append(elements, m.elements...)
+	return nil
+}
+
+func (m *boundedAppendMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	return EncodeList(m.elements...), nil, nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+// Package mergers implements commonly used merge operators.
+//
+// Every merger has a stable name that is recorded in the OPTIONS file, and a
+// store must always be opened with the merger it was created with. New
+// returns the merger for a name and can be used as ParseHooks.NewMerger.
+//
+// The mergers validate their operands and return an error from the read or
+// compaction that encounters an invalid one. Values written with Set are
+// treated as the oldest operand, so they must be valid operands, too.
+package mergers // import "github.com/edgelesssys/estore/mergers"
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore"
+)
+
+const (
+	boundedAppendPrefix = "estore.boundedappend."
+	hyperLogLogPrefix   = "estore.hyperloglog."
+)
+
+// Int64Add adds signed 64-bit integers encoded with EncodeInt64. The sum
+// wraps around on overflow.
+var Int64Add = newFixed64Merger("estore.int64add", func(older, newer uint64) uint64 {
+	return older + newer
+})
+
+// Uint64Add adds unsigned 64-bit integers encoded with EncodeUint64. The sum
+// wraps around on overflow.
+var Uint64Add = newFixed64Merger("estore.uint64add", func(older, newer uint64) uint64 {
+	return older + newer
+})
+
+// Int64Max keeps the largest of the signed 64-bit integers encoded with
+// EncodeInt64.
+var Int64Max = newFixed64Merger("estore.int64max", func(older, newer uint64) uint64 {
+	if int64(newer) > int64(older) {
+		return newer
+	}
+	return older
+})
+
+// Int64Min keeps the smallest of the signed 64-bit integers encoded with
+// EncodeInt64.
+var Int64Min = newFixed64Merger("estore.int64min", func(older, newer uint64) uint64 {
+	if int64(newer) < int64(older) {
+		return newer
+	}
+	return older
+})
+
+// Uint64Max keeps the largest of the unsigned 64-bit integers encoded with
+// EncodeUint64.
+var Uint64Max = newFixed64Merger("estore.uint64max", func(older, newer uint64) uint64 {
+	if newer > older {
+		return newer
+	}
+	return older
+})
+
+// Uint64Min keeps the smallest of the unsigned 64-bit integers encoded with
+// EncodeUint64.
+var Uint64Min = newFixed64Merger("estore.uint64min", func(older, newer uint64) uint64 {
+	if newer < older {
+		return newer
+	}
+	return older
+})
+
+// New returns the merger with the given name. It knows all mergers of this
+// package, including parameterized ones like BoundedAppend and HyperLogLog.
+func New(name string) (*estore.Merger, error) {
+	for _, m := range []*estore.Merger{
+		Int64Add, Uint64Add, Int64Max, Int64Min, Uint64Max, Uint64Min,
+		SortedUvarintUnion, JSONMergePatch,
+	} {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	if s, ok := strings.CutPrefix(name, boundedAppendPrefix); ok {
+		if limit, err := strconv.Atoi(s); err == nil && limit > 0 && strconv.Itoa(limit) == s {
+			return BoundedAppend(limit), nil
+		}
+	}
+	if s, ok := strings.CutPrefix(name, hyperLogLogPrefix); ok {
+		if precision, err := strconv.ParseUint(s, 10, 8); err == nil && validHyperLogLogPrecision(uint8(precision)) &&
+			strconv.FormatUint(precision, 10) == s {
+			return HyperLogLog(uint8(precision)), nil
+		}
+	}
+	return nil, errors.Newf("estore: unknown merger %q", errors.Safe(name))
+}
+
+// EncodeInt64 encodes v as an operand for the Int64 mergers.
+func EncodeInt64(v int64) []byte {
+	return EncodeUint64(uint64(v))
+}
+
+// DecodeInt64 decodes a value of the Int64 mergers.
+func DecodeInt64(value []byte) (int64, error) {
+	v, err := DecodeUint64(value)
+	return int64(v), err
+}
+
+// EncodeUint64 encodes v as an operand for the Uint64 mergers. The encoding
+// is 8 bytes little endian.
+func EncodeUint64(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+// DecodeUint64 decodes a value of the Uint64 mergers.
+func DecodeUint64(value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, errors.Newf("estore: integer operand must be 8 bytes, got %d", errors.Safe(len(value)))
+	}
+	return binary.LittleEndian.Uint64(value), nil
+}
+
+// fixed64Merger folds fixed-width 64-bit integers.
+type fixed64Merger struct {
+	fold  func(older, newer uint64) uint64
+	value uint64
+}
+
+func newFixed64Merger(name string, fold func(older, newer uint64) uint64) *estore.Merger {
+	return &estore.Merger{
+		Merge: func(key, value []byte) (estore.ValueMerger, error) {
+			v, err := DecodeUint64(value)
+			if err != nil {
+				return nil, err
+			}
+			return &fixed64Merger{fold: fold, value: v}, nil
+		},
+		Name: name,
+	}
+}
+
+func (m *fixed64Merger) MergeNewer(value []byte) error {
+	v, err := DecodeUint64(value)
+	if err != nil {
+		return err
+	}
+	m.value = m.fold(m.value, v)
+	return nil
+}
+
+func (m *fixed64Merger) MergeOlder(value []byte) error {
+	v, err := DecodeUint64(value)
+	if err != nil {
+		return err
+	}
+	m.value = m.fold(v, m.value)
+	return nil
+}
+
+func (m *fixed64Merger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	return EncodeUint64(m.value), nil, nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package mergers
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// merge merges the operands, which are ordered from oldest to newest. If
+// newer is set, it starts with the oldest operand and adds the others with
+// MergeNewer, otherwise it starts with the newest and uses MergeOlder.
+func merge(t *testing.T, m *estore.Merger, operands [][]byte, newer, includesBase bool) []byte {
+	t.Helper()
+	var vm estore.ValueMerger
+	var err error
+	if newer {
+		vm, err = m.Merge(nil, operands[0])
+		require.NoError(t, err)
+		for _, op := range operands[1:] {
+			require.NoError(t, vm.MergeNewer(op))
+		}
+	} else {
+		vm, err = m.Merge(nil, operands[len(operands)-1])
+		require.NoError(t, err)
+		for i := len(operands) - 2; i >= 0; i-- {
+			require.NoError(t, vm.MergeOlder(operands[i]))
+		}
+	}
+	value, closer, err := vm.Finish(includesBase)
+	require.NoError(t, err)
+	require.Nil(t, closer)
+	return append([]byte(nil), value...)
+}
+
+// checkMerger checks that merging the operands in either direction and
+// merging any suffix of them first, like a compaction that doesn't see the
+// base, all lead to the same result. It returns the result.
+func checkMerger(t *testing.T, m *estore.Merger, operands ...[]byte) []byte {
+	t.Helper()
+	want := merge(t, m, operands, true, true)
+	require.Equal(t, want, merge(t, m, operands, false, true))
+	for i := 1; i < len(operands); i++ {
+		for _, newer := range []bool{false, true} {
+			partial := merge(t, m, operands[i:], newer, false)
+			ops := append(append([][]byte(nil), operands[:i]...), partial)
+			require.Equal(t, want, merge(t, m, ops, !newer, true), "split at %d", i)
+		}
+	}
+	return want
+}
+
+func TestNew(t *testing.T) {
+	for _, m := range []*estore.Merger{
+		Int64Add, Uint64Add, Int64Max, Int64Min, Uint64Max, Uint64Min,
+		SortedUvarintUnion, JSONMergePatch, BoundedAppend(1), BoundedAppend(100),
+		HyperLogLog(MinHyperLogLogPrecision), HyperLogLog(MaxHyperLogLogPrecision),
+	} {
+		got, err := New(m.Name)
+		require.NoError(t, err, m.Name)
+		require.Equal(t, m.Name, got.Name)
+	}
+	for _, name := range []string{
+		"", "pebble.concatenate", "estore.boundedappend.0", "estore.boundedappend.01",
+		"estore.boundedappend.x", "estore.hyperloglog.3", "estore.hyperloglog.17",
+	} {
+		_, err := New(name)
+		require.Error(t, err, name)
+	}
+}
+
+func TestFixed64(t *testing.T) {
+	i64 := func(vs ...int64) [][]byte {
+		var ops [][]byte
+		for _, v := range vs {
+			ops = append(ops, EncodeInt64(v))
+		}
+		return ops
+	}
+	u64 := func(vs ...uint64) [][]byte {
+		var ops [][]byte
+		for _, v := range vs {
+			ops = append(ops, EncodeUint64(v))
+		}
+		return ops
+	}
+
+	testCases := []struct {
+		merger   *estore.Merger
+		operands [][]byte
+		want     []byte
+	}{
+		{Int64Add, i64(1, -5, 10), EncodeInt64(6)},
+		{Int64Add, i64(math.MaxInt64, 1), EncodeInt64(math.MinInt64)},
+		{Uint64Add, u64(1, 2, 3), EncodeUint64(6)},
+		{Int64Max, i64(-3, -1, -2), EncodeInt64(-1)},
+		{Int64Min, i64(3, -1, 2), EncodeInt64(-1)},
+		{Uint64Max, u64(3, math.MaxUint64, 2), EncodeUint64(math.MaxUint64)},
+		{Uint64Min, u64(3, 1, 2), EncodeUint64(1)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.merger.Name, func(t *testing.T) {
+			require.Equal(t, tc.want, checkMerger(t, tc.merger, tc.operands...))
+		})
+	}
+
+	_, err := Int64Add.Merge(nil, []byte("short"))
+	require.Error(t, err)
+	_, err = DecodeUint64(make([]byte, 9))
+	require.Error(t, err)
+}
+
+func TestSortedUvarintUnion(t *testing.T) {
+	require := require.New(t)
+
+	value := checkMerger(t, SortedUvarintUnion,
+		EncodeUvarintList([]uint64{5, 1, 300}),
+		EncodeUvarintList(nil),
+		EncodeUvarintList([]uint64{1, 2, 2, 1 << 40}),
+	)
+	values, err := DecodeUvarintList(value)
+	require.NoError(err)
+	require.Equal([]uint64{1, 2, 5, 300, 1 << 40}, values)
+
+	for _, invalid := range [][]byte{{2, 1}, {1, 1}, {0x80}} {
+		_, err := DecodeUvarintList(invalid)
+		require.Error(err)
+		_, err = SortedUvarintUnion.Merge(nil, invalid)
+		require.Error(err)
+	}
+}
+
+func TestBoundedAppend(t *testing.T) {
+	require := require.New(t)
+
+	list := func(elements ...string) []byte {
+		var bs [][]byte
+		for _, e := range elements {
+			bs = append(bs, []byte(e))
+		}
+		return EncodeList(bs...)
+	}
+	operands := [][]byte{list("a", "b"), list(), list("c"), list("d", "e", "f"), list("g")}
+
+	for limit, want := range map[int][]byte{
+		1:  list("g"),
+		3:  list("e", "f", "g"),
+		5:  list("c", "d", "e", "f", "g"),
+		10: list("a", "b", "c", "d", "e", "f", "g"),
+	} {
+		require.Equal(want, checkMerger(t, BoundedAppend(limit), operands...), "limit %d", limit)
+	}
+
+	elements, err := DecodeList(list("", "xyz"))
+	require.NoError(err)
+	require.Equal([][]byte{{}, []byte("xyz")}, elements)
+	_, err = DecodeList([]byte{5, 'a'})
+	require.Error(err)
+	require.Panics(func() { BoundedAppend(0) })
+}
+
+func TestDB(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	key := bytes.Repeat([]byte{2}, 16)
+	merger := BoundedAppend(2)
+	db, err := estore.Open("", &estore.Options{FS: fs, EncryptionKey: key, Merger: merger})
+	require.NoError(err)
+
+	get := func(key string) [][]byte {
+		value, closer, err := db.Get([]byte(key))
+		require.NoError(err)
+		defer closer.Close()
+		elements, err := DecodeList(value)
+		require.NoError(err)
+		return elements
+	}
+
+	for i := 0; i < 5; i++ {
+		require.NoError(db.Merge([]byte("k"), EncodeList([]byte(fmt.Sprint(i))), nil))
+		require.NoError(db.Flush())
+	}
+	require.Equal([][]byte{[]byte("3"), []byte("4")}, get("k"))
+	require.NoError(db.Compact([]byte("a"), []byte("z"), true))
+	require.Equal([][]byte{[]byte("3"), []byte("4")}, get("k"))
+	require.NoError(db.Close())
+
+	// the merger is recorded in the OPTIONS file
+	_, err = estore.Open("", &estore.Options{FS: fs, EncryptionKey: key, Merger: BoundedAppend(3)})
+	require.ErrorContains(err, merger.Name)
+	db, err = estore.Open("", &estore.Options{FS: fs, EncryptionKey: key, Merger: merger})
+	require.NoError(err)
+	require.NoError(db.Close())
+}
@@ -609,7 +609,7 @@ func (m *mergingIter) nextEntry(l *mergingIterLevel, succKey []byte) {
 	if invariants.Enabled && m.prefix != nil {
 		if s := m.split(l.iterKey.UserKey); !bytes.Equal(m.prefix, l.iterKey.UserKey[:s]) {
 			m.logger.Fatalf("mergingIter: prefix violation: nexting beyond prefix %q; existing heap root %q\n%s",
-				m.prefix, l.iterKey, debug.Stack())
+				base.UserData(m.prefix), l.iterKey, debug.Stack())
 		}
 	}
 
@@ -1040,7 +1040,7 @@ func (m *mergingIter) seekGE(key []byte, level int, flags base.SeekGEFlags) {
 
 	for ; level < len(m.levels); level++ {
 		if invariants.Enabled && m.lower != nil && m.heap.cmp(key, m.lower) < 0 {
-			m.logger.Fatalf("mergingIter: lower bound violation: %s < %s\n%s", key, m.lower, debug.Stack())
+			m.logger.Fatalf("mergingIter: lower bound violation: %s < %s\n%s", base.UserData(key), base.UserData(m.lower), debug.Stack())
 		}
 
 		l := &m.levels[level]
@@ -1132,7 +1132,7 @@ func (m *mergingIter) seekLT(key []byte, level int, flags base.SeekLTFlags) {
 	m.prefix = nil
 	for ; level < len(m.levels); level++ {
 		if invariants.Enabled && m.upper != nil && m.heap.cmp(key, m.upper) > 0 {
-			m.logger.Fatalf("mergingIter: upper bound violation: %s > %s\n%s", key, m.upper, debug.Stack())
+			m.logger.Fatalf("mergingIter: upper bound violation: %s > %s\n%s", base.UserData(key), base.UserData(m.upper), debug.Stack())
 		}
 
 		l := &m.levels[level]
@@ -1276,7 +1276,7 @@ func (m *mergingIter) NextPrefix(succKey []byte) (*InternalKey, LazyValue) {
 	m.levelsPositioned[(*root).index] = true
 	if invariants.Enabled && m.heap.cmp((*root).iterKey.UserKey, succKey) >= 0 {
 		m.logger.Fatalf("pebble: invariant violation: NextPrefix(%q) called on merging iterator already positioned at %q",
-			succKey, (*root).iterKey)
+			base.UserData(succKey), (*root).iterKey)
 	}
 	m.nextEntry(*root, succKey)
 	// NB: root is a pointer to the heap root. nextEntry may have changed
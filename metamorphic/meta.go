@@ -273,6 +273,15 @@ func RunAndCompare(t *testing.T, rootDir string, rOpts ...RunOption) {
 		}
 	}
 
+	// Pick the merger for all runs. Runs that start from the state of a
+	// previous run must use the merger of that run.
+	if runOpts.initialStatePath == "" && runOpts.previousOpsPath == "" {
+		merger := testMergers[rng.Intn(len(testMergers))]
+		for _, o := range options {
+			o.Opts.Merger = merger
+		}
+	}
+
 	// Run the options.
 	t.Run("execution", func(t *testing.T) {
 		for _, name := range names {
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"path/filepath"
@@ -19,6 +20,7 @@ import (
 	"github.com/edgelesssys/estore/internal/keyspan"
 	"github.com/edgelesssys/estore/internal/private"
 	"github.com/edgelesssys/estore/internal/testkeys"
+	"github.com/edgelesssys/estore/mergers"
 	"github.com/edgelesssys/estore/objstorage/objstorageprovider"
 	"github.com/edgelesssys/estore/sstable"
 	"github.com/edgelesssys/estore/vfs"
@@ -295,10 +297,78 @@ type mergeOp struct {
 
 func (o *mergeOp) run(t *test, h historyRecorder) {
 	w := t.getWriter(o.writerID)
-	err := w.Merge(o.key, o.value, t.writeOpts)
+	err := w.Merge(o.key, mergerValue(t.opts.Merger, o.value), t.writeOpts)
 	h.Recordf("%s // %v", o, err)
 }
 
+// testMergers are the mergers that a test may run with. All runs of a test
+// use the same merger.
+var testMergers = []*pebble.Merger{
+	pebble.DefaultMerger,
+	mergers.Int64Add,
+	mergers.Uint64Add,
+	mergers.Int64Max,
+	mergers.Int64Min,
+	mergers.Uint64Max,
+	mergers.Uint64Min,
+	mergers.SortedUvarintUnion,
+	mergers.BoundedAppend(4),
+	mergers.HyperLogLog(mergers.MinHyperLogLogPrecision),
+	mergers.JSONMergePatch,
+}
+
+// mergerValue deterministically derives a valid operand for the merger from
+// a generated value. Values written with Set are converted, too, as they're
+// the base of later merges.
+func mergerValue(merger *pebble.Merger, value []byte) []byte {
+	var n uint64
+	for _, b := range value {
+		n = n*31 + uint64(b)
+	}
+	switch merger.Name {
+	case mergers.Int64Add.Name, mergers.Int64Max.Name, mergers.Int64Min.Name:
+		// Use small numbers of both signs.
+		return mergers.EncodeInt64(int64(n%2001) - 1000)
+	case mergers.Uint64Add.Name, mergers.Uint64Max.Name, mergers.Uint64Min.Name:
+		return mergers.EncodeUint64(n)
+	case mergers.SortedUvarintUnion.Name:
+		values := make([]uint64, len(value))
+		for i, b := range value {
+			values[i] = uint64(b % 32)
+		}
+		return mergers.EncodeUvarintList(values)
+	case mergers.BoundedAppend(4).Name:
+		return mergers.EncodeList(value)
+	case mergers.HyperLogLog(mergers.MinHyperLogLogPrecision).Name:
+		elements := make([][]byte, len(value))
+		for i := range value {
+			elements[i] = value[i : i+1]
+		}
+		return mergers.HyperLogLogOperand(mergers.MinHyperLogLogPrecision, elements...)
+	case mergers.JSONMergePatch.Name:
+		// Build an object with few members, so that patches overlap. Some
+		// members are deleted or nested.
+		doc := map[string]any{}
+		for _, b := range value {
+			k := fmt.Sprintf("k%d", b%4)
+			switch {
+			case b%5 == 0:
+				doc[k] = nil
+			case b%7 == 0:
+				doc[k] = map[string]any{fmt.Sprintf("n%d", b%3): int(b)}
+			default:
+				doc[k] = int(b)
+			}
+		}
+		v, err := json.Marshal(doc)
+		if err != nil {
+			panic(err)
+		}
+		return v
+	}
+	return value
+}
+
 func (o *mergeOp) String() string       { return fmt.Sprintf("%s.Merge(%q, %q)", o.writerID, o.key, o.value) }
 func (o *mergeOp) receiver() objID      { return o.writerID }
 func (o *mergeOp) syncObjs() objIDSlice { return nil }
@@ -312,7 +382,7 @@ type setOp struct {
 
 func (o *setOp) run(t *test, h historyRecorder) {
 	w := t.getWriter(o.writerID)
-	err := w.Set(o.key, o.value, t.writeOpts)
+	err := w.Set(o.key, mergerValue(t.opts.Merger, o.value), t.writeOpts)
 	h.Recordf("%s // %v", o, err)
 }
 
@@ -19,6 +19,7 @@ import (
 	"github.com/edgelesssys/estore/bloom"
 	"github.com/edgelesssys/estore/internal/cache"
 	"github.com/edgelesssys/estore/internal/testkeys"
+	"github.com/edgelesssys/estore/mergers"
 	"github.com/edgelesssys/estore/objstorage/remote"
 	"github.com/edgelesssys/estore/sstable"
 	"github.com/edgelesssys/estore/vfs"
@@ -49,6 +50,7 @@ func parseOptions(
 	hooks := &pebble.ParseHooks{
 		NewCache:        pebble.NewCache,
 		NewFilterPolicy: filterPolicyFromName,
+		NewMerger:       mergers.New,
 		SkipUnknown: func(name, value string) bool {
 			switch name {
 			case "TestOptions":
@@ -12,6 +12,7 @@ import (
 	"github.com/cockroachdb/redact"
 	"github.com/edgelesssys/estore/internal/base"
 	"github.com/edgelesssys/estore/internal/cache"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/internal/humanize"
 	"github.com/edgelesssys/estore/objstorage/objstorageprovider/sharedcache"
 	"github.com/edgelesssys/estore/record"
@@ -161,6 +162,9 @@ type Metrics struct {
 		RewriteCount      int64
 		MultiLevelCount   int64
 		CounterLevelCount int64
+		// EDG: DownloadCount is the number of compactions scheduled by
+		// DB.Download.
+		DownloadCount int64
 		// An estimate of the number of bytes that need to be compacted for the LSM
 		// to reach a stable state.
 		EstimatedDebt uint64
@@ -298,6 +302,23 @@ type Metrics struct {
 
 	SecondaryCacheMetrics SecondaryCacheMetrics
 
+	// EDG: encryption metrics.
+	Encryption struct {
+		// Bytes encrypted and decrypted per file type. The counts refer to
+		// plaintext bytes.
+		Table, WAL, Manifest, Options EncryptionFileMetrics
+		// The number of ciphertexts that failed authentication since the DB was
+		// opened. A non-zero count indicates corruption or tampering.
+		AuthFailures uint64
+		// The most recent authentication failures, oldest first.
+		RecentAuthFailures []EncryptionAuthFailure
+		SaltChain          SaltChainMetrics
+		// MonotonicCounterLatency records the latencies of the
+		// Options.SetMonotonicCounter calls made by Transaction.Commit. It is
+		// nil if no monotonic counter is configured.
+		MonotonicCounterLatency prometheus.Histogram
+	}
+
 	private struct {
 		optionsFileSize  uint64
 		manifestFileSize uint64
@@ -312,6 +333,14 @@ var (
 		prometheus.ExponentialBucketsRange(float64(time.Millisecond*5), float64(10*time.Second), 50)...,
 	)
 
+	// MonotonicCounterLatencyBuckets are prometheus histogram buckets suitable
+	// for a histogram that records latencies of Options.SetMonotonicCounter.
+	// Trusted counters may be backed by hardware or a remote service, so the
+	// range is wide.
+	MonotonicCounterLatencyBuckets = prometheus.ExponentialBucketsRange(
+		float64(time.Microsecond*10), float64(10*time.Second), 50,
+	)
+
 	// SecondaryCacheIOBuckets exported to enable exporting from package pebble to
 	// enable exporting metrics with below buckets in CRDB.
 	SecondaryCacheIOBuckets = sharedcache.IOBuckets
@@ -320,6 +349,22 @@ var (
 	SecondaryCacheChannelWriteBuckets = sharedcache.ChannelWriteBuckets
 )
 
+// EncryptionFileMetrics holds the encryption metrics of one file type.
+type EncryptionFileMetrics struct {
+	BytesEncrypted uint64
+	BytesDecrypted uint64
+	// BytesPadded is the overhead of Options.BlockPadding and
+	// Options.WALPadding.
+	BytesPadded uint64
+}
+
+// EncryptionAuthFailure describes a block or chunk that failed authentication.
+type EncryptionAuthFailure = edg.AuthFailure
+
+// SaltChainMetrics describes the SALTCHAIN, which holds a salt per encrypted
+// file.
+type SaltChainMetrics = edg.ChainStats
+
 // DiskSpaceUsage returns the total disk space used by the database in bytes,
 // including live and obsolete files.
 func (m *Metrics) DiskSpaceUsage() uint64 {
@@ -414,6 +459,10 @@ func (m *Metrics) Total() LevelMetrics {
 //	Table iters: 21
 //	Filter utility: 47.4%
 //	Ingestions: 27  as flushable: 36 (34B in 35 tables)
+//	Encrypted: sstable: 37B  WAL: 38B  MANIFEST: 39B  OPTIONS: 40B
+//	Decrypted: sstable: 41B  WAL: 42B  MANIFEST: 43B  OPTIONS: 44B
+//	Auth failures: 45  last: sstable 000046 at offset 47
+//	Salt chain: 48 salts (49B)  verified in 50µs
 func (m *Metrics) String() string {
 	return redact.StringWithoutMarkers(m)
 }
@@ -598,6 +647,30 @@ func (m *Metrics) SafeFormat(w redact.SafePrinter, _ rune) {
 		redact.Safe(m.Flush.AsIngestCount),
 		humanize.Bytes.Uint64(m.Flush.AsIngestBytes),
 		redact.Safe(m.Flush.AsIngestTableCount))
+
+	enc := &m.Encryption
+	formatEncryptionMetrics := func(name redact.SafeString, bytes func(*EncryptionFileMetrics) uint64) {
+		w.Printf("%s: sstable: %s  WAL: %s  MANIFEST: %s  OPTIONS: %s\n",
+			name,
+			humanize.Bytes.Uint64(bytes(&enc.Table)),
+			humanize.Bytes.Uint64(bytes(&enc.WAL)),
+			humanize.Bytes.Uint64(bytes(&enc.Manifest)),
+			humanize.Bytes.Uint64(bytes(&enc.Options)))
+	}
+	formatEncryptionMetrics("Encrypted", func(m *EncryptionFileMetrics) uint64 { return m.BytesEncrypted })
+	formatEncryptionMetrics("Decrypted", func(m *EncryptionFileMetrics) uint64 { return m.BytesDecrypted })
+	formatEncryptionMetrics("Padded", func(m *EncryptionFileMetrics) uint64 { return m.BytesPadded })
+	w.Printf("Auth failures: %d", redact.Safe(enc.AuthFailures))
+	if n := len(enc.RecentAuthFailures); n > 0 {
+		last := enc.RecentAuthFailures[n-1]
+		w.Printf("  last: %s %s at offset %d",
+			redact.SafeString(last.FileType.String()), last.FileNum, redact.Safe(last.Offset))
+	}
+	w.Printf("\n")
+	w.Printf("Salt chain: %d salts (%s)  verified in %s\n",
+		redact.Safe(enc.SaltChain.Salts),
+		humanize.Bytes.Int64(enc.SaltChain.Size),
+		redact.Safe(enc.SaltChain.VerifyDuration))
 }
 
 func hitRate(hits, misses int64) float64 {
@@ -611,14 +684,16 @@ func percent(numerator, denominator int64) float64 {
 	return 100 * float64(numerator) / float64(denominator)
 }
 
-// StringForTests is identical to m.String() on 64-bit platforms. It is used to
-// provide a platform-independent result for tests.
+// StringForTests is identical to m.String() on 64-bit platforms, except for
+// timings, which are zeroed. It is used to provide a platform-independent and
+// deterministic result for tests.
 func (m *Metrics) StringForTests() string {
 	mCopy := *m
+	mCopy.Encryption.SaltChain.VerifyDuration = 0
 	if math.MaxInt == math.MaxInt32 {
 		// This is the difference in Sizeof(sstable.Reader{})) between 64 and 32 bit
 		// platforms.
-		const tableCacheSizeAdjustment = 212
+		const tableCacheSizeAdjustment = 216
 		mCopy.TableCache.Size += mCopy.TableCache.Count * tableCacheSizeAdjustment
 	}
 	return redact.StringWithoutMarkers(&mCopy)
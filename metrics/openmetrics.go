@@ -0,0 +1,476 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+// Package metrics exports the metrics of a DB in the OpenMetrics text format.
+//
+// Metric names and labels are stable, so dashboards and alerts can be shared
+// between services. All names are prefixed with a namespace, which defaults
+// to "estore". Per-level metrics carry a "level" label, cache metrics a
+// "cache" label, and encryption metrics a "file_type" label. Durations are
+// exported in seconds and sizes in bytes.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgelesssys/estore"
+	"github.com/prometheus/client_golang/prometheus"
+	prometheusgo "github.com/prometheus/client_model/go"
+)
+
+// ContentType is the HTTP content type of the OpenMetrics text format.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// DefaultNamespace is the default prefix of all metric names.
+const DefaultNamespace = "estore"
+
+// Source provides the metrics to export. It is implemented by *estore.DB.
+type Source interface {
+	Metrics() *estore.Metrics
+}
+
+// Collector exports the metrics of a Source in the OpenMetrics text format.
+type Collector struct {
+	source    Source
+	namespace string
+}
+
+var _ io.WriterTo = (*Collector)(nil)
+var _ http.Handler = (*Collector)(nil)
+
+// NewCollector creates a Collector for source. All metric names are prefixed
+// with namespace. If namespace is empty, DefaultNamespace is used.
+func NewCollector(source Source, namespace string) *Collector {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &Collector{source: source, namespace: namespace}
+}
+
+// WriteTo writes the current metrics of the source to w.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if err := Write(&buf, c.source.Metrics(), c.namespace); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP implements http.Handler. It responds with the current metrics of
+// the source.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var buf bytes.Buffer
+	if err := Write(&buf, c.source.Metrics(), c.namespace); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = buf.WriteTo(w)
+}
+
+// Write writes m to w in the OpenMetrics text format. All metric names are
+// prefixed with namespace. If namespace is empty, DefaultNamespace is used.
+func Write(w io.Writer, m *estore.Metrics, namespace string) error {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	e := &encoder{w: w, namespace: namespace}
+	e.writeLevels(m)
+	e.writeCompactions(m)
+	e.writeFlushes(m)
+	e.writeMemTables(m)
+	e.writeTables(m)
+	e.writeCaches(m)
+	e.writeWAL(m)
+	e.writeEncryption(m)
+	e.gauge("uptime_seconds", "Time since the DB was opened.").
+		sample(nil, m.Uptime.Seconds())
+	e.printf("# EOF\n")
+	return e.err
+}
+
+func (e *encoder) writeLevels(m *estore.Metrics) {
+	type levelMetric struct {
+		name, typ, help string
+		value           func(*estore.LevelMetrics) float64
+	}
+	levelMetrics := []levelMetric{
+		{"level_sublevels", typeGauge, "Number of sublevels in the level, i.e., its read amplification.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.Sublevels) }},
+		{"level_files", typeGauge, "Number of sstables in the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.NumFiles) }},
+		{"level_virtual_files", typeGauge, "Number of virtual sstables in the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.NumVirtualFiles) }},
+		{"level_size_bytes", typeGauge, "Total size of the sstables in the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.Size) }},
+		{"level_virtual_size_bytes", typeGauge, "Total size of the virtual sstables in the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.VirtualSize) }},
+		{"level_value_blocks_size_bytes", typeGauge, "Total size of the value blocks in the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.Additional.ValueBlocksSize) }},
+		{"level_score", typeGauge, "Compaction score of the level.",
+			func(l *estore.LevelMetrics) float64 { return l.Score }},
+		{"level_write_amp", typeGauge, "Write amplification of the level.",
+			func(l *estore.LevelMetrics) float64 { return l.WriteAmp() }},
+		{"level_in_bytes", typeCounter, "Bytes flowing into the level from other levels, excluding moves and ingestions.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.BytesIn) }},
+		{"level_ingested_bytes", typeCounter, "Bytes ingested into the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.BytesIngested) }},
+		{"level_moved_bytes", typeCounter, "Bytes moved into the level by move compactions.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.BytesMoved) }},
+		{"level_read_bytes", typeCounter, "Bytes read by compactions at the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.BytesRead) }},
+		{"level_compacted_bytes", typeCounter, "Bytes written by compactions into the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.BytesCompacted) }},
+		{"level_flushed_bytes", typeCounter, "Bytes written by flushes into the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.BytesFlushed) }},
+		{"level_compacted_tables", typeCounter, "Number of sstables compacted into the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.TablesCompacted) }},
+		{"level_flushed_tables", typeCounter, "Number of sstables flushed into the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.TablesFlushed) }},
+		{"level_ingested_tables", typeCounter, "Number of sstables ingested into the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.TablesIngested) }},
+		{"level_moved_tables", typeCounter, "Number of sstables moved into the level.",
+			func(l *estore.LevelMetrics) float64 { return float64(l.TablesMoved) }},
+	}
+	for _, lm := range levelMetrics {
+		f := e.family(lm.name, lm.typ, lm.help)
+		for level := range m.Levels {
+			f.sample([]string{"level", strconv.Itoa(level)}, lm.value(&m.Levels[level]))
+		}
+	}
+	e.gauge("read_amp", "Read amplification of the DB.").sample(nil, float64(m.ReadAmp()))
+}
+
+func (e *encoder) writeCompactions(m *estore.Metrics) {
+	c := &m.Compact
+	e.counter("compactions", "Number of compactions.").sample(nil, float64(c.Count))
+	f := e.counter("compactions_by_kind", "Number of compactions per kind.")
+	for _, k := range []struct {
+		kind  string
+		count int64
+	}{
+		{"default", c.DefaultCount},
+		{"delete", c.DeleteOnlyCount},
+		{"elision", c.ElisionOnlyCount},
+		{"move", c.MoveCount},
+		{"read", c.ReadCount},
+		{"rewrite", c.RewriteCount},
+		{"download", c.DownloadCount},
+	} {
+		f.sample([]string{"kind", k.kind}, float64(k.count))
+	}
+	e.counter("compactions_multilevel", "Number of multi-level compactions.").
+		sample(nil, float64(c.MultiLevelCount))
+	e.counter("compaction_duration_seconds", "Cumulative duration of compactions.").
+		sample(nil, c.Duration.Seconds())
+	e.gauge("compactions_in_progress", "Number of compactions in progress.").
+		sample(nil, float64(c.NumInProgress))
+	e.gauge("compaction_in_progress_bytes", "Bytes in sstables being written by compactions in progress.").
+		sample(nil, float64(c.InProgressBytes))
+	e.gauge("compaction_estimated_debt_bytes", "Estimated bytes to compact for the LSM to reach a stable state.").
+		sample(nil, float64(c.EstimatedDebt))
+	e.gauge("compaction_marked_files", "Number of sstables marked for compaction.").
+		sample(nil, float64(c.MarkedFiles))
+	e.counter("ingestions", "Number of ingestions.").sample(nil, float64(m.Ingest.Count))
+}
+
+func (e *encoder) writeFlushes(m *estore.Metrics) {
+	f := &m.Flush
+	e.counter("flushes", "Number of flushes.").sample(nil, float64(f.Count))
+	e.gauge("flushes_in_progress", "Number of flushes in progress.").sample(nil, float64(f.NumInProgress))
+	e.throughput("flush", "flushes", f.WriteThroughput)
+	e.counter("flushes_as_ingest", "Number of flushes of ingested sstables.").
+		sample(nil, float64(f.AsIngestCount))
+	e.counter("flushed_as_ingest_tables", "Number of ingested sstables flushed as flushables.").
+		sample(nil, float64(f.AsIngestTableCount))
+	e.counter("flushed_as_ingest_bytes", "Bytes of ingested sstables flushed as flushables.").
+		sample(nil, float64(f.AsIngestBytes))
+}
+
+func (e *encoder) writeMemTables(m *estore.Metrics) {
+	mt := &m.MemTable
+	e.gauge("memtables", "Number of memtables.").sample(nil, float64(mt.Count))
+	e.gauge("memtable_size_bytes", "Bytes allocated by memtables and large batches.").
+		sample(nil, float64(mt.Size))
+	e.gauge("memtable_zombies", "Number of zombie memtables.").sample(nil, float64(mt.ZombieCount))
+	e.gauge("memtable_zombie_size_bytes", "Bytes in zombie memtables.").sample(nil, float64(mt.ZombieSize))
+}
+
+func (e *encoder) writeTables(m *estore.Metrics) {
+	t := &m.Table
+	e.gauge("table_obsolete", "Number of obsolete sstables.").sample(nil, float64(t.ObsoleteCount))
+	e.gauge("table_obsolete_size_bytes", "Bytes in obsolete sstables.").sample(nil, float64(t.ObsoleteSize))
+	e.gauge("table_zombies", "Number of zombie sstables.").sample(nil, float64(t.ZombieCount))
+	e.gauge("table_zombie_size_bytes", "Bytes in zombie sstables.").sample(nil, float64(t.ZombieSize))
+	e.gauge("table_backing", "Number of backing sstables.").sample(nil, float64(t.BackingTableCount))
+	e.gauge("table_backing_size_bytes", "Bytes in backing sstables.").sample(nil, float64(t.BackingTableSize))
+	e.gauge("table_iterators", "Number of open sstable iterators.").sample(nil, float64(m.TableIters))
+
+	k := &m.Keys
+	e.gauge("range_key_sets", "Approximate number of range key sets.").sample(nil, float64(k.RangeKeySetsCount))
+	e.gauge("tombstones", "Approximate number of point and range tombstones.").
+		sample(nil, float64(k.TombstoneCount))
+	e.counter("missized_tombstones", "Number of missized DELSIZED keys encountered by compactions.").
+		sample(nil, float64(k.MissizedTombstonesCount))
+
+	s := &m.Snapshots
+	e.gauge("snapshots", "Number of open snapshots.").sample(nil, float64(s.Count))
+	e.gauge("snapshot_earliest_seqnum", "Sequence number of the earliest open snapshot.").
+		sample(nil, float64(s.EarliestSeqNum))
+	e.counter("snapshot_pinned_keys", "Keys written that would have been elided without open snapshots.").
+		sample(nil, float64(s.PinnedKeys))
+	e.counter("snapshot_pinned_bytes", "Bytes written that would have been elided without open snapshots.").
+		sample(nil, float64(s.PinnedSize))
+
+	e.counter("filter_hits", "Number of data block reads avoided by filters.").sample(nil, float64(m.Filter.Hits))
+	e.counter("filter_misses", "Number of filter checks that didn't avoid a data block read.").
+		sample(nil, float64(m.Filter.Misses))
+	e.counter("filter_range_hits", "Number of table reads avoided by range filters.").
+		sample(nil, float64(m.Filter.RangeHits))
+	e.counter("filter_range_misses", "Number of range filter checks that didn't avoid a table read.").
+		sample(nil, float64(m.Filter.RangeMisses))
+}
+
+func (e *encoder) writeCaches(m *estore.Metrics) {
+	caches := []struct {
+		name    string
+		metrics *estore.CacheMetrics
+	}{
+		{"block", &m.BlockCache},
+		{"table", &m.TableCache},
+	}
+	cacheMetrics := []struct {
+		name, typ, help string
+		value           func(*estore.CacheMetrics) int64
+	}{
+		{"cache_entries", typeGauge, "Number of entries in the cache.",
+			func(c *estore.CacheMetrics) int64 { return c.Count }},
+		{"cache_size_bytes", typeGauge, "Bytes in the cache.",
+			func(c *estore.CacheMetrics) int64 { return c.Size }},
+		{"cache_hits", typeCounter, "Number of cache hits.",
+			func(c *estore.CacheMetrics) int64 { return c.Hits }},
+		{"cache_misses", typeCounter, "Number of cache misses.",
+			func(c *estore.CacheMetrics) int64 { return c.Misses }},
+	}
+	for _, cm := range cacheMetrics {
+		f := e.family(cm.name, cm.typ, cm.help)
+		for _, c := range caches {
+			f.sample([]string{"cache", c.name}, float64(cm.value(c.metrics)))
+		}
+	}
+
+	sc := &m.SecondaryCacheMetrics
+	e.gauge("secondary_cache_entries", "Number of entries in the secondary cache.").
+		sample(nil, float64(sc.Count))
+	e.gauge("secondary_cache_size_bytes", "Bytes in the secondary cache.").sample(nil, float64(sc.Size))
+	e.counter("secondary_cache_reads", "Number of secondary cache reads.").sample(nil, float64(sc.TotalReads))
+	e.counter("secondary_cache_multi_shard_reads", "Number of secondary cache reads spanning shards.").
+		sample(nil, float64(sc.MultiShardReads))
+	e.counter("secondary_cache_multi_block_reads", "Number of secondary cache reads spanning blocks.").
+		sample(nil, float64(sc.MultiBlockReads))
+	e.counter("secondary_cache_reads_by_result", "Number of secondary cache reads per hit result.").
+		sample([]string{"result", "full_hit"}, float64(sc.ReadsWithFullHit)).
+		sample([]string{"result", "partial_hit"}, float64(sc.ReadsWithPartialHit)).
+		sample([]string{"result", "miss"}, float64(sc.ReadsWithNoHit))
+	e.counter("secondary_cache_evictions", "Number of secondary cache evictions.").
+		sample(nil, float64(sc.Evictions))
+	e.counter("secondary_cache_write_back_failures", "Number of failed secondary cache writes.").
+		sample(nil, float64(sc.WriteBackFailures))
+	e.histogram("secondary_cache_get_latency_seconds", "Latency of secondary cache gets.", sc.GetLatency)
+	e.histogram("secondary_cache_disk_read_latency_seconds", "Latency of secondary cache block reads.",
+		sc.DiskReadLatency)
+	e.histogram("secondary_cache_queue_put_latency_seconds", "Latency of queueing secondary cache writes.",
+		sc.QueuePutLatency)
+	e.histogram("secondary_cache_put_latency_seconds", "Latency of secondary cache puts.", sc.PutLatency)
+	e.histogram("secondary_cache_disk_write_latency_seconds", "Latency of secondary cache block writes.",
+		sc.DiskWriteLatency)
+}
+
+func (e *encoder) writeWAL(m *estore.Metrics) {
+	w := &m.WAL
+	e.gauge("wal_files", "Number of live WAL files.").sample(nil, float64(w.Files))
+	e.gauge("wal_obsolete_files", "Number of obsolete WAL files.").sample(nil, float64(w.ObsoleteFiles))
+	e.gauge("wal_obsolete_physical_size_bytes", "Physical size of the obsolete WAL files.").
+		sample(nil, float64(w.ObsoletePhysicalSize))
+	e.gauge("wal_size_bytes", "Size of the live data in the WAL files.").sample(nil, float64(w.Size))
+	e.gauge("wal_physical_size_bytes", "Physical size of the WAL files.").sample(nil, float64(w.PhysicalSize))
+	e.counter("wal_in_bytes", "Logical bytes written to the WAL.").sample(nil, float64(w.BytesIn))
+	e.counter("wal_written_bytes", "Physical bytes written to the WAL.").sample(nil, float64(w.BytesWritten))
+
+	lw := &m.LogWriter
+	e.histogram("wal_fsync_latency_seconds", "Latency of WAL fsyncs.", lw.FsyncLatency)
+	e.throughput("wal_writer", "the WAL writer", lw.WriteThroughput)
+	e.gauge("wal_writer_pending_buffer_len", "Mean number of pending WAL writer buffers.").
+		sample(nil, lw.PendingBufferLen.Mean())
+	e.gauge("wal_writer_sync_queue_len", "Mean length of the WAL writer sync queue.").
+		sample(nil, lw.SyncQueueLen.Mean())
+}
+
+func (e *encoder) writeEncryption(m *estore.Metrics) {
+	enc := &m.Encryption
+	files := []struct {
+		fileType string
+		metrics  *estore.EncryptionFileMetrics
+	}{
+		{"sstable", &enc.Table},
+		{"wal", &enc.WAL},
+		{"manifest", &enc.Manifest},
+		{"options", &enc.Options},
+	}
+	encrypted := e.counter("encrypted_bytes", "Plaintext bytes encrypted per file type.")
+	for _, f := range files {
+		encrypted.sample([]string{"file_type", f.fileType}, float64(f.metrics.BytesEncrypted))
+	}
+	decrypted := e.counter("decrypted_bytes", "Plaintext bytes decrypted per file type.")
+	for _, f := range files {
+		decrypted.sample([]string{"file_type", f.fileType}, float64(f.metrics.BytesDecrypted))
+	}
+	padded := e.counter("padded_bytes", "Bytes of padding written per file type.")
+	for _, f := range files {
+		padded.sample([]string{"file_type", f.fileType}, float64(f.metrics.BytesPadded))
+	}
+	e.counter("auth_failures", "Number of ciphertexts that failed authentication.").
+		sample(nil, float64(enc.AuthFailures))
+	e.gauge("salt_chain_salts", "Number of live salts in the SALTCHAIN.").sample(nil, float64(enc.SaltChain.Salts))
+	e.gauge("salt_chain_size_bytes", "Size of the SALTCHAIN.").sample(nil, float64(enc.SaltChain.Size))
+	e.gauge("salt_chain_verify_duration_seconds", "Time it took to verify the SALTCHAIN at open.").
+		sample(nil, enc.SaltChain.VerifyDuration.Seconds())
+	e.histogram("monotonic_counter_latency_seconds", "Latency of updating the trusted monotonic counter.",
+		enc.MonotonicCounterLatency)
+}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// encoder writes metric families in the OpenMetrics text format. The first
+// error is kept in err and all subsequent writes are skipped.
+type encoder struct {
+	w         io.Writer
+	namespace string
+	err       error
+}
+
+// family is a metric family that samples are added to.
+type family struct {
+	e    *encoder
+	name string
+	typ  string
+}
+
+func (e *encoder) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = fmt.Fprintf(e.w, format, args...)
+}
+
+func (e *encoder) family(name, typ, help string) *family {
+	name = e.namespace + "_" + name
+	e.printf("# TYPE %s %s\n", name, typ)
+	if unit := unitOf(name); unit != "" {
+		e.printf("# UNIT %s %s\n", name, unit)
+	}
+	e.printf("# HELP %s %s\n", name, help)
+	return &family{e: e, name: name, typ: typ}
+}
+
+func (e *encoder) counter(name, help string) *family {
+	return e.family(name, typeCounter, help)
+}
+
+func (e *encoder) gauge(name, help string) *family {
+	return e.family(name, typeGauge, help)
+}
+
+// throughput writes the counters of a ThroughputMetric with the given name
+// prefix.
+func (e *encoder) throughput(prefix, what string, t estore.ThroughputMetric) {
+	e.counter(prefix+"_bytes", "Bytes processed by "+what+".").sample(nil, float64(t.Bytes))
+	e.counter(prefix+"_work_duration_seconds", "Time spent working by "+what+".").
+		sample(nil, t.WorkDuration.Seconds())
+	e.counter(prefix+"_idle_duration_seconds", "Time spent idle by "+what+".").
+		sample(nil, t.IdleDuration.Seconds())
+}
+
+// histogram writes a histogram that records nanoseconds. The values are
+// exported in seconds. A nil histogram is written without samples.
+func (e *encoder) histogram(name, help string, h prometheus.Histogram) {
+	f := e.family(name, typeHistogram, help)
+	if h == nil {
+		return
+	}
+	var m prometheusgo.Metric
+	if err := h.Write(&m); err != nil {
+		if e.err == nil {
+			e.err = err
+		}
+		return
+	}
+	const nanosPerSecond = float64(time.Second)
+	hist := m.GetHistogram()
+	for _, b := range hist.GetBucket() {
+		e.printf("%s_bucket{le=\"%s\"} %d\n",
+			f.name, formatFloat(b.GetUpperBound()/nanosPerSecond), b.GetCumulativeCount())
+	}
+	e.printf("%s_bucket{le=\"+Inf\"} %d\n", f.name, hist.GetSampleCount())
+	e.printf("%s_sum %s\n", f.name, formatFloat(hist.GetSampleSum()/nanosPerSecond))
+	e.printf("%s_count %d\n", f.name, hist.GetSampleCount())
+}
+
+// sample adds a sample with the given label name-value pairs to f.
+func (f *family) sample(labels []string, value float64) *family {
+	name := f.name
+	if f.typ == typeCounter {
+		name += "_total"
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+		}
+		b.WriteByte('}')
+	}
+	f.e.printf("%s %s\n", b.String(), formatFloat(value))
+	return f
+}
+
+// unitOf returns the OpenMetrics unit of a metric name, which is its suffix
+// if the suffix is a unit.
+func unitOf(name string) string {
+	for _, unit := range []string{"bytes", "seconds"} {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
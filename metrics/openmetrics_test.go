@@ -0,0 +1,95 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	require := require.New(t)
+
+	db, err := estore.Open("db", &estore.Options{
+		EncryptionKey: bytes.Repeat([]byte{2}, 16),
+		FS:            vfs.NewMem(),
+		Logger:        base.NoopLoggerAndTracer{},
+	})
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Set([]byte("key"), []byte("val"), estore.Sync))
+	require.NoError(db.Flush())
+
+	var buf bytes.Buffer
+	_, err = NewCollector(db, "").WriteTo(&buf)
+	require.NoError(err)
+	out := buf.String()
+	requireWellFormed(t, out)
+	require.Contains(out, "# TYPE estore_level_files gauge\n")
+	require.Contains(out, "estore_level_files{level=\"0\"} 1\n")
+	require.Contains(out, "estore_flushes_total 1\n")
+	require.Contains(out, "# UNIT estore_wal_fsync_latency_seconds seconds\n")
+	require.Contains(out, "estore_wal_fsync_latency_seconds_bucket{le=\"+Inf\"}")
+	require.Contains(out, "estore_cache_hits_total{cache=\"block\"}")
+	require.Contains(out, "estore_auth_failures_total 0\n")
+	require.NotContains(out, "estore_encrypted_bytes_total{file_type=\"sstable\"} 0\n")
+
+	// custom namespace
+	buf.Reset()
+	_, err = NewCollector(db, "svc").WriteTo(&buf)
+	require.NoError(err)
+	requireWellFormed(t, buf.String())
+	require.Contains(buf.String(), "svc_read_amp 1\n")
+	require.NotContains(buf.String(), "estore_")
+
+	// HTTP
+	rec := httptest.NewRecorder()
+	NewCollector(db, "").ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(ContentType, rec.Header().Get("Content-Type"))
+	requireWellFormed(t, rec.Body.String())
+}
+
+// requireWellFormed checks that every sample belongs to the preceding
+// metric family and that the exposition is terminated by # EOF.
+func requireWellFormed(t *testing.T, out string) {
+	t.Helper()
+	require.True(t, strings.HasSuffix(out, "\n# EOF\n"))
+	families := map[string]bool{}
+	var family, typ string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n# EOF\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			require.Len(t, fields, 4, line)
+			family, typ = fields[2], fields[3]
+			require.False(t, families[family], "duplicate family %s", family)
+			families[family] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# ") {
+			require.Equal(t, family, strings.Fields(line)[2], line)
+			continue
+		}
+		name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		switch typ {
+		case "counter":
+			require.Equal(t, family+"_total", name, line)
+		case "gauge":
+			require.Equal(t, family, name, line)
+		case "histogram":
+			require.Contains(t, []string{family + "_bucket", family + "_sum", family + "_count"}, name, line)
+		default:
+			t.Fatalf("unexpected type %q", typ)
+		}
+	}
+}
@@ -67,6 +67,13 @@ func exampleMetrics() Metrics {
 	m.WAL.BytesIn = 25
 	m.WAL.BytesWritten = 26
 	m.Ingest.Count = 27
+	m.Encryption.Table = EncryptionFileMetrics{BytesEncrypted: 37, BytesDecrypted: 41}
+	m.Encryption.WAL = EncryptionFileMetrics{BytesEncrypted: 38, BytesDecrypted: 42}
+	m.Encryption.Manifest = EncryptionFileMetrics{BytesEncrypted: 39, BytesDecrypted: 43}
+	m.Encryption.Options = EncryptionFileMetrics{BytesEncrypted: 40, BytesDecrypted: 44}
+	m.Encryption.AuthFailures = 45
+	m.Encryption.RecentAuthFailures = []EncryptionAuthFailure{{FileNum: 46, Offset: 47}}
+	m.Encryption.SaltChain = SaltChainMetrics{Salts: 48, Size: 49, VerifyDuration: 50 * time.Microsecond}
 
 	for i := range m.Levels {
 		l := &m.Levels[i]
@@ -0,0 +1,191 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/edgelesssys/estore/internal/manual"
+)
+
+// MultiGetResult is the result of the lookup of a key by MultiGet.
+type MultiGetResult struct {
+	// Value is the value of the key. The caller should not modify its contents.
+	// It remains valid until Closer is closed.
+	Value []byte
+	// Closer is set if Err is nil. The caller MUST close it when it no longer
+	// needs Value.
+	Closer io.Closer
+	// Err is ErrNotFound if the key is not found, or the error that occurred
+	// while looking up the key.
+	Err error
+}
+
+// MultiGet gets the values for the given keys. It returns a result for each
+// key in the order of the keys, with a value and a closer or an error. Keys
+// that aren't found have the error ErrNotFound.
+//
+// MultiGet is more efficient than calling Get for each key. It looks up the
+// keys in sorted order through a single iterator, so the iterators of the
+// memtables and levels are shared by all keys, each table and its filter are
+// only loaded once, and a data block that holds several of the keys is only
+// read and decrypted once. If the comparer has a Split function, the lookups
+// use the filters like Get does.
+//
+// It is safe to modify the contents of the keys after MultiGet returns.
+func (d *DB) MultiGet(keys [][]byte) []MultiGetResult {
+	return d.multiGet(keys, nil /* batch */, nil /* snapshot */)
+}
+
+// MultiGet is like DB.MultiGet, but reads from the snapshot.
+func (s *Snapshot) MultiGet(keys [][]byte) []MultiGetResult {
+	if s.db == nil {
+		panic(ErrClosed)
+	}
+	return s.db.multiGet(keys, nil /* batch */, s)
+}
+
+// MultiGet is like DB.MultiGet, but also reads the writes of the transaction.
+func (t *Transaction) MultiGet(keys [][]byte) []MultiGetResult {
+	if t.Batch == nil {
+		return t.snap.MultiGet(keys)
+	}
+	return t.db.multiGet(keys, t.Batch, t.snap)
+}
+
+// multiGetValues holds the values of a MultiGet. It is shared by the results
+// and released when all their closers are closed.
+type multiGetValues struct {
+	data []byte
+	refs atomic.Int32
+}
+
+var multiGetValuesPool = sync.Pool{
+	New: func() interface{} {
+		return &multiGetValues{}
+	},
+}
+
+// multiGetValuesMaxPooledSize is the maximum size of the values that are
+// returned to the pool to avoid holding on to large buffers.
+const multiGetValuesMaxPooledSize = 1 << 20
+
+func (v *multiGetValues) unref() {
+	if v.refs.Add(-1) != 0 {
+		return
+	}
+	// EDG: the values are plaintext
+	manual.Scrub(v.data)
+	if cap(v.data) <= multiGetValuesMaxPooledSize {
+		v.data = v.data[:0]
+		multiGetValuesPool.Put(v)
+	}
+}
+
+type multiGetCloser struct {
+	values *multiGetValues
+}
+
+func (c *multiGetCloser) Close() error {
+	if c.values != nil {
+		c.values.unref()
+		c.values = nil
+	}
+	return nil
+}
+
+func (d *DB) multiGet(keys [][]byte, b *Batch, s *Snapshot) []MultiGetResult {
+	results := make([]MultiGetResult, len(keys))
+	if len(keys) == 0 {
+		return results
+	}
+	var seqNum uint64
+	if s != nil {
+		seqNum = s.seqNum
+	}
+	iter := d.newIter(context.Background(), b, snapshotIterOpts{seqNum: seqNum}, nil)
+
+	// Look up the keys in sorted order, so that the iterator only moves
+	// forward and can step instead of seeking.
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	cmp := d.opts.Comparer.Compare
+	sort.SliceStable(order, func(i, j int) bool {
+		return cmp(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	values := multiGetValuesPool.Get().(*multiGetValues)
+	// offsets holds the position of each value in values.data until all values
+	// are read, because values.data may be reallocated.
+	offsets := make([][2]int, len(keys))
+	found := 0
+	for n, i := range order {
+		key := keys[i]
+		if n > 0 && d.opts.Comparer.Equal(key, keys[order[n-1]]) {
+			prev := order[n-1]
+			results[i].Err = results[prev].Err
+			offsets[i] = offsets[prev]
+			if results[i].Err == nil {
+				found++
+			}
+			continue
+		}
+
+		var valid bool
+		if d.opts.Comparer.Split != nil {
+			valid = iter.SeekPrefixGE(key)
+		} else {
+			valid = iter.SeekGE(key)
+		}
+		if !valid || !d.opts.Comparer.Equal(iter.Key(), key) {
+			results[i].Err = iter.Error()
+			if results[i].Err == nil {
+				results[i].Err = ErrNotFound
+			}
+			continue
+		}
+		value, err := iter.ValueAndErr()
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		offsets[i] = [2]int{len(values.data), len(values.data) + len(value)}
+		values.data = append(values.data, value...)
+		found++
+	}
+	if err := iter.Close(); err != nil {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = err
+				found--
+			}
+		}
+	}
+
+	if found == 0 {
+		values.refs.Store(1)
+		values.unref()
+		return results
+	}
+	values.refs.Store(int32(found))
+	closers := make([]multiGetCloser, len(keys))
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		closers[i].values = values
+		results[i].Value = values.data[offsets[i][0]:offsets[i][1]:offsets[i][1]]
+		results[i].Closer = &closers[i]
+	}
+	return results
+}
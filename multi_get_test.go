@@ -0,0 +1,202 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/edgelesssys/estore/bloom"
+	"github.com/edgelesssys/estore/internal/manual"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// readMultiGetResults returns the values of the results, with "!" for keys that
+// aren't found, and closes the results.
+func readMultiGetResults(t *testing.T, results []MultiGetResult) []string {
+	var values []string
+	for _, res := range results {
+		if res.Err == ErrNotFound {
+			values = append(values, "!")
+			continue
+		}
+		require.NoError(t, res.Err)
+		values = append(values, string(res.Value))
+		require.NoError(t, res.Closer.Close())
+	}
+	return values
+}
+
+func TestMultiGet(t *testing.T) {
+	require := require.New(t)
+
+	d, err := Open("", &Options{
+		FS:     vfs.NewMem(),
+		Levels: []LevelOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+		Merger: &Merger{
+			Merge: func(key, value []byte) (ValueMerger, error) {
+				return &testMultiGetMerger{value: append([]byte(nil), value...)}, nil
+			},
+			Name: "test",
+		},
+
+		DisableAutomaticCompactions: true,
+	})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+
+	// keys in two tables, the memtable, and a merge spanning them
+	for i := 0; i < 100; i++ {
+		require.NoError(d.Set([]byte(fmt.Sprintf("a%02d", i)), []byte(fmt.Sprint("a", i)), nil))
+	}
+	require.NoError(d.Merge([]byte("m"), []byte("1"), nil))
+	require.NoError(d.Flush())
+	for i := 0; i < 100; i += 2 {
+		require.NoError(d.Set([]byte(fmt.Sprintf("a%02d", i)), []byte(fmt.Sprint("b", i)), nil))
+	}
+	require.NoError(d.Merge([]byte("m"), []byte("2"), nil))
+	require.NoError(d.Flush())
+	require.NoError(d.Delete([]byte("a01"), nil))
+	require.NoError(d.Merge([]byte("m"), []byte("3"), nil))
+
+	keys := [][]byte{
+		[]byte("a03"), []byte("m"), []byte("a01"), []byte("a02"), []byte("z"),
+		[]byte("a03"), []byte("a"), []byte("a99"), []byte("a98"),
+	}
+	want := []string{"a3", "123", "!", "b2", "!", "a3", "!", "a99", "b98"}
+	require.Equal(want, readMultiGetResults(t, d.MultiGet(keys)))
+	for i, key := range keys {
+		value, closer, err := d.Get(key)
+		if want[i] == "!" {
+			require.ErrorIs(err, ErrNotFound)
+			continue
+		}
+		require.NoError(err)
+		require.Equal(want[i], string(value))
+		require.NoError(closer.Close())
+	}
+	require.Empty(d.MultiGet(nil))
+
+	// Values remain valid until their closer is closed, and the keys can be
+	// modified.
+	results := d.MultiGet(keys[:2])
+	keys[0][0] = 'x'
+	require.NoError(results[1].Closer.Close())
+	require.Equal([]string{"!"}, readMultiGetResults(t, d.MultiGet(keys[:1])))
+	require.Equal("a3", string(results[0].Value))
+	require.NoError(results[0].Closer.Close())
+	keys[0][0] = 'a'
+
+	// snapshots
+	snap := d.NewSnapshot()
+	require.NoError(d.Set([]byte("a01"), []byte("c1"), nil))
+	require.NoError(d.Delete([]byte("a02"), nil))
+	require.Equal([]string{"!", "b2"}, readMultiGetResults(t, snap.MultiGet(keys[2:4])))
+	require.Equal([]string{"c1", "!"}, readMultiGetResults(t, d.MultiGet(keys[2:4])))
+	require.NoError(snap.Close())
+
+	// transactions read their own writes at their snapshot
+	tx := d.NewTransaction(true)
+	require.NoError(d.Set([]byte("a04"), []byte("c4"), nil))
+	require.NoError(tx.Set([]byte("a05"), []byte("t5"), nil))
+	require.NoError(tx.Delete([]byte("a03"), nil))
+	txKeys := [][]byte{[]byte("a05"), []byte("a04"), []byte("a03"), []byte("a01")}
+	require.Equal([]string{"t5", "b4", "!", "c1"}, readMultiGetResults(t, tx.MultiGet(txKeys)))
+	tx.Close()
+	tx = d.NewTransaction(false)
+	require.Equal([]string{"a5", "c4", "a3", "c1"}, readMultiGetResults(t, tx.MultiGet(txKeys)))
+	tx.Close()
+}
+
+type testMultiGetMerger struct {
+	value []byte
+}
+
+func (m *testMultiGetMerger) MergeNewer(value []byte) error {
+	m.value = append(m.value, value...)
+	return nil
+}
+
+func (m *testMultiGetMerger) MergeOlder(value []byte) error {
+	m.value = append(append([]byte(nil), value...), m.value...)
+	return nil
+}
+
+func (m *testMultiGetMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	return m.value, nil, nil
+}
+
+func TestMultiGetZeroizeMemory(t *testing.T) {
+	require := require.New(t)
+	manual.EnableZeroization()
+	defer manual.TestDisableZeroization()
+
+	d, err := Open("", &Options{FS: vfs.NewMem()})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+	require.NoError(d.Set([]byte("a"), []byte("secret"), nil))
+	require.NoError(d.Flush())
+	require.NoError(d.Set([]byte("b"), []byte("secret"), nil))
+
+	results := d.MultiGet([][]byte{[]byte("a"), []byte("b")})
+	var values [][]byte
+	for _, res := range results {
+		require.NoError(res.Err)
+		require.Equal("secret", string(res.Value))
+		values = append(values, res.Value)
+	}
+	for _, res := range results {
+		require.NoError(res.Closer.Close())
+	}
+
+	// the values are overwritten before they are returned to the pool
+	for _, v := range values {
+		require.Equal(make([]byte, len(v)), v)
+	}
+}
+
+func BenchmarkMultiGet(b *testing.B) {
+	d, err := Open("", &Options{
+		FS:     vfs.NewMem(),
+		Levels: []LevelOptions{{FilterPolicy: bloom.FilterPolicy(10)}},
+	})
+	require.NoError(b, err)
+	defer d.Close()
+	const numKeys = 10000
+	for i := 0; i < numKeys; i++ {
+		require.NoError(b, d.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value"), nil))
+	}
+	require.NoError(b, d.Flush())
+	keys := make([][]byte, 200)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%05d", i*numKeys/len(keys)))
+	}
+
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				_, closer, err := d.Get(key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				closer.Close()
+			}
+		}
+	})
+	b.Run("MultiGet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, res := range d.MultiGet(keys) {
+				if res.Err != nil {
+					b.Fatal(res.Err)
+				}
+				res.Closer.Close()
+			}
+		}
+	})
+}
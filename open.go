@@ -90,6 +90,13 @@ func open(dirname string, opts *Options) (db *DB, _ error) {
 	if err := opts.Validate(); err != nil {
 		return nil, err
 	}
+	if opts.RedactUserData {
+		base.EnableRedaction()
+		opts.Comparer = base.RedactComparer(opts.Comparer)
+	}
+	if opts.ZeroizeMemory {
+		manual.EnableZeroization()
+	}
 	if opts.LoggerAndTracer == nil {
 		opts.LoggerAndTracer = &base.LoggerWithNoopTracer{Logger: opts.Logger}
 	} else {
@@ -266,11 +273,30 @@ func open(dirname string, opts *Options) (db *DB, _ error) {
 
 	setCurrent := setCurrentFunc(d.FormatMajorVersion(), manifestMarker, opts.FS, dirname, d.dataDir)
 
-	d.keyManager, err = edg.NewKeyManager(opts.FS, dirname, d.opts.EncryptionKey)
+	if err := edgCheckEncryptionMode(opts, dirname); err != nil {
+		return nil, err
+	}
+	d.keyManager, err = edgNewKeyManager(d.opts, dirname)
 	if err != nil {
 		return nil, err
 	}
 	d.mu.versions.keyManager = d.keyManager
+	if opts.private.observeKeyManager != nil {
+		opts.private.observeKeyManager(d.keyManager)
+	}
+	// EDG: A torn block at the end of the SALTCHAIN of an existing DB is
+	// dropped once the files that the DB references are known. Until then,
+	// nothing can be appended, so the markers are only verified.
+	_, tornSaltChain := d.keyManager.TornTail()
+	tornSaltChain = tornSaltChain && manifestExists
+	if !tornSaltChain {
+		if err := d.edgDropTornSaltBlock(formatVersion, manifestFileNum, manifestExists, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.edgVerifyMarkers(formatVersion, manifestFileNum, manifestExists, !tornSaltChain); err != nil {
+		return nil, err
+	}
 
 	if !manifestExists {
 		// DB does not exist.
@@ -340,7 +366,25 @@ func open(dirname string, opts *Options) (db *DB, _ error) {
 		return nil, err
 	}
 
-	d.cleanupManager = openCleanupManager(opts, d.objProvider, d.onObsoleteTableDelete, d.getDeletionPacerInfo)
+	d.cleanupManager = openCleanupManager(opts, d.objProvider, d.onObsoleteTableDelete, d.getDeletionPacerInfo, d.keyManager)
+
+	// EDG: Drop the torn block now that the recovered version and the WALs to
+	// replay are known, and record the markers.
+	if tornSaltChain {
+		var walNums []base.FileNum
+		for _, filename := range ls {
+			if ft, fn, ok := base.ParseFilename(opts.FS, filename); ok && ft == fileTypeLog &&
+				fn.FileNum() >= d.mu.versions.minUnflushedLogNum {
+				walNums = append(walNums, fn.FileNum())
+			}
+		}
+		if err := d.edgDropTornSaltBlock(formatVersion, manifestFileNum, manifestExists, walNums); err != nil {
+			return nil, err
+		}
+		if err := d.edgVerifyMarkers(formatVersion, manifestFileNum, manifestExists, true); err != nil {
+			return nil, err
+		}
+	}
 
 	if manifestExists {
 		curVersion := d.mu.versions.currentVersion()
@@ -426,13 +470,34 @@ func open(dirname string, opts *Options) (db *DB, _ error) {
 
 	var ve versionEdit
 	var toFlush flushableList
+	var truncatedLogNum FileNum
 	for i, lf := range logFiles {
+		path := opts.FS.PathJoin(d.walDirname, lf.name)
+		if truncatedLogNum != 0 {
+			// In PointInTimeRecovery mode, replay stops at the first torn WAL.
+			// Subsequent WALs are discarded so that the recovered state is
+			// consistent.
+			d.opts.EventListener.WALTailTruncated(WALTailTruncatedInfo{
+				JobID:   jobID,
+				Path:    path,
+				FileNum: lf.num,
+				Err:     errors.Newf("pebble: preceding WAL %s was truncated", truncatedLogNum),
+			})
+			d.mu.versions.markFileNumUsed(lf.num)
+			continue
+		}
 		lastWAL := i == len(logFiles)-1
-		flush, maxSeqNum, err := d.replayWAL(jobID, &ve, opts.FS,
-			opts.FS.PathJoin(d.walDirname, lf.name), lf.num, strictWALTail && !lastWAL)
+		flush, maxSeqNum, truncated, err := d.replayWAL(jobID, &ve, opts.FS, path, lf.num,
+			opts.WALRecoveryMode.toleratesTornTail(lastWAL, strictWALTail))
 		if err != nil {
 			return nil, err
 		}
+		if truncated {
+			d.walTailTruncated = true
+			if opts.WALRecoveryMode == PointInTimeRecovery {
+				truncatedLogNum = lf.num
+			}
+		}
 		toFlush = append(toFlush, flush...)
 		d.mu.versions.markFileNumUsed(lf.num)
 		if d.mu.versions.logSeqNum.Load() < maxSeqNum {
@@ -504,6 +569,7 @@ func open(dirname string, opts *Options) (db *DB, _ error) {
 		}
 		d.mu.log.LogWriter = record.NewLogWriter(logFile, newLogNum, logWriterConfig)
 		d.mu.log.LogWriter.EncryptionKey = encryptionKey
+		d.mu.log.LogWriter.EncryptionStats = d.keyManager.Stats().File(edg.FileTypeWAL)
 		d.mu.versions.metrics.WAL.Files++
 	}
 	d.updateReadStateLocked(d.opts.DebugCheck)
@@ -536,7 +602,7 @@ func open(dirname string, opts *Options) (db *DB, _ error) {
 		}
 		serializedOpts := []byte(opts.String())
 
-		encryptedOpts, err := edg.EncryptOptions(serializedOpts, d.optionsFileNum, d.keyManager)
+		encryptedOpts, err := edg.EncryptOptions(d.edgOptionsHeader(), serializedOpts, d.optionsFileNum, d.keyManager)
 		if err != nil {
 			return nil, errors.CombineErrors(err, optionsFile.Close())
 		}
@@ -563,6 +629,9 @@ func open(dirname string, opts *Options) (db *DB, _ error) {
 	}
 
 	if !d.opts.ReadOnly {
+		if err := d.edgPruneSaltsLocked(); err != nil {
+			return nil, err
+		}
 		d.scanObsoleteFiles(ls)
 		d.deleteObsoleteFiles(jobID)
 	} else {
@@ -679,13 +748,8 @@ func GetVersion(dir string, fs vfs.FS) (string, error) {
 			} else {
 				continue
 			}
-			f, err := fs.Open(fs.PathJoin(dir, filename))
-			if err != nil {
-				return "", err
-			}
-			data, err := io.ReadAll(f)
-			f.Close()
-
+			// EDG: the version is in the plaintext header
+			data, _, err := edgReadOptionsHeader(fs, fs.PathJoin(dir, filename))
 			if err != nil {
 				return "", err
 			}
@@ -719,14 +783,19 @@ func GetVersion(dir string, fs vfs.FS) (string, error) {
 // to the manifest, it is up to the caller of replayWAL to unreference the
 // toFlush flushables returned by replayWAL.
 //
+// If tolerateTornTail is true, a torn write at the end of the log (see
+// record.Reader.TornTail) ends the replay instead of failing it. The discarded
+// tail is reported through EventListener.WALTailTruncated and the truncated
+// return value is set.
+//
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) replayWAL(
-	jobID int, ve *versionEdit, fs vfs.FS, filename string, logNum FileNum, strictWALTail bool,
-) (toFlush flushableList, maxSeqNum uint64, err error) {
+	jobID int, ve *versionEdit, fs vfs.FS, filename string, logNum FileNum, tolerateTornTail bool,
+) (toFlush flushableList, maxSeqNum uint64, truncated bool, err error) {
 	file, err := fs.Open(filename)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, false, err
 	}
 	defer file.Close()
 	var (
@@ -808,9 +877,11 @@ func (d *DB) replayWAL(
 
 	encryptionKey, err := d.keyManager.Get(logNum)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, false, err
 	}
 	rr.EncryptionKey = encryptionKey
+	rr.EncryptionStats = d.keyManager.Stats().File(edg.FileTypeWAL)
+	rr.TolerateTornTail = tolerateTornTail
 
 	for {
 		offset = rr.Offset()
@@ -826,19 +897,37 @@ func (d *DB) replayWAL(
 			// to otherwise treat them like EOF.
 			if err == io.EOF {
 				break
-			} else if record.IsInvalidRecord(err) && !strictWALTail {
-				break
 			}
-			return nil, 0, errors.Wrap(err, "pebble: error when replaying WAL")
+			// EDG: a chunk that fails authentication is only tolerated if it is
+			// a torn write at the very end of the log. Anything else indicates
+			// tampering.
+			if tolerateTornTail {
+				torn, tornErr := rr.TornTail()
+				if tornErr != nil {
+					return nil, 0, false, tornErr
+				}
+				if torn {
+					d.opts.EventListener.WALTailTruncated(WALTailTruncatedInfo{
+						JobID:   jobID,
+						Path:    filename,
+						FileNum: logNum,
+						Offset:  offset,
+						Err:     err,
+					})
+					truncated = true
+					break
+				}
+			}
+			return nil, 0, false, errors.Wrap(err, "pebble: error when replaying WAL")
 		}
 
 		if buf.Len() < batchHeaderLen {
-			return nil, 0, base.CorruptionErrorf("pebble: corrupt log file %q (num %s)",
+			return nil, 0, false, base.CorruptionErrorf("pebble: corrupt log file %q (num %s)",
 				filename, errors.Safe(logNum))
 		}
 
 		if d.opts.ErrorIfNotPristine {
-			return nil, 0, errors.WithDetailf(ErrDBNotPristine, "location: %q", d.dirname)
+			return nil, 0, false, errors.WithDetailf(ErrDBNotPristine, "location: %q", d.dirname)
 		}
 
 		// Specify Batch.db so that Batch.SetRepr will compute Batch.memTableSize
@@ -853,7 +942,7 @@ func (d *DB) replayWAL(
 		{
 			br := b.Reader()
 			if kind, encodedFileNum, _, ok, err := br.Next(); err != nil {
-				return nil, 0, err
+				return nil, 0, false, err
 			} else if ok && kind == InternalKeyKindIngestSST {
 				fileNums := make([]base.DiskFileNum, 0, b.Count())
 				addFileNum := func(encodedFileNum []byte) {
@@ -868,7 +957,7 @@ func (d *DB) replayWAL(
 				for i := 1; i < int(b.Count()); i++ {
 					kind, encodedFileNum, _, ok, err := br.Next()
 					if err != nil {
-						return nil, 0, err
+						return nil, 0, false, err
 					}
 					if kind != InternalKeyKindIngestSST {
 						panic("pebble: invalid batch key kind.")
@@ -880,7 +969,7 @@ func (d *DB) replayWAL(
 				}
 
 				if _, _, _, ok, err := br.Next(); err != nil {
-					return nil, 0, err
+					return nil, 0, false, err
 				} else if ok {
 					panic("pebble: invalid number of entries in batch.")
 				}
@@ -890,29 +979,29 @@ func (d *DB) replayWAL(
 					var readable objstorage.Readable
 					objMeta, err := d.objProvider.Lookup(fileTypeTable, n)
 					if err != nil {
-						return nil, 0, errors.Wrap(err, "pebble: error when looking up ingested SSTs")
+						return nil, 0, false, errors.Wrap(err, "pebble: error when looking up ingested SSTs")
 					}
 					if objMeta.IsRemote() {
 						readable, err = d.objProvider.OpenForReading(context.TODO(), fileTypeTable, n, objstorage.OpenOptions{MustExist: true})
 						if err != nil {
-							return nil, 0, errors.Wrap(err, "pebble: error when opening flushable ingest files")
+							return nil, 0, false, errors.Wrap(err, "pebble: error when opening flushable ingest files")
 						}
 					} else {
 						path := base.MakeFilepath(d.opts.FS, d.dirname, fileTypeTable, n)
 						f, err := d.opts.FS.Open(path)
 						if err != nil {
-							return nil, 0, err
+							return nil, 0, false, err
 						}
 
 						readable, err = sstable.NewSimpleReadable(f)
 						if err != nil {
-							return nil, 0, err
+							return nil, 0, false, err
 						}
 					}
 					// NB: ingestLoad1 will close readable.
 					meta[i], err = ingestLoad1(d.opts, d.FormatMajorVersion(), readable, d.cacheID, n)
 					if err != nil {
-						return nil, 0, errors.Wrap(err, "pebble: error when loading flushable ingest files")
+						return nil, 0, false, errors.Wrap(err, "pebble: error when loading flushable ingest files")
 					}
 				}
 
@@ -924,7 +1013,7 @@ func (d *DB) replayWAL(
 					meta, seqNum, logNum,
 				)
 				if err != nil {
-					return nil, 0, err
+					return nil, 0, false, err
 				}
 
 				if d.opts.ReadOnly {
@@ -965,7 +1054,7 @@ func (d *DB) replayWAL(
 						ve.NewFiles = append(ve.NewFiles, newFileEntry{Level: 0, Meta: file.FileMetadata})
 					}
 				}
-				return toFlush, maxSeqNum, nil
+				return toFlush, maxSeqNum, false, nil
 			}
 		}
 
@@ -976,7 +1065,7 @@ func (d *DB) replayWAL(
 			b.data = append([]byte(nil), b.data...)
 			b.flushable, err = newFlushableBatch(&b, d.opts.Comparer)
 			if err != nil {
-				return nil, 0, err
+				return nil, 0, false, err
 			}
 			entry := d.newFlushableEntry(b.flushable, logNum, b.SeqNum())
 			// Disable memory accounting by adding a reader ref that will never be
@@ -999,7 +1088,7 @@ func (d *DB) replayWAL(
 		} else {
 			ensureMem(seqNum)
 			if err = mem.prepare(&b); err != nil && err != arenaskl.ErrArenaFull {
-				return nil, 0, err
+				return nil, 0, false, err
 			}
 			// We loop since DB.newMemTable() slowly grows the size of allocated memtables, so the
 			// batch may not initially fit, but will eventually fit (since it is smaller than
@@ -1009,11 +1098,11 @@ func (d *DB) replayWAL(
 				ensureMem(seqNum)
 				err = mem.prepare(&b)
 				if err != nil && err != arenaskl.ErrArenaFull {
-					return nil, 0, err
+					return nil, 0, false, err
 				}
 			}
 			if err = mem.apply(&b, seqNum); err != nil {
-				return nil, 0, err
+				return nil, 0, false, err
 			}
 			mem.writerUnref()
 		}
@@ -1027,10 +1116,10 @@ func (d *DB) replayWAL(
 	if !d.opts.ReadOnly {
 		err = updateVE()
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, false, err
 		}
 	}
-	return toFlush, maxSeqNum, err
+	return toFlush, maxSeqNum, truncated, err
 }
 
 func checkOptions(
@@ -1047,10 +1136,15 @@ func checkOptions(
 		return false, err
 	}
 
-	data, err = edg.DecryptOptions(data, fileNum, keyManager)
+	header, data, err := edg.DecryptOptions(data, fileNum, keyManager)
 	if err != nil {
 		return false, err
 	}
+	// EDG: the header is authenticated, so the encryption mode recorded in it
+	// can be trusted.
+	if err := edgCheckCipherSuite(header, keyManager.CipherSuite()); err != nil {
+		return false, err
+	}
 
 	return opts.checkOptions(string(data))
 }
@@ -1065,6 +1159,16 @@ type DBDesc struct {
 	// ManifestFilename is the filename of the current active manifest,
 	// if the database exists.
 	ManifestFilename string
+	// OptionsFilename is the filename of the most recent OPTIONS file, if
+	// there is one.
+	OptionsFilename string
+	// Comparer, Merger and CipherSuite are read from the plaintext header of
+	// the most recent OPTIONS file. They are empty if there is no OPTIONS file
+	// or if it has been written without a header. Peek doesn't authenticate
+	// the header, but Open rejects a modified header.
+	Comparer    string
+	Merger      string
+	CipherSuite string
 }
 
 // Peek looks for an existing database in dirname on the provided FS. It
@@ -1099,6 +1203,9 @@ func Peek(dirname string, fs vfs.FS) (*DBDesc, error) {
 	if exists {
 		desc.ManifestFilename = base.MakeFilepath(fs, dirname, fileTypeManifest, manifestFileNum)
 	}
+	if err := edgPeekOptions(fs, dirname, desc); err != nil {
+		return nil, err
+	}
 	return desc, nil
 }
 
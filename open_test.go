@@ -374,7 +374,7 @@ func TestOpenOptionsCheck(t *testing.T) {
 	require.Regexp(t, `merger name from file.*!=.*`, err)
 }
 
-func DisabledTestOpenCrashWritingOptions(t *testing.T) { // EDG: doesn't work with encrypted OPTIONS file
+func TestOpenCrashWritingOptions(t *testing.T) {
 	memFS := vfs.NewMem()
 
 	d, err := Open("", &Options{FS: memFS})
@@ -1079,7 +1079,12 @@ func TestGetVersion(t *testing.T) {
 	require.Empty(t, version)
 
 	// Case 2: Pebble created file.
-	// EDG: doesn't work with encrypted OPTIONS file
+	db, err := Open("", opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	version, err = GetVersion("", mem)
+	require.NoError(t, err)
+	require.Equal(t, "0.1", version)
 
 	// Case 3: Manually created OPTIONS file with a higher number.
 	highestOptionsNum := FileNum(0)
@@ -16,6 +16,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/edgelesssys/estore/internal/base"
 	"github.com/edgelesssys/estore/internal/cache"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/internal/humanize"
 	"github.com/edgelesssys/estore/internal/keyspan"
 	"github.com/edgelesssys/estore/internal/manifest"
@@ -55,6 +56,9 @@ type FilterWriter = base.FilterWriter
 // FilterPolicy exports the base.FilterPolicy type.
 type FilterPolicy = base.FilterPolicy
 
+// RangeFilterPolicy exports the base.RangeFilterPolicy type.
+type RangeFilterPolicy = base.RangeFilterPolicy
+
 // TablePropertyCollector exports the sstable.TablePropertyCollector type.
 type TablePropertyCollector = sstable.TablePropertyCollector
 
@@ -99,6 +103,54 @@ func (t IterKeyType) String() string {
 	}
 }
 
+// WALRecoveryMode configures how Open handles a WAL whose final chunks are
+// torn or fail authentication.
+type WALRecoveryMode int8
+
+const (
+	// AbsoluteConsistency fails Open on any WAL chunk that is truncated or
+	// fails authentication. This is the default.
+	AbsoluteConsistency WALRecoveryMode = iota
+	// TolerateCorruptedTailRecords truncates a torn tail of the most recent
+	// WAL. A torn write is a chunk that is truncated or fails authentication
+	// and is followed by nothing but zero bytes. Any other authentication
+	// failure still fails Open.
+	TolerateCorruptedTailRecords
+	// PointInTimeRecovery truncates a torn tail of any WAL and stops the replay
+	// there. Subsequent WALs are discarded, so the recovered state corresponds
+	// to a prefix of the committed batches. Any authentication failure that
+	// isn't a torn tail still fails Open.
+	PointInTimeRecovery
+)
+
+// String implements fmt.Stringer.
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case AbsoluteConsistency:
+		return "absolute-consistency"
+	case TolerateCorruptedTailRecords:
+		return "tolerate-corrupted-tail-records"
+	case PointInTimeRecovery:
+		return "point-in-time-recovery"
+	default:
+		panic(fmt.Sprintf("unknown WAL recovery mode %d", m))
+	}
+}
+
+// toleratesTornTail returns whether a torn tail of a WAL may be truncated
+// during replay. strictWALTail is the corresponding private option read from
+// the OPTIONS file.
+func (m WALRecoveryMode) toleratesTornTail(lastWAL, strictWALTail bool) bool {
+	switch m {
+	case TolerateCorruptedTailRecords:
+		return lastWAL || !strictWALTail
+	case PointInTimeRecovery:
+		return true
+	default:
+		return false
+	}
+}
+
 // IterOptions hold the optional per-query parameters for NewIter.
 //
 // Like Options, a nil *IterOptions is valid and means to use the default
@@ -186,6 +238,18 @@ type IterOptions struct {
 	// existing is not low or if we just expect a one-time Seek (where loading the
 	// data block directly is better).
 	UseL6Filters bool
+	// EDG: PrefetchBlocks enables the prefetching of data blocks for long
+	// forward scans. When the iterator loads a data block of a table while
+	// moving forward, it loads up to PrefetchBlocks following blocks of the
+	// table on background goroutines, so that reading, decrypting and
+	// decompressing them overlaps with the iteration. Prefetched blocks that
+	// the iteration skips, e.g., because it seeks, are wasted work, so this
+	// should only be used for scans that read most of the keys in their range.
+	// Zero disables prefetching.
+	PrefetchBlocks int
+	// EDG: PrefetchMemory bounds the total size of the blocks that are
+	// prefetched but not yet used by the iterator. Zero means 8 MiB.
+	PrefetchMemory int64
 
 	// Internal options.
 
@@ -199,11 +263,30 @@ type IterOptions struct {
 	// files and is used to decide whether to hide obsolete points. A value of 0
 	// implies obsolete points should not be hidden.
 	snapshotForHideObsoletePoints uint64
+	// EDG: prefetcher is created from PrefetchBlocks and PrefetchMemory and
+	// shared by the table iterators of the Iterator.
+	prefetcher *sstable.Prefetcher
 
 	// NB: If adding new Options, you must account for them in iterator
 	// construction and Iterator.SetOptions.
 }
 
+// defaultPrefetchMemory is the default of IterOptions.PrefetchMemory.
+const defaultPrefetchMemory = 8 << 20
+
+// EDG: initPrefetcher creates the prefetcher if prefetching is enabled.
+func (o *IterOptions) initPrefetcher() {
+	o.prefetcher = nil
+	if o.PrefetchBlocks <= 0 {
+		return
+	}
+	memory := o.PrefetchMemory
+	if memory <= 0 {
+		memory = defaultPrefetchMemory
+	}
+	o.prefetcher = sstable.NewPrefetcher(o.PrefetchBlocks, memory)
+}
+
 // GetLowerBound returns the LowerBound or nil if the receiver is nil.
 func (o *IterOptions) GetLowerBound() []byte {
 	if o == nil {
@@ -406,7 +489,8 @@ type LevelOptions struct {
 	// reduce disk reads for Get calls.
 	//
 	// One such implementation is bloom.FilterPolicy(10) from the pebble/bloom
-	// package.
+	// package. EDG: bloom.RibbonFilterPolicy(10) has the same false positive
+	// rate, but is about 30% smaller.
 	//
 	// The default value means to use no filter.
 	FilterPolicy FilterPolicy
@@ -470,6 +554,15 @@ type Options struct {
 	// EncryptionKey is the master key for encryption at rest. Must be 16, 24, or 32 bytes.
 	EncryptionKey []byte
 
+	// Insecure_DisableEncryption stores all files in plaintext instead of
+	// encrypting them. EncryptionKey must not be set. This is only meant for
+	// development and for measuring the overhead of encryption.
+	//
+	// The mode is recorded in the OPTIONS file, and a DB can't be opened in the
+	// other mode. Use EncryptInPlace to encrypt a DB that has been created with
+	// this option.
+	Insecure_DisableEncryption bool
+
 	// SetMonotonicCounter is a callback that EStore invokes to provide rollback protection by using a trusted monotonic counter.
 	//
 	// The behavior of the counter must be the following:
@@ -481,6 +574,71 @@ type Options struct {
 	// If not set, rollback protection is disabled.
 	SetMonotonicCounter func(uint64) (uint64, error)
 
+	// ForwardSecrecy enables crypto-shredding of obsolete files. When a file
+	// becomes obsolete and is deleted, its salt is removed from the SALTCHAIN,
+	// so the file can't be decrypted anymore, even with the master key and a
+	// copy of the deleted file. Salts that a crash left behind are removed
+	// when the DB is opened. Use DB.ShredObsolete to make overwritten and
+	// deleted data unrecoverable at a specific point in time.
+	//
+	// Note that an ArchiveCleaner archives files that can't be decrypted if
+	// this option is enabled.
+	ForwardSecrecy bool
+
+	// EnableTTL enables per-key expiry. If set, the value of every SET is
+	// stored with a header that records when the key expires (see
+	// DB.SetWithTTL). Reads hide expired keys, and compactions into the
+	// bottommost level drop them. With FormatBlockPropertyCollector or newer,
+	// bottommost sstables whose point keys have all expired are also picked
+	// for elision-only compactions.
+	//
+	// This option is recorded in the OPTIONS file and can't be changed for an
+	// existing store. Batch.SetDeferred writes the header in front of the
+	// value, and batches built without a DB get the header when they are
+	// applied. Ingested sstables must be written with MakeWriterOptions, which
+	// records the expiry of their keys; other sstables are rejected.
+	EnableTTL bool
+
+	// CompactionFilter is called by compactions for the newest version of
+	// each key and can keep, remove, or change it (see CompactionFilter).
+	// Flushes don't call the filter.
+	CompactionFilter CompactionFilter
+
+	// RedactUserData replaces user keys and values with redaction markers
+	// wherever they would be printed: in errors, in panics of invariant checks,
+	// in the events passed to the EventListener, in log messages and in the
+	// formatting of keys, e.g., of the bounds in SSTables. Use this if logs and
+	// error reports leave the confidential environment.
+	//
+	// Once a DB is opened with this option, the formatting of user keys is
+	// redacted for the whole process, because some of it isn't associated with
+	// a DB.
+	RedactUserData bool
+
+	// ZeroizeMemory overwrites buffers that may hold plaintext with zeros when
+	// they are released: block cache values on eviction, memtable arenas,
+	// batch data, and MultiGet values. Closing the DB wipes the master key and
+	// the derived file keys held by the DB. Use this if core dumps or swapped
+	// pages may leave the confidential environment.
+	//
+	// Like RedactUserData, this applies to the whole process once a DB is
+	// opened with this option, because the block cache may be shared.
+	ZeroizeMemory bool
+
+	// BlockPadding pads each sstable block written by the DB to a multiple of
+	// this many bytes. See sstable.WriterOptions.BlockPadding. Choosing the
+	// block size as granularity makes all data blocks occupy the same space.
+	// Zero disables the padding.
+	BlockPadding int
+
+	// WALPadding pads each batch committed to the DB to a multiple of this
+	// many bytes by adding a LogData record of zeros to it. As each batch is
+	// written to the WAL as a single record, this hides the lengths of keys
+	// and values and the number of operations in a batch from an observer of
+	// the file growth. The LogData record is removed from the batch again
+	// after it has been committed. Zero disables the padding.
+	WALPadding int
+
 	// Sync sstables periodically in order to smooth out writes to disk. This
 	// option does not provide any persistency guarantee, but is used to avoid
 	// latency spikes if the OS automatically decides to write out a large chunk
@@ -956,6 +1114,14 @@ type Options struct {
 	// changing options dynamically?
 	WALMinSyncInterval func() time.Duration
 
+	// WALRecoveryMode configures how torn writes at the end of WALs are handled
+	// during Open. Note that without SetMonotonicCounter, truncating the tail
+	// of a WAL can't be distinguished from an attacker removing the most
+	// recent writes.
+	//
+	// The default value is AbsoluteConsistency.
+	WALRecoveryMode WALRecoveryMode
+
 	// TargetByteDeletionRate is the rate (in bytes per second) at which sstable file
 	// deletions are limited to (under normal circumstances).
 	//
@@ -1016,6 +1182,10 @@ type Options struct {
 		// against the FS are made after the DB is closed, the FS may leak a
 		// goroutine indefinitely.
 		fsCloser io.Closer
+
+		// EDG: observeKeyManager is called with the KeyManager of the DB when
+		// it's opened. It's set through private.ObserveKeyManager.
+		observeKeyManager func(*edg.KeyManager)
 	}
 }
 
@@ -1262,6 +1432,9 @@ func (o *Options) String() string {
 	fmt.Fprintf(&buf, "  compaction_debt_concurrency=%d\n", o.Experimental.CompactionDebtConcurrency)
 	fmt.Fprintf(&buf, "  comparer=%s\n", o.Comparer.Name)
 	fmt.Fprintf(&buf, "  disable_wal=%t\n", o.DisableWAL)
+	if o.EnableTTL {
+		fmt.Fprintf(&buf, "  enable_ttl=%t\n", true)
+	}
 	if o.Experimental.DisableIngestAsFlushable != nil && o.Experimental.DisableIngestAsFlushable() {
 		fmt.Fprintf(&buf, "  disable_ingest_as_flushable=%t\n", true)
 	}
@@ -1542,6 +1715,8 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 				// Do nothing; deprecated.
 			case "strict_wal_tail":
 				o.private.strictWALTail, err = strconv.ParseBool(value)
+			case "enable_ttl":
+				o.EnableTTL, err = strconv.ParseBool(value)
 			case "merger":
 				switch value {
 				case "nullptr":
@@ -1653,6 +1828,11 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 			}
 			return err
 		}
+		if section == "Encryption" && key == "cipher_suite" {
+			// EDG: written to the header of the OPTIONS file for information.
+			// The cipher is determined by the encryption key.
+			return nil
+		}
 		if hooks != nil && hooks.SkipUnknown != nil && hooks.SkipUnknown(section+"."+key, value) {
 			return nil
 		}
@@ -1662,7 +1842,8 @@ func (o *Options) Parse(s string, hooks *ParseHooks) error {
 
 func (o *Options) checkOptions(s string) (strictWALTail bool, err error) {
 	// TODO(jackson): Refactor to avoid awkwardness of the strictWALTail return value.
-	return strictWALTail, parseOptions(s, func(section, key, value string) error {
+	var enableTTL bool
+	err = parseOptions(s, func(section, key, value string) error {
 		switch section + "." + key {
 		case "Options.comparer":
 			if value != o.Comparer.Name {
@@ -1681,9 +1862,23 @@ func (o *Options) checkOptions(s string) (strictWALTail bool, err error) {
 			if err != nil {
 				return errors.Errorf("pebble: error parsing strict_wal_tail value %q: %w", value, err)
 			}
+		case "Options.enable_ttl":
+			enableTTL, err = strconv.ParseBool(value)
+			if err != nil {
+				return errors.Errorf("estore: error parsing enable_ttl value %q: %w", value, err)
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		return strictWALTail, err
+	}
+	// EDG: Values are encoded differently if TTL is enabled.
+	if enableTTL != o.EnableTTL {
+		return strictWALTail, errors.Errorf("estore: enable_ttl from file %t != enable_ttl from options %t",
+			enableTTL, o.EnableTTL)
+	}
+	return strictWALTail, nil
 }
 
 // Check verifies the options are compatible with the previous options
@@ -1722,9 +1917,22 @@ func (o *Options) Validate() error {
 		fmt.Fprintf(&buf, "FormatMajorVersion (%d) must be <= %d\n",
 			o.FormatMajorVersion, internalFormatNewest)
 	}
+	if o.WALRecoveryMode < AbsoluteConsistency || o.WALRecoveryMode > PointInTimeRecovery {
+		fmt.Fprintf(&buf, "WALRecoveryMode (%d) is unknown\n", o.WALRecoveryMode)
+	}
+	if o.BlockPadding < 0 || o.WALPadding < 0 {
+		fmt.Fprintf(&buf, "BlockPadding (%d) and WALPadding (%d) must not be negative\n",
+			o.BlockPadding, o.WALPadding)
+	}
 	if o.TableCache != nil && o.Cache != o.TableCache.cache {
 		fmt.Fprintf(&buf, "underlying cache in the TableCache and the Cache dont match\n")
 	}
+	if o.Insecure_DisableEncryption && o.EncryptionKey != nil {
+		fmt.Fprintf(&buf, "EncryptionKey must not be set if Insecure_DisableEncryption is set\n")
+	}
+	if n := len(o.EncryptionKey); n != 0 && n != 16 && n != 24 && n != 32 {
+		fmt.Fprintf(&buf, "EncryptionKey (%d bytes) must be 16, 24, or 32 bytes\n", n)
+	}
 	if buf.Len() == 0 {
 		return nil
 	}
@@ -1761,6 +1969,13 @@ func (o *Options) MakeWriterOptions(level int, format sstable.TableFormat) sstab
 		}
 		writerOpts.TablePropertyCollectors = o.TablePropertyCollectors
 		writerOpts.BlockPropertyCollectors = o.BlockPropertyCollectors
+		if o.EnableTTL {
+			// EDG: Record the expiry of point keys so that expired tables can be
+			// picked for elision-only compactions.
+			n := len(o.BlockPropertyCollectors)
+			writerOpts.BlockPropertyCollectors = append(
+				o.BlockPropertyCollectors[:n:n], newTTLBlockPropertyCollector)
+		}
 	}
 	if format >= sstable.TableFormatPebblev3 {
 		writerOpts.ShortAttributeExtractor = o.Experimental.ShortAttributeExtractor
@@ -1777,5 +1992,6 @@ func (o *Options) MakeWriterOptions(level int, format sstable.TableFormat) sstab
 	writerOpts.FilterPolicy = levelOpts.FilterPolicy
 	writerOpts.FilterType = levelOpts.FilterType
 	writerOpts.IndexBlockSize = levelOpts.IndexBlockSize
+	writerOpts.BlockPadding = o.BlockPadding
 	return writerOpts
 }
@@ -0,0 +1,100 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIteratorPrefetch(t *testing.T) {
+	require := require.New(t)
+
+	d, err := Open("", &Options{
+		FS:     vfs.NewMem(),
+		Levels: []LevelOptions{{BlockSize: 256}},
+
+		DisableAutomaticCompactions: true,
+	})
+	require.NoError(err)
+	defer func() { require.NoError(d.Close()) }()
+
+	// three tables with overlapping keys, overwrites and deletions
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%05d", i))
+	}
+	for table := 0; table < 3; table++ {
+		for i := table; i < 10000; i += 2 {
+			require.NoError(d.Set(key(i), []byte(fmt.Sprint(table, "-", i)), nil))
+		}
+		require.NoError(d.Flush())
+	}
+	require.NoError(d.DeleteRange(key(5000), key(5500), nil))
+	require.NoError(d.Flush())
+
+	scan := func(iter *Iterator) []string {
+		var values []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			values = append(values, string(iter.Key())+"="+string(iter.Value()))
+		}
+		require.NoError(iter.Error())
+		return values
+	}
+	newIter := func(o *IterOptions) *Iterator {
+		iter, err := d.NewIter(o)
+		require.NoError(err)
+		return iter
+	}
+
+	iter := newIter(nil)
+	want := scan(iter)
+	require.NoError(iter.Close())
+	require.Len(want, 9500)
+
+	iter = newIter(&IterOptions{PrefetchBlocks: 8})
+	require.NotNil(iter.opts.prefetcher)
+	require.Equal(want, scan(iter))
+
+	// the options with bounds
+	iter.SetOptions(&IterOptions{LowerBound: key(4000), UpperBound: key(6000), PrefetchBlocks: 8})
+	require.Equal(want[4000:5500], scan(iter))
+
+	// a clone has its own prefetcher
+	clone, err := iter.Clone(CloneOptions{})
+	require.NoError(err)
+	require.NotSame(iter.opts.prefetcher, clone.opts.prefetcher)
+	require.Equal(want[4000:5500], scan(clone))
+	require.NoError(clone.Close())
+
+	// changing the prefetch options reconstructs the iterator
+	iter.SetOptions(&IterOptions{PrefetchBlocks: 2, PrefetchMemory: 512})
+	require.Equal(want, scan(iter))
+	iter.SetOptions(&IterOptions{})
+	require.Nil(iter.opts.prefetcher)
+	require.Equal(want, scan(iter))
+	require.NoError(iter.Close())
+
+	// seeks and reverse iteration
+	iter = newIter(&IterOptions{PrefetchBlocks: 16})
+	for i := 0; i < len(want); i += 1000 {
+		seekKey := []byte(strings.Split(want[i], "=")[0])
+		require.True(iter.SeekGE(seekKey))
+		for j := i; j < i+100; j++ {
+			require.Equal(want[j], string(iter.Key())+"="+string(iter.Value()))
+			iter.Next()
+		}
+		for j := i + 99; j > i; j-- {
+			require.True(iter.Prev())
+			require.Equal(want[j], string(iter.Key())+"="+string(iter.Value()))
+		}
+	}
+	require.NoError(iter.Close())
+}
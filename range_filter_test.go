@@ -0,0 +1,106 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/edgelesssys/estore/bloom"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeFilter(t *testing.T) {
+	// A small index block size yields two-level indexes.
+	for _, indexBlockSize := range []int{0, 1} {
+		t.Run(fmt.Sprint("index-block-size=", indexBlockSize), func(t *testing.T) {
+			require := require.New(t)
+
+			d, err := Open("", &Options{
+				FS: vfs.NewMem(),
+				Levels: []LevelOptions{{
+					BlockSize:      256,
+					FilterPolicy:   bloom.RangeFilterPolicy{BitsPerKey: 20, MaxPrefixLen: 9},
+					IndexBlockSize: indexBlockSize,
+				}},
+
+				DisableAutomaticCompactions: true,
+			})
+			require.NoError(err)
+			defer func() { require.NoError(d.Close()) }()
+
+			// Each table holds the keys of series "a" and "b" in a separate time
+			// range, so their key ranges overlap.
+			key := func(series string, ts uint64) []byte {
+				return binary.BigEndian.AppendUint64([]byte(series), ts)
+			}
+			for table := uint64(0); table < 3; table++ {
+				for _, series := range []string{"a", "b"} {
+					for ts := table * 100; ts < (table+1)*100; ts++ {
+						require.NoError(d.Set(key(series, ts), []byte(fmt.Sprint(series, ts)), nil))
+					}
+				}
+				require.NoError(d.Flush())
+			}
+
+			scan := func(iter *Iterator, reverse bool) []string {
+				var values []string
+				if reverse {
+					for iter.Last(); iter.Valid(); iter.Prev() {
+						values = append(values, string(iter.Value()))
+					}
+				} else {
+					for iter.First(); iter.Valid(); iter.Next() {
+						values = append(values, string(iter.Value()))
+					}
+				}
+				require.NoError(iter.Error())
+				return values
+			}
+
+			iter, err := d.NewIter(&IterOptions{LowerBound: key("a", 150), UpperBound: key("a", 153)})
+			require.NoError(err)
+			require.Equal([]string{"a150", "a151", "a152"}, scan(iter, false))
+			require.Equal([]string{"a152", "a151", "a150"}, scan(iter, true))
+			m := d.Metrics().Filter
+			require.Positive(m.RangeHits)
+			require.Positive(m.RangeMisses)
+
+			// a time range without keys
+			iter.SetBounds(key("a", 300), key("a", 400))
+			require.Empty(scan(iter, false))
+			require.False(iter.SeekGE(key("a", 0)))
+			require.Greater(d.Metrics().Filter.RangeHits, m.RangeHits)
+
+			// bounds that span tables
+			iter.SetBounds(key("b", 98), key("b", 202))
+			values := scan(iter, false)
+			require.Len(values, 104)
+			require.Equal("b98", values[0])
+			require.Equal("b201", values[len(values)-1])
+			require.NoError(iter.Close())
+
+			// point lookups use the filter, too
+			value, closer, err := d.Get(key("b", 42))
+			require.NoError(err)
+			require.Equal("b42", string(value))
+			require.NoError(closer.Close())
+			_, _, err = d.Get(key("b", 300))
+			require.ErrorIs(err, ErrNotFound)
+
+			// without bounds, the range filter isn't used
+			m = d.Metrics().Filter
+			iter, err = d.NewIter(nil)
+			require.NoError(err)
+			require.Len(scan(iter, false), 600)
+			require.NoError(iter.Close())
+			require.Equal(m.RangeHits+m.RangeMisses, d.Metrics().Filter.RangeHits+d.Metrics().Filter.RangeMisses)
+		})
+	}
+}
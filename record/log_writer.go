@@ -305,7 +305,9 @@ type LogWriter struct {
 	queueSemChan chan struct{}
 
 	EncryptionKey []byte
-	chunkNum      uint64 // sequence number of the last written chunk
+	// EncryptionStats, if set, counts the encrypted bytes.
+	EncryptionStats *edg.FileStats
+	chunkNum        uint64 // sequence number of the last written chunk
 }
 
 // LogWriterConfig is a struct used for configuring new LogWriters
@@ -738,6 +740,7 @@ func (w *LogWriter) emitFragment(n int, p []byte) (remainingP []byte) {
 		panic(err)
 	}
 	w.chunkNum++
+	w.EncryptionStats.Encrypted(int(j - i - 18))
 	ciphertext := aead.Seal(nil, edgMakeNonce(w.chunkNum), b.buf[i+18:j], nil)
 	copy(b.buf[i:], ciphertext[len(ciphertext)-16:])
 	copy(b.buf[i+18:], ciphertext[:len(ciphertext)-16])
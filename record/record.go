@@ -163,7 +163,24 @@ type Reader struct {
 	buf [blockSize]byte
 
 	EncryptionKey []byte
-	chunkNum      uint64 // sequence number of the last read chunk
+	// EncryptionStats, if set, counts the decrypted bytes and authentication
+	// failures.
+	EncryptionStats *edg.FileStats
+	// TolerateTornTail, if set, defers counting an authentication failure
+	// until TornTail is called, which counts it unless the chunk is a torn
+	// tail. The caller must call TornTail after an error.
+	TolerateTornTail bool
+	chunkNum         uint64 // sequence number of the last read chunk
+	// authFailed is set if an authentication failure at authFailedOffset
+	// hasn't been counted yet.
+	authFailed       bool
+	authFailedOffset int64
+
+	// suspectTail is true if the most recent error was caused by a chunk that
+	// is truncated or fails authentication. In that case, buf[tailFrom:n] and
+	// the remainder of r must be zero for the chunk to be a torn tail.
+	suspectTail bool
+	tailFrom    int
 }
 
 // NewReader returns a new reader. If the file contains records encoded using
@@ -190,6 +207,7 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 			r.end = r.begin + int(length)
 			if r.end > r.n {
 				// The chunk straddles a 32KB boundary (or the end of file).
+				r.suspectTail, r.tailFrom = true, r.n
 				return ErrInvalidChunk
 			}
 
@@ -203,8 +221,16 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 			r.chunkNum++
 			ciphertext, err = aead.Open(ciphertext[:0], edgMakeNonce(r.chunkNum), ciphertext, nil)
 			if err != nil {
+				offset := r.blockNum*blockSize + int64(r.begin-headerSize)
+				if r.TolerateTornTail {
+					r.authFailed, r.authFailedOffset = true, offset
+				} else {
+					r.EncryptionStats.AuthFailed(base.FileNum(r.logNum), offset)
+				}
+				r.suspectTail, r.tailFrom = true, r.end
 				return ErrInvalidChunk
 			}
+			r.EncryptionStats.Decrypted(len(ciphertext))
 			copy(r.buf[r.begin-1:], ciphertext)
 
 			chunkType := r.buf[r.begin-1]
@@ -216,6 +242,7 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 			}
 			r.last = chunkType == fullChunkType || chunkType == lastChunkType
 			r.recovering = false
+			r.suspectTail = false
 			return nil
 		}
 		if r.n < blockSize && r.blockNum >= 0 {
@@ -223,6 +250,7 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 				// This can happen if the previous instance of the log ended with a
 				// partial block at the same blockNum as the new log but extended
 				// beyond the partial block of the new log.
+				r.suspectTail, r.tailFrom = true, r.n
 				return ErrInvalidChunk
 			}
 			return io.EOF
@@ -230,6 +258,7 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 		n, err := io.ReadFull(r.r, r.buf[:])
 		if err != nil && err != io.ErrUnexpectedEOF {
 			if err == io.EOF && !wantFirst {
+				r.suspectTail, r.tailFrom = true, r.n
 				return io.ErrUnexpectedEOF
 			}
 			return err
@@ -264,6 +293,55 @@ func (r *Reader) Offset() int64 {
 	return int64(r.blockNum)*blockSize + int64(r.end)
 }
 
+// TornTail reports whether the error most recently returned by the Reader was
+// caused by a torn write at the end of the log: the offending chunk is
+// truncated or fails authentication, and it is followed by nothing but zero
+// bytes up to the end of the file. A chunk that fails authentication and is
+// followed by any other data is never considered torn, because a crash can't
+// produce it.
+//
+// TornTail consumes the remainder of the underlying io.Reader.
+func (r *Reader) TornTail() (bool, error) {
+	torn, err := r.tornTail()
+	if r.authFailed {
+		r.authFailed = false
+		if !torn {
+			r.EncryptionStats.AuthFailed(base.FileNum(r.logNum), r.authFailedOffset)
+		}
+	}
+	return torn, err
+}
+
+func (r *Reader) tornTail() (bool, error) {
+	if r.err == nil || !r.suspectTail {
+		return false, nil
+	}
+	for _, b := range r.buf[r.tailFrom:r.n] {
+		if b != 0 {
+			return false, nil
+		}
+	}
+	if r.n < blockSize {
+		// The final block has been read.
+		return true, nil
+	}
+	var buf [blockSize]byte
+	for {
+		n, err := r.r.Read(buf[:])
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
 // recover clears any errors read so far, so that calling Next will start
 // reading from the next good 32KiB block. If there are no such blocks, Next
 // will return io.EOF. recover also marks the current reader, the one most
@@ -390,7 +468,9 @@ type Writer struct {
 	buf [blockSize]byte
 
 	EncryptionKey []byte
-	chunkNum      uint64 // sequence number of the last written chunk
+	// EncryptionStats, if set, counts the encrypted bytes.
+	EncryptionStats *edg.FileStats
+	chunkNum        uint64 // sequence number of the last written chunk
 }
 
 // NewWriter returns a new Writer.
@@ -438,6 +518,7 @@ func (w *Writer) fillHeader(last bool) {
 	}
 	// Use chunk number as IV. Files are written and read sequentially, so this is secure and simple.
 	w.chunkNum++
+	w.EncryptionStats.Encrypted(w.j - w.i - 18)
 	ciphertext := aead.Seal(nil, edgMakeNonce(w.chunkNum), w.buf[w.i+18:w.j], nil)
 	copy(w.buf[w.i:], ciphertext[len(ciphertext)-16:])
 	copy(w.buf[w.i+18:], ciphertext[:len(ciphertext)-16])
@@ -1034,6 +1034,92 @@ func DisabledTestRecycleLogWithPartialRecord(t *testing.T) { // EDG: we don't su
 	require.Equal(t, err, ErrInvalidChunk)
 }
 
+func TestTornTail(t *testing.T) {
+	recs, err := makeTestRecords(100, blockSize, 200)
+	require.NoError(t, err)
+	last := recs.offsets[2]
+
+	testCases := []struct {
+		name string
+		// mutate returns the log contents to read.
+		mutate func(buf []byte) []byte
+		torn   bool
+		// authFailed is whether an authentication failure is counted, which
+		// is only the case if the failing chunk isn't a torn tail.
+		authFailed bool
+	}{
+		{
+			name:   "truncated within the last chunk",
+			mutate: func(buf []byte) []byte { return buf[:len(buf)-10] },
+			torn:   true,
+		},
+		{
+			name:   "truncated within the last header",
+			mutate: func(buf []byte) []byte { return buf[:last+5] },
+			torn:   true,
+		},
+		{
+			name: "zeroed last chunk",
+			mutate: func(buf []byte) []byte {
+				buf = append(buf[:last], make([]byte, len(buf)-int(last)+50)...)
+				return buf
+			},
+			torn: true,
+		},
+		{
+			name: "corrupted last chunk",
+			mutate: func(buf []byte) []byte {
+				buf[len(buf)-1] ^= 0xff
+				return buf
+			},
+			torn: true,
+		},
+		{
+			name: "corrupted last chunk followed by data",
+			mutate: func(buf []byte) []byte {
+				buf[len(buf)-1] ^= 0xff
+				return append(buf, 1)
+			},
+			torn:       false,
+			authFailed: true,
+		},
+		{
+			name: "corrupted first chunk",
+			mutate: func(buf []byte) []byte {
+				buf[legacyHeaderSize] ^= 0xff
+				return buf
+			},
+			torn:       false,
+			authFailed: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := tc.mutate(append([]byte(nil), recs.buf...))
+			r := NewReader(bytes.NewReader(buf), 0 /* logNum */)
+			stats := edg.NewStats()
+			r.EncryptionStats = stats.File(edg.FileTypeWAL)
+			r.TolerateTornTail = true
+			for {
+				rr, err := r.Next()
+				if err == nil {
+					_, err = io.ReadAll(rr)
+				}
+				if err == nil {
+					continue
+				}
+				require.NotEqual(t, io.EOF, err)
+				torn, err := r.TornTail()
+				require.NoError(t, err)
+				require.Equal(t, tc.torn, torn)
+				authFailures, _ := stats.AuthFailures()
+				require.Equal(t, tc.authFailed, authFailures > 0)
+				return
+			}
+		})
+	}
+}
+
 func BenchmarkRecordWrite(b *testing.B) {
 	for _, size := range []int{8, 16, 32, 64, 256, 1028, 4096, 65_536} {
 		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
@@ -0,0 +1,273 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package replay
+
+import (
+	"io"
+
+	"github.com/cockroachdb/errors"
+	pebble "github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/internal/private"
+	"github.com/edgelesssys/estore/objstorage/objstorageprovider"
+	"github.com/edgelesssys/estore/record"
+	"github.com/edgelesssys/estore/sstable"
+	"github.com/edgelesssys/estore/vfs"
+)
+
+// SetBenchmarkKey sets a key that the captured workload is re-encrypted with
+// when the collection is stopped. This allows to replay the workload without
+// access to the master key of the DB. Must be called before Start.
+func (w *WorkloadCollector) SetBenchmarkKey(key []byte) {
+	w.config.benchmarkKey = key
+}
+
+// edgAttach makes the DB opened with opts pass its KeyManager to the
+// collector, which looks up the salts of the captured files in it.
+func (w *WorkloadCollector) edgAttach(opts *pebble.Options) {
+	private.ObserveKeyManager.(func(*pebble.Options, func(*edg.KeyManager)))(opts, func(keyManager *edg.KeyManager) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.mu.srcKeys = keyManager
+	})
+}
+
+// edgSnapshotSaltsLocked records the salts of the given files, so that they
+// can be added to the captured SALTCHAIN even if the files are shredded before
+// they are copied. Requires w.mu.
+func (w *WorkloadCollector) edgSnapshotSaltsLocked(fileNums ...base.FileNum) {
+	// No DB has been opened with the collector's options, so there are no
+	// salts.
+	if w.mu.srcKeys == nil {
+		return
+	}
+	for _, fileNum := range fileNums {
+		if salt, ok := w.mu.srcKeys.Salt(fileNum); ok {
+			w.mu.salts[fileNum] = salt
+		}
+	}
+}
+
+// edgCaptureSalt adds the salt of a copied file to the captured SALTCHAIN.
+// Only called by the copyFiles goroutine. Errors are recorded and returned by
+// Stop.
+func (w *WorkloadCollector) edgCaptureSalt(filePath string) {
+	_, fileNum, ok := base.ParseFilename(w.config.srcFS, w.config.srcFS.PathBase(filePath))
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	salt, ok := w.mu.salts[fileNum.FileNum()]
+	delete(w.mu.salts, fileNum.FileNum())
+	failed := w.mu.edgErr != nil
+	w.mu.Unlock()
+	if !ok || failed {
+		return
+	}
+
+	err := w.edgImportSalt(fileNum.FileNum(), salt)
+	if err != nil {
+		w.mu.Lock()
+		w.mu.edgErr = errors.Wrapf(err, "replay: capturing salt of %s", filePath)
+		w.mu.Unlock()
+	}
+}
+
+func (w *WorkloadCollector) edgImportSalt(fileNum base.FileNum, salt []byte) error {
+	if w.keyManager == nil {
+		var err error
+		opts := w.config.opts
+		w.keyManager, err = edg.OpenKeyManager(w.config.destFS, w.config.destDir, opts.EncryptionKey, opts.Insecure_DisableEncryption)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.keyManager.Import(fileNum, salt)
+	return err
+}
+
+// edgFinishCapture closes the captured SALTCHAIN and re-encrypts the workload
+// if a benchmark key is set. It returns the first error of the capture. Called
+// after the copyFiles goroutine exited.
+func (w *WorkloadCollector) edgFinishCapture() error {
+	w.mu.Lock()
+	err := w.mu.edgErr
+	w.mu.edgErr = nil
+	w.mu.Unlock()
+	if w.keyManager == nil {
+		return err
+	}
+	err = errors.CombineErrors(err, w.keyManager.Close())
+	w.keyManager = nil
+	if err != nil || w.config.benchmarkKey == nil {
+		return err
+	}
+	return ReencryptWorkload(w.config.destFS, w.config.destDir, w.config.opts, w.config.benchmarkKey)
+}
+
+// ReencryptWorkload re-encrypts the manifests and sstables of a captured
+// workload with newKey. opts.EncryptionKey must be the key the workload is
+// currently encrypted with, or opts.Insecure_DisableEncryption must be set if
+// it isn't encrypted. opts.Comparer and opts.Merger must match those of the
+// DB the workload was captured from. The workload's SALTCHAIN is
+// replaced by one for newKey.
+//
+// The workload is rewritten in place. If ReencryptWorkload fails, the workload
+// may be left unusable.
+func ReencryptWorkload(fs vfs.FS, dir string, opts *pebble.Options, newKey []byte) error {
+	opts = opts.Clone().EnsureDefaults()
+
+	// Collect the keys of all files of the workload.
+	oldKeys, err := edg.OpenKeyManager(fs, dir, opts.EncryptionKey, opts.Insecure_DisableEncryption)
+	if err != nil {
+		return err
+	}
+	type workloadFile struct {
+		typ     base.FileType
+		fileNum base.DiskFileNum
+		key     []byte
+	}
+	var files []workloadFile
+	filenames, err := fs.List(dir)
+	if err != nil {
+		_ = oldKeys.Close()
+		return err
+	}
+	for _, filename := range filenames {
+		typ, fileNum, ok := base.ParseFilename(fs, filename)
+		if !ok || (typ != base.FileTypeManifest && typ != base.FileTypeTable) {
+			continue
+		}
+		key, err := oldKeys.Get(fileNum.FileNum())
+		if err != nil {
+			_ = oldKeys.Close()
+			return errors.Wrapf(err, "getting key of %s", filename)
+		}
+		files = append(files, workloadFile{typ: typ, fileNum: fileNum, key: key})
+	}
+	if err := oldKeys.Close(); err != nil {
+		return err
+	}
+
+	// Replace the SALTCHAIN. The old one is kept until all files are
+	// re-encrypted.
+	saltChain := fs.PathJoin(dir, edg.SaltChainFilename)
+	oldSaltChain := saltChain + ".old"
+	if err := fs.Rename(saltChain, oldSaltChain); err != nil {
+		return err
+	}
+	newKeys, err := edg.NewKeyManager(fs, dir, newKey)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		key, err := newKeys.Create(f.fileNum.FileNum())
+		if err != nil {
+			_ = newKeys.Close()
+			return err
+		}
+		path := base.MakeFilepath(fs, dir, f.typ, f.fileNum)
+		if f.typ == base.FileTypeManifest {
+			err = reencryptManifest(fs, path, f.fileNum, f.key, key)
+		} else {
+			err = reencryptTable(fs, path, opts, f.key, key)
+		}
+		if err != nil {
+			_ = newKeys.Close()
+			return errors.Wrapf(err, "re-encrypting %s", path)
+		}
+	}
+	if err := newKeys.Close(); err != nil {
+		return err
+	}
+	return fs.Remove(oldSaltChain)
+}
+
+// reencryptFile writes a re-encrypted version of the file at path to a
+// temporary file using reencrypt, and then replaces the original file.
+func reencryptFile(fs vfs.FS, path string, reencrypt func(src, dst vfs.File) error) error {
+	src, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	dst, err := fs.Create(tmpPath)
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+	err = reencrypt(src, dst)
+	err = errors.CombineErrors(err, src.Close())
+	if err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmpPath, path)
+}
+
+func reencryptManifest(fs vfs.FS, path string, fileNum base.DiskFileNum, oldKey, newKey []byte) error {
+	return reencryptFile(fs, path, func(src, dst vfs.File) error {
+		rr := record.NewReader(src, fileNum.FileNum())
+		rr.EncryptionKey = oldKey
+		rw := record.NewWriter(dst)
+		rw.EncryptionKey = newKey
+		for {
+			r, err := rr.Next()
+			// The tail of the last manifest may have been captured while it was
+			// being written.
+			if err == io.EOF || record.IsInvalidRecord(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			w, err := rw.Next()
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, r); err != nil {
+				return err
+			}
+		}
+		return rw.Close()
+	})
+}
+
+func reencryptTable(fs vfs.FS, path string, opts *pebble.Options, oldKey, newKey []byte) error {
+	return reencryptFile(fs, path, func(src, dst vfs.File) error {
+		readable, err := sstable.NewSimpleReadable(&nopCloseFile{src})
+		if err != nil {
+			return err
+		}
+		readerOpts := opts.MakeReaderOptions()
+		readerOpts.EncryptionKey = oldKey
+		r, err := sstable.NewReader(readable, readerOpts)
+		if err != nil {
+			return err
+		}
+		writerOpts := opts.MakeWriterOptions(0, sstable.TableFormatUnspecified)
+		writerOpts.EncryptionKey = newKey
+		_, err = sstable.Reencrypt(r, objstorageprovider.NewFileWritable(&nopCloseFile{dst}), writerOpts)
+		return errors.CombineErrors(err, r.Close())
+	})
+}
+
+// nopCloseFile prevents the sstable reader and writer from closing the file,
+// which is left to reencryptFile.
+type nopCloseFile struct {
+	vfs.File
+}
+
+func (nopCloseFile) Close() error { return nil }
@@ -6,8 +6,144 @@ SPDX-License-Identifier: AGPL-3.0-only
 
 package replay
 
-import "github.com/edgelesssys/estore/internal/edg"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	pebble "github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
 
 func init() {
 	edg.TestEnableRandomKey()
 }
+
+func TestEncryptedWorkload(t *testing.T) {
+	require := require.New(t)
+	masterKey := bytes.Repeat([]byte{2}, 16)
+	benchmarkKey := bytes.Repeat([]byte{3}, 16)
+
+	// capture a workload and re-encrypt it with the benchmark key
+	destFS := captureTestWorkload(t, &pebble.Options{EncryptionKey: masterKey}, benchmarkKey)
+
+	// the master key can't be used anymore
+	_, err := edg.ReadSaltChain(destFS, "workload", masterKey)
+	require.Error(err)
+
+	// replay with the benchmark key
+	replayTestWorkload(t, &Runner{WorkloadFS: destFS, WorkloadEncryptionKey: benchmarkKey})
+}
+
+func TestPlaintextWorkload(t *testing.T) {
+	benchmarkKey := bytes.Repeat([]byte{3}, 16)
+
+	t.Run("plaintext", func(t *testing.T) {
+		destFS := captureTestWorkload(t, &pebble.Options{Insecure_DisableEncryption: true}, nil)
+		replayTestWorkload(t, &Runner{WorkloadFS: destFS, WorkloadPlaintext: true})
+	})
+	t.Run("benchmark key", func(t *testing.T) {
+		destFS := captureTestWorkload(t, &pebble.Options{Insecure_DisableEncryption: true}, benchmarkKey)
+		replayTestWorkload(t, &Runner{WorkloadFS: destFS, WorkloadEncryptionKey: benchmarkKey})
+	})
+}
+
+// captureTestWorkload captures a workload of five flushes from a DB opened
+// with o and returns the FS that holds it in the "workload" directory.
+func captureTestWorkload(t *testing.T, o *pebble.Options, benchmarkKey []byte) vfs.FS {
+	require := require.New(t)
+	o.FS = vfs.NewMem()
+	o.Logger = base.NoopLoggerAndTracer{}
+	wc := NewWorkloadCollector("")
+	wc.Attach(o)
+	if benchmarkKey != nil {
+		wc.SetBenchmarkKey(benchmarkKey)
+	}
+	d, err := pebble.Open("", o)
+	require.NoError(err)
+	defer d.Close()
+
+	destFS := vfs.NewMem()
+	require.NoError(destFS.MkdirAll("workload", os.ModePerm))
+	wc.Start(destFS, "workload")
+	for i := 0; i < 5; i++ {
+		// Write two keys so that the replay recognizes the table as flushed.
+		require.NoError(d.Set([]byte(fmt.Sprint("a", i)), []byte("val"), pebble.NoSync))
+		require.NoError(d.Set([]byte(fmt.Sprint("b", i)), []byte("val"), pebble.NoSync))
+		require.NoError(d.Flush())
+	}
+	require.NoError(wc.WaitAndStop())
+
+	// every captured file has a salt in the captured SALTCHAIN
+	filenames, err := destFS.List("workload")
+	require.NoError(err)
+	var files int
+	for _, filename := range filenames {
+		if typ, _, ok := base.ParseFilename(destFS, filename); ok && (typ == base.FileTypeManifest || typ == base.FileTypeTable) {
+			files++
+		}
+	}
+	require.Equal(6, files)
+	keys, err := edg.OpenKeyManager(destFS, "workload", benchmarkKey, benchmarkKey == nil)
+	require.NoError(err)
+	require.Equal(files, keys.ChainStats().Salts)
+	require.NoError(keys.Close())
+	return destFS
+}
+
+// replayTestWorkload replays the workload captured by captureTestWorkload with
+// r and checks the resulting DB.
+func replayTestWorkload(t *testing.T, r *Runner) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	require.NoError(fs.MkdirAll("run", os.ModePerm))
+	r.RunDir = "run"
+	r.WorkloadPath = "workload"
+	r.Pacer = Unpaced{}
+	// Compact after every flush so that Wait observes the compactions
+	// quiescing.
+	r.Opts = &pebble.Options{FS: fs, L0CompactionThreshold: 1, Logger: base.NoopLoggerAndTracer{}}
+	require.NoError(r.Run(context.Background()))
+	_, err := r.Wait()
+	require.NoError(err)
+	for i := 0; i < 5; i++ {
+		for _, prefix := range []string{"a", "b"} {
+			val, closer, err := r.d.Get([]byte(fmt.Sprint(prefix, i)))
+			require.NoError(err)
+			require.Equal("val", string(val))
+			require.NoError(closer.Close())
+		}
+	}
+	require.NoError(r.Close())
+}
+
+func TestEncryptedWorkloadCaptureError(t *testing.T) {
+	require := require.New(t)
+	o := &pebble.Options{
+		EncryptionKey: bytes.Repeat([]byte{2}, 16),
+		FS:            vfs.NewMem(),
+		Logger:        base.NoopLoggerAndTracer{},
+	}
+	wc := NewWorkloadCollector("")
+	wc.Attach(o)
+	d, err := pebble.Open("", o)
+	require.NoError(err)
+	defer d.Close()
+
+	// the captured SALTCHAIN can't be created
+	destFS := vfs.NewMem()
+	require.NoError(destFS.MkdirAll(destFS.PathJoin("workload", edg.SaltChainFilename), os.ModePerm))
+	wc.Start(destFS, "workload")
+	require.NoError(d.Set([]byte("a"), []byte("val"), pebble.NoSync))
+	require.NoError(d.Set([]byte("b"), []byte("val"), pebble.NoSync))
+	require.NoError(d.Flush())
+	require.Error(wc.WaitAndStop())
+
+	// the error isn't returned again
+	require.NoError(wc.Stop())
+}
@@ -26,6 +26,7 @@ import (
 	pebble "github.com/edgelesssys/estore"
 	"github.com/edgelesssys/estore/internal/base"
 	"github.com/edgelesssys/estore/internal/bytealloc"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/internal/manifest"
 	"github.com/edgelesssys/estore/internal/rangedel"
 	"github.com/edgelesssys/estore/internal/rangekey"
@@ -263,6 +264,16 @@ type Runner struct {
 	Pacer         Pacer
 	Opts          *pebble.Options
 	MaxWriteBytes uint64
+	// EDG: WorkloadEncryptionKey is the key the workload's manifests and
+	// sstables are encrypted with. This is the master key of the DB the
+	// workload was captured from, or the benchmark key if the workload was
+	// re-encrypted. Must be set unless the workload was captured in a test
+	// without encryption key.
+	WorkloadEncryptionKey []byte
+	// EDG: WorkloadPlaintext must be set instead of WorkloadEncryptionKey if
+	// the workload was captured from a DB created with
+	// Options.Insecure_DisableEncryption and hasn't been re-encrypted.
+	WorkloadPlaintext bool
 
 	// Internal state.
 
@@ -279,6 +290,10 @@ type Runner struct {
 	steps         chan workloadStep
 	stepsApplied  chan workloadStep
 
+	// EDG: workloadKeys provides the keys of the workload's files. It's nil
+	// if neither WorkloadEncryptionKey nor WorkloadPlaintext is set.
+	workloadKeys *edg.KeyManager
+
 	metrics struct {
 		estimatedDebt    SampledMetric
 		quiesceDuration  time.Duration
@@ -350,6 +365,12 @@ func (r *Runner) Run(ctx context.Context) error {
 	r.writeStallMetrics.durationByReason = make(map[string]time.Duration)
 	r.Opts.EnsureDefaults()
 	r.readerOpts = r.Opts.MakeReaderOptions()
+	if r.WorkloadEncryptionKey != nil || r.WorkloadPlaintext {
+		r.workloadKeys, err = edg.OpenKeyManager(r.WorkloadFS, r.WorkloadPath, r.WorkloadEncryptionKey, r.WorkloadPlaintext)
+		if err != nil {
+			return err
+		}
+	}
 	r.Opts.DisableWAL = true
 	r.d, err = pebble.Open(r.RunDir, r.Opts)
 	if err != nil {
@@ -564,7 +585,11 @@ func (r *Runner) Wait() (Metrics, error) {
 // Close closes remaining open resources, including the database. It must be
 // called after Wait.
 func (r *Runner) Close() error {
-	return r.d.Close()
+	err := r.d.Close()
+	if r.workloadKeys != nil {
+		err = errors.CombineErrors(err, r.workloadKeys.Close())
+	}
+	return err
 }
 
 // A workloadStep describes a single manifest edit in the workload. It may be a
@@ -738,6 +763,15 @@ func (r *Runner) prepareWorkloadSteps(ctx context.Context) error {
 			defer f.Close()
 
 			rr := record.NewReader(f, 0 /* logNum */)
+			if r.workloadKeys != nil {
+				_, fileNum, ok := base.ParseFilename(r.WorkloadFS, manifestName)
+				if !ok {
+					return errors.Newf("invalid manifest name %q", manifestName)
+				}
+				if rr.EncryptionKey, err = r.workloadKeys.Get(fileNum.FileNum()); err != nil {
+					return errors.Wrapf(err, "getting key of %q", manifestName)
+				}
+			}
 			// A manifest's first record always holds the initial version state.
 			// If this is the first manifest we're examining, we load it in
 			// order to seed `metas` with the file metadata of the existing
@@ -838,7 +872,7 @@ func (r *Runner) prepareWorkloadSteps(ctx context.Context) error {
 				case flushStepKind:
 					// Load all of the flushed sstables' keys into a batch.
 					s.flushBatch = r.d.NewBatch()
-					if err := loadFlushedSSTableKeys(s.flushBatch, r.WorkloadFS, r.WorkloadPath, newFiles, r.readerOpts, &flushBufs); err != nil {
+					if err := loadFlushedSSTableKeys(s.flushBatch, r.WorkloadFS, r.WorkloadPath, newFiles, r.readerOpts, r.workloadKeys, &flushBufs); err != nil {
 						return errors.Wrapf(err, "flush in %q at offset %d", manifestName, rr.Offset())
 					}
 					cumulativeWriteBytes += uint64(s.flushBatch.Len())
@@ -972,12 +1006,16 @@ func findManifestStart(
 // necessary, but it ensures we accurately exercise some microoptimizations (eg,
 // detecting user key changes by descending trailer). There may be additional
 // dependencies on sequence numbers in the future.
+//
+// EDG: If keys is non-nil, the sstables are decrypted with the keys it
+// provides.
 func loadFlushedSSTableKeys(
 	b *pebble.Batch,
 	fs vfs.FS,
 	path string,
 	fileNums []base.DiskFileNum,
 	readOpts sstable.ReaderOptions,
+	keys *edg.KeyManager,
 	bufs *flushBuffers,
 ) error {
 	// Load all the keys across all the sstables.
@@ -993,6 +1031,13 @@ func loadFlushedSSTableKeys(
 				f.Close()
 				return err
 			}
+			readOpts := readOpts
+			if keys != nil {
+				if readOpts.EncryptionKey, err = keys.Get(fileNum.FileNum()); err != nil {
+					readable.Close()
+					return err
+				}
+			}
 			r, err := sstable.NewReader(readable, readOpts)
 			if err != nil {
 				return err
@@ -198,7 +198,7 @@ func TestLoadFlushedSSTableKeys(t *testing.T) {
 			}
 
 			b := d.NewBatch()
-			err := loadFlushedSSTableKeys(b, opts.FS, "", diskFileNums, opts.MakeReaderOptions(), &flushBufs)
+			err := loadFlushedSSTableKeys(b, opts.FS, "", diskFileNums, opts.MakeReaderOptions(), nil /* keys */, &flushBufs)
 			if err != nil {
 				b.Close()
 				return err.Error()
@@ -321,7 +321,7 @@ func collectCorpus(t *testing.T, fs *vfs.MemFS, name string) {
 				wc.mu.copyCond.Wait()
 			}
 			wc.mu.Unlock()
-			wc.Stop()
+			require.NoError(t, wc.Stop())
 			return "stopped"
 		case "tree":
 			return fs.String()
@@ -575,7 +575,7 @@ func buildHeavyWorkload(t *testing.T) vfs.FS {
 		require.NoError(t, b.Commit(pebble.NoSync))
 		require.NoError(t, d.Flush())
 	}
-	wc.WaitAndStop()
+	require.NoError(t, wc.WaitAndStop())
 
 	defer d.Close()
 	return destFS
@@ -12,6 +12,7 @@ import (
 
 	pebble "github.com/edgelesssys/estore"
 	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/vfs"
 )
 
@@ -57,7 +58,20 @@ type WorkloadCollector struct {
 		copyCond       sync.Cond
 		tablesCopied   int
 		tablesEnqueued int
+
+		// EDG: salts holds the salts of files that have been enqueued but not
+		// yet copied.
+		salts map[base.FileNum][]byte
+		// EDG: srcKeys is the KeyManager of the DB the workload is captured
+		// from.
+		srcKeys *edg.KeyManager
+		// EDG: edgErr is the first error of capturing the salts. It's
+		// returned by Stop.
+		edgErr error
 	}
+	// EDG: keyManager writes the SALTCHAIN of the captured workload. It is
+	// only accessed by the copyFiles goroutine.
+	keyManager *edg.KeyManager
 	// Stores the current manifest that is being used by the database.
 	curManifest atomic.Uint64
 	// Stores whether the workload collector is enabled.
@@ -77,6 +91,12 @@ type WorkloadCollector struct {
 		// cleaner stores the cleaner to use when files become obsolete and need to
 		// be cleaned.
 		cleaner base.Cleaner
+		// EDG: opts are the options of the DB. opts.EncryptionKey and
+		// opts.Insecure_DisableEncryption are needed to write the SALTCHAIN.
+		opts *pebble.Options
+		// EDG: benchmarkKey, if set, is the key the captured workload is
+		// re-encrypted with when the collection is stopped.
+		benchmarkKey []byte
 	}
 	copier struct {
 		sync.Cond
@@ -92,6 +112,7 @@ func NewWorkloadCollector(srcDir string) *WorkloadCollector {
 	wc.config.srcDir = srcDir
 	wc.mu.copyCond.L = &wc.mu.Mutex
 	wc.mu.fileState = make(map[string]workloadCaptureState)
+	wc.mu.salts = make(map[base.FileNum][]byte)
 	wc.copier.Cond.L = &wc.mu.Mutex
 	return wc
 }
@@ -115,6 +136,9 @@ func (w *WorkloadCollector) Attach(opts *pebble.Options) {
 	}
 	w.config.cleaner, opts.Cleaner = opts.Cleaner, c
 	w.config.srcFS = opts.FS
+	w.config.opts = opts
+	// EDG: look up the salts of captured files in the DB's KeyManager
+	w.edgAttach(opts)
 }
 
 // enqueueCopyLocked enqueues the sstable with the provided filenum be copied in
@@ -165,9 +189,12 @@ func (w *WorkloadCollector) onTableIngest(info pebble.TableIngestInfo) {
 	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	var fileNums []base.FileNum
 	for _, table := range info.Tables {
 		w.enqueueCopyLocked(table.FileNum.DiskFileNum())
+		fileNums = append(fileNums, table.FileNum)
 	}
+	w.edgSnapshotSaltsLocked(fileNums...)
 	w.copier.Broadcast()
 }
 
@@ -179,9 +206,12 @@ func (w *WorkloadCollector) onFlushEnd(info pebble.FlushInfo) {
 	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	var fileNums []base.FileNum
 	for _, table := range info.Output {
 		w.enqueueCopyLocked(table.FileNum.DiskFileNum())
+		fileNums = append(fileNums, table.FileNum)
 	}
+	w.edgSnapshotSaltsLocked(fileNums...)
 	w.copier.Broadcast()
 }
 
@@ -203,6 +233,7 @@ func (w *WorkloadCollector) onManifestCreated(info pebble.ManifestCreateInfo) {
 	w.mu.manifests = append(w.mu.manifests, &manifestDetails{
 		sourceFilepath: info.Path,
 	})
+	w.edgSnapshotSaltsLocked(info.FileNum)
 }
 
 // copyFiles is run in a separate goroutine, copying sstables and manifests.
@@ -280,6 +311,7 @@ func (w *WorkloadCollector) copyManifests(startAtIndex int, manifests []*manifes
 			if err != nil {
 				panic(err)
 			}
+			w.edgCaptureSalt(manifest.sourceFilepath)
 		}
 
 		data, err := io.ReadAll(manifest.sourceFile)
@@ -326,6 +358,7 @@ func (w *WorkloadCollector) copySSTables(pending []string) {
 		if err != nil {
 			panic(err)
 		}
+		w.edgCaptureSalt(filePath)
 	}
 
 	// Identify the subset of `pending` files that should now be cleaned. The
@@ -379,6 +412,7 @@ func (w *WorkloadCollector) Start(destFS vfs.FS, destPath string) {
 		fileName := base.MakeFilename(base.FileTypeManifest, fileNum.DiskFileNum())
 		w.mu.manifests = append(w.mu.manifests[:0], &manifestDetails{sourceFilepath: w.srcFilepath(fileName)})
 		w.mu.fileState[fileName] |= readyForProcessing
+		w.edgSnapshotSaltsLocked(fileNum)
 	}
 
 	// Begin copying files asynchronously in the background.
@@ -390,28 +424,30 @@ func (w *WorkloadCollector) Start(destFS vfs.FS, destPath string) {
 // WaitAndStop waits for all enqueued sstables to be copied over, and then
 // calls Stop. Gracefully ensures that all sstables referenced in the collected
 // manifest's latest version edit will exist in the copy directory.
-func (w *WorkloadCollector) WaitAndStop() {
+func (w *WorkloadCollector) WaitAndStop() error {
 	w.mu.Lock()
 	for w.mu.tablesEnqueued != w.mu.tablesCopied {
 		w.mu.copyCond.Wait()
 	}
 	w.mu.Unlock()
-	w.Stop()
+	return w.Stop()
 }
 
-// Stop stops collection of the workload.
-func (w *WorkloadCollector) Stop() {
+// Stop stops collection of the workload. EDG: It returns an error if the
+// SALTCHAIN of the workload couldn't be captured or re-encrypted.
+func (w *WorkloadCollector) Stop() error {
 	w.mu.Lock()
 	// If the collector is running then that means w.enabled == true so swap it to
 	// false and continue else return since it is not running.
 	if !w.enabled.CompareAndSwap(true, false) {
 		w.mu.Unlock()
-		return
+		return nil
 	}
 	w.copier.stop = true
 	w.copier.Broadcast()
 	w.mu.Unlock()
 	<-w.copier.done
+	return w.edgFinishCapture()
 }
 
 // IsRunning returns whether the WorkloadCollector is currently running.
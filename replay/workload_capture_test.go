@@ -153,7 +153,7 @@ func TestWorkloadCollector(t *testing.T) {
 				}
 				return buf.String()
 			case "stop":
-				c.Stop()
+				require.NoError(t, c.Stop())
 				return ""
 			case "wait":
 				// Wait until all pending sstables have been copied, then list
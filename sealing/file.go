@@ -0,0 +1,54 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package sealing
+
+import (
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/vfs"
+)
+
+// FileSealer seals data with a key-encryption key that is read from a file,
+// e.g., a secret that is mounted into the container. It doesn't depend on an
+// enclave.
+type FileSealer struct {
+	key []byte
+}
+
+var _ Sealer = (*FileSealer)(nil)
+
+// NewFileSealer returns a FileSealer that uses the key in the file at path. The
+// key must be 16, 24 or 32 bytes long and selects AES-128, AES-192 or AES-256.
+func NewFileSealer(fs vfs.FS, path string) (*FileSealer, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	key, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, errors.Newf("invalid size of key-encryption key: %d", len(key))
+	}
+	return &FileSealer{key: key}, nil
+}
+
+// Seal implements Sealer.
+func (s *FileSealer) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	return edg.SealGCM(s.key, plaintext, additionalData)
+}
+
+// Unseal implements Sealer.
+func (s *FileSealer) Unseal(sealed, additionalData []byte) ([]byte, error) {
+	return edg.OpenGCM(s.key, sealed, additionalData)
+}
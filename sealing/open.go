@@ -0,0 +1,171 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package sealing
+
+import (
+	"crypto"
+	"crypto/rand"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
+	"github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/vfs"
+)
+
+// KeyringFilename is the name of the file next to the SALTCHAIN that holds the
+// master key wrapped by the Sealer and the recovery keys.
+const KeyringFilename = edg.KeyringFilename
+
+const masterKeySize = 32
+
+// OpenSealed opens the DB in dirname with a master key that is sealed by
+// sealer. On first open, it generates a new master key and stores it in the
+// keyring in dirname, wrapped by sealer and by each of the recovery keys. On
+// later opens, it unseals the key from the keyring. The plaintext key is never
+// written to disk.
+//
+// A recovery key is an *rsa.PublicKey or an *ecdh.PublicKey of curve X25519.
+// Its private key can recover the DB with estore.RecoverWithKey if sealer can't
+// unseal the key anymore, e.g., because the sealing key of the enclave has
+// changed. If recovery keys are passed for an existing DB, they replace the
+// ones in the keyring.
+//
+// opts may be nil. opts.EncryptionKey must not be set, because the key is
+// managed by OpenSealed. If opts.Lock is nil, OpenSealed locks the directory
+// before it accesses the keyring.
+func OpenSealed(
+	dirname string, sealer Sealer, opts *estore.Options, recoveryKeys ...crypto.PublicKey,
+) (*estore.DB, error) {
+	if opts == nil {
+		opts = &estore.Options{}
+	}
+	if opts.EncryptionKey != nil {
+		return nil, errors.New("estore: OpenSealed manages the encryption key, but Options.EncryptionKey is set")
+	}
+	fs := opts.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+	l := keyLoader{
+		fs:           fs,
+		dirname:      dirname,
+		sealer:       sealer,
+		recoveryKeys: recoveryKeys,
+		readOnly:     opts.ReadOnly,
+		mustExist:    opts.ReadOnly || opts.ErrorIfNotExists,
+	}
+
+	// don't modify the caller's options
+	opts = opts.Clone()
+
+	// Hold the lock while the keyring is read and written, so that concurrent
+	// opens can't generate different keys or overwrite each other's keyring.
+	if opts.Lock == nil {
+		if l.mustExist {
+			if _, err := fs.Stat(dirname); oserror.IsNotExist(err) {
+				return nil, errors.Wrapf(estore.ErrDBDoesNotExist, "dirname=%q", dirname)
+			}
+		} else if err := fs.MkdirAll(dirname, 0755); err != nil {
+			return nil, err
+		}
+		lock, err := estore.LockDirectory(dirname, fs)
+		if err != nil {
+			return nil, err
+		}
+		// The DB keeps its own reference to the lock.
+		defer lock.Close()
+		opts.Lock = lock
+	}
+
+	key, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	opts.EncryptionKey = key
+	return estore.Open(dirname, opts)
+}
+
+type keyLoader struct {
+	fs           vfs.FS
+	dirname      string
+	sealer       Sealer
+	recoveryKeys []crypto.PublicKey
+	readOnly     bool
+	mustExist    bool
+}
+
+// load unseals the master key stored in the keyring, or generates and stores a
+// new one if the DB doesn't exist yet.
+func (l keyLoader) load() ([]byte, error) {
+	keyring, err := edg.ReadKeyring(l.fs, l.dirname)
+	if err == nil {
+		key, err := keyring.Unseal(l.sealer)
+		if err != nil {
+			return nil, errors.Wrap(err, "estore: unsealing master key")
+		}
+		if len(l.recoveryKeys) > 0 && !l.readOnly {
+			current, err := keyring.RecoveryKeys()
+			if err != nil {
+				return nil, err
+			}
+			if !equalKeys(current, l.recoveryKeys) {
+				if err := l.writeKeyring(key); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return key, nil
+	}
+	if !oserror.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Never generate a new key for an existing DB, because the DB couldn't be
+	// opened with it.
+	if _, err := l.fs.Stat(l.fs.PathJoin(l.dirname, edg.SaltChainFilename)); err == nil {
+		return nil, errors.Newf("estore: %s is missing for existing DB in %q", KeyringFilename, l.dirname)
+	} else if !oserror.IsNotExist(err) {
+		return nil, err
+	}
+	if l.mustExist {
+		return nil, errors.Wrapf(estore.ErrDBDoesNotExist, "dirname=%q", l.dirname)
+	}
+
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := l.writeKeyring(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKeyring wraps key with the sealer and the recovery keys and writes the
+// keyring.
+func (l keyLoader) writeKeyring(key []byte) error {
+	keyring, err := edg.NewKeyring(key, l.sealer, l.recoveryKeys)
+	if err != nil {
+		return errors.Wrap(err, "estore: creating keyring")
+	}
+	return keyring.Write(l.fs, l.dirname)
+}
+
+// equalKeys returns whether a and b contain the same public keys in the same
+// order.
+func equalKeys(a, b []crypto.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if k, ok := a[i].(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package sealing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/internal/edg"
+)
+
+// KeyProvider derives sealing keys from the identity of an enclave. The
+// methods match the functions of EGo's enclave package, so an implementation
+// for EGo only has to forward the calls:
+//
+//	type egoKeyProvider struct{}
+//
+//	func (egoKeyProvider) GetProductSealKey() ([]byte, []byte, error) {
+//		return enclave.GetProductSealKey()
+//	}
+//
+//	func (egoKeyProvider) GetSealKey(keyInfo []byte) ([]byte, error) {
+//		return enclave.GetSealKey(keyInfo)
+//	}
+type KeyProvider interface {
+	// GetProductSealKey returns a new key that is bound to the product ID and
+	// the signer of the enclave, and the info that is needed to derive the key
+	// again.
+	GetProductSealKey() (key, keyInfo []byte, err error)
+	// GetSealKey derives the key for the info that GetProductSealKey returned.
+	GetSealKey(keyInfo []byte) ([]byte, error)
+}
+
+// ProductSealer seals data with keys that are bound to the product ID and the
+// signer of the enclave. Other versions of the enclave from the same signer can
+// unseal the data, which allows updates of the application.
+type ProductSealer struct {
+	provider KeyProvider
+}
+
+var _ Sealer = (*ProductSealer)(nil)
+
+// NewProductSealer returns a ProductSealer that gets the keys from provider.
+func NewProductSealer(provider KeyProvider) *ProductSealer {
+	return &ProductSealer{provider: provider}
+}
+
+// Seal implements Sealer. The key info is stored in the sealed data. The result
+// is uint32(len(keyInfo))|keyInfo|nonce|ciphertext.
+func (s *ProductSealer) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	key, keyInfo, err := s.provider.GetProductSealKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting product seal key")
+	}
+	header := binary.LittleEndian.AppendUint32(nil, uint32(len(keyInfo)))
+	header = append(header, keyInfo...)
+	sealed, err := edg.SealGCM(key, plaintext, append(header[:len(header):len(header)], additionalData...))
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// Unseal implements Sealer.
+func (s *ProductSealer) Unseal(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < 4 {
+		return nil, errors.New("sealed data is too short")
+	}
+	keyInfoLen := uint64(binary.LittleEndian.Uint32(sealed))
+	if uint64(len(sealed)-4) < keyInfoLen {
+		return nil, errors.New("sealed data is too short")
+	}
+	header, sealed := sealed[:4+keyInfoLen], sealed[4+keyInfoLen:]
+	key, err := s.provider.GetSealKey(header[4:])
+	if err != nil {
+		return nil, errors.Wrap(err, "getting seal key")
+	}
+	return edg.OpenGCM(key, sealed, append(header[:len(header):len(header)], additionalData...))
+}
+
+// FakeKeyProvider is a KeyProvider for tests outside of an enclave. Its keys
+// are derived from a random secret that only lives in memory, so data sealed
+// with them can only be unsealed with the same FakeKeyProvider. It provides no
+// protection.
+type FakeKeyProvider struct {
+	secret []byte
+}
+
+var _ KeyProvider = (*FakeKeyProvider)(nil)
+
+// NewFakeKeyProvider returns a FakeKeyProvider with a new random secret. Two
+// FakeKeyProviders behave like enclaves of different signers.
+func NewFakeKeyProvider() *FakeKeyProvider {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &FakeKeyProvider{secret: secret}
+}
+
+// GetProductSealKey implements KeyProvider.
+func (p *FakeKeyProvider) GetProductSealKey() ([]byte, []byte, error) {
+	keyInfo := make([]byte, 16)
+	if _, err := rand.Read(keyInfo); err != nil {
+		return nil, nil, err
+	}
+	key, err := p.GetSealKey(keyInfo)
+	return key, keyInfo, err
+}
+
+// GetSealKey implements KeyProvider.
+func (p *FakeKeyProvider) GetSealKey(keyInfo []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(keyInfo)
+	return mac.Sum(nil)[:16], nil
+}
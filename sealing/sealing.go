@@ -0,0 +1,17 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+// Package sealing manages the master key of an EStore so that applications
+// don't have to bring their own key. OpenSealed generates the key on first
+// open and only stores it wrapped in a keyring: sealed by a Sealer, e.g., bound
+// to the identity of an enclave, and optionally by recovery keys.
+package sealing
+
+import "github.com/edgelesssys/estore"
+
+// Sealer seals data so that only the same or an authorized party can unseal
+// it. The additional data is authenticated, but not stored in the sealed data.
+type Sealer = estore.Sealer
@@ -0,0 +1,210 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package sealing_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/edgelesssys/estore"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/sealing"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealers(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "kek", bytes.Repeat([]byte{2}, 32))
+	writeFile(t, fs, "kek-other", bytes.Repeat([]byte{3}, 16))
+	writeFile(t, fs, "kek-invalid", bytes.Repeat([]byte{3}, 15))
+
+	newFileSealer := func(path string) sealing.Sealer {
+		s, err := sealing.NewFileSealer(fs, path)
+		require.NoError(t, err)
+		return s
+	}
+	_, err := sealing.NewFileSealer(fs, "kek-invalid")
+	require.Error(t, err)
+	provider := sealing.NewFakeKeyProvider()
+
+	testCases := map[string]struct {
+		sealer sealing.Sealer
+		// same is another Sealer that can unseal the data
+		same sealing.Sealer
+		// other is a Sealer that can't unseal the data
+		other sealing.Sealer
+	}{
+		"file": {
+			sealer: newFileSealer("kek"),
+			same:   newFileSealer("kek"),
+			other:  newFileSealer("kek-other"),
+		},
+		"product": {
+			sealer: sealing.NewProductSealer(provider),
+			same:   sealing.NewProductSealer(provider),
+			other:  sealing.NewProductSealer(sealing.NewFakeKeyProvider()),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			plaintext := []byte("plaintext")
+			additionalData := []byte("additional data")
+			sealed, err := tc.sealer.Seal(plaintext, additionalData)
+			require.NoError(err)
+			require.NotContains(string(sealed), string(plaintext))
+
+			// sealing is randomized
+			sealed2, err := tc.sealer.Seal(plaintext, additionalData)
+			require.NoError(err)
+			require.NotEqual(sealed, sealed2)
+
+			unsealed, err := tc.same.Unseal(sealed, additionalData)
+			require.NoError(err)
+			require.Equal(plaintext, unsealed)
+
+			_, err = tc.other.Unseal(sealed, additionalData)
+			require.Error(err)
+			_, err = tc.same.Unseal(sealed, []byte("other data"))
+			require.Error(err)
+			for i := range sealed {
+				tampered := bytes.Clone(sealed)
+				tampered[i] ^= 1
+				_, err = tc.same.Unseal(tampered, additionalData)
+				require.Error(err)
+			}
+			for i := range sealed {
+				_, err = tc.same.Unseal(sealed[:i], additionalData)
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestOpenSealed(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	sealer := sealing.NewProductSealer(sealing.NewFakeKeyProvider())
+	opts := &estore.Options{FS: fs, Logger: base.NoopLoggerAndTracer{}}
+
+	// the DB must exist if requested
+	_, err := sealing.OpenSealed("db", sealer, &estore.Options{FS: fs, ErrorIfNotExists: true})
+	require.ErrorIs(err, estore.ErrDBDoesNotExist)
+
+	// the keyring isn't accessed while another opener holds the lock
+	require.NoError(fs.MkdirAll("db", 0755))
+	lock, err := estore.LockDirectory("db", fs)
+	require.NoError(err)
+	_, err = sealing.OpenSealed("db", sealer, opts)
+	require.Error(err)
+	_, err = fs.Stat(fs.PathJoin("db", sealing.KeyringFilename))
+	require.Error(err)
+	require.NoError(lock.Close())
+
+	// the first open generates the key
+	db, err := sealing.OpenSealed("db", sealer, opts)
+	require.NoError(err)
+	require.Nil(opts.EncryptionKey)
+	require.NoError(db.Set([]byte("key"), []byte("value"), nil))
+	require.NoError(db.Close())
+
+	// only the keyring is stored
+	f, err := fs.Open(fs.PathJoin("db", sealing.KeyringFilename))
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	// later opens unseal the key
+	db, err = sealing.OpenSealed("db", sealer, opts)
+	require.NoError(err)
+	// the open DB holds the lock
+	_, err = sealing.OpenSealed("db", sealer, opts)
+	require.Error(err)
+	val, closer, err := db.Get([]byte("key"))
+	require.NoError(err)
+	require.Equal("value", string(val))
+	require.NoError(closer.Close())
+	require.NoError(db.Close())
+
+	// a different enclave can't unseal the key
+	other := sealing.NewProductSealer(sealing.NewFakeKeyProvider())
+	_, err = sealing.OpenSealed("db", other, opts)
+	require.ErrorContains(err, "unsealing master key")
+
+	// the key is managed by OpenSealed
+	_, err = sealing.OpenSealed("db", sealer, &estore.Options{FS: fs, EncryptionKey: bytes.Repeat([]byte{2}, 16)})
+	require.Error(err)
+
+	// an existing DB doesn't get a new key
+	require.NoError(fs.Remove(fs.PathJoin("db", sealing.KeyringFilename)))
+	_, err = sealing.OpenSealed("db", sealer, opts)
+	require.ErrorContains(err, "missing")
+}
+
+func TestRecoverWithKey(t *testing.T) {
+	require := require.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(err)
+	otherKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(err)
+
+	fs := vfs.NewMem()
+	opts := &estore.Options{FS: fs, Logger: base.NoopLoggerAndTracer{}}
+	sealer := sealing.NewProductSealer(sealing.NewFakeKeyProvider())
+	db, err := sealing.OpenSealed("db", sealer, opts, &rsaKey.PublicKey, x25519Key.PublicKey())
+	require.NoError(err)
+	require.NoError(db.Set([]byte("key"), []byte("value"), nil))
+	require.NoError(db.Close())
+
+	// the sealing key changed, e.g., after a CPU SVN update
+	newSealer := sealing.NewProductSealer(sealing.NewFakeKeyProvider())
+	_, err = sealing.OpenSealed("db", newSealer, opts)
+	require.Error(err)
+
+	// recovery requires one of the recovery keys
+	require.Error(estore.RecoverWithKey("db", fs, otherKey, newSealer))
+
+	for _, recoveryKey := range []crypto.PrivateKey{x25519Key, rsaKey} {
+		require.NoError(estore.RecoverWithKey("db", fs, recoveryKey, newSealer))
+		db, err = sealing.OpenSealed("db", newSealer, opts)
+		require.NoError(err)
+		val, closer, err := db.Get([]byte("key"))
+		require.NoError(err)
+		require.Equal("value", string(val))
+		require.NoError(closer.Close())
+		require.NoError(db.Close())
+
+		// the old sealer can't unseal the key anymore
+		_, err = sealing.OpenSealed("db", sealer, opts)
+		require.Error(err)
+		newSealer, sealer = sealer, newSealer
+	}
+
+	// recovery keys can be replaced, which requires the primary sealer
+	db, err = sealing.OpenSealed("db", sealer, opts, otherKey.PublicKey())
+	require.NoError(err)
+	require.NoError(db.Close())
+	require.Error(estore.RecoverWithKey("db", fs, rsaKey, newSealer))
+	require.NoError(estore.RecoverWithKey("db", fs, otherKey, newSealer))
+}
+
+func writeFile(t *testing.T, fs vfs.FS, path string, data []byte) {
+	f, err := fs.Create(path)
+	require.NoError(t, err)
+	_, err = f.WriteApproved(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
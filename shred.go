@@ -0,0 +1,149 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/manifest"
+)
+
+// ShredObsolete makes data that has been overwritten or deleted
+// unrecoverable. It flushes the memtables, compacts the whole key space so
+// that shadowed keys and tombstones are dropped, rotates the MANIFEST, and
+// waits until all obsolete files have been deleted and their salts have been
+// removed from the SALTCHAIN. Afterwards, the overwritten or deleted data
+// can't be decrypted anymore, not even with the master key and a copy of the
+// deleted files.
+//
+// ShredObsolete requires Options.ForwardSecrecy. Data that is still visible
+// to an open Snapshot or EventuallyFileOnlySnapshot isn't dropped, and files
+// that are still referenced by open iterators are only shredded once they are
+// released.
+func (d *DB) ShredObsolete() error {
+	if err := d.closed.Load(); err != nil {
+		panic(err)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if !d.opts.ForwardSecrecy {
+		return errors.New("estore: ShredObsolete requires Options.ForwardSecrecy")
+	}
+
+	// Flush the memtables, so that the WALs become obsolete.
+	if err := d.Flush(); err != nil {
+		return err
+	}
+
+	// Compact the whole key space.
+	d.mu.Lock()
+	start, end := d.edgKeySpanLocked()
+	d.mu.Unlock()
+	if start != nil {
+		for level := 0; level < numLevels-1; level++ {
+			if err := d.manualCompact(start, end, level, false /* parallelize */); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.mu.Lock()
+	if d.mu.disableFileDeletions > 0 {
+		d.mu.Unlock()
+		return errors.New("estore: ShredObsolete can't delete files while file deletions are disabled")
+	}
+
+	// The MANIFEST contains the bounds of deleted files, and the previous
+	// NumPrevManifest manifests are retained. Rotate often enough that all
+	// manifests which may contain these bounds become obsolete.
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	for i := 0; i <= d.opts.NumPrevManifest; i++ {
+		d.mu.versions.logLock()
+		if err := d.mu.versions.logAndApply(
+			jobID,
+			&manifest.VersionEdit{},
+			map[int]*LevelMetrics{},
+			true, /* forceRotation */
+			func() []compactionInfo { return d.getInProgressCompactionInfoLocked(nil) },
+		); err != nil {
+			d.mu.Unlock()
+			return err
+		}
+	}
+	d.deleteObsoleteFiles(jobID)
+	d.mu.Unlock()
+
+	d.cleanupManager.Wait()
+	return nil
+}
+
+// edgPruneSaltsLocked removes the salts of files that neither exist nor are
+// referenced by the current version if forward secrecy is enabled. A crash
+// between deleting an obsolete file and removing its salt leaves the salt in
+// the SALTCHAIN. It must only be called during Open, when no files are being
+// created. d.mu must be held.
+func (d *DB) edgPruneSaltsLocked() error {
+	if !d.opts.ForwardSecrecy {
+		return nil
+	}
+	keep := make(map[base.FileNum]bool)
+	for _, dir := range []string{d.dirname, d.walDirname} {
+		ls, err := d.opts.FS.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, filename := range ls {
+			if _, fileNum, ok := base.ParseFilename(d.opts.FS, filename); ok {
+				keep[fileNum.FileNum()] = true
+			}
+		}
+	}
+	for _, obj := range d.objProvider.List() {
+		keep[obj.DiskFileNum.FileNum()] = true
+	}
+	for _, level := range d.mu.versions.currentVersion().Levels {
+		iter := level.Iter()
+		for f := iter.First(); f != nil; f = iter.Next() {
+			keep[f.FileBacking.DiskFileNum.FileNum()] = true
+		}
+	}
+
+	var prune []base.FileNum
+	for _, fileNum := range d.keyManager.FileNums() {
+		if !keep[fileNum] {
+			prune = append(prune, fileNum)
+		}
+	}
+	if len(prune) == 0 {
+		return nil
+	}
+	if err := d.keyManager.Remove(prune); err != nil {
+		return errors.Wrap(err, "estore: shredding salts of deleted files")
+	}
+	d.opts.Logger.Infof("estore: shredded the salts of %d deleted files", len(prune))
+	return nil
+}
+
+// edgKeySpanLocked returns the smallest and largest user key of all files in
+// the current version. It returns nil if the LSM is empty. d.mu must be held.
+func (d *DB) edgKeySpanLocked() (start, end []byte) {
+	cur := d.mu.versions.currentVersion()
+	for level := range cur.Levels {
+		iter := cur.Levels[level].Iter()
+		for f := iter.First(); f != nil; f = iter.Next() {
+			if start == nil || d.cmp(f.Smallest.UserKey, start) < 0 {
+				start = f.Smallest.UserKey
+			}
+			if end == nil || d.cmp(f.Largest.UserKey, end) > 0 {
+				end = f.Largest.UserKey
+			}
+		}
+	}
+	return start, end
+}
@@ -168,6 +168,15 @@ func (l *snapshotList) earliest() uint64 {
 	return v
 }
 
+// latest returns the sequence number of the most recent snapshot, or 0 if
+// there are no snapshots.
+func (l *snapshotList) latest() uint64 {
+	if l.empty() {
+		return 0
+	}
+	return l.root.prev.seqNum
+}
+
 func (l *snapshotList) toSlice() []uint64 {
 	if l.empty() {
 		return nil
@@ -264,6 +273,7 @@ func (d *DB) makeEventuallyFileOnlySnapshot(
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	d.edgWaitForFilteredInstallsLocked()
 	seqNum := d.mu.versions.visibleSeqNum.Load()
 	// Check if any of the keyRanges overlap with a memtable.
 	for i := range d.mu.mem.queue {
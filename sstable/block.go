@@ -1370,7 +1370,7 @@ func (i *blockIter) nextPrefixV3(succKey []byte) (*InternalKey, base.LazyValue)
 		nextCmpCount++
 		if invariants.Enabled && prefixChanged && i.cmp(i.ikey.UserKey, succKey) < 0 {
 			panic(errors.AssertionFailedf("prefix should have changed but %x < %x",
-				i.ikey.UserKey, succKey))
+				base.UserData(i.ikey.UserKey), base.UserData(succKey)))
 		}
 		if prefixChanged || i.cmp(i.ikey.UserKey, succKey) >= 0 {
 			// Prefix has changed.
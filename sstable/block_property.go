@@ -117,6 +117,18 @@ type BlockPropertyCollector interface {
 	FinishTable(buf []byte) ([]byte, error)
 }
 
+// ValueBlockPropertyCollector is an extension to the BlockPropertyCollector
+// interface for collectors that inspect the values of SETs. From
+// TableFormatPebblev3 on, the Writer passes nil values for SETs to
+// collectors, unless they implement this interface and NeedsValues returns
+// true.
+type ValueBlockPropertyCollector interface {
+	BlockPropertyCollector
+	// NeedsValues returns whether the collector must be passed the values of
+	// SETs.
+	NeedsValues() bool
+}
+
 // SuffixReplaceableBlockCollector is an extension to the BlockPropertyCollector
 // interface that allows a block property collector to indicate that it supports
 // being *updated* during suffix replacement, i.e. when an existing SST in which
@@ -374,6 +386,21 @@ func (i *interval) decode(buf []byte) error {
 	return nil
 }
 
+// DecodeTableInterval decodes the [lower, upper) interval that a
+// BlockIntervalCollector stored in the user properties of a table. The
+// interval is empty (lower >= upper) if the collector didn't see any keys.
+func DecodeTableInterval(prop string) (lower, upper uint64, err error) {
+	if len(prop) == 0 {
+		return 0, 0, base.CorruptionErrorf("cannot decode empty table interval property")
+	}
+	// The first byte is the shortID of the collector.
+	var i interval
+	if err := i.decode([]byte(prop[1:])); err != nil {
+		return 0, 0, err
+	}
+	return i.lower, i.upper, nil
+}
+
 func (i *interval) union(x interval) {
 	if x.lower >= x.upper {
 		// x is the empty set.
@@ -9,20 +9,46 @@ package sstable
 import (
 	"context"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 
 	"github.com/cockroachdb/errors"
 	"github.com/edgelesssys/estore/internal/base"
 	"github.com/edgelesssys/estore/internal/edg"
+	"github.com/edgelesssys/estore/internal/keyspan"
+	"github.com/edgelesssys/estore/internal/rangedel"
+	"github.com/edgelesssys/estore/internal/rangekey"
 	"github.com/edgelesssys/estore/objstorage"
 )
 
 func (w *Writer) edgEncrypt(bh BlockHandle, block, blockTrailerBuf []byte) []byte {
 	buf := append(block, blockTrailerBuf[:blockTrailerLen-edg.GCMTagSize]...)
+	w.encryptionStats.Encrypted(len(buf))
 	return w.aead.Seal(buf[:0], edgGetNonce(bh), buf, nil)
 }
 
+// edgPad writes random bytes after a block of n bytes, so that the block
+// occupies a multiple of w.blockPadding bytes in the file. Random bytes can't
+// be told apart from ciphertext.
+func (w *Writer) edgPad(n int) error {
+	pad := edg.PaddingLen(n, w.blockPadding)
+	if pad == 0 {
+		return nil
+	}
+	buf := make([]byte, pad)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	if err := w.writable.WriteApproved(buf); err != nil {
+		return err
+	}
+	w.meta.Size += uint64(pad)
+	w.encryptionStats.Padded(pad)
+	return nil
+}
+
 func (w *Writer) edgEncryptFooter(encodedFooter []byte, offset uint64) []byte {
+	w.encryptionStats.Encrypted(len(encodedFooter))
 	return w.aead.Seal(encodedFooter[:0], edgGetFooterNonce(offset), encodedFooter, nil)
 }
 
@@ -30,12 +56,149 @@ func (r *Reader) edgDecrypt(bh BlockHandle, buf []byte) error {
 	if r.unencrypted {
 		return nil
 	}
-	if _, err := r.aead.Open(buf[:0], edgGetNonce(bh), buf, nil); err != nil {
+	plaintext, err := r.aead.Open(buf[:0], edgGetNonce(bh), buf, nil)
+	if err != nil {
+		r.opts.EncryptionStats.AuthFailed(r.fileNum.FileNum(), int64(bh.Offset))
 		return base.CorruptionErrorf("checksum mismatch: %w", err) // EDG: include "checksum mismatch" in the message to satisfy tests
 	}
+	r.opts.EncryptionStats.Decrypted(len(plaintext))
 	return nil
 }
 
+// Reencrypt copies the point keys, range deletions, and range keys of r to
+// out, encrypted with o.EncryptionKey. The table is rewritten key by key, so
+// its blocks and properties may differ from the original table. o.TableFormat
+// and o.MergerName default to those of r.
+func Reencrypt(r *Reader, out objstorage.Writable, o WriterOptions) (*WriterMetadata, error) {
+	if o.TableFormat == TableFormatUnspecified {
+		var err error
+		if o.TableFormat, err = r.TableFormat(); err != nil {
+			return nil, err
+		}
+	}
+	if o.MergerName == "" {
+		o.MergerName = r.Properties.MergerName
+	}
+	o.IsStrictObsolete = false
+	w := NewWriter(out, o)
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+	}()
+
+	iter, err := r.NewIter(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, lv := iter.First(); k != nil; k, lv = iter.Next() {
+		v, _, err := lv.Value(nil)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if err := w.Add(*k, v); err != nil {
+			iter.Close()
+			return nil, err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := edgCopySpans(r.NewRawRangeDelIter, func(s *keyspan.Span) error {
+		return rangedel.Encode(s, w.Add)
+	}); err != nil {
+		return nil, err
+	}
+	// The raw range key fragments are already fragmented, so they can bypass
+	// the fragmenter.
+	if err := edgCopySpans(r.NewRawRangeKeyIter, func(s *keyspan.Span) error {
+		return rangekey.Encode(s, w.AddRangeKey)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		w = nil
+		return nil, err
+	}
+	meta, err := w.Metadata()
+	w = nil
+	return meta, err
+}
+
+// ReencryptBlocks re-encrypts the table in data, which r reads, with newKey in
+// place. Unlike Reencrypt, it keeps the layout of the table: each block and the
+// footer are decrypted and encrypted again at the same offset, and the padding
+// between blocks is left as is. This requires that the old and the new cipher
+// have the same overhead, which is the case for all ciphers returned by
+// edg.GetCipher.
+func ReencryptBlocks(r *Reader, data []byte, newKey []byte) error {
+	aead, err := edg.GetCipher(newKey)
+	if err != nil {
+		return err
+	}
+	if aead.Overhead() != r.aead.Overhead() {
+		return errors.New("sstable: ciphers differ in overhead")
+	}
+	l, err := r.Layout()
+	if err != nil {
+		return err
+	}
+	handles := append([]BlockHandle(nil), l.Index...)
+	for _, bh := range l.Data {
+		handles = append(handles, bh.BlockHandle)
+	}
+	handles = append(handles, l.ValueBlock...)
+	handles = append(handles, l.TopIndex, l.Filter, l.RangeDel, l.RangeKey, l.ValueIndex, l.Properties, l.MetaIndex)
+
+	reencrypt := func(buf, nonce []byte) error {
+		plaintext, err := r.aead.Open(buf[:0], nonce, buf, nil)
+		if err != nil {
+			return base.CorruptionErrorf("sstable: decrypting block: %w", err)
+		}
+		aead.Seal(plaintext[:0], nonce, plaintext, nil)
+		return nil
+	}
+	done := make(map[uint64]bool)
+	for _, bh := range handles {
+		if bh.Length == 0 || done[bh.Offset] {
+			continue
+		}
+		done[bh.Offset] = true
+		end := bh.Offset + bh.Length + blockTrailerLen
+		if end > uint64(len(data)) {
+			return base.CorruptionErrorf("sstable: block at offset %d exceeds the table", bh.Offset)
+		}
+		if err := reencrypt(data[bh.Offset:end], edgGetNonce(bh)); err != nil {
+			return err
+		}
+	}
+
+	off := len(data) - (maxFooterLen + edg.GCMTagSize)
+	if off < 0 {
+		return errors.New("invalid table (file size is too small)")
+	}
+	return reencrypt(data[off:], edgGetFooterNonce(uint64(off)))
+}
+
+func edgCopySpans(
+	newIter func() (keyspan.FragmentIterator, error), emit func(*keyspan.Span) error,
+) error {
+	iter, err := newIter()
+	if err != nil || iter == nil {
+		return err
+	}
+	for s := iter.First(); s != nil; s = iter.Next() {
+		if err := emit(s); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
 func edgGetNonce(bh BlockHandle) []byte {
 	nonce := make([]byte, 12)
 	binary.LittleEndian.PutUint64(nonce, bh.Offset)
@@ -56,7 +219,9 @@ type decryptedFooter struct {
 	size int64
 }
 
-func newDecryptedFooter(readable objstorage.Readable, aead cipher.AEAD) (decryptedFooter, error) {
+func newDecryptedFooter(
+	readable objstorage.Readable, aead cipher.AEAD, stats *edg.FileStats, fileNum base.FileNum,
+) (decryptedFooter, error) {
 	f := decryptedFooter{buf: make([]byte, maxFooterLen+edg.GCMTagSize), size: readable.Size()}
 	off := f.size - int64(len(f.buf))
 	if off < 0 {
@@ -68,8 +233,10 @@ func newDecryptedFooter(readable objstorage.Readable, aead cipher.AEAD) (decrypt
 	var err error
 	f.buf, err = aead.Open(f.buf[:0], edgGetFooterNonce(uint64(off)), f.buf, nil)
 	if err != nil {
+		stats.AuthFailed(fileNum, off)
 		return decryptedFooter{}, err
 	}
+	stats.Decrypted(len(f.buf))
 	return f, nil
 }
 
@@ -7,8 +7,11 @@ SPDX-License-Identifier: AGPL-3.0-only
 package sstable
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 
+	"github.com/edgelesssys/estore/internal/base"
 	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/objstorage/objstorageprovider"
 	"github.com/edgelesssys/estore/vfs"
@@ -66,3 +69,122 @@ func encryptSST(t *testing.T, testFile ReadableFile) vfs.File {
 	require.NoError(err)
 	return encryptedFile
 }
+
+func TestReencrypt(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 16)
+
+	f, err := fs.Create("old")
+	require.NoError(err)
+	w := NewWriter(objstorageprovider.NewFileWritable(f), WriterOptions{
+		TableFormat:   TableFormatPebblev2,
+		EncryptionKey: oldKey,
+	})
+	require.NoError(w.Add(base.MakeInternalKey([]byte("a"), 3, InternalKeyKindSet), []byte("val")))
+	require.NoError(w.Add(base.MakeInternalKey([]byte("b"), 2, InternalKeyKindDelete), nil))
+	require.NoError(w.DeleteRange([]byte("c"), []byte("d")))
+	require.NoError(w.RangeKeySet([]byte("e"), []byte("f"), nil, []byte("rk")))
+	require.NoError(w.Close())
+
+	open := func(name string, key []byte) (*Reader, error) {
+		f, err := fs.Open(name)
+		require.NoError(err)
+		readable, err := NewSimpleReadable(f)
+		require.NoError(err)
+		return NewReader(readable, ReaderOptions{EncryptionKey: key})
+	}
+
+	r, err := open("old", oldKey)
+	require.NoError(err)
+	f, err = fs.Create("new")
+	require.NoError(err)
+	_, err = Reencrypt(r, objstorageprovider.NewFileWritable(f), WriterOptions{EncryptionKey: newKey})
+	require.NoError(err)
+	require.NoError(r.Close())
+
+	_, err = open("new", oldKey)
+	require.Error(err)
+	r, err = open("new", newKey)
+	require.NoError(err)
+	defer r.Close()
+	format, err := r.TableFormat()
+	require.NoError(err)
+	require.Equal(TableFormatPebblev2, format)
+
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(err)
+	var points []string
+	for k, lv := iter.First(); k != nil; k, lv = iter.Next() {
+		v, _, err := lv.Value(nil)
+		require.NoError(err)
+		points = append(points, fmt.Sprintf("%s:%s", k, v))
+	}
+	require.NoError(iter.Close())
+	require.Equal([]string{"a#3,1:val", "b#2,0:"}, points)
+
+	rangeDels, err := r.NewRawRangeDelIter()
+	require.NoError(err)
+	require.Equal("c-d:{(#0,RANGEDEL)}", rangeDels.First().String())
+	require.NoError(rangeDels.Close())
+	rangeKeys, err := r.NewRawRangeKeyIter()
+	require.NoError(err)
+	require.Equal("e-f:{(#0,RANGEKEYSET,,rk)}", rangeKeys.First().String())
+	require.NoError(rangeKeys.Close())
+}
+
+func TestValueBlocksPadding(t *testing.T) {
+	require := require.New(t)
+	fs := vfs.NewMem()
+	const blockPadding = 4096
+
+	f, err := fs.Create("table")
+	require.NoError(err)
+	w := NewWriter(objstorageprovider.NewFileWritable(f), WriterOptions{
+		TableFormat:  TableFormatPebblev3,
+		BlockSize:    100,
+		BlockPadding: blockPadding,
+	})
+	// the older versions of a key are written to value blocks
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		for seqNum := uint64(3); seqNum > 0; seqNum-- {
+			value := bytes.Repeat([]byte{byte('a' + seqNum)}, 100)
+			require.NoError(w.Add(base.MakeInternalKey(key, seqNum, InternalKeyKindSet), value))
+		}
+	}
+	require.NoError(w.Close())
+	meta, err := w.Metadata()
+	require.NoError(err)
+	require.NotZero(meta.Properties.NumValueBlocks)
+
+	f, err = fs.Open("table")
+	require.NoError(err)
+	readable, err := NewSimpleReadable(f)
+	require.NoError(err)
+	r, err := NewReader(readable, ReaderOptions{})
+	require.NoError(err)
+	defer r.Close()
+
+	// each value block and the value block index occupy a multiple of the
+	// padding
+	l, err := r.Layout()
+	require.NoError(err)
+	require.Len(l.ValueBlock, int(meta.Properties.NumValueBlocks))
+	for _, bh := range append(l.ValueBlock, l.ValueIndex) {
+		require.Zero(bh.Offset % blockPadding)
+	}
+
+	iter, err := r.NewIter(nil, nil)
+	require.NoError(err)
+	n := 0
+	for k, lv := iter.First(); k != nil; k, lv = iter.Next() {
+		v, _, err := lv.Value(nil)
+		require.NoError(err)
+		require.Equal(bytes.Repeat([]byte{byte('a' + k.SeqNum())}, 100), v)
+		n++
+	}
+	require.NoError(iter.Close())
+	require.Equal(30, n)
+}
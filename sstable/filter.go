@@ -16,6 +16,13 @@ type FilterMetrics struct {
 	// the filter policy was checked but was unable to filter an access of a data
 	// block.
 	Misses int64
+	// EDG: The number of hits for the range filter. This is the number of
+	// times a range filter was used to skip a table because it contains no
+	// keys within the iterator bounds.
+	RangeHits int64
+	// EDG: The number of misses for the range filter. This is the number of
+	// times a range filter was checked but was unable to skip the table.
+	RangeMisses int64
 }
 
 // FilterMetricsTracker is used to keep track of filter metrics. It contains the
@@ -26,6 +33,10 @@ type FilterMetricsTracker struct {
 	hits atomic.Int64
 	// See FilterMetrics.Misses.
 	misses atomic.Int64
+	// See FilterMetrics.RangeHits.
+	rangeHits atomic.Int64
+	// See FilterMetrics.RangeMisses.
+	rangeMisses atomic.Int64
 }
 
 var _ ReaderOption = (*FilterMetricsTracker)(nil)
@@ -39,8 +50,10 @@ func (m *FilterMetricsTracker) readerApply(r *Reader) {
 // Load returns the current values as FilterMetrics.
 func (m *FilterMetricsTracker) Load() FilterMetrics {
 	return FilterMetrics{
-		Hits:   m.hits.Load(),
-		Misses: m.misses.Load(),
+		Hits:        m.hits.Load(),
+		Misses:      m.misses.Load(),
+		RangeHits:   m.rangeHits.Load(),
+		RangeMisses: m.rangeMisses.Load(),
 	}
 }
 
@@ -64,8 +77,10 @@ type filterWriter interface {
 }
 
 type tableFilterReader struct {
-	policy  FilterPolicy
-	metrics *FilterMetricsTracker
+	policy FilterPolicy
+	// EDG: rangePolicy is set if the filter is a range filter.
+	rangePolicy RangeFilterPolicy
+	metrics     *FilterMetricsTracker
 }
 
 func newTableFilterReader(policy FilterPolicy) *tableFilterReader {
@@ -87,6 +102,33 @@ func (f *tableFilterReader) mayContain(data, key []byte) bool {
 	return mayContain
 }
 
+// EDG: mayContainRange returns whether the table may contain a key in
+// [lower, upper). The filter holds the Split prefixes of the keys. Every key
+// in the range has a prefix in [prefix(lower), upper), or in
+// [prefix(lower), prefix(upper)] if upper has a suffix, because prefixes are
+// ordered bytewise and sort before the keys with a suffix.
+func (f *tableFilterReader) mayContainRange(data, lower, upper []byte, split Split) bool {
+	if split != nil {
+		if lower != nil {
+			lower = lower[:split(lower)]
+		}
+		if upper != nil {
+			if n := split(upper); n < len(upper) {
+				upper = append(upper[:n:n], 0)
+			}
+		}
+	}
+	mayContain := f.rangePolicy.MayContainRange(TableFilter, data, lower, upper)
+	if f.metrics != nil {
+		if mayContain {
+			f.metrics.rangeMisses.Add(1)
+		} else {
+			f.metrics.rangeHits.Add(1)
+		}
+	}
+	return mayContain
+}
+
 type tableFilterWriter struct {
 	policy FilterPolicy
 	writer FilterWriter
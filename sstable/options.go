@@ -7,6 +7,7 @@ package sstable
 import (
 	"github.com/edgelesssys/estore/internal/base"
 	"github.com/edgelesssys/estore/internal/cache"
+	"github.com/edgelesssys/estore/internal/edg"
 )
 
 // Compression is the per-block compression algorithm to use.
@@ -61,6 +62,9 @@ type FilterWriter = base.FilterWriter
 // FilterPolicy exports the base.FilterPolicy type.
 type FilterPolicy = base.FilterPolicy
 
+// RangeFilterPolicy exports the base.RangeFilterPolicy type.
+type RangeFilterPolicy = base.RangeFilterPolicy
+
 // TablePropertyCollector provides a hook for collecting user-defined
 // properties based on the keys and values stored in an sstable. A new
 // TablePropertyCollector is created for an sstable when the sstable is being
@@ -139,6 +143,10 @@ type ReaderOptions struct {
 	LoggerAndTracer base.LoggerAndTracer
 
 	EncryptionKey []byte
+
+	// EncryptionStats, if set, counts the decrypted bytes and authentication
+	// failures.
+	EncryptionStats *edg.FileStats
 }
 
 func (o ReaderOptions) ensureDefaults() ReaderOptions {
@@ -201,7 +209,8 @@ type WriterOptions struct {
 	// reduce disk reads for Get calls.
 	//
 	// One such implementation is bloom.FilterPolicy(10) from the pebble/bloom
-	// package.
+	// package. EDG: bloom.RibbonFilterPolicy(10) has the same false positive
+	// rate, but is about 30% smaller.
 	//
 	// The default value means to use no filter.
 	FilterPolicy FilterPolicy
@@ -273,6 +282,16 @@ type WriterOptions struct {
 	RequiredInPlaceValueBound UserKeyPrefixBound
 
 	EncryptionKey []byte
+
+	// EncryptionStats, if set, counts the encrypted bytes.
+	EncryptionStats *edg.FileStats
+
+	// BlockPadding, if positive, pads each block with random bytes so that it
+	// occupies a multiple of BlockPadding bytes in the file. This hides the
+	// exact sizes of blocks, and thereby the lengths of keys and values, from
+	// an observer of the storage. The padding is not referenced by any block
+	// handle.
+	BlockPadding int
 }
 
 func (o WriterOptions) ensureDefaults() WriterOptions {
@@ -0,0 +1,207 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package sstable
+
+import (
+	"context"
+	"sync"
+
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/objstorage/objstorageprovider/objiotracing"
+)
+
+// Prefetcher loads data blocks ahead of forward iteration on background
+// goroutines. When an iterator loads a data block while moving forward, it
+// schedules the loading of the following blocks of the table, so that reading,
+// decrypting and decompressing them runs in parallel with the iteration.
+//
+// Iterators of tables with a two-level index only prefetch the blocks of the
+// current index block.
+//
+// A Prefetcher can be shared by the iterators of multiple tables and is safe
+// for concurrent use. It bounds the number of blocks loaded ahead by each
+// iterator and the total size of the blocks that are loaded ahead but not yet
+// used.
+type Prefetcher struct {
+	blocks int
+	memory int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// NewPrefetcher returns a Prefetcher that loads up to blocks data blocks
+// ahead of each iterator, holding at most memory bytes of blocks that haven't
+// been used yet.
+func NewPrefetcher(blocks int, memory int64) *Prefetcher {
+	return &Prefetcher{blocks: blocks, memory: memory}
+}
+
+type prefetcherKey struct{}
+
+// WithPrefetcher returns a context for the creation of iterators that use p.
+func WithPrefetcher(ctx context.Context, p *Prefetcher) context.Context {
+	return context.WithValue(ctx, prefetcherKey{}, p)
+}
+
+func prefetcherFromContext(ctx context.Context) *Prefetcher {
+	p, _ := ctx.Value(prefetcherKey{}).(*Prefetcher)
+	return p
+}
+
+// reserve reserves memory for a block of the given size. It always succeeds
+// if no memory is reserved, so that blocks larger than the budget can be
+// prefetched one at a time.
+func (p *Prefetcher) reserve(size uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.used > 0 && p.used+int64(size) > p.memory {
+		return false
+	}
+	p.used += int64(size)
+	return true
+}
+
+func (p *Prefetcher) release(size uint64) {
+	p.mu.Lock()
+	p.used -= int64(size)
+	p.mu.Unlock()
+}
+
+// prefetchTask loads a data block on a background goroutine.
+type prefetchTask struct {
+	bh BlockHandle
+	// sep is the index key of the block.
+	sep    []byte
+	done   chan struct{}
+	handle bufferHandle
+	err    error
+}
+
+// blockPrefetch is the prefetch state of a table iterator.
+type blockPrefetch struct {
+	p *Prefetcher
+	// tasks holds the scheduled blocks in the order of the table.
+	tasks []*prefetchTask
+	// cursor iterates over the index block to find the following blocks.
+	cursor blockIter
+}
+
+// take returns the prefetched block with the handle bh, if any. It discards
+// the prefetched blocks before it, which the iterator skipped.
+func (f *blockPrefetch) take(bh BlockHandle) (bufferHandle, bool) {
+	for len(f.tasks) > 0 && f.tasks[0].bh.Offset <= bh.Offset {
+		t := f.tasks[0]
+		f.tasks[0] = nil
+		f.tasks = f.tasks[1:]
+		<-t.done
+		f.p.release(t.bh.Length)
+		if t.bh == bh && t.err == nil {
+			return t.handle, true
+		}
+		// On errors, the iterator loads the block itself and surfaces the
+		// error.
+		t.handle.Release()
+	}
+	return bufferHandle{}, false
+}
+
+// close waits for the scheduled blocks and releases them. It must be called
+// before the reader may be closed.
+func (f *blockPrefetch) close() {
+	for _, t := range f.tasks {
+		<-t.done
+		f.p.release(t.bh.Length)
+		t.handle.Release()
+	}
+	f.tasks = f.tasks[:0]
+}
+
+// readDataBlock reads the current data block, using a prefetched block if
+// there is one. If the iterator is moving forward, it schedules the loading
+// of the following blocks.
+func (i *singleLevelIterator) readDataBlock(ctx context.Context, dir int8) (bufferHandle, error) {
+	if i.prefetch.p == nil {
+		return i.reader.readBlock(ctx, i.dataBH, nil /* transform */, i.dataRH, i.stats, i.bufferPool)
+	}
+	block, ok := i.prefetch.take(i.dataBH)
+	if ok {
+		if i.stats != nil {
+			i.stats.BlockBytes += i.dataBH.Length
+		}
+	} else {
+		var err error
+		block, err = i.reader.readBlock(ctx, i.dataBH, nil /* transform */, i.dataRH, i.stats, i.bufferPool)
+		if err != nil {
+			return bufferHandle{}, err
+		}
+	}
+	if dir > 0 {
+		i.prefetchFollowingBlocks()
+	}
+	return block, nil
+}
+
+// prefetchFollowingBlocks schedules the loading of the data blocks that
+// follow the current one in the index block, until the iterator has enough
+// blocks scheduled, the memory budget is used up, or the blocks are beyond the
+// upper bound.
+func (i *singleLevelIterator) prefetchFollowingBlocks() {
+	f := &i.prefetch
+	if len(f.tasks) >= f.p.blocks {
+		return
+	}
+	// Continue after the last scheduled block.
+	after, sep := i.dataBH, i.index.Key().UserKey
+	if n := len(f.tasks); n > 0 {
+		after, sep = f.tasks[n-1].bh, f.tasks[n-1].sep
+	}
+	if i.upper != nil && i.cmp(sep, i.upper) >= 0 {
+		// The following blocks only contain keys beyond the upper bound.
+		return
+	}
+	if err := f.cursor.init(i.cmp, i.index.data, i.reader.Properties.GlobalSeqNum, false); err != nil {
+		return
+	}
+	for key, val := f.cursor.SeekGE(sep, base.SeekGEFlagsNone); key != nil && len(f.tasks) < f.p.blocks; key, val = f.cursor.Next() {
+		bhp, err := decodeBlockHandleWithProperties(val.InPlaceValue())
+		if err != nil {
+			return
+		}
+		if bhp.Offset <= after.Offset {
+			continue
+		}
+		prefetch := true
+		if i.bpfs != nil {
+			intersects, err := i.bpfs.intersects(bhp.Props)
+			prefetch = err == nil && intersects != blockExcluded
+		}
+		if prefetch {
+			if !f.p.reserve(bhp.Length) {
+				return
+			}
+			t := &prefetchTask{
+				bh:   bhp.BlockHandle,
+				sep:  append([]byte(nil), key.UserKey...),
+				done: make(chan struct{}),
+			}
+			f.tasks = append(f.tasks, t)
+			go i.reader.prefetchBlock(i.ctx, t)
+		}
+		if i.upper != nil && i.cmp(key.UserKey, i.upper) >= 0 {
+			return
+		}
+	}
+}
+
+// prefetchBlock loads the block of the task into the block cache and keeps a
+// handle to it.
+func (r *Reader) prefetchBlock(ctx context.Context, t *prefetchTask) {
+	ctx = objiotracing.WithBlockType(ctx, objiotracing.DataBlock)
+	t.handle, t.err = r.readBlock(ctx, t.bh, nil /* transform */, nil /* readHandle */, nil /* stats */, nil /* bufferPool */)
+	close(t.done)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package sstable
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetch(t *testing.T) {
+	// single-level and two-level index
+	for _, indexBlockSize := range []int{1 << 20, 2048} {
+		t.Run(fmt.Sprintf("index-block-size=%d", indexBlockSize), func(t *testing.T) {
+			require := require.New(t)
+			const numEntries = 5000
+			r := buildTestTable(t, numEntries, 256, indexBlockSize, NoCompression)
+			defer func() { require.NoError(r.Close()) }()
+
+			key := func(i uint64) []byte {
+				return binary.BigEndian.AppendUint64(nil, i)
+			}
+			p := NewPrefetcher(4, 2048)
+			newIter := func(lower, upper []byte) Iterator {
+				iter, err := r.NewIterWithBlockPropertyFiltersAndContextEtc(
+					WithPrefetcher(context.Background(), p), lower, upper, nil, /* filterer */
+					false /* hideObsoletePoints */, true /* useFilterBlock */, nil /* stats */, TrivialReaderProvider{Reader: r})
+				require.NoError(err)
+				return iter
+			}
+			// check iterates over the keys of the iterator, seeking over some of
+			// them, and compares them with the keys [from, to).
+			check := func(iter Iterator, from, to uint64) {
+				i := from
+				prefetched := false
+				for k, _ := iter.SeekGE(key(from), 0); k != nil; k, _ = iter.Next() {
+					require.Equal(key(i)[:8], k.UserKey[:8])
+					prefetched = prefetched || p.used > 0
+					i++
+					if i%1000 == 0 && i < to {
+						// skip some keys, discarding prefetched blocks
+						i += 500
+						k, _ = iter.SeekGE(key(i), 0)
+						require.Equal(key(i)[:8], k.UserKey[:8])
+						i++
+					}
+				}
+				require.Equal(to, i)
+				require.NoError(iter.Error())
+				require.True(prefetched)
+			}
+
+			iter := newIter(nil, nil)
+			check(iter, 0, numEntries)
+			// reverse iteration doesn't prefetch, but uses blocks prefetched
+			// before
+			n := 0
+			for k, _ := iter.SeekLT(key(2500), 0); k != nil && n < 1000; k, _ = iter.Prev() {
+				require.Equal(key(uint64(2499 - n))[:8], k.UserKey[:8])
+				n++
+			}
+			require.NoError(iter.Close())
+			require.Zero(p.used)
+
+			// bounds
+			iter = newIter(key(1200), key(3700))
+			check(iter, 1200, 3700)
+			require.NoError(iter.Close())
+			require.Zero(p.used)
+		})
+	}
+}
+
+func TestPrefetcherReserve(t *testing.T) {
+	require := require.New(t)
+	p := NewPrefetcher(2, 100)
+	// a block larger than the budget can be reserved if nothing else is
+	require.True(p.reserve(150))
+	require.False(p.reserve(1))
+	p.release(150)
+	require.True(p.reserve(60))
+	require.True(p.reserve(40))
+	require.False(p.reserve(1))
+	p.release(60)
+	p.release(40)
+	require.Zero(p.used)
+}
@@ -172,6 +172,8 @@ type Properties struct {
 	PrefixExtractorName string `prop:"rocksdb.prefix.extractor.name"`
 	// If filtering is enabled, was the filter created on the key prefix.
 	PrefixFiltering bool `prop:"rocksdb.block.based.table.prefix.filtering"`
+	// EDG: If filtering is enabled, can the filter rule out ranges of keys.
+	RangeFiltering bool `prop:"estore.range.filtering"`
 	// A comma separated list of names of the property collectors used in this
 	// table.
 	PropertyCollectorNames string `prop:"rocksdb.property.collectors"`
@@ -417,6 +419,9 @@ func (p *Properties) save(tblFormat TableFormat, w *rawBlockWriter) {
 	if p.PropertyCollectorNames != "" {
 		p.saveString(m, unsafe.Offsetof(p.PropertyCollectorNames), p.PropertyCollectorNames)
 	}
+	if p.RangeFiltering {
+		p.saveBool(m, unsafe.Offsetof(p.RangeFiltering), p.RangeFiltering)
+	}
 	if p.SnapshotPinnedKeys > 0 {
 		p.saveUvarint(m, unsafe.Offsetof(p.SnapshotPinnedKeys), p.SnapshotPinnedKeys)
 		p.saveUvarint(m, unsafe.Offsetof(p.SnapshotPinnedKeySize), p.SnapshotPinnedKeySize)
@@ -794,6 +794,11 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle) error {
 				switch t.ftype {
 				case TableFilter:
 					r.tableFilter = newTableFilterReader(fp)
+					// EDG: Only use range filters of tables that were written with
+					// them.
+					if rfp, ok := fp.(RangeFilterPolicy); ok && r.Properties.RangeFiltering {
+						r.tableFilter.rangePolicy = rfp
+					}
 				default:
 					return base.CorruptionErrorf("unknown filter type: %v", errors.Safe(t.ftype))
 				}
@@ -1148,7 +1153,7 @@ func NewReader(f objstorage.Readable, o ReaderOptions, extraOpts ...ReaderOption
 	}
 	r.aead = aead
 	if !r.unencrypted {
-		f, err = newDecryptedFooter(f, aead)
+		f, err = newDecryptedFooter(f, aead, o.EncryptionStats, r.fileNum.FileNum())
 		if err != nil {
 			r.err = err
 			return nil, r.Close()
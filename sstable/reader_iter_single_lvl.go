@@ -153,6 +153,15 @@ type singleLevelIterator struct {
 	useFilter              bool
 	lastBloomFilterMatched bool
 
+	// EDG: rangeFilterState caches the result of the range filter check for
+	// the current bounds: 0 if unchecked, +1 if the table may contain keys
+	// within the bounds, and -1 if it doesn't.
+	rangeFilterState int8
+
+	// EDG: prefetch loads the following data blocks during forward iteration
+	// if a Prefetcher is passed in the context.
+	prefetch blockPrefetch
+
 	hideObsoletePoints bool
 }
 
@@ -199,6 +208,9 @@ func (i *singleLevelIterator) init(
 	i.stats = stats
 	i.hideObsoletePoints = hideObsoletePoints
 	i.bufferPool = bufferPool
+	if bufferPool == nil {
+		i.prefetch.p = prefetcherFromContext(ctx) // EDG
+	}
 	err = i.index.initHandle(i.cmp, indexH, r.Properties.GlobalSeqNum, false)
 	if err != nil {
 		// blockIter.Close releases indexH and always returns a nil error
@@ -263,6 +275,8 @@ func (i *singleLevelIterator) resetForReuse() singleLevelIterator {
 	return singleLevelIterator{
 		index: i.index.resetForReuse(),
 		data:  i.data.resetForReuse(),
+		// EDG: reuse the slice of prefetch tasks
+		prefetch: blockPrefetch{tasks: i.prefetch.tasks[:0]},
 	}
 }
 
@@ -345,6 +359,41 @@ func (i *singleLevelIterator) SetBounds(lower, upper []byte) {
 	i.upper = upper
 	i.blockLower = nil
 	i.blockUpper = nil
+	i.rangeFilterState = 0
+}
+
+// EDG: excludedByRangeFilter returns whether the range filter of the table
+// shows that it contains no keys within the iterator bounds. In that case, it
+// invalidates the data block, and Next and Prev return nil, too. The result is
+// cached until the bounds change.
+func (i *singleLevelIterator) excludedByRangeFilter() bool {
+	if i.rangeFilterState == 0 {
+		i.rangeFilterState = +1
+		f := i.reader.tableFilter
+		if f != nil && f.rangePolicy != nil && i.useFilter && !i.endKeyInclusive &&
+			(i.lower != nil || i.upper != nil) {
+			dataH, err := i.reader.readFilter(i.ctx, i.stats)
+			if err != nil {
+				i.rangeFilterState = 0
+				i.err = err
+				i.data.invalidate()
+				return true
+			}
+			if !f.mayContainRange(dataH.Get(), i.lower, i.upper, i.reader.Split) {
+				i.rangeFilterState = -1
+			}
+			dataH.Release()
+		}
+	}
+	if i.rangeFilterState > 0 {
+		return false
+	}
+	i.data.invalidate()
+	i.exhaustedBounds = 0
+	i.boundsCmp = 0
+	i.positionedUsingLatestBounds = false
+	i.maybeFilteredKeysSingleLevel = false
+	return true
 }
 
 // loadBlock loads the block at the current index position and leaves i.data
@@ -395,7 +444,7 @@ func (i *singleLevelIterator) loadBlock(dir int8) loadBlockResult {
 		// blockIntersects
 	}
 	ctx := objiotracing.WithBlockType(i.ctx, objiotracing.DataBlock)
-	block, err := i.reader.readBlock(ctx, i.dataBH, nil /* transform */, i.dataRH, i.stats, i.bufferPool)
+	block, err := i.readDataBlock(ctx, dir) // EDG: use prefetched blocks
 	if err != nil {
 		i.err = err
 		return loadBlockFailed
@@ -618,6 +667,9 @@ func (i *singleLevelIterator) SeekGE(
 	boundsCmp := i.boundsCmp
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
+	if i.excludedByRangeFilter() {
+		return nil, base.LazyValue{}
+	}
 	i.positionedUsingLatestBounds = true
 	return i.seekGEHelper(key, boundsCmp, flags)
 }
@@ -883,6 +935,9 @@ func (i *singleLevelIterator) SeekLT(
 	boundsCmp := i.boundsCmp
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
+	if i.excludedByRangeFilter() {
+		return nil, base.LazyValue{}
+	}
 
 	// Seeking operations perform various step-instead-of-seeking optimizations:
 	// eg by considering monotonically increasing bounds (i.boundsCmp). Care
@@ -991,6 +1046,10 @@ func (i *singleLevelIterator) First() (*InternalKey, base.LazyValue) {
 	if i.lower != nil {
 		panic("singleLevelIterator.First() used despite lower bound")
 	}
+	i.err = nil // clear cached iteration error
+	if i.excludedByRangeFilter() {
+		return nil, base.LazyValue{}
+	}
 	i.positionedUsingLatestBounds = true
 	i.maybeFilteredKeysSingleLevel = false
 
@@ -1060,6 +1119,10 @@ func (i *singleLevelIterator) Last() (*InternalKey, base.LazyValue) {
 	if i.upper != nil {
 		panic("singleLevelIterator.Last() used despite upper bound")
 	}
+	i.err = nil // clear cached iteration error
+	if i.excludedByRangeFilter() {
+		return nil, base.LazyValue{}
+	}
 	i.positionedUsingLatestBounds = true
 	i.maybeFilteredKeysSingleLevel = false
 	return i.lastInternal()
@@ -1121,7 +1184,8 @@ func (i *singleLevelIterator) Next() (*InternalKey, base.LazyValue) {
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
 
-	if i.err != nil {
+	// EDG: A negative rangeFilterState means that no key is within the bounds.
+	if i.err != nil || i.rangeFilterState < 0 {
 		return nil, base.LazyValue{}
 	}
 	if key, val := i.data.Next(); key != nil {
@@ -1146,7 +1210,8 @@ func (i *singleLevelIterator) NextPrefix(succKey []byte) (*InternalKey, base.Laz
 	i.maybeFilteredKeysSingleLevel = false
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
-	if i.err != nil {
+	// EDG: A negative rangeFilterState means that no key is within the bounds.
+	if i.err != nil || i.rangeFilterState < 0 {
 		return nil, base.LazyValue{}
 	}
 	if key, val := i.data.NextPrefix(succKey); key != nil {
@@ -1223,7 +1288,8 @@ func (i *singleLevelIterator) Prev() (*InternalKey, base.LazyValue) {
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
 
-	if i.err != nil {
+	// EDG: A negative rangeFilterState means that no key is within the bounds.
+	if i.err != nil || i.rangeFilterState < 0 {
 		return nil, base.LazyValue{}
 	}
 	if key, val := i.data.Prev(); key != nil {
@@ -1357,6 +1423,7 @@ func firstError(err0, err1 error) error {
 // Close implements internalIterator.Close, as documented in the pebble
 // package.
 func (i *singleLevelIterator) Close() error {
+	i.prefetch.close() // EDG: the background reads must finish before the reader may be closed
 	var err error
 	if i.closeHook != nil {
 		err = firstError(err, i.closeHook(i))
@@ -172,6 +172,9 @@ func (i *twoLevelIterator) init(
 	i.stats = stats
 	i.hideObsoletePoints = hideObsoletePoints
 	i.bufferPool = bufferPool
+	if bufferPool == nil {
+		i.prefetch.p = prefetcherFromContext(ctx) // EDG
+	}
 	err = i.topLevelIndex.initHandle(i.cmp, topLevelIndexH, r.Properties.GlobalSeqNum, false)
 	if err != nil {
 		// blockIter.Close releases topLevelIndexH and always returns a nil error
@@ -247,6 +250,11 @@ func (i *twoLevelIterator) SeekGE(
 		// Already exhausted, so return nil.
 		return nil, base.LazyValue{}
 	}
+	if i.excludedByRangeFilter() {
+		i.index.invalidate()
+		i.maybeFilteredKeysTwoLevel = false
+		return nil, base.LazyValue{}
+	}
 
 	// SeekGE performs various step-instead-of-seeking optimizations: eg enabled
 	// by trySeekUsingNext, or by monotonically increasing bounds (i.boundsCmp).
@@ -617,6 +625,11 @@ func (i *twoLevelIterator) SeekLT(
 	i.err = nil // clear cached iteration error
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
+	if i.excludedByRangeFilter() {
+		i.index.invalidate()
+		i.maybeFilteredKeysTwoLevel = false
+		return nil, base.LazyValue{}
+	}
 
 	var result loadBlockResult
 	var ikey *InternalKey
@@ -697,6 +710,10 @@ func (i *twoLevelIterator) First() (*InternalKey, base.LazyValue) {
 	i.err = nil // clear cached iteration error
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
+	if i.excludedByRangeFilter() {
+		i.index.invalidate()
+		return nil, base.LazyValue{}
+	}
 
 	var ikey *InternalKey
 	if ikey, _ = i.topLevelIndex.First(); ikey == nil {
@@ -750,6 +767,10 @@ func (i *twoLevelIterator) Last() (*InternalKey, base.LazyValue) {
 	i.err = nil // clear cached iteration error
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
+	if i.excludedByRangeFilter() {
+		i.index.invalidate()
+		return nil, base.LazyValue{}
+	}
 
 	var ikey *InternalKey
 	if ikey, _ = i.topLevelIndex.Last(); ikey == nil {
@@ -788,7 +809,8 @@ func (i *twoLevelIterator) Next() (*InternalKey, base.LazyValue) {
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
 	i.maybeFilteredKeysTwoLevel = false
-	if i.err != nil {
+	// EDG: A negative rangeFilterState means that no key is within the bounds.
+	if i.err != nil || i.rangeFilterState < 0 {
 		return nil, base.LazyValue{}
 	}
 	if key, val := i.singleLevelIterator.Next(); key != nil {
@@ -805,7 +827,8 @@ func (i *twoLevelIterator) NextPrefix(succKey []byte) (*InternalKey, base.LazyVa
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
 	i.maybeFilteredKeysTwoLevel = false
-	if i.err != nil {
+	// EDG: A negative rangeFilterState means that no key is within the bounds.
+	if i.err != nil || i.rangeFilterState < 0 {
 		return nil, base.LazyValue{}
 	}
 	if key, val := i.singleLevelIterator.NextPrefix(succKey); key != nil {
@@ -852,7 +875,8 @@ func (i *twoLevelIterator) Prev() (*InternalKey, base.LazyValue) {
 	// Seek optimization only applies until iterator is first positioned after SetBounds.
 	i.boundsCmp = 0
 	i.maybeFilteredKeysTwoLevel = false
-	if i.err != nil {
+	// EDG: A negative rangeFilterState means that no key is within the bounds.
+	if i.err != nil || i.rangeFilterState < 0 {
 		return nil, base.LazyValue{}
 	}
 	if key, val := i.singleLevelIterator.Prev(); key != nil {
@@ -942,6 +966,7 @@ func (i *twoLevelIterator) skipBackward() (*InternalKey, base.LazyValue) {
 // Close implements internalIterator.Close, as documented in the pebble
 // package.
 func (i *twoLevelIterator) Close() error {
+	i.prefetch.close() // EDG: the background reads must finish before the reader may be closed
 	var err error
 	if i.closeHook != nil {
 		err = firstError(err, i.closeHook(i))
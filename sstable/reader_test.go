@@ -597,6 +597,69 @@ func TestReaderStats(t *testing.T) {
 		})
 }
 
+// EDG: An iterator whose bounds the range filter excludes stays exhausted
+// when it's moved with Next or Prev.
+func TestReaderRangeFilterExcludedBounds(t *testing.T) {
+	policy := bloom.RangeFilterPolicy{BitsPerKey: 20, MaxPrefixLen: 9}
+	// A small index block size yields a two-level index.
+	for _, indexBlockSize := range []int{0, 1} {
+		t.Run(fmt.Sprint("index-block-size=", indexBlockSize), func(t *testing.T) {
+			require := require.New(t)
+
+			mem := vfs.NewMem()
+			f, err := mem.Create("test")
+			require.NoError(err)
+			w := NewWriter(objstorageprovider.NewFileWritable(f), WriterOptions{
+				BlockSize:      32,
+				IndexBlockSize: indexBlockSize,
+				FilterPolicy:   policy,
+				TableFormat:    TableFormatPebblev2,
+			})
+			for i := 0; i < 50; i++ {
+				require.NoError(w.Set([]byte(fmt.Sprintf("k%03d", i)), nil))
+			}
+			require.NoError(w.Close())
+
+			f, err = mem.Open("test")
+			require.NoError(err)
+			r, err := newReader(f, ReaderOptions{Filters: map[string]FilterPolicy{policy.Name(): policy}})
+			require.NoError(err)
+			defer r.Close()
+
+			iter, err := r.NewIter([]byte("z"), []byte("zz"))
+			require.NoError(err)
+			defer iter.Close()
+
+			// move the index away from its initial position first
+			iter.SetBounds(nil, nil)
+			key, _ := iter.SeekGE([]byte("k010"), base.SeekGEFlagsNone)
+			require.Equal("k010", string(key.UserKey))
+
+			iter.SetBounds([]byte("z"), []byte("zz"))
+			key, _ = iter.SeekLT([]byte("zz"), base.SeekLTFlagsNone)
+			require.Nil(key)
+			key, _ = iter.Next()
+			require.Nil(key)
+			key, _ = iter.SeekGE([]byte("z"), base.SeekGEFlagsNone)
+			require.Nil(key)
+			key, _ = iter.Prev()
+			require.Nil(key)
+			key, _ = iter.SeekGE([]byte("z"), base.SeekGEFlagsNone)
+			require.Nil(key)
+			key, _ = iter.NextPrefix([]byte("z\x00"))
+			require.Nil(key)
+			require.NoError(iter.Error())
+
+			// new bounds make the keys visible again
+			iter.SetBounds([]byte("k020"), []byte("k030"))
+			key, _ = iter.SeekLT([]byte("k030"), base.SeekLTFlagsNone)
+			require.Equal("k029", string(key.UserKey))
+			key, _ = iter.Prev()
+			require.Equal("k028", string(key.UserKey))
+		})
+	}
+}
+
 func TestReaderWithBlockPropertyFilter(t *testing.T) {
 	// Some of these tests examine internal iterator state, so they require
 	// determinism. When the invariants tag is set, disableBoundsOpt may disable
@@ -228,7 +228,7 @@ func rewriteBlocks(
 			si := split(key.UserKey)
 			oldSuffix := key.UserKey[si:]
 			if !bytes.Equal(oldSuffix, from) {
-				err := errors.Errorf("key has suffix %q, expected %q", oldSuffix, from)
+				err := errors.Errorf("key has suffix %q, expected %q", base.UserData(oldSuffix), base.UserData(from))
 				return err
 			}
 			newLen := si + len(to)
@@ -423,7 +423,7 @@ func rewriteRangeKeyBlockToWriter(r *Reader, w *Writer, from, to []byte) error {
 				return errBadKind
 			}
 			if !bytes.Equal(s.Keys[i].Suffix, from) {
-				return errors.Errorf("key has suffix %q, expected %q", s.Keys[i].Suffix, from)
+				return errors.Errorf("key has suffix %q, expected %q", base.UserData(s.Keys[i].Suffix), base.UserData(from))
 			}
 			s.Keys[i].Suffix = to
 		}
@@ -491,7 +491,7 @@ func RewriteKeySuffixesViaWriter(
 		}
 		oldSuffix := k.UserKey[r.Split(k.UserKey):]
 		if !bytes.Equal(oldSuffix, from) {
-			return nil, errors.Errorf("key has suffix %q, expected %q", oldSuffix, from)
+			return nil, errors.Errorf("key has suffix %q, expected %q", base.UserData(oldSuffix), base.UserData(from))
 		}
 		scratch.UserKey = append(scratch.UserKey[:0], k.UserKey[:len(k.UserKey)-len(from)]...)
 		scratch.UserKey = append(scratch.UserKey, to...)
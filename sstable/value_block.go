@@ -598,7 +598,7 @@ func (w *valueBlockWriter) computeChecksum(block []byte) {
 }
 
 func (w *valueBlockWriter) finish(
-	writer io.Writer, fileOffset uint64,
+	writer *Writer, fileOffset uint64,
 ) (valueBlocksIndexHandle, valueBlocksAndIndexStats, error) {
 	if len(w.buf.b) > 0 {
 		w.compressAndFlush()
@@ -610,17 +610,19 @@ func (w *valueBlockWriter) finish(
 	largestOffset := uint64(0)
 	largestLength := uint64(0)
 	for i := range w.blocks {
+		// EDG: The writer pads each block, so the offsets are taken from the
+		// writer.
+		w.blocks[i].handle.Offset = writer.meta.Size
 		_, err := writer.Write(w.blocks[i].block.b)
 		if err != nil {
 			return valueBlocksIndexHandle{}, valueBlocksAndIndexStats{}, err
 		}
-		w.blocks[i].handle.Offset += fileOffset
 		largestOffset = w.blocks[i].handle.Offset
 		if largestLength < w.blocks[i].handle.Length {
 			largestLength = w.blocks[i].handle.Length
 		}
 	}
-	vbihOffset := fileOffset + w.totalBlockBytes
+	vbihOffset := writer.meta.Size
 
 	vbih := valueBlocksIndexHandle{
 		h: BlockHandle{
@@ -637,7 +639,7 @@ func (w *valueBlockWriter) finish(
 	stats := valueBlocksAndIndexStats{
 		numValueBlocks:          uint64(n),
 		numValuesInValueBlocks:  w.numValues,
-		valueBlocksAndIndexSize: w.totalBlockBytes + vbih.h.Length + blockTrailerLen,
+		valueBlocksAndIndexSize: writer.meta.Size - fileOffset,
 	}
 	return vbih, stats, err
 }
@@ -218,7 +218,9 @@ type Writer struct {
 	requiredInPlaceValueBound UserKeyPrefixBound
 	valueBlockWriter          *valueBlockWriter
 
-	aead cipher.AEAD
+	aead            cipher.AEAD
+	encryptionStats *edg.FileStats
+	blockPadding    int
 }
 
 type pointKeyInfo struct {
@@ -1006,7 +1008,10 @@ func (w *Writer) addPoint(key InternalKey, value []byte, forceObsolete bool) err
 			// Values for SET are not required to be in-place, and in the future may
 			// not even be read by the compaction, so pass nil values. Block
 			// property collectors in such Pebble DB's must not look at the value.
-			v = nil
+			// EDG: Unless they explicitly ask for it.
+			if c, ok := w.blockPropCollectors[i].(ValueBlockPropertyCollector); !ok || !c.NeedsValues() {
+				v = nil
+			}
 		}
 		if err := w.blockPropCollectors[i].Add(key, v); err != nil {
 			w.err = err
@@ -1049,7 +1054,7 @@ func (w *Writer) addPoint(key InternalKey, value []byte, forceObsolete bool) err
 			size, n = binary.Uvarint(value)
 			if n <= 0 {
 				w.err = errors.Newf("%s key's value (%x) does not parse as uvarint",
-					errors.Safe(key.Kind().String()), value)
+					errors.Safe(key.Kind().String()), base.UserData(value))
 				return w.err
 			}
 		}
@@ -1801,6 +1806,9 @@ func (w *Writer) writeCompressedBlock(block []byte, blockTrailerBuf []byte) (Blo
 		return BlockHandle{}, err
 	}
 	w.meta.Size += uint64(len(ciphertext))
+	if err := w.edgPad(len(ciphertext)); err != nil {
+		return BlockHandle{}, err
+	}
 
 	return bh, nil
 }
@@ -1818,8 +1826,16 @@ func (w *Writer) Write(blockWithTrailer []byte) (n int, err error) {
 		// cache.
 		w.cache.Delete(w.cacheID, w.fileNum, offset)
 	}
-	w.meta.Size += uint64(len(blockWithTrailer))
-	if err := w.writable.Write(blockWithTrailer); err != nil {
+	// EDG: Value blocks are encrypted and padded like the blocks written by
+	// writeCompressedBlock. The trailer has room for the tag.
+	length := len(blockWithTrailer) - blockTrailerLen
+	bh := BlockHandle{Offset: offset, Length: uint64(length)}
+	ciphertext := w.edgEncrypt(bh, blockWithTrailer[:length], blockWithTrailer[length:])
+	if err := w.writable.WriteApproved(ciphertext); err != nil {
+		return 0, err
+	}
+	w.meta.Size += uint64(len(ciphertext))
+	if err := w.edgPad(len(ciphertext)); err != nil {
 		return 0, err
 	}
 	return len(blockWithTrailer), nil
@@ -2008,7 +2024,7 @@ func (w *Writer) Close() (err error) {
 		kind := key.Kind()
 		endKey, _, ok := rangekey.DecodeEndKey(kind, w.rangeKeyBlock.curValue)
 		if !ok {
-			return errors.Newf("invalid end key: %s", w.rangeKeyBlock.curValue)
+			return errors.Newf("invalid end key: %s", base.UserData(w.rangeKeyBlock.curValue))
 		}
 		k := base.MakeExclusiveSentinelKey(kind, endKey).Clone()
 		w.meta.SetLargestRangeKey(k)
@@ -2280,6 +2296,8 @@ func NewWriter(writable objstorage.Writable, o WriterOptions, extraOpts ...Write
 		switch o.FilterType {
 		case TableFilter:
 			w.filter = newTableFilterWriter(o.FilterPolicy)
+			// EDG: Record whether the filter can be used for bounded iteration.
+			_, w.props.RangeFiltering = o.FilterPolicy.(RangeFilterPolicy)
 			if w.split != nil {
 				w.props.PrefixExtractorName = o.Comparer.Name
 				w.props.PrefixFiltering = true
@@ -2364,6 +2382,8 @@ func NewWriter(writable objstorage.Writable, o WriterOptions, extraOpts ...Write
 		return w
 	}
 	w.aead = aead
+	w.encryptionStats = o.EncryptionStats
+	w.blockPadding = o.BlockPadding
 
 	return w
 }
@@ -519,6 +519,10 @@ func (c *tableCacheShard) newIters(
 	if opts != nil {
 		useFilter = manifest.LevelToInt(opts.level) != 6 || opts.UseL6Filters
 		ctx = objiotracing.WithLevel(ctx, manifest.LevelToInt(opts.level))
+		if opts.prefetcher != nil {
+			// EDG: The table iterator prefetches data blocks.
+			ctx = sstable.WithPrefetcher(ctx, opts.prefetcher)
+		}
 	}
 	tableFormat, err := v.reader.TableFormat()
 	if err != nil {
@@ -1104,6 +1108,7 @@ func (v *tableCacheValue) load(loadInfo loadInfo, c *tableCacheShard, dbOpts *ta
 		cacheOpts := private.SSTableCacheOpts(dbOpts.cacheID, loadInfo.backingFileNum).(sstable.ReaderOption)
 		opts := dbOpts.opts
 		opts.EncryptionKey, err = dbOpts.keyManager.Get(loadInfo.backingFileNum.FileNum())
+		opts.EncryptionStats = dbOpts.keyManager.Stats().File(edg.FileTypeTable)
 		if err == nil {
 			v.reader, err = sstable.NewReader(f, opts, cacheOpts, dbOpts.filterMetrics)
 		}
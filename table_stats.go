@@ -282,6 +282,11 @@ func (d *DB) loadTableStats(
 			// picking.
 			stats.NumRangeKeySets = props.NumRangeKeySets
 			stats.ValueBlocksSize = props.ValueBlocksSize
+			// EDG: The expiry is only known for physical tables. The user
+			// properties of virtual tables aren't available.
+			if pr, ok := r.(*sstable.Reader); ok {
+				stats.TTLMaxExpiry, err = ttlMaxExpiry(pr.Properties.UserProperties)
+			}
 			return
 		})
 	if err != nil {
@@ -616,6 +621,12 @@ func maybeSetStatsFromProperties(meta physicalMeta, props *sstable.Properties) b
 		return false
 	}
 
+	// EDG: Leave errors decoding the expiry to the table stats collector.
+	maxExpiry, err := ttlMaxExpiry(props.UserProperties)
+	if err != nil {
+		return false
+	}
+
 	var pointEstimate uint64
 	if props.NumEntries > 0 {
 		// Use the file's own average key and value sizes as an estimate. This
@@ -633,6 +644,7 @@ func maybeSetStatsFromProperties(meta physicalMeta, props *sstable.Properties) b
 	meta.Stats.PointDeletionsBytesEstimate = pointEstimate
 	meta.Stats.RangeDeletionsBytesEstimate = 0
 	meta.Stats.ValueBlocksSize = props.ValueBlocksSize
+	meta.Stats.TTLMaxExpiry = maxExpiry
 	meta.StatsMarkValid()
 	return true
 }
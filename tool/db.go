@@ -16,6 +16,7 @@ import (
 	"github.com/cockroachdb/errors/oserror"
 	pebble "github.com/edgelesssys/estore"
 	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/internal/edg"
 	"github.com/edgelesssys/estore/internal/humanize"
 	"github.com/edgelesssys/estore/internal/manifest"
 	"github.com/edgelesssys/estore/objstorage"
@@ -36,6 +37,7 @@ type dbT struct {
 	Get        *cobra.Command
 	Logs       *cobra.Command
 	LSM        *cobra.Command
+	Peek       *cobra.Command
 	Properties *cobra.Command
 	Scan       *cobra.Command
 	Set        *cobra.Command
@@ -141,6 +143,18 @@ be in use by another process.
 		Args: cobra.ExactArgs(1),
 		Run:  d.runLSM,
 	}
+	d.Peek = &cobra.Command{
+		Use:   "peek <dir>",
+		Short: "print DB format and compatibility",
+		Long: `
+Print the format major version, the active MANIFEST, and the comparer, merger
+and cipher suite recorded in the plaintext header of the OPTIONS file, and
+whether the tool knows the comparer and merger. Doesn't require the encryption
+key. The header is authenticated when the DB is opened.
+`,
+		Args: cobra.ExactArgs(1),
+		Run:  d.runPeek,
+	}
 	d.Properties = &cobra.Command{
 		Use:   "properties <dir>",
 		Short: "print aggregated sstable properties",
@@ -192,7 +206,7 @@ specified database.
 		Run:  d.runIOBench,
 	}
 
-	d.Root.AddCommand(d.Check, d.Upgrade, d.Checkpoint, d.Get, d.Logs, d.LSM, d.Properties, d.Scan, d.Set, d.Space, d.IOBench)
+	d.Root.AddCommand(d.Check, d.Upgrade, d.Checkpoint, d.Get, d.Logs, d.LSM, d.Peek, d.Properties, d.Scan, d.Set, d.Space, d.IOBench)
 	d.Root.PersistentFlags().BoolVarP(&d.verbose, "verbose", "v", false, "verbose output")
 
 	for _, cmd := range []*cobra.Command{d.Check, d.Upgrade, d.Checkpoint, d.Get, d.LSM, d.Properties, d.Scan, d.Set, d.Space} {
@@ -285,6 +299,11 @@ func (d *dbT) loadOptions(dir string) error {
 				if err != nil {
 					return err
 				}
+				// EDG: the comparer and merger are in the plaintext header,
+				// which can be read without the key.
+				if header, ok := edg.ReadOptionsHeader(data); ok {
+					data = header
+				}
 
 				if err := dbOpts.Parse(string(data), hooks); err != nil {
 					return err
@@ -519,6 +538,38 @@ func (d *dbT) runScan(cmd *cobra.Command, args []string) {
 		count, makePlural("record", count), elapsed.Seconds())
 }
 
+func (d *dbT) runPeek(cmd *cobra.Command, args []string) {
+	stdout, stderr := cmd.OutOrStdout(), cmd.ErrOrStderr()
+	desc, err := pebble.Peek(args[0], d.opts.FS)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return
+	}
+	if !desc.Exists {
+		fmt.Fprintf(stderr, "%s\n", oserror.ErrNotExist)
+		return
+	}
+	fmt.Fprintf(stdout, "format major version: %d\n", desc.FormatMajorVersion)
+	fmt.Fprintf(stdout, "manifest: %s\n", d.opts.FS.PathBase(desc.ManifestFilename))
+	if desc.OptionsFilename == "" {
+		return
+	}
+	fmt.Fprintf(stdout, "options: %s\n", d.opts.FS.PathBase(desc.OptionsFilename))
+	if desc.Comparer == "" {
+		fmt.Fprintf(stdout, "options header: none\n")
+		return
+	}
+	known := func(ok bool) string {
+		if ok {
+			return "known"
+		}
+		return "unknown"
+	}
+	fmt.Fprintf(stdout, "comparer: %s (%s)\n", desc.Comparer, known(d.comparers[desc.Comparer] != nil))
+	fmt.Fprintf(stdout, "merger: %s (%s)\n", desc.Merger, known(d.mergers[desc.Merger] != nil))
+	fmt.Fprintf(stdout, "cipher suite: %s\n", desc.CipherSuite)
+}
+
 func (d *dbT) runSpace(cmd *cobra.Command, args []string) {
 	stdout, stderr := cmd.OutOrStdout(), cmd.ErrOrStderr()
 	db, err := d.openDB(args[0])
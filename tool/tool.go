@@ -114,7 +114,8 @@ func New(opts ...Option) *T {
 
 	opts = append(opts,
 		Comparers(base.DefaultComparer),
-		Filters(bloom.FilterPolicy(10)),
+		// EDG: also read the filters of the estore filter policies.
+		Filters(bloom.FilterPolicy(10), bloom.RibbonFilterPolicy(10)),
 		Mergers(base.DefaultMerger))
 
 	for _, opt := range opts {
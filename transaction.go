@@ -9,6 +9,7 @@ package estore
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/cockroachdb/errors"
 )
@@ -22,7 +23,9 @@ func (d *DB) NewTransaction(writable bool) *Transaction {
 		return &Transaction{snap: d.NewSnapshot()}
 	}
 	d.txLock.Lock()
-	return &Transaction{Batch: d.NewIndexedBatch(), snap: d.NewSnapshot()}
+	t := &Transaction{Batch: d.NewIndexedBatch(), snap: d.NewSnapshot()}
+	t.Batch.txSnap = t.snap
+	return t
 }
 
 // Transaction is a database transaction.
@@ -53,7 +56,9 @@ func (t *Transaction) Commit() error {
 		prevStoreCount := db.monotonicCounter
 		db.monotonicCounter++
 
+		start := time.Now()
 		prevSourceCount, err := db.opts.SetMonotonicCounter(db.monotonicCounter)
+		db.monotonicCounterLatency.Observe(float64(time.Since(start)))
 		if err != nil {
 			// We don't know if the source counter was incremented or not.
 			// Keep the store counter incremented. It will be synced on next successful commit.
@@ -0,0 +1,407 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/edgelesssys/estore/internal/base"
+	"github.com/edgelesssys/estore/sstable"
+)
+
+// If Options.EnableTTL is set, the value of every SET starts with a header
+// that holds the expiry of the key:
+//
+//	ttlHeaderNoExpiry                   the key doesn't expire
+//	ttlHeaderExpiry, 8 byte expiry      the key expires at the given time
+//
+// The expiry is encoded in Unix nanoseconds, little endian. MERGE operands
+// don't carry a header.
+const (
+	ttlHeaderNoExpiry byte = iota
+	ttlHeaderExpiry
+)
+
+const ttlExpiryLen = 8
+
+// ttlBlockPropertyName is the name of the block property collector that
+// records the expiry of point keys.
+const ttlBlockPropertyName = "estore.ttl"
+
+// ErrTTLDisabled is returned by SetWithTTL if Options.EnableTTL isn't set.
+var ErrTTLDisabled = errors.New("estore: TTL is not enabled")
+
+// ttlValueLen returns the length of value after encoding it with the given
+// expiry.
+func ttlValueLen(expiry uint64, valueLen int) int {
+	if expiry == 0 {
+		return 1 + valueLen
+	}
+	return 1 + ttlExpiryLen + valueLen
+}
+
+// ttlEncodeValue encodes value with the given expiry into dst, which must
+// have a length of ttlValueLen(expiry, len(value)). An expiry of 0 means
+// that the key doesn't expire.
+func ttlEncodeValue(dst []byte, expiry uint64, value []byte) {
+	if expiry == 0 {
+		dst[0] = ttlHeaderNoExpiry
+		copy(dst[1:], value)
+		return
+	}
+	dst[0] = ttlHeaderExpiry
+	binary.LittleEndian.PutUint64(dst[1:], expiry)
+	copy(dst[1+ttlExpiryLen:], value)
+}
+
+// ttlAppendValue appends value encoded with the given expiry to dst.
+func ttlAppendValue(dst []byte, expiry uint64, value []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, ttlValueLen(expiry, len(value)))...)
+	ttlEncodeValue(dst[n:], expiry, value)
+	return dst
+}
+
+// ttlDecodeValue splits an encoded value into its expiry and the user value.
+// An expiry of 0 means that the key doesn't expire.
+func ttlDecodeValue(value []byte) (expiry uint64, userValue []byte, err error) {
+	if len(value) == 0 {
+		return 0, nil, base.CorruptionErrorf("estore: value is missing its TTL header")
+	}
+	switch value[0] {
+	case ttlHeaderNoExpiry:
+		return 0, value[1:], nil
+	case ttlHeaderExpiry:
+		if len(value) < 1+ttlExpiryLen {
+			return 0, nil, base.CorruptionErrorf("estore: truncated TTL header")
+		}
+		return binary.LittleEndian.Uint64(value[1:]), value[1+ttlExpiryLen:], nil
+	}
+	return 0, nil, base.CorruptionErrorf("estore: unknown TTL header %d", errors.Safe(value[0]))
+}
+
+// ttlExpired returns whether the given expiry is reached at now.
+func ttlExpired(expiry, now uint64) bool {
+	return expiry != 0 && expiry <= now
+}
+
+// ttlNow returns the current time in Unix nanoseconds if TTL is enabled, and
+// 0 otherwise.
+func (d *DB) ttlNow() uint64 {
+	if !d.opts.EnableTTL {
+		return 0
+	}
+	return uint64(d.timeNow().UnixNano())
+}
+
+// ttlExpiry returns the expiry for a key written now with the given TTL.
+func (d *DB) ttlExpiry(ttl time.Duration) uint64 {
+	return uint64(d.timeNow().Add(ttl).UnixNano())
+}
+
+// SetWithTTL sets the value for the given key like Set. The key expires after
+// the given TTL. Afterwards, reads treat the key as deleted, and compactions
+// into the bottommost level drop it. MERGE operands that a compaction folds
+// into the value expire together with it. Requires Options.EnableTTL.
+//
+// It is safe to modify the contents of the arguments after SetWithTTL returns.
+func (d *DB) SetWithTTL(key, value []byte, ttl time.Duration, opts *WriteOptions) error {
+	b := newBatch(d)
+	if err := b.SetWithTTL(key, value, ttl, opts); err != nil {
+		return err
+	}
+	if err := d.Apply(b, opts); err != nil {
+		return err
+	}
+	// Only release the batch on success.
+	b.release()
+	return nil
+}
+
+// SetWithTTL adds an action to the batch that sets the key to map to the
+// value until the given TTL has passed. The TTL starts when SetWithTTL is
+// called, not when the batch is committed. Requires Options.EnableTTL.
+//
+// It is safe to modify the contents of the arguments after SetWithTTL returns.
+func (b *Batch) SetWithTTL(key, value []byte, ttl time.Duration, _ *WriteOptions) error {
+	if !b.ttlEnabled() {
+		return ErrTTLDisabled
+	}
+	if ttl <= 0 {
+		return errors.Newf("estore: TTL must be positive: %s", ttl)
+	}
+	if err := b.updateIndexes(key, value, true); err != nil {
+		return err
+	}
+	return b.setWithExpiry(key, value, b.db.ttlExpiry(ttl))
+}
+
+func (b *Batch) ttlEnabled() bool {
+	return b.db != nil && b.db.opts.EnableTTL
+}
+
+func (b *Batch) setWithExpiry(key, value []byte, expiry uint64) error {
+	b.prepareDeferredKeyValueRecord(len(key), ttlValueLen(expiry, len(value)), InternalKeyKindSet)
+	copy(b.deferredOp.Key, key)
+	ttlEncodeValue(b.deferredOp.Value, expiry, value)
+	if b.index != nil {
+		if err := b.index.Add(b.deferredOp.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ttlEncodeRawSets adds a TTL header without expiry to the values of the SETs
+// in the records of the batch that start at offset.
+func (b *Batch) ttlEncodeRawSets(offset int) error {
+	records := append([]byte(nil), b.data[offset:]...)
+	b.data = b.data[:offset]
+	for r := BatchReader(records); len(r) > 0; {
+		record := r
+		kind, key, value, ok, err := r.Next()
+		if !ok {
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if kind != InternalKeyKindSet {
+			b.data = append(b.data, record[:len(record)-len(r)]...)
+			continue
+		}
+		b.data = append(b.data, byte(kind))
+		b.data = binary.AppendUvarint(b.data, uint64(len(key)))
+		b.data = append(b.data, key...)
+		b.data = binary.AppendUvarint(b.data, uint64(ttlValueLen(0, len(value))))
+		b.data = ttlAppendValue(b.data, 0, value)
+	}
+	return nil
+}
+
+// ttlCheckIngest returns an error if a table with the given properties can't
+// be ingested because its SET values may lack the TTL header. The TTL block
+// property collector rejects values without a valid header, so a table that
+// records its property has been written with the header.
+func ttlCheckIngest(opts *Options, props *sstable.Properties) error {
+	if !opts.EnableTTL || props.NumEntries <= props.NumDeletions+props.NumMergeOperands {
+		return nil
+	}
+	if _, ok := props.UserProperties[ttlBlockPropertyName]; !ok {
+		return errors.New("estore: ingested table lacks TTL headers; write it with Options.MakeWriterOptions")
+	}
+	return nil
+}
+
+// ttlIter wraps the point iterator of an Iterator if TTL is enabled. It strips
+// the TTL header from SET values and surfaces expired SETs as DELs, so that
+// they shadow older versions of the key.
+type ttlIter struct {
+	iter internalIterator
+	now  uint64
+	key  InternalKey
+	buf  []byte
+	err  error
+}
+
+// ttlIter implements the base.InternalIterator interface.
+var _ internalIterator = (*ttlIter)(nil)
+
+func (i *ttlIter) init(iter internalIterator, now uint64) {
+	*i = ttlIter{iter: iter, now: now, buf: i.buf[:0]}
+}
+
+func (i *ttlIter) decode(key *InternalKey, value base.LazyValue) (*InternalKey, base.LazyValue) {
+	if key == nil {
+		return nil, base.LazyValue{}
+	}
+	switch key.Kind() {
+	case InternalKeyKindSet, InternalKeyKindSetWithDelete:
+	default:
+		return key, value
+	}
+	v, callerOwned, err := value.Value(i.buf[:0])
+	if err != nil {
+		i.err = err
+		return nil, base.LazyValue{}
+	}
+	if callerOwned {
+		i.buf = v
+	}
+	expiry, v, err := ttlDecodeValue(v)
+	if err != nil {
+		i.err = err
+		return nil, base.LazyValue{}
+	}
+	if ttlExpired(expiry, i.now) {
+		i.key = *key
+		i.key.SetKind(InternalKeyKindDelete)
+		return &i.key, base.LazyValue{}
+	}
+	return key, base.MakeInPlaceValue(v)
+}
+
+func (i *ttlIter) SeekGE(key []byte, flags base.SeekGEFlags) (*InternalKey, base.LazyValue) {
+	i.err = nil
+	return i.decode(i.iter.SeekGE(key, flags))
+}
+
+func (i *ttlIter) SeekPrefixGE(
+	prefix, key []byte, flags base.SeekGEFlags,
+) (*base.InternalKey, base.LazyValue) {
+	i.err = nil
+	return i.decode(i.iter.SeekPrefixGE(prefix, key, flags))
+}
+
+func (i *ttlIter) SeekLT(key []byte, flags base.SeekLTFlags) (*InternalKey, base.LazyValue) {
+	i.err = nil
+	return i.decode(i.iter.SeekLT(key, flags))
+}
+
+func (i *ttlIter) First() (*InternalKey, base.LazyValue) {
+	i.err = nil
+	return i.decode(i.iter.First())
+}
+
+func (i *ttlIter) Last() (*InternalKey, base.LazyValue) {
+	i.err = nil
+	return i.decode(i.iter.Last())
+}
+
+func (i *ttlIter) Next() (*InternalKey, base.LazyValue) {
+	if i.err != nil {
+		return nil, base.LazyValue{}
+	}
+	return i.decode(i.iter.Next())
+}
+
+func (i *ttlIter) NextPrefix(succKey []byte) (*InternalKey, base.LazyValue) {
+	if i.err != nil {
+		return nil, base.LazyValue{}
+	}
+	return i.decode(i.iter.NextPrefix(succKey))
+}
+
+func (i *ttlIter) Prev() (*InternalKey, base.LazyValue) {
+	if i.err != nil {
+		return nil, base.LazyValue{}
+	}
+	return i.decode(i.iter.Prev())
+}
+
+func (i *ttlIter) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+func (i *ttlIter) Close() error {
+	err := i.iter.Close()
+	if i.err != nil {
+		return i.err
+	}
+	return err
+}
+
+func (i *ttlIter) SetBounds(lower, upper []byte) {
+	i.iter.SetBounds(lower, upper)
+}
+
+func (i *ttlIter) String() string {
+	return fmt.Sprintf("ttl(%s)", i.iter)
+}
+
+// ttlIntervalCollector collects the [earliest, latest] expiry of the point
+// keys of a data block. Keys that don't expire, including tombstones and
+// MERGE operands, count as expiring at ttlNever, so a table can only be
+// considered expired if all of its point keys have expired.
+type ttlIntervalCollector struct {
+	lower, upper uint64
+}
+
+// ttlNever is the expiry recorded for keys that don't expire. It's one less
+// than the maximum so that the exclusive upper bound of the interval doesn't
+// overflow.
+const ttlNever = math.MaxUint64 - 1
+
+var _ sstable.DataBlockIntervalCollector = (*ttlIntervalCollector)(nil)
+
+// ttlBlockPropertyCollector records the [earliest, latest] expiry of point
+// keys in each block and in the table.
+type ttlBlockPropertyCollector struct {
+	BlockPropertyCollector
+}
+
+var _ sstable.ValueBlockPropertyCollector = ttlBlockPropertyCollector{}
+
+func newTTLBlockPropertyCollector() BlockPropertyCollector {
+	return ttlBlockPropertyCollector{
+		sstable.NewBlockIntervalCollector(ttlBlockPropertyName, &ttlIntervalCollector{}, nil),
+	}
+}
+
+// NeedsValues implements the sstable.ValueBlockPropertyCollector interface.
+func (ttlBlockPropertyCollector) NeedsValues() bool {
+	return true
+}
+
+// Add implements the sstable.DataBlockIntervalCollector interface.
+func (c *ttlIntervalCollector) Add(key InternalKey, value []byte) error {
+	expiry := uint64(ttlNever)
+	switch key.Kind() {
+	case InternalKeyKindSet, InternalKeyKindSetWithDelete:
+		e, _, err := ttlDecodeValue(value)
+		if err != nil {
+			return err
+		}
+		if e != 0 {
+			expiry = e
+		}
+	}
+	if c.lower == c.upper {
+		c.lower, c.upper = expiry, expiry+1
+		return nil
+	}
+	if expiry < c.lower {
+		c.lower = expiry
+	}
+	if expiry+1 > c.upper {
+		c.upper = expiry + 1
+	}
+	return nil
+}
+
+// FinishDataBlock implements the sstable.DataBlockIntervalCollector interface.
+func (c *ttlIntervalCollector) FinishDataBlock() (lower, upper uint64, err error) {
+	lower, upper = c.lower, c.upper
+	c.lower, c.upper = 0, 0
+	return lower, upper, nil
+}
+
+// ttlMaxExpiry returns the latest expiry of the point keys of a table
+// according to the table's user properties. It returns 0 if the table wasn't
+// written with TTL enabled, if it has no point keys, or if any of its point
+// keys doesn't expire.
+func ttlMaxExpiry(userProps map[string]string) (uint64, error) {
+	prop, ok := userProps[ttlBlockPropertyName]
+	if !ok {
+		return 0, nil
+	}
+	lower, upper, err := sstable.DecodeTableInterval(prop)
+	if err != nil {
+		return 0, err
+	}
+	if lower >= upper || upper-1 == ttlNever {
+		return 0, nil
+	}
+	return upper - 1, nil
+}
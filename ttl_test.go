@@ -0,0 +1,302 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: AGPL-3.0-only
+*/
+
+package estore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/estore/objstorage/objstorageprovider"
+	"github.com/edgelesssys/estore/sstable"
+	"github.com/edgelesssys/estore/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLValueEncoding(t *testing.T) {
+	require := require.New(t)
+
+	for _, expiry := range []uint64{0, 1, 1 << 60} {
+		for _, value := range []string{"", "value"} {
+			encoded := ttlAppendValue([]byte("prefix"), expiry, []byte(value))
+			require.Len(encoded, len("prefix")+ttlValueLen(expiry, len(value)))
+			gotExpiry, gotValue, err := ttlDecodeValue(encoded[len("prefix"):])
+			require.NoError(err)
+			require.Equal(expiry, gotExpiry)
+			require.Equal(value, string(gotValue))
+		}
+	}
+
+	for _, value := range []string{"", "\x01abc", "\x02"} {
+		_, _, err := ttlDecodeValue([]byte(value))
+		require.Error(err)
+	}
+}
+
+func openTTLTestDB(t *testing.T, fs vfs.FS, now *time.Time) *DB {
+	d, err := Open("", &Options{FS: fs, EnableTTL: true, FormatMajorVersion: FormatNewest})
+	require.NoError(t, err)
+	d.timeNow = func() time.Time { return *now }
+	return d
+}
+
+func TestTTL(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1000, 0)
+	d := openTTLTestDB(t, vfs.NewMem(), &now)
+	defer func() { require.NoError(d.Close()) }()
+
+	require.NoError(d.Set([]byte("c"), []byte("old"), nil))
+	require.NoError(d.Flush())
+	require.NoError(d.SetWithTTL([]byte("a"), []byte("val-a"), time.Minute, nil))
+	require.NoError(d.Set([]byte("b"), []byte("val-b"), nil))
+	require.NoError(d.SetWithTTL([]byte("c"), []byte("val-c"), time.Hour, nil))
+	require.Error(d.SetWithTTL([]byte("d"), []byte("val-d"), 0, nil))
+
+	b := d.NewIndexedBatch()
+	require.NoError(b.SetWithTTL([]byte("e"), []byte("val-e"), time.Minute, nil))
+
+	get := func(r Reader, key string) string {
+		val, closer, err := r.Get([]byte(key))
+		if err == ErrNotFound {
+			return ""
+		}
+		require.NoError(err)
+		defer closer.Close()
+		return string(val)
+	}
+	scan := func(r Reader) []string {
+		iter, err := r.NewIter(nil)
+		require.NoError(err)
+		defer iter.Close()
+		var kvs []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			kvs = append(kvs, string(iter.Key())+"="+string(iter.Value()))
+		}
+		require.NoError(iter.Error())
+		// reverse iteration sees the same keys
+		var n int
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			n++
+		}
+		require.Equal(len(kvs), n)
+		return kvs
+	}
+
+	require.Equal("val-a", get(d, "a"))
+	require.Equal("val-c", get(d, "c"))
+	require.Equal("val-e", get(b, "e"))
+	require.Equal([]string{"a=val-a", "b=val-b", "c=val-c"}, scan(d))
+	require.Equal([]string{"a=val-a", "b=val-b", "c=val-c", "e=val-e"}, scan(b))
+
+	// expired keys are hidden and don't uncover older versions
+	now = now.Add(time.Hour)
+	for _, r := range []Reader{d, b} {
+		require.Empty(get(r, "a"))
+		require.Equal("val-b", get(r, "b"))
+		require.Empty(get(r, "c"))
+		require.Empty(get(r, "e"))
+		require.Equal([]string{"b=val-b"}, scan(r))
+	}
+	require.NoError(b.Close())
+
+	// a SET without TTL makes the key visible again
+	require.NoError(d.Set([]byte("a"), []byte("new-a"), nil))
+	require.Equal("new-a", get(d, "a"))
+}
+
+func TestTTLMerge(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1000, 0)
+	d := openTTLTestDB(t, vfs.NewMem(), &now)
+	defer func() { require.NoError(d.Close()) }()
+
+	require.NoError(d.SetWithTTL([]byte("a"), []byte("a"), time.Minute, nil))
+	require.NoError(d.SetWithTTL([]byte("b"), []byte("b"), time.Hour, nil))
+	now = now.Add(30 * time.Minute)
+	require.NoError(d.Merge([]byte("a"), []byte("1"), nil))
+	require.NoError(d.Merge([]byte("b"), []byte("2"), nil))
+
+	get := func(key string) string {
+		val, closer, err := d.Get([]byte(key))
+		if err == ErrNotFound {
+			return ""
+		}
+		require.NoError(err)
+		defer closer.Close()
+		return string(val)
+	}
+	require.Equal("1", get("a"))
+	require.Equal("b2", get("b"))
+
+	// compacting merges the operands into the base value, which keeps its
+	// expiry
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.Equal("1", get("a"))
+	require.Equal("b2", get("b"))
+	now = now.Add(time.Hour)
+	require.Equal("1", get("a"))
+	require.Empty(get("b"))
+}
+
+func TestTTLCompactionMerge(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1000, 0)
+	d := openTTLTestDB(t, vfs.NewMem(), &now)
+	defer func() { require.NoError(d.Close()) }()
+
+	require.NoError(d.SetWithTTL([]byte("a"), []byte("a"), time.Hour, nil))
+	require.NoError(d.Merge([]byte("a"), []byte("1"), nil))
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	d.waitTableStats()
+
+	// the merged value is a SET with the expiry of the base value
+	d.mu.Lock()
+	iter := d.mu.versions.currentVersion().Levels[numLevels-1].Iter()
+	maxExpiry := iter.First().Stats.TTLMaxExpiry
+	d.mu.Unlock()
+	require.Equal(uint64(now.Add(time.Hour).UnixNano()), maxExpiry)
+
+	val, closer, err := d.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal("a1", string(val))
+	require.NoError(closer.Close())
+
+	// after the expiry, the merged value is gone, too
+	now = now.Add(time.Hour)
+	_, _, err = d.Get([]byte("a"))
+	require.ErrorIs(err, ErrNotFound)
+}
+
+func TestTTLHeaderEnforcement(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1000, 0)
+	fs := vfs.NewMem()
+	d := openTTLTestDB(t, fs, &now)
+	defer func() { require.NoError(d.Close()) }()
+
+	get := func(key string) string {
+		val, closer, err := d.Get([]byte(key))
+		require.NoError(err)
+		defer closer.Close()
+		return string(val)
+	}
+
+	// SetDeferred writes the header
+	b := d.NewBatch()
+	op := b.SetDeferred(1, 5)
+	copy(op.Key, "a")
+	copy(op.Value, "val-a")
+	require.NoError(op.Finish())
+	require.NoError(b.Commit(nil))
+	require.Equal("val-a", get("a"))
+
+	// a batch without DB gets the header when it's applied, also through
+	// another batch
+	b = &Batch{}
+	require.NoError(b.Set([]byte("b"), []byte("val-b"), nil))
+	require.NoError(b.Merge([]byte("b"), []byte("1"), nil))
+	require.NoError(d.Apply(b, nil))
+	require.Equal("val-b1", get("b"))
+
+	b = &Batch{}
+	require.NoError(b.Set([]byte("c"), []byte("val-c"), nil))
+	b2 := d.NewIndexedBatch()
+	require.NoError(b2.Apply(b, nil))
+	val, closer, err := b2.Get([]byte("c"))
+	require.NoError(err)
+	require.Equal("val-c", string(val))
+	require.NoError(closer.Close())
+	require.NoError(b2.Commit(nil))
+	require.Equal("val-c", get("c"))
+
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	require.Equal("val-a", get("a"))
+	require.Equal("val-b1", get("b"))
+	require.Equal("val-c", get("c"))
+
+	// ingested tables must be written with the writer options of the DB
+	writeTable := func(name string, opts sstable.WriterOptions, value []byte) {
+		f, err := fs.Create(name)
+		require.NoError(err)
+		w := sstable.NewWriter(objstorageprovider.NewFileWritable(f), opts)
+		require.NoError(w.Set([]byte("d"), value))
+		require.NoError(w.Close())
+	}
+	format := d.FormatMajorVersion().MaxTableFormat()
+	writeTable("raw.sst", sstable.WriterOptions{TableFormat: format}, []byte("val-d"))
+	require.ErrorContains(d.Ingest([]string{"raw.sst"}), "lacks TTL headers")
+	writeTable("encoded.sst", d.opts.MakeWriterOptions(0, format), ttlAppendValue(nil, 0, []byte("val-d")))
+	require.NoError(d.Ingest([]string{"encoded.sst"}))
+	require.Equal("val-d", get("d"))
+}
+
+func TestTTLCompaction(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1000, 0)
+	d := openTTLTestDB(t, vfs.NewMem(), &now)
+	defer func() { require.NoError(d.Close()) }()
+
+	require.NoError(d.SetWithTTL([]byte("a"), []byte("val-a"), time.Minute, nil))
+	require.NoError(d.SetWithTTL([]byte("b"), []byte("val-b"), time.Hour, nil))
+	require.NoError(d.Compact([]byte("a"), []byte("z"), true))
+	d.waitTableStats()
+
+	m := d.Metrics()
+	require.EqualValues(1, m.Levels[numLevels-1].NumFiles)
+	d.mu.Lock()
+	iter := d.mu.versions.currentVersion().Levels[numLevels-1].Iter()
+	maxExpiry := iter.First().Stats.TTLMaxExpiry
+	d.mu.Unlock()
+	require.Equal(uint64(now.Add(time.Hour).UnixNano()), maxExpiry)
+
+	// the file isn't picked before all keys have expired
+	now = now.Add(time.Minute)
+	scheduleElisionOnly := func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.maybeScheduleCompactionPicker(pickElisionOnly)
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+	}
+	scheduleElisionOnly()
+	require.Zero(d.Metrics().Compact.ElisionOnlyCount)
+
+	now = now.Add(time.Hour)
+	scheduleElisionOnly()
+	m = d.Metrics()
+	require.EqualValues(1, m.Compact.ElisionOnlyCount)
+	require.Zero(m.Levels[numLevels-1].NumFiles)
+}
+
+func TestTTLOptionsCheck(t *testing.T) {
+	require := require.New(t)
+
+	fs := vfs.NewMem()
+	d, err := Open("", &Options{FS: fs})
+	require.NoError(err)
+	require.ErrorIs(d.SetWithTTL([]byte("a"), nil, time.Minute, nil), ErrTTLDisabled)
+	require.NoError(d.Close())
+
+	// TTL can't be enabled for an existing store
+	_, err = Open("", &Options{FS: fs, EnableTTL: true})
+	require.ErrorContains(err, "enable_ttl")
+
+	fs = vfs.NewMem()
+	now := time.Now()
+	d = openTTLTestDB(t, fs, &now)
+	require.NoError(d.Close())
+
+	// nor disabled
+	_, err = Open("", &Options{FS: fs})
+	require.ErrorContains(err, "enable_ttl")
+}
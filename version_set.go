@@ -187,7 +187,7 @@ func (vs *versionSet) create(
 	}
 	if err == nil {
 		// NB: setCurrent is responsible for syncing the data directory.
-		if err = vs.setCurrent(vs.manifestFileNum); err != nil {
+		if err = vs.edgSetCurrent(vs.manifestFileNum); err != nil {
 			vs.opts.Logger.Fatalf("MANIFEST set current failed: %v", err)
 		}
 	}
@@ -229,13 +229,14 @@ func (vs *versionSet) load(
 			errors.Safe(manifestFilename), dirname)
 	}
 	defer manifest.Close()
-	rr := record.NewReader(manifest, 0 /* logNum */)
+	rr := record.NewReader(manifest, manifestFileNum)
 
 	encryptionKey, err := vs.keyManager.Get(manifestFileNum)
 	if err != nil {
 		return err
 	}
 	rr.EncryptionKey = encryptionKey
+	rr.EncryptionStats = vs.keyManager.Stats().File(edg.FileTypeManifest)
 
 	for {
 		r, err := rr.Next()
@@ -573,7 +574,7 @@ func (vs *versionSet) logAndApply(
 		}
 		if newManifestFileNum != 0 {
 			// NB: setCurrent is responsible for syncing the data directory.
-			if err := vs.setCurrent(newManifestFileNum); err != nil {
+			if err := vs.edgSetCurrent(newManifestFileNum); err != nil {
 				return errors.Wrap(err, "MANIFEST set current failed")
 			}
 			vs.opts.EventListener.ManifestCreated(ManifestCreateInfo{
@@ -698,6 +699,10 @@ func (vs *versionSet) incrementCompactions(
 	case compactionKindRewrite:
 		vs.metrics.Compact.Count++
 		vs.metrics.Compact.RewriteCount++
+
+	case compactionKindDownload:
+		vs.metrics.Compact.Count++
+		vs.metrics.Compact.DownloadCount++
 	}
 	if len(extraLevels) > 0 {
 		vs.metrics.Compact.MultiLevelCount++
@@ -740,6 +745,7 @@ func (vs *versionSet) createManifest(
 	}
 	manifest = record.NewWriter(manifestFile)
 	manifest.EncryptionKey = encryptionKey
+	manifest.EncryptionStats = vs.keyManager.Stats().File(edg.FileTypeManifest)
 
 	snapshot := versionEdit{
 		ComparerName: vs.cmpName,
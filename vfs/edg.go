@@ -44,3 +44,47 @@ func (d *diskHealthCheckingFile) WriteApproved(p []byte) (n int, err error) {
 	})
 	return n, err
 }
+
+// CrashClone returns a new strict MemFS that only contains the synced state of
+// y, i.e., the state that would survive if the process crashed at this point.
+// Unlike ResetToSyncedState, y remains usable, so that a test can take a clone
+// at every sync point of a single run. y must be strict.
+func (y *MemFS) CrashClone() *MemFS {
+	if !y.strict {
+		panic("pebble/vfs: CrashClone requires a strict MemFS")
+	}
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	// hard links share a node, so clone each node only once
+	clones := map[*memNode]*memNode{}
+	return &MemFS{
+		root:             y.root.crashClone(clones),
+		strict:           true,
+		windowsSemantics: y.windowsSemantics,
+	}
+}
+
+// crashClone returns a copy of the synced state of f. MemFS.mu must be held.
+func (f *memNode) crashClone(clones map[*memNode]*memNode) *memNode {
+	if c, ok := clones[f]; ok {
+		return c
+	}
+	c := &memNode{name: f.name, isDir: f.isDir}
+	clones[f] = c
+	if f.isDir {
+		c.children = make(map[string]*memNode, len(f.syncedChildren))
+		c.syncedChildren = make(map[string]*memNode, len(f.syncedChildren))
+		for name, child := range f.syncedChildren {
+			childClone := child.crashClone(clones)
+			c.children[name] = childClone
+			c.syncedChildren[name] = childClone
+		}
+		return c
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.mu.data = append([]byte(nil), f.mu.syncedData...)
+	c.mu.syncedData = append([]byte(nil), f.mu.syncedData...)
+	c.mu.modTime = f.mu.modTime
+	return c
+}
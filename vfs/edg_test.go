@@ -6,9 +6,73 @@ SPDX-License-Identifier: AGPL-3.0-only
 
 package vfs
 
-import "time"
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
 
 func (m mockFile) WriteApproved(p []byte) (int, error) {
 	time.Sleep(m.syncAndWriteDuration)
 	return len(p), nil
 }
+
+func TestMemFSCrashClone(t *testing.T) {
+	require := require.New(t)
+
+	fs := NewStrictMem()
+	require.NoError(fs.MkdirAll("dir", 0755))
+	root, err := fs.OpenDir("")
+	require.NoError(err)
+	require.NoError(root.Sync())
+	dir, err := fs.OpenDir("dir")
+	require.NoError(err)
+
+	synced, err := fs.Create("dir/synced")
+	require.NoError(err)
+	_, err = synced.WriteApproved([]byte("foo"))
+	require.NoError(err)
+	require.NoError(synced.Sync())
+	_, err = synced.WriteApproved([]byte("bar"))
+	require.NoError(err)
+	require.NoError(dir.Sync())
+	require.NoError(fs.Link("dir/synced", "dir/link"))
+
+	clone := fs.CrashClone()
+
+	// the clone doesn't see unsynced data and directory entries
+	names, err := clone.List("dir")
+	require.NoError(err)
+	require.Equal([]string{"synced"}, names)
+	f, err := clone.Open("dir/synced")
+	require.NoError(err)
+	data, err := io.ReadAll(f)
+	require.NoError(err)
+	require.Equal("foo", string(data))
+	require.NoError(f.Close())
+
+	// the original is unchanged
+	f, err = fs.Open("dir/link")
+	require.NoError(err)
+	data, err = io.ReadAll(f)
+	require.NoError(err)
+	require.Equal("foobar", string(data))
+	require.NoError(f.Close())
+
+	// the clone is independent of the original
+	f, err = clone.Create("dir/synced")
+	require.NoError(err)
+	require.NoError(f.Close())
+	f, err = fs.Open("dir/synced")
+	require.NoError(err)
+	data, err = io.ReadAll(f)
+	require.NoError(err)
+	require.Equal("foobar", string(data))
+	require.NoError(f.Close())
+
+	require.NoError(synced.Close())
+	require.NoError(dir.Close())
+	require.NoError(root.Close())
+}